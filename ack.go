@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxAwaitingAcks bounds the receipt ids a connection remembers for acks,
+// the oldest being forgotten.
+const maxAwaitingAcks = 1000
+
+type ackRecord struct {
+	ReceiptID string `json:"receipt_id"`
+	UserID    int64  `json:"user_id"`
+	AckedAt   int64  `json:"acked_at"`
+
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// ackTracker holds the receipt ids flushed to a connection and not acked
+// yet, and limits its acks to cfg.AckRate per second.
+type ackTracker struct {
+	mu          sync.Mutex
+	awaiting    *seenSet
+	windowStart time.Time
+	acks        int
+	// unconfirmed are the ids waiting for an ack to be confirmed, oldest
+	// first, with cfg.ConfirmTimeout.
+	unconfirmed []flushedReceipt
+}
+
+type flushedReceipt struct {
+	id      string
+	flushed time.Time
+}
+
+func newAckTracker() *ackTracker {
+	if cfg.AckChannel == "" {
+		return nil
+	}
+	return &ackTracker{awaiting: newSeenSet(maxAwaitingAcks)}
+}
+
+// await records receipt ids flushed to the connection at now. With
+// cfg.ConfirmTimeout it returns the oldest ids awaiting confirmation that
+// no longer fit, which can't be confirmed anymore.
+func (t *ackTracker) await(ids []string, now time.Time) []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, id := range ids {
+		if t.awaiting.add(id) && cfg.ConfirmTimeout > 0 {
+			t.unconfirmed = append(t.unconfirmed, flushedReceipt{id, now})
+		}
+	}
+	var dropped []string
+	for len(t.unconfirmed) > maxAwaitingAcks {
+		dropped = append(dropped, t.unconfirmed[0].id)
+		t.awaiting.remove(t.unconfirmed[0].id)
+		t.unconfirmed = t.unconfirmed[1:]
+	}
+	return dropped
+}
+
+// expire forgets the ids flushed cfg.ConfirmTimeout before now without an
+// ack, and returns them. A zero now expires them all.
+func (t *ackTracker) expire(now time.Time) []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var expired []string
+	for len(t.unconfirmed) > 0 && (now.IsZero() || now.Sub(t.unconfirmed[0].flushed) >= cfg.ConfirmTimeout) {
+		expired = append(expired, t.unconfirmed[0].id)
+		t.awaiting.remove(t.unconfirmed[0].id)
+		t.unconfirmed = t.unconfirmed[1:]
+	}
+	return expired
+}
+
+var (
+	errAckRate    = errors.New("too many acks")
+	errAckUnknown = errors.New("receipt id not delivered on this connection or already acked")
+)
+
+// ack accepts the ack of receipt id, once.
+func (t *ackTracker) ack(id string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.windowStart) >= time.Second {
+		t.windowStart, t.acks = now, 0
+	}
+	if t.acks >= cfg.AckRate {
+		return errAckRate
+	}
+	t.acks++
+	if !t.awaiting.remove(id) {
+		return errAckUnknown
+	}
+	for i, r := range t.unconfirmed {
+		if r.id == id {
+			t.unconfirmed = append(t.unconfirmed[:i], t.unconfirmed[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// confirmDeliveries reports the receipts not acked within
+// cfg.ConfirmTimeout as unconfirmed, and the ones still waiting when ctx is
+// done.
+func (c *SSEClient) confirmDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(max(cfg.ConfirmTimeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.queueReceipts(c.acks.expire(now), now, receiptUnconfirmed)
+		case <-ctx.Done():
+			c.queueReceipts(c.acks.expire(time.Time{}), time.Now(), receiptUnconfirmed)
+			return
+		}
+	}
+}
+
+// ackHandler publishes the browser's confirmation that it handled a message
+// with a receipt_id to the ack channel. The request must carry a token for
+// the connection's user, and the receipt id must have been flushed to the
+// connection and not acked yet. The token authenticates it, so like
+// refreshes it's open to any origin and needs no cookies.
+func ackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	claims, err := verifyToken(requestToken(r))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	client := registry.get(r.PathValue("conn_id"))
+	if client == nil || client.acks == nil {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	if client.userID != claims.UserID || client.namespace != claims.Namespace {
+		client.logf("Refused ack with a token for user %d in namespace %q", claims.UserID, claims.Namespace)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		ReceiptID string `json:"receipt_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReceiptID == "" {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, `Expected JSON body {"receipt_id": "..."}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	switch err := client.acks.ack(req.ReceiptID, now); {
+	case errors.Is(err, errAckRate):
+		metrics.acksRefused.Add(1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many acks", http.StatusTooManyRequests)
+		return
+	case err != nil:
+		metrics.acksRefused.Add(1)
+		http.Error(w, "Unknown receipt id", http.StatusNotFound)
+		return
+	}
+
+	b, _ := json.Marshal(ackRecord{ReceiptID: req.ReceiptID, UserID: client.userID, AckedAt: now.UnixMilli(), Metadata: client.metadata})
+	pctx, cancel, ok := backgroundRedis(r.Context())
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Failed to publish ack", http.StatusServiceUnavailable)
+		return
+	}
+	defer cancel()
+	if err := client.redisDB().Publish(pctx, client.qualify(cfg.AckChannel), b).Err(); err != nil {
+		client.logf("Failed to publish ack %s for user %d: %v", req.ReceiptID, client.userID, redisErr(err))
+		http.Error(w, "Failed to publish ack", http.StatusServiceUnavailable)
+		return
+	}
+	metrics.acks.Add(1)
+	if cfg.ConfirmTimeout > 0 {
+		client.queueReceipts([]string{req.ReceiptID}, now, receiptConfirmed)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
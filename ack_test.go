@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// deliverReceipt sends a message with receipt id to the stream of userID
+// and waits until the connection awaits its ack.
+func deliverReceipt(t *testing.T, s *sseStream, conn string, userID int64, id string) {
+	t.Helper()
+	rdb.Publish(ctx, userChannel(userID), `{"receipt_id": "`+id+`"}`)
+	s.nextData(t)
+	client := registry.get(conn)
+	waitFor(t, "the flushed receipt", func() bool {
+		client.acks.mu.Lock()
+		defer client.acks.mu.Unlock()
+		return client.acks.awaiting.keys[id]
+	})
+}
+
+func postAck(t *testing.T, srv *httptest.Server, conn, body, bearer string) int {
+	t.Helper()
+	return post(t, srv.URL+"/ack/"+conn, body, bearer).StatusCode
+}
+
+func TestAckPublished(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.AckChannel = "acks" })
+	published := subscribeTo(t, "acks")
+	s, conn := connect(t, srv, 1971, nil)
+	deliverReceipt(t, s, conn, 1971, "r-1")
+
+	before := time.Now().Truncate(time.Millisecond)
+	if code := postAck(t, srv, conn, `{"receipt_id": "r-1"}`, token(t, 1971, nil)); code != http.StatusNoContent {
+		t.Fatalf("ack: %d, want 204", code)
+	}
+	var r ackRecord
+	if err := json.Unmarshal([]byte(receive(t, published)), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.ReceiptID != "r-1" || r.UserID != 1971 || time.UnixMilli(r.AckedAt).Before(before) {
+		t.Errorf("ack record %+v", r)
+	}
+	if code := postAck(t, srv, conn, `{"receipt_id": "r-1"}`, token(t, 1971, nil)); code != http.StatusNotFound {
+		t.Errorf("second ack: %d, want 404", code)
+	}
+}
+
+func TestAckOpenToAnyOriginWithoutCredentials(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.AckChannel = "acks" })
+	s, conn := connect(t, srv, 1972, nil)
+	deliverReceipt(t, s, conn, 1972, "r-1")
+
+	resp := post(t, srv.URL+"/ack/"+conn, `{"receipt_id": "r-1"}`, token(t, 1972, nil))
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("ack: %s, allowed origin %q", resp.Status, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	// Browsers refuse credentials for any origin.
+	if v, ok := resp.Header["Access-Control-Allow-Credentials"]; ok {
+		t.Errorf("Access-Control-Allow-Credentials %q along with any origin", v)
+	}
+}
+
+func TestInvalidAcksRefused(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.AckChannel = "acks" })
+	s, conn := connect(t, srv, 1972, nil)
+	deliverReceipt(t, s, conn, 1972, "r-2")
+	own := token(t, 1972, nil)
+
+	refused := metrics.acksRefused.Load()
+	for _, tt := range []struct {
+		name, conn, body, bearer string
+		want                     int
+	}{
+		{"bad token", conn, `{"receipt_id": "r-2"}`, "not-a-jwt", http.StatusUnauthorized},
+		{"other user", conn, `{"receipt_id": "r-2"}`, token(t, 1973, nil), http.StatusForbidden},
+		{"unknown connection", "no-such-conn", `{"receipt_id": "r-2"}`, own, http.StatusNotFound},
+		{"no receipt id", conn, `{}`, own, http.StatusBadRequest},
+		{"undelivered receipt", conn, `{"receipt_id": "r-9"}`, own, http.StatusNotFound},
+	} {
+		if code := postAck(t, srv, tt.conn, tt.body, tt.bearer); code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, code, tt.want)
+		}
+	}
+	if n := metrics.acksRefused.Load() - refused; n != 1 {
+		t.Errorf("%d acks refused counted, want the undelivered one", n)
+	}
+	// The refused acks left the delivered receipt to be acked.
+	if code := postAck(t, srv, conn, `{"receipt_id": "r-2"}`, own); code != http.StatusNoContent {
+		t.Errorf("valid ack after the refused ones: %d", code)
+	}
+}
+
+func TestAcksRateLimited(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.AckChannel = "acks"
+		c.AckRate = 2
+	})
+	acks := newAckTracker()
+	now := time.Now()
+	acks.await([]string{"a", "b", "c"}, now)
+	for i, want := range []error{nil, nil, errAckRate} {
+		if err := acks.ack([]string{"a", "b", "c"}[i], now); !errors.Is(err, want) {
+			t.Errorf("ack %d: %v, want %v", i+1, err, want)
+		}
+	}
+	// A second later the limit starts over, and "c" still awaits its ack.
+	if err := acks.ack("c", now.Add(time.Second)); err != nil {
+		t.Errorf("ack the next second: %v", err)
+	}
+}
+
+func TestAcksOffWithoutChannel(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	s, conn := connect(t, srv, 1974, nil)
+	rdb.Publish(ctx, "events:user:1974", `{"receipt_id": "r-4"}`)
+	s.nextData(t)
+	if code := postAck(t, srv, conn, `{"receipt_id": "r-4"}`, token(t, 1974, nil)); code != http.StatusNotFound {
+		t.Errorf("ack without GO_SSE_SIDECAR_ACK_CHANNEL: %d, want 404", code)
+	}
+}
+
+// confirmSidecar holds receipts back for acks for up to timeout.
+func confirmSidecar(t *testing.T, timeout time.Duration) (*httptest.Server, <-chan string) {
+	t.Helper()
+	_, srv, published := receiptSidecar(t, func(c *Config) {
+		c.AckChannel = "acks"
+		c.ConfirmTimeout = timeout
+	})
+	return srv, published
+}
+
+func TestReceiptConfirmedByAck(t *testing.T) {
+	srv, published := confirmSidecar(t, 5*time.Second)
+	s, conn := connect(t, srv, 2121, nil)
+	deliverReceipt(t, s, conn, 2121, "r-1")
+	select {
+	case p := <-published:
+		t.Fatalf("receipt %s sent on flush", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	acked := time.Now().Truncate(time.Millisecond)
+	if code := postAck(t, srv, conn, `{"receipt_id": "r-1"}`, token(t, 2121, nil)); code != http.StatusNoContent {
+		t.Fatalf("ack: %d", code)
+	}
+	r := decodeReceipt(t, receive(t, published))
+	if r.ReceiptID != "r-1" || r.Status != receiptConfirmed || time.UnixMilli(r.DeliveredAt).Before(acked) {
+		t.Errorf("receipt %+v, want it confirmed at the ack", r)
+	}
+}
+
+func TestReceiptUnconfirmedAfterTimeout(t *testing.T) {
+	srv, published := confirmSidecar(t, 50*time.Millisecond)
+	s, conn := connect(t, srv, 2122, nil)
+	unconfirmed := metrics.receiptsUnconfirmed.Load()
+	deliverReceipt(t, s, conn, 2122, "r-2")
+
+	if r := decodeReceipt(t, receive(t, published)); r.ReceiptID != "r-2" || r.Status != receiptUnconfirmed {
+		t.Errorf("receipt %+v, want it unconfirmed", r)
+	}
+	if n := metrics.receiptsUnconfirmed.Load() - unconfirmed; n != 1 {
+		t.Errorf("%d unconfirmed receipts counted", n)
+	}
+	if code := postAck(t, srv, conn, `{"receipt_id": "r-2"}`, token(t, 2122, nil)); code != http.StatusNotFound {
+		t.Errorf("late ack: %d, want 404", code)
+	}
+}
+
+func TestReceiptUnconfirmedWhenConnectionCloses(t *testing.T) {
+	srv, published := confirmSidecar(t, time.Minute)
+	s, conn := connect(t, srv, 2123, nil)
+	deliverReceipt(t, s, conn, 2123, "r-3")
+	s.resp.Body.Close()
+	if r := decodeReceipt(t, receive(t, published)); r.ReceiptID != "r-3" || r.Status != receiptUnconfirmed {
+		t.Errorf("receipt %+v, want it unconfirmed on close", r)
+	}
+}
+
+func TestAwaitingConfirmationBounded(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.AckChannel = "acks"
+		c.ConfirmTimeout = time.Minute
+	})
+	tr := newAckTracker()
+	ids := make([]string, maxAwaitingAcks+2)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("r-%d", i)
+	}
+	// The oldest ones can't be confirmed anymore.
+	if dropped := tr.await(ids, time.Now()); !reflect.DeepEqual(dropped, []string{"r-0", "r-1"}) {
+		t.Errorf("dropped %v", dropped)
+	}
+	if err := tr.ack("r-0", time.Now()); !errors.Is(err, errAckUnknown) {
+		t.Errorf("ack of a dropped id: %v", err)
+	}
+	if expired := tr.expire(time.Now().Add(time.Minute)); len(expired) != maxAwaitingAcks {
+		t.Errorf("%d expired, want %d", len(expired), maxAwaitingAcks)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requireAdmin checks the `Authorization: Bearer <token>` header against
+// GO_SSE_SIDECAR_ADMIN_TOKEN and writes the error response when it fails.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	expected := os.Getenv("GO_SSE_SIDECAR_ADMIN_TOKEN")
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if expected == "" || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// minAllowlistRefresh bounds how often the allowlists are read from Redis.
+const minAllowlistRefresh = time.Second
+
+// redisAllowlists are the channel allow and deny lists and the namespaces
+// read from Redis sets (one entry per member, same syntax as the
+// environment), so operators can change them without a restart. A list
+// whose set is missing or empty, or fails to load, keeps its previous
+// value, at first the one from the environment.
+type redisAllowlists struct {
+	allow        atomic.Pointer[channelMatcher]
+	deny         atomic.Pointer[channelMatcher]
+	namespaceSet atomic.Pointer[map[string]bool]
+}
+
+var allowlists = &redisAllowlists{}
+
+func (a *redisAllowlists) channelAllow() *channelMatcher {
+	if m := a.allow.Load(); m != nil {
+		return m
+	}
+	return cfg.ChannelAllow
+}
+
+func (a *redisAllowlists) channelDeny() *channelMatcher {
+	if m := a.deny.Load(); m != nil {
+		return m
+	}
+	return cfg.ChannelDeny
+}
+
+func (a *redisAllowlists) namespaces() map[string]bool {
+	if m := a.namespaceSet.Load(); m != nil {
+		return *m
+	}
+	return cfg.Namespaces
+}
+
+// enabled reports whether any allowlist is read from Redis.
+func (a *redisAllowlists) enabled() bool {
+	return cfg.ChannelAllowKey != "" || cfg.ChannelDenyKey != "" || cfg.NamespacesKey != ""
+}
+
+// load reads the configured sets once.
+func (a *redisAllowlists) load(lctx context.Context) {
+	if entries, ok := a.members(lctx, cfg.ChannelAllowKey); ok {
+		if m, err := compileChannelMatcher(entries); err != nil {
+			log.Printf("[SSE-SIDECAR] Ignoring channel allowlist %s: %v", cfg.ChannelAllowKey, err)
+		} else {
+			a.allow.Store(m)
+		}
+	}
+	if entries, ok := a.members(lctx, cfg.ChannelDenyKey); ok {
+		if m, err := compileChannelMatcher(entries); err != nil {
+			log.Printf("[SSE-SIDECAR] Ignoring channel denylist %s: %v", cfg.ChannelDenyKey, err)
+		} else {
+			a.deny.Store(m)
+		}
+	}
+	if entries, ok := a.members(lctx, cfg.NamespacesKey); ok {
+		if m, err := compileNamespaces(entries); err != nil {
+			log.Printf("[SSE-SIDECAR] Ignoring namespaces %s: %v", cfg.NamespacesKey, err)
+		} else {
+			a.namespaceSet.Store(&m)
+		}
+	}
+}
+
+// members returns the entries of a set, false when it's not configured,
+// missing, empty or can't be read.
+func (a *redisAllowlists) members(lctx context.Context, key string) ([]string, bool) {
+	if key == "" {
+		return nil, false
+	}
+	rctx, cancel := context.WithTimeout(lctx, 2*time.Second)
+	defer cancel()
+	entries, err := rdb.SMembers(rctx, key).Result()
+	if err != nil {
+		log.Printf("[SSE-SIDECAR] Failed to read allowlist %s, keeping the current one: %v", key, redisErr(err))
+		return nil, false
+	}
+	return entries, len(entries) > 0
+}
+
+// run refreshes the allowlists every cfg.AllowlistRefresh.
+func (a *redisAllowlists) run() {
+	ticker := time.NewTicker(cfg.AllowlistRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.load(ctx)
+	}
+}
+
+// String describes the lists in use, for the startup log.
+func (a *redisAllowlists) String() string {
+	count := func(m *channelMatcher) int {
+		if m == nil {
+			return 0
+		}
+		return len(m.prefixes) + len(m.patterns)
+	}
+	return fmt.Sprintf("%d allowed and %d denied channel entries, %d namespaces", count(a.channelAllow()), count(a.channelDeny()), len(a.namespaces()))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useRedisAllowlists reads the lists from the `allow`, `deny` and
+// `namespaces` sets, starting over from the environment's.
+func useRedisAllowlists(t *testing.T, set func(c *Config)) (*miniredis.Miniredis, *httptest.Server) {
+	t.Helper()
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.ChannelAllowKey, c.ChannelDenyKey, c.NamespacesKey = "allow", "deny", "namespaces"
+		if set != nil {
+			set(c)
+		}
+	})
+	old := allowlists
+	allowlists = &redisAllowlists{}
+	t.Cleanup(func() { allowlists = old })
+	return mr, srv
+}
+
+func TestAllowlistsLoadedFromRedis(t *testing.T) {
+	mr, _ := useRedisAllowlists(t, nil)
+	mr.SAdd("allow", "rooms:", "/^jobs:[0-9]+$/")
+	mr.SAdd("deny", "rooms:secret")
+	mr.SAdd("namespaces", "prod")
+	allowlists.load(ctx)
+
+	for ch, want := range map[string]bool{"rooms:1": true, "jobs:42": true, "jobs:x": false, "orders:1": false} {
+		if got := allowlists.channelAllow().match(ch); got != want {
+			t.Errorf("allowlist %s: %v, want %v", ch, got, want)
+		}
+	}
+	if !allowlists.channelDeny().match("rooms:secret") {
+		t.Error("denylist not loaded")
+	}
+	if ns := allowlists.namespaces(); !ns["prod"] || len(ns) != 1 {
+		t.Errorf("namespaces %v", ns)
+	}
+}
+
+func TestAllowlistsRefreshPicksUpChanges(t *testing.T) {
+	mr, _ := useRedisAllowlists(t, nil)
+	mr.SAdd("namespaces", "prod")
+	allowlists.load(ctx)
+	mr.SRem("namespaces", "prod")
+	mr.SAdd("namespaces", "staging")
+	allowlists.load(ctx)
+	if ns := allowlists.namespaces(); ns["prod"] || !ns["staging"] {
+		t.Errorf("namespaces %v after the refresh, want staging only", ns)
+	}
+}
+
+func TestAllowlistsFallBackToEnvironment(t *testing.T) {
+	mr, _ := useRedisAllowlists(t, func(c *Config) {
+		c.ChannelAllow = mustMatcher(t, "env:")
+		c.Namespaces = map[string]bool{"from-env": true}
+	})
+	// Missing sets keep the environment's lists.
+	allowlists.load(ctx)
+	if !allowlists.channelAllow().match("env:1") || !allowlists.namespaces()["from-env"] {
+		t.Error("environment lists not used without the sets")
+	}
+
+	// A failed refresh keeps the lists loaded last, as does an invalid one.
+	mr.SAdd("namespaces", "prod")
+	allowlists.load(ctx)
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	allowlists.load(ctx)
+	mr.SetError("")
+	mr.SAdd("namespaces", "not:valid")
+	allowlists.load(ctx)
+	if ns := allowlists.namespaces(); !ns["prod"] || ns["from-env"] {
+		t.Errorf("namespaces %v, want the last ones loaded", ns)
+	}
+}
+
+func TestStreamUsesRedisNamespaces(t *testing.T) {
+	mr, srv := useRedisAllowlists(t, nil)
+	mr.SAdd("namespaces", "prod")
+	allowlists.load(ctx)
+	if code := streamStatus(t, srv, 2061, jwt.MapClaims{"namespace": "prod"}); code != http.StatusOK {
+		t.Errorf("namespace from the set: %d", code)
+	}
+	mr.SRem("namespaces", "prod")
+	mr.SAdd("namespaces", "staging")
+	allowlists.load(ctx)
+	if code := streamStatus(t, srv, 2061, jwt.MapClaims{"namespace": "prod"}); code != http.StatusForbidden {
+		t.Errorf("namespace removed from the set: %d, want 403", code)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type SSETokenClaims struct {
+	UserID int64 `json:"user_id"`
+	// Channels lists the extra channels the user may subscribe to on a live
+	// connection through POST /control/{conn_id}.
+	Channels []string `json:"channels,omitempty"`
+	// Teams are the teams the user belongs to. The connection also listens on
+	// each team's channel.
+	Teams []int64 `json:"teams,omitempty"`
+	// PresenceUsers are the users whose presence the user may watch.
+	PresenceUsers []int64 `json:"presence_users,omitempty"`
+	// DB selects the Redis logical database of the connection, see redisFor.
+	DB *int `json:"db,omitempty"`
+	// Namespace prefixes the connection's channels and keys, see
+	// namespaceFor.
+	Namespace string `json:"namespace,omitempty"`
+	// Tier selects the connection's limits, see tierFor.
+	Tier string `json:"tier,omitempty"`
+	jwt.RegisteredClaims
+
+	// raw holds every claim of the token, for the configurable checks.
+	raw map[string]interface{}
+}
+
+func (c *SSETokenClaims) UnmarshalJSON(b []byte) error {
+	type plain SSETokenClaims
+	var v interface{} = (*plain)(c)
+	if len(cfg.ClaimSchemas) > 0 {
+		// applyClaimSchemas reads the user id, `user_id` being a string for
+		// some issuers.
+		v = &struct {
+			*plain
+			UserID json.RawMessage `json:"user_id"`
+		}{plain: (*plain)(c)}
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.raw)
+}
+
+// claimMatches reports whether the named claim equals value, or contains it
+// when the claim is a list. Non-string claims are compared by their JSON form.
+func (c *SSETokenClaims) claimMatches(name, value string) bool {
+	v, ok := c.raw[name]
+	if !ok {
+		return false
+	}
+	if list, ok := v.([]interface{}); ok {
+		for _, item := range list {
+			if claimString(item) == value {
+				return true
+			}
+		}
+		return false
+	}
+	return claimString(v) == value
+}
+
+func claimString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// connectionMetadata returns the cfg.MetadataClaims present in the token, or
+// nil when there are none. Only those claims are ever published.
+func connectionMetadata(claims *SSETokenClaims) map[string]interface{} {
+	return pickClaims(claims, cfg.MetadataClaims)
+}
+
+// eventMetadata returns the cfg.EventClaims present in the token, added to
+// every event of the connection, or nil when there are none.
+func eventMetadata(claims *SSETokenClaims) map[string]interface{} {
+	return pickClaims(claims, cfg.EventClaims)
+}
+
+func pickClaims(claims *SSETokenClaims, names []string) map[string]interface{} {
+	var picked map[string]interface{}
+	for _, name := range names {
+		if v, ok := claims.raw[name]; ok {
+			if picked == nil {
+				picked = make(map[string]interface{}, len(names))
+			}
+			picked[name] = v
+		}
+	}
+	return picked
+}
+
+// requiredClaim is a `name:value` rule a token must satisfy to connect.
+type requiredClaim struct {
+	name  string
+	value string
+}
+
+func parseRequiredClaim(name, v string) *requiredClaim {
+	if v == "" {
+		return nil
+	}
+	claim, value, ok := strings.Cut(v, ":")
+	if !ok || claim == "" {
+		log.Fatalf("Invalid %s %q, expected claim:value", name, v)
+	}
+	return &requiredClaim{name: claim, value: value}
+}
+
+// parseJWTAlgs parses the comma-separated JWT algorithm allowlist. `none` and
+// unknown algorithms are refused at startup.
+func parseJWTAlgs(name, v string) []string {
+	var algs []string
+	for _, alg := range strings.Split(v, ",") {
+		alg = strings.TrimSpace(alg)
+		if alg == "" {
+			continue
+		}
+		if strings.EqualFold(alg, "none") || jwt.GetSigningMethod(alg) == nil {
+			log.Fatalf("Invalid %s: unsupported algorithm %q", name, alg)
+		}
+		algs = append(algs, alg)
+	}
+	if len(algs) == 0 {
+		log.Fatalf("Invalid %s: at least one algorithm is required", name)
+	}
+	return algs
+}
+
+// parseECPublicKey parses a PEM encoded EC public key. Since env files can't
+// easily hold newlines, literal `\n` sequences are accepted too.
+func parseECPublicKey(name, v string) *ecdsa.PublicKey {
+	if v == "" {
+		return nil
+	}
+	key, err := jwt.ParseECPublicKeyFromPEM([]byte(strings.ReplaceAll(v, `\n`, "\n")))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return key
+}
+
+// errUnsignedToken is returned for tokens using the `none` algorithm or
+// without a signature, the classic JWT bypass.
+var errUnsignedToken = errors.New("unsigned token rejected (alg none or empty signature)")
+
+// errMalformedToken is returned for values that aren't a JWT at all, ex: a
+// session cookie sent in the token slot, as opposed to a JWT that fails
+// verification.
+var errMalformedToken = errors.New("malformed token, not a JWT")
+
+// checkStructure rejects values that don't have the three base64url
+// segments of a JWT, without saying more about them: they may be secrets.
+func checkStructure(tokenString string) error {
+	if tokenString == "" {
+		return fmt.Errorf("%w: empty", errMalformedToken)
+	}
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: %d segments, expected 3", errMalformedToken, len(parts))
+	}
+	for i, part := range parts[:2] {
+		if _, err := base64.RawURLEncoding.DecodeString(part); err != nil {
+			return fmt.Errorf("%w: segment %d is not base64url", errMalformedToken, i+1)
+		}
+	}
+	return nil
+}
+
+// checkSigned rejects unsigned tokens before they reach the parser. The
+// algorithm allowlist never contains `none` either, this is an extra guard.
+func checkSigned(tokenString string) error {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) == 3 && parts[2] == "" {
+		return errUnsignedToken
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil // malformed, left to the parser
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(header, &h) == nil && strings.EqualFold(strings.TrimSpace(h.Alg), "none") {
+		return errUnsignedToken
+	}
+	return nil
+}
+
+func verifySseToken(tokenString string, secret string) (*SSETokenClaims, error) {
+	if err := checkStructure(tokenString); err != nil {
+		metrics.malformedTokens.Add(1)
+		return nil, err
+	}
+	if err := checkSigned(tokenString); err != nil {
+		metrics.unsignedTokens.Add(1)
+		return nil, err
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &SSETokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			return []byte(secret), nil
+		case *jwt.SigningMethodECDSA, *jwt.SigningMethodRSA:
+			if jwks != nil {
+				kid, _ := token.Header["kid"].(string)
+				return jwks.key(kid, token.Method.Alg())
+			}
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+				return nil, fmt.Errorf("no JWKS configured for %v", token.Header["alg"])
+			}
+			key := signingKeys.publicKey()
+			if key == nil {
+				return nil, fmt.Errorf("no EC public key configured for %v", token.Header["alg"])
+			}
+			return key, nil
+		}
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}, jwt.WithValidMethods(cfg.JWTAlgs))
+
+	if errors.Is(err, jwt.ErrTokenMalformed) {
+		metrics.malformedTokens.Add(1)
+		return nil, fmt.Errorf("%w: %w", errMalformedToken, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("token parse error: %w", err)
+	}
+
+	if claims, ok := token.Claims.(*SSETokenClaims); ok && token.Valid {
+		if err := claims.applyClaimSchemas(); err != nil {
+			return nil, err
+		}
+		return claims, nil
+	}
+
+	return nil, fmt.Errorf("invalid token")
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signHMAC(t *testing.T, method jwt.SigningMethod, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParseJWTAlgs(t *testing.T) {
+	got := parseJWTAlgs("algs", " HS256, ES256 ,,")
+	if want := []string{"HS256", "ES256"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseJWTAlgs = %v, want %v", got, want)
+	}
+}
+
+func TestVerifyRejectsAlgorithmsOutsideAllowlist(t *testing.T) {
+	useConfig(t, nil)
+	claims := jwt.MapClaims{"user_id": 7, "exp": time.Now().Add(time.Hour).Unix()}
+
+	if _, err := verifySseToken(signHMAC(t, jwt.SigningMethodHS256, claims), testSecret); err != nil {
+		t.Fatalf("HS256 token rejected by the default allowlist: %v", err)
+	}
+	hs384 := signHMAC(t, jwt.SigningMethodHS384, claims)
+	if _, err := verifySseToken(hs384, testSecret); err == nil {
+		t.Fatal("HS384 token accepted with only HS256 allowed")
+	}
+
+	cfg.JWTAlgs = []string{"HS256", "HS384"}
+	if _, err := verifySseToken(hs384, testSecret); err != nil {
+		t.Fatalf("HS384 token rejected once allowed: %v", err)
+	}
+}
+
+func TestStreamRefusesDisallowedAlgorithm(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	tok := signHMAC(t, jwt.SigningMethodHS512, jwt.MapClaims{"user_id": 7})
+
+	resp := get(t, srv.URL+"/sse-events?ssetoken="+tok, nil)
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Fatalf("HS512 token: %s, want 401", resp.Status)
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "event-stream") {
+		t.Error("stream opened for a refused token")
+	}
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// useECKey sets the EC verification key for the test.
+func useECKey(t *testing.T, key *ecdsa.PublicKey) {
+	old := signingKeys.key
+	signingKeys.key = key
+	t.Cleanup(func() { signingKeys.key = old })
+}
+
+func TestParseECPublicKeyAcceptsEscapedNewlines(t *testing.T) {
+	key := newECKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	// As found in a .env file, on one line.
+	got := parseECPublicKey("key", strings.ReplaceAll(block, "\n", `\n`))
+	if !got.Equal(&key.PublicKey) {
+		t.Fatal("parsed key differs from the encoded one")
+	}
+	if parseECPublicKey("key", "") != nil {
+		t.Error("empty value parsed as a key")
+	}
+}
+
+func TestVerifyES256(t *testing.T) {
+	useConfig(t, func(c *Config) { c.JWTAlgs = []string{"HS256", "ES256"} })
+	key := newECKey(t)
+	useECKey(t, &key.PublicKey)
+
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"user_id": 9}).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := verifySseToken(tok, testSecret)
+	if err != nil {
+		t.Fatalf("ES256 token rejected: %v", err)
+	}
+	if claims.UserID != 9 {
+		t.Errorf("user_id = %d", claims.UserID)
+	}
+
+	other := newECKey(t)
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"user_id": 9}).SignedString(other)
+	if _, err := verifySseToken(forged, testSecret); err == nil {
+		t.Error("token signed by another key accepted")
+	}
+	// HS256 keeps working next to ES256.
+	if _, err := verifySseToken(signHMAC(t, jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 9}), testSecret); err != nil {
+		t.Errorf("HS256 token rejected: %v", err)
+	}
+}
+
+func TestVerifyES256WithoutKey(t *testing.T) {
+	useConfig(t, func(c *Config) { c.JWTAlgs = []string{"ES256"} })
+	useECKey(t, nil)
+
+	tok, _ := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"user_id": 9}).SignedString(newECKey(t))
+	_, err := verifySseToken(tok, testSecret)
+	if err == nil || !strings.Contains(err.Error(), "no EC public key") {
+		t.Fatalf("err = %v, want the missing key reported", err)
+	}
+}
+
+func TestClaimMatches(t *testing.T) {
+	claims := &SSETokenClaims{raw: map[string]interface{}{
+		"features": []interface{}{"beta", "sse"},
+		"plan":     "pro",
+		"level":    float64(3),
+	}}
+	tests := []struct {
+		name, value string
+		want        bool
+	}{
+		{"features", "sse", true},
+		{"features", "alpha", false},
+		{"plan", "pro", true},
+		{"plan", "free", false},
+		{"level", "3", true},
+		{"missing", "", false},
+	}
+	for _, tt := range tests {
+		if got := claims.claimMatches(tt.name, tt.value); got != tt.want {
+			t.Errorf("claimMatches(%q, %q) = %v, want %v", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRequiredClaimGatesConnections(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.RequiredClaim = parseRequiredClaim("claim", "features:sse")
+	})
+
+	without := token(t, 7, jwt.MapClaims{"features": []string{"beta"}})
+	resp := get(t, srv.URL+"/sse-events?ssetoken="+without, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("token without the feature: %s, want 403", resp.Status)
+	}
+
+	with := token(t, 7, jwt.MapClaims{"features": []string{"beta", "sse"}})
+	connect(t, srv, 7, url.Values{"ssetoken": {with}})
+}
+
+func TestVerifyRejectsUnsignedTokens(t *testing.T) {
+	useConfig(t, nil)
+	claims := jwt.MapClaims{"user_id": 7}
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := signHMAC(t, jwt.SigningMethodHS256, claims)
+	parts := strings.Split(signed, ".")
+	header := func(alg string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT"}`))
+	}
+
+	tokens := map[string]string{
+		"alg none":            none,
+		"alg NONE":            header("NONE") + "." + parts[1] + ".",
+		"alg none, signature": header(" None ") + "." + parts[1] + "." + parts[2],
+		"empty signature":     parts[0] + "." + parts[1] + ".",
+	}
+	for name, tok := range tokens {
+		before := metrics.unsignedTokens.Load()
+		_, err := verifySseToken(tok, testSecret)
+		if !errors.Is(err, errUnsignedToken) {
+			t.Errorf("%s: err = %v, want errUnsignedToken", name, err)
+		}
+		if metrics.unsignedTokens.Load() != before+1 {
+			t.Errorf("%s: not counted in the unsigned token metric", name)
+		}
+	}
+}
+
+func TestConnectionMetadataInPublishedRecords(t *testing.T) {
+	_, srv, receiptsPublished := receiptSidecar(t, func(c *Config) {
+		c.PresenceChannel = "presence"
+		c.DeadLetterChannel = "deadletters"
+		c.MetadataClaims = []string{"device_id", "app_version"}
+	})
+	startDeadLetters(t)
+	presence := subscribeTo(t, "presence")
+	deadLettered := subscribeTo(t, "deadletters")
+
+	tok := token(t, 1631, jwt.MapClaims{"device_id": "ios-7f3", "app_version": "4.2.0", "email": "a@example.com"})
+	s, conn := connect(t, srv, 1631, url.Values{"ssetoken": {tok}})
+	want := map[string]interface{}{"device_id": "ios-7f3", "app_version": "4.2.0"}
+
+	if r := decodePresence(t, receive(t, presence)); !reflect.DeepEqual(r.Metadata, want) {
+		t.Errorf("presence metadata %v, want only the allowlisted claims", r.Metadata)
+	}
+
+	rdb.Publish(ctx, "events:user:1631", `{"receipt_id": "r-9"}`)
+	s.nextData(t)
+	if r := decodeReceipt(t, receive(t, receiptsPublished)); !reflect.DeepEqual(r.Metadata, want) {
+		t.Errorf("receipt metadata %v", r.Metadata)
+	}
+
+	deadLetters.add(registry.get(conn), sseMessage{payload: "x"}, "stale")
+	if r := decodeDeadLetter(t, receive(t, deadLettered)); !reflect.DeepEqual(r.Metadata, want) {
+		t.Errorf("dead-letter metadata %v", r.Metadata)
+	}
+}
+
+func TestConnectionMetadataOffByDefault(t *testing.T) {
+	useConfig(t, nil)
+	claims, err := verifyToken(token(t, 1632, jwt.MapClaims{"device_id": "ios-7f3"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md := connectionMetadata(claims); md != nil {
+		t.Errorf("metadata %v without GO_SSE_SIDECAR_METADATA_CLAIMS", md)
+	}
+}
+
+func TestVerifyTellsMalformedTokensApart(t *testing.T) {
+	useConfig(t, nil)
+	signed := signHMAC(t, jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 7})
+	parts := strings.Split(signed, ".")
+	for name, tok := range map[string]string{
+		"empty":             "",
+		"session cookie":    "s%3Aj2Vx0v9F.Jx1bYq",
+		"two segments":      parts[0] + "." + parts[1],
+		"four segments":     signed + ".x",
+		"header not base64": "{alg}." + parts[1] + "." + parts[2],
+		"header not JSON":   base64.RawURLEncoding.EncodeToString([]byte("not json")) + "." + parts[1] + "." + parts[2],
+	} {
+		before := metrics.malformedTokens.Load()
+		if _, err := verifySseToken(tok, testSecret); !errors.Is(err, errMalformedToken) {
+			t.Errorf("%s: err = %v, want errMalformedToken", name, err)
+		}
+		if metrics.malformedTokens.Load() != before+1 {
+			t.Errorf("%s: not counted in the malformed token metric", name)
+		}
+	}
+
+	// Well formed JWTs failing verification aren't malformed.
+	for name, tok := range map[string]string{
+		"wrong secret": func() string {
+			s, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 7}).SignedString([]byte("other"))
+			return s
+		}(),
+		"expired":       signHMAC(t, jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 7, "exp": time.Now().Add(-time.Hour).Unix()}),
+		"bad signature": parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])),
+	} {
+		before := metrics.malformedTokens.Load()
+		_, err := verifySseToken(tok, testSecret)
+		if err == nil || errors.Is(err, errMalformedToken) {
+			t.Errorf("%s: err = %v, want a verification error", name, err)
+		}
+		if metrics.malformedTokens.Load() != before {
+			t.Errorf("%s: counted as malformed", name)
+		}
+	}
+}
+
+func TestStreamSaysWhenTokenIsNotAJWT(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	for tok, want := range map[string]string{
+		"session-cookie-value": "Unauthorized: not a JWT\n",
+		signHMAC(t, jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 2011, "exp": time.Now().Add(-time.Hour).Unix()}): "Unauthorized\n",
+	} {
+		resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {tok}}.Encode(), nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || string(body) != want {
+			t.Errorf("%.20s: %s %q, want 401 %q", tok, resp.Status, body, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxAuthFailureEntries bounds the addresses tracked by authFailureLimiter.
+const maxAuthFailureEntries = 10000
+
+// maxAuthBlock bounds the block of an address.
+const maxAuthBlock = time.Hour
+
+// authFailureLimiter blocks the addresses that keep sending invalid tokens:
+// after cfg.AuthFailThreshold failures, for cfg.AuthFailBlock, doubled on
+// every further failure. An address is forgotten cfg.AuthFailWindow after
+// its last failure, once no longer blocked.
+type authFailureLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*authFailure
+	// swept is when the expired entries were last removed.
+	swept time.Time
+}
+
+type authFailure struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+var authLimiter = &authFailureLimiter{entries: make(map[string]*authFailure)}
+
+// blocked reports whether ip is blocked, and for how long.
+func (l *authFailureLimiter) blocked(ip string, now time.Time) (time.Duration, bool) {
+	if cfg.AuthFailThreshold <= 0 {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[ip]
+	if !ok || !now.Before(e.blockedUntil) {
+		return 0, false
+	}
+	return e.blockedUntil.Sub(now), true
+}
+
+// fail records a failure from ip.
+func (l *authFailureLimiter) fail(ip string, now time.Time) {
+	if cfg.AuthFailThreshold <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[ip]
+	if ok && l.expired(e, now) {
+		e, ok = nil, false
+	}
+	if !ok {
+		if len(l.entries) >= maxAuthFailureEntries || now.Sub(l.swept) >= cfg.AuthFailWindow {
+			l.evict(now)
+		}
+		e = &authFailure{}
+		l.entries[ip] = e
+	}
+	e.count++
+	e.last = now
+	if over := e.count - cfg.AuthFailThreshold; over >= 0 {
+		block := time.Duration(float64(cfg.AuthFailBlock) * math.Pow(2, float64(min(over, 20))))
+		e.blockedUntil = now.Add(min(block, maxAuthBlock))
+		log.Printf("[SECURITY] %d invalid tokens from %s, blocking it for %v", e.count, ip, min(block, maxAuthBlock))
+	}
+}
+
+func (l *authFailureLimiter) expired(e *authFailure, now time.Time) bool {
+	return now.Sub(e.last) >= cfg.AuthFailWindow && !now.Before(e.blockedUntil)
+}
+
+// evict forgets the expired entries, and the least recent one when the map
+// is still full.
+func (l *authFailureLimiter) evict(now time.Time) {
+	l.swept = now
+	var oldest string
+	for ip, e := range l.entries {
+		if l.expired(e, now) {
+			delete(l.entries, ip)
+			continue
+		}
+		if oldest == "" || e.last.Before(l.entries[oldest].last) {
+			oldest = ip
+		}
+	}
+	if len(l.entries) >= maxAuthFailureEntries {
+		delete(l.entries, oldest)
+	}
+}
+
+// refuseBlocked answers a request from a blocked address.
+func refuseBlocked(w http.ResponseWriter, retry time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(retry.Seconds())))
+	http.Error(w, "Too many invalid tokens", http.StatusTooManyRequests)
+}
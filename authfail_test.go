@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// useAuthLimiter starts the test with no address tracked.
+func useAuthLimiter(t *testing.T) {
+	t.Helper()
+	old := authLimiter
+	authLimiter = &authFailureLimiter{entries: make(map[string]*authFailure)}
+	t.Cleanup(func() { authLimiter = old })
+}
+
+func TestAuthFailuresBackOff(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.AuthFailThreshold = 3
+		c.AuthFailBlock = 10 * time.Second
+		c.AuthFailWindow = time.Minute
+	})
+	useAuthLimiter(t)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		authLimiter.fail("10.0.0.1", now)
+	}
+	if _, blocked := authLimiter.blocked("10.0.0.1", now); blocked {
+		t.Fatal("blocked under the threshold")
+	}
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		authLimiter.fail("10.0.0.1", now)
+		retry, blocked := authLimiter.blocked("10.0.0.1", now)
+		if !blocked || retry != want {
+			t.Errorf("failure %d: blocked %v for %v, want %v", i+3, blocked, retry, want)
+		}
+	}
+	if _, blocked := authLimiter.blocked("10.0.0.2", now); blocked {
+		t.Error("other address blocked")
+	}
+	if _, blocked := authLimiter.blocked("10.0.0.1", now.Add(40*time.Second)); blocked {
+		t.Error("still blocked after the block")
+	}
+}
+
+func TestAuthFailuresForgotten(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.AuthFailThreshold = 2
+		c.AuthFailBlock = time.Second
+		c.AuthFailWindow = time.Minute
+	})
+	useAuthLimiter(t)
+	now := time.Now()
+	authLimiter.fail("10.0.0.1", now)
+	// Past the window the count starts over, one failure doesn't block.
+	authLimiter.fail("10.0.0.1", now.Add(time.Minute))
+	if _, blocked := authLimiter.blocked("10.0.0.1", now.Add(time.Minute)); blocked {
+		t.Error("failure outside the window counted")
+	}
+
+	for i := 0; i < maxAuthFailureEntries; i++ {
+		authLimiter.fail(fmt.Sprintf("10.1.%d.%d", i/256, i%256), now.Add(time.Minute))
+	}
+	if n := len(authLimiter.entries); n > maxAuthFailureEntries {
+		t.Errorf("%d addresses tracked, want at most %d", n, maxAuthFailureEntries)
+	}
+	// Everything expired: the next failure sweeps them.
+	later := now.Add(3 * time.Minute)
+	authLimiter.fail("10.0.0.3", later)
+	if n := len(authLimiter.entries); n != 1 {
+		t.Errorf("%d addresses tracked after they expired, want 1", n)
+	}
+}
+
+func TestAuthFailuresOffByDefault(t *testing.T) {
+	useConfig(t, nil)
+	useAuthLimiter(t)
+	for i := 0; i < 100; i++ {
+		authLimiter.fail("10.0.0.1", time.Now())
+	}
+	if _, blocked := authLimiter.blocked("10.0.0.1", time.Now()); blocked || len(authLimiter.entries) != 0 {
+		t.Error("address tracked without GO_SSE_SIDECAR_AUTH_FAIL_THRESHOLD")
+	}
+}
+
+func TestStreamBlocksAddressAfterInvalidTokens(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.AuthFailThreshold = 2
+		c.AuthFailBlock = time.Minute
+		// The test server is the proxy, the client is in X-Forwarded-For.
+		c.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	})
+	useAuthLimiter(t)
+	stream := func(ip, ssetoken string) *http.Response {
+		t.Helper()
+		resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {ssetoken}}.Encode(), http.Header{"X-Forwarded-For": {ip}})
+		resp.Body.Close()
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := stream("203.0.113.7", "guess"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("guess %d: %d, want 401", i, resp.StatusCode)
+		}
+	}
+	blocked := metrics.authBlocked.Load()
+	resp := stream("203.0.113.7", token(t, 1881, nil))
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+		t.Errorf("valid token from the blocked address: %d, Retry-After %q, want 429 for 60s",
+			resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if n := metrics.authBlocked.Load() - blocked; n != 1 {
+		t.Errorf("%d blocked requests counted", n)
+	}
+	if resp := stream("203.0.113.8", token(t, 1882, nil)); resp.StatusCode != http.StatusOK {
+		t.Errorf("other client behind the same proxy: %d, want 200", resp.StatusCode)
+	}
+}
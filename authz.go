@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+var authzClient = &http.Client{}
+
+type authzRequest struct {
+	UserID       int64                  `json:"user_id"`
+	ConnectionID string                 `json:"connection_id"`
+	Claims       map[string]interface{} `json:"claims"`
+}
+
+type authzResponse struct {
+	Allow bool `json:"allow"`
+}
+
+// authorize asks cfg.AuthzWebhook whether the connection may open, ex: to
+// check a live ban list the token can't carry. On deny or failure it writes
+// the error response and returns false; with cfg.AuthzFailOpen a webhook
+// that fails or times out lets the connection through.
+func authorize(w http.ResponseWriter, r *http.Request, connID string, claims *SSETokenClaims) bool {
+	if cfg.AuthzWebhook == "" {
+		return true
+	}
+	allow, err := callAuthzWebhook(r.Context(), connID, claims)
+	switch {
+	case err != nil && cfg.AuthzFailOpen:
+		log.Printf("[SECURITY] [conn %s] Authorization webhook failed, allowing user %d: %v", connID, claims.UserID, err)
+		return true
+	case err != nil:
+		log.Printf("[SECURITY] [conn %s] Authorization webhook failed, refusing user %d: %v", connID, claims.UserID, err)
+		http.Error(w, "Authorization unavailable", http.StatusServiceUnavailable)
+		return false
+	case !allow:
+		log.Printf("[SECURITY] [conn %s] Authorization webhook denied user %d", connID, claims.UserID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func callAuthzWebhook(ctx context.Context, connID string, claims *SSETokenClaims) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.AuthzTimeout)
+	defer cancel()
+
+	body, _ := json.Marshal(authzRequest{UserID: claims.UserID, ConnectionID: connID, Claims: claims.raw})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.AuthzWebhook, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := authzClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var decision authzResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("decode: %v", err)
+	}
+	return decision.Allow, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authzWebhook serves the authorization webhook with decide, and returns
+// the requests it got.
+func authzWebhook(t *testing.T, decide func(w http.ResponseWriter, req authzRequest)) <-chan authzRequest {
+	t.Helper()
+	requests := make(chan authzRequest, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+		requests <- req
+		decide(w, req)
+	}))
+	t.Cleanup(hook.Close)
+	cfg.AuthzWebhook = hook.URL
+	return requests
+}
+
+func streamStatus(t *testing.T, srv *httptest.Server, userID int64, claims jwt.MapClaims) int {
+	t.Helper()
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, userID, claims)}}.Encode(), nil)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAuthzWebhookAllows(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	requests := authzWebhook(t, func(w http.ResponseWriter, req authzRequest) {
+		json.NewEncoder(w).Encode(authzResponse{Allow: true})
+	})
+	s, conn := connect(t, srv, 1761, url.Values{"ssetoken": {token(t, 1761, jwt.MapClaims{"plan": "pro"})}})
+
+	req := <-requests
+	if req.UserID != 1761 || req.ConnectionID != conn || req.Claims["plan"] != "pro" {
+		t.Errorf("webhook got %+v, want the connection and its claims", req)
+	}
+	rdb.Publish(ctx, "events:user:1761", "allowed")
+	if ev := s.nextData(t); ev.data != "allowed" {
+		t.Errorf("got %q", ev.data)
+	}
+}
+
+func TestAuthzWebhookDenies(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	authzWebhook(t, func(w http.ResponseWriter, req authzRequest) {
+		json.NewEncoder(w).Encode(authzResponse{Allow: req.UserID != 1762})
+	})
+	if code := streamStatus(t, srv, 1762, nil); code != http.StatusForbidden {
+		t.Errorf("banned user: %d, want 403", code)
+	}
+	if len(registry.forUser("", 1762)) != 0 {
+		t.Error("denied connection registered")
+	}
+	if code := streamStatus(t, srv, 1763, nil); code != http.StatusOK {
+		t.Errorf("other user: %d, want 200", code)
+	}
+}
+
+func TestAuthzWebhookTimeout(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		_, srv := newSidecar(t, func(c *Config) {
+			c.AuthzTimeout = 50 * time.Millisecond
+			c.AuthzFailOpen = failOpen
+		})
+		release := make(chan struct{})
+		authzWebhook(t, func(w http.ResponseWriter, req authzRequest) {
+			<-release
+		})
+		start := time.Now()
+		code := streamStatus(t, srv, 1764, nil)
+		close(release)
+		if want := map[bool]int{false: http.StatusServiceUnavailable, true: http.StatusOK}[failOpen]; code != want {
+			t.Errorf("fail open %v: %d, want %d", failOpen, code, want)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("fail open %v: answered after %v, want within GO_SSE_SIDECAR_AUTHZ_TIMEOUT", failOpen, d)
+		}
+	}
+}
+
+func TestAuthzWebhookErrorStatusFailsClosed(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	authzWebhook(t, func(w http.ResponseWriter, req authzRequest) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	if code := streamStatus(t, srv, 1765, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503 when the webhook fails", code)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// limitBody caps the request body of h at cfg.MaxBodyBytes.
+func limitBody(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+		h(w, r)
+	}
+}
+
+// bodyTooLarge answers 413 and reports true when err comes from a body over
+// cfg.MaxBodyBytes.
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	return true
+}
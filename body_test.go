@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// padded is the JSON object body with a filler field making it size bytes.
+func padded(body string, size int) string {
+	const filler = `, "filler": ""}`
+	return strings.TrimSuffix(body, "}") + filler[:13] + strings.Repeat("x", size-len(body)-len(filler)+1) + filler[13:]
+}
+
+func TestBodyLimitOnPOSTEndpoints(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin")
+	_, srv := newSidecar(t, func(c *Config) { c.MaxBodyBytes = 256 })
+	tok := token(t, 1901, jwt.MapClaims{"channels": []string{"rooms:1"}})
+	_, conn := connect(t, srv, 1901, url.Values{"ssetoken": {tok}})
+
+	for _, tt := range []struct {
+		path, body, bearer string
+		ok                 int
+	}{
+		{"/control/" + conn, `{"action": "subscribe", "channels": ["rooms:1"]}`, tok, http.StatusOK},
+		{"/loopback", `{"user_id": 1901, "payload": "hi"}`, "admin", http.StatusOK},
+	} {
+		if resp := post(t, srv.URL+tt.path, padded(tt.body, 256), tt.bearer); resp.StatusCode != tt.ok {
+			t.Errorf("%s at the limit: %s, want %d", tt.path, resp.Status, tt.ok)
+		}
+		if resp := post(t, srv.URL+tt.path, padded(tt.body, 257), tt.bearer); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s over the limit: %s, want 413", tt.path, resp.Status)
+		}
+	}
+
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin-secret")
+	if rec := adminDisconnect(t, padded(`{"claims": {"tenant": "initech"}}`, 256)); rec.Code != http.StatusOK {
+		t.Errorf("/disconnect at the limit: %d", rec.Code)
+	}
+	if rec := adminDisconnect(t, padded(`{"claims": {"tenant": "initech"}}`, 257)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("/disconnect over the limit: %d, want 413", rec.Code)
+	}
+}
+
+func TestBodyLimitDefault(t *testing.T) {
+	useConfig(t, nil)
+	if cfg.MaxBodyBytes != 1<<20 {
+		t.Errorf("default limit %d, want 1MiB", cfg.MaxBodyBytes)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// configEventData is the data of the `config` event: what a client needs to
+// know about the server to follow the stream without client.js. Only
+// settings that shape the protocol go in, nothing about the deployment.
+type configEventData struct {
+	RetryMS    int64 `json:"retry_ms"`
+	MaxRetryMS int64 `json:"max_retry_ms"`
+	// KeepaliveMS is 0 without keepalives. KeepaliveFormat is `comment` or
+	// `event` (an `event: ping`).
+	KeepaliveMS     int64    `json:"keepalive_ms"`
+	KeepaliveFormat string   `json:"keepalive_format"`
+	Events          []string `json:"events"`
+	Replay          struct {
+		// Backfill is how many history entries a connection replays.
+		Backfill int  `json:"backfill"`
+		Snapshot bool `json:"snapshot"`
+		CaughtUp bool `json:"caught_up"`
+	} `json:"replay"`
+}
+
+// writeConfigEvent sends the connection's `config` event, the first of the
+// stream with cfg.ConfigEvent. Its retry field also sets EventSource's
+// reconnect delay.
+func (c *SSEClient) writeConfigEvent(w io.Writer) error {
+	data := configEventData{
+		RetryMS:         cfg.ClientRetry.Milliseconds(),
+		MaxRetryMS:      cfg.ClientMaxRetry.Milliseconds(),
+		KeepaliveMS:     cfg.KeepaliveInterval.Milliseconds(),
+		KeepaliveFormat: cfg.KeepaliveFormat,
+		Events:          clientEvents(),
+	}
+	if data.Events == nil {
+		data.Events = []string{}
+	}
+	data.Replay.Backfill = c.backfill()
+	data.Replay.Snapshot = cfg.SnapshotKey != ""
+	data.Replay.CaughtUp = cfg.CaughtUp
+	b, _ := json.Marshal(data)
+	return writeFrame(w, sseFrame{event: "config", data: string(b), retry: cfg.ClientRetry})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigEventReflectsSettings(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.ConfigEvent = true
+		c.ClientRetry = 1500 * time.Millisecond
+		c.ClientMaxRetry = 20 * time.Second
+		c.KeepaliveInterval = 25 * time.Second
+		c.KeepaliveFormat = "event"
+		c.HistoryBackfill = 5
+		c.SnapshotKey = "snapshot:{user_id}"
+		c.CaughtUp = true
+	})
+	s := openStream(t, srv, url.Values{"ssetoken": {token(t, 2401, nil)}})
+	ev := s.next(t)
+	if ev.event != "config" || ev.retry != "1500" {
+		t.Fatalf("first frame %+v, want the config event with retry 1500", ev)
+	}
+	var data configEventData
+	if err := json.Unmarshal([]byte(ev.data), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.RetryMS != 1500 || data.MaxRetryMS != 20000 || data.KeepaliveMS != 25000 || data.KeepaliveFormat != "event" {
+		t.Errorf("config %+v", data)
+	}
+	if !reflect.DeepEqual(data.Events, clientEvents()) {
+		t.Errorf("events %v, want %v", data.Events, clientEvents())
+	}
+	listed := make(map[string]bool)
+	for _, name := range data.Events {
+		listed[name] = true
+	}
+	for _, name := range []string{"config", "ping", "snapshot", "caught_up"} {
+		if !listed[name] {
+			t.Errorf("events %v lack %s", data.Events, name)
+		}
+	}
+	if r := data.Replay; r.Backfill != 5 || !r.Snapshot || !r.CaughtUp {
+		t.Errorf("replay %+v", r)
+	}
+	s.nextEvent(t, "connected")
+}
+
+func TestConfigEventWithoutKeepaliveOrReplay(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.ConfigEvent = true
+		c.KeepaliveInterval = 0
+		c.HistoryBackfill = 0
+	})
+	s := openStream(t, srv, url.Values{"ssetoken": {token(t, 2402, nil)}})
+	ev := s.next(t)
+	if ev.event != "config" {
+		t.Fatalf("first frame %+v", ev)
+	}
+	// Every field is there, empty ones included.
+	var raw map[string]json.RawMessage
+	json.Unmarshal([]byte(ev.data), &raw)
+	for _, key := range []string{"retry_ms", "max_retry_ms", "keepalive_ms", "keepalive_format", "events", "replay"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("config %s lacks %s", ev.data, key)
+		}
+	}
+	if len(raw) != 6 {
+		t.Errorf("config %s has unexpected fields", ev.data)
+	}
+	if string(raw["keepalive_ms"]) != "0" || string(raw["replay"]) != `{"backfill":0,"snapshot":false,"caught_up":false}` {
+		t.Errorf("config %s", ev.data)
+	}
+}
+
+func TestConfigEventBackfillOfFeed(t *testing.T) {
+	_, srv := feedSidecar(t)
+	cfg.ConfigEvent = true
+	for feed, want := range map[string]int{"": 1, "activity": 2, "notifications": 0} {
+		q := url.Values{"ssetoken": {token(t, 2403, nil)}}
+		if feed != "" {
+			q.Set("feed", feed)
+		}
+		s := openStream(t, srv, q)
+		ev := s.next(t)
+		var data configEventData
+		if err := json.Unmarshal([]byte(ev.data), &data); ev.event != "config" || err != nil || data.Replay.Backfill != want {
+			t.Errorf("feed %q: %+v, want backfill %d", feed, ev, want)
+		}
+		s.resp.Body.Close()
+	}
+}
+
+func TestNoConfigEventByDefault(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	s := openStream(t, srv, url.Values{"ssetoken": {token(t, 2404, nil)}})
+	if ev := s.next(t); ev.event != "connected" {
+		t.Errorf("first frame %+v, want connected", ev)
+	}
+	for _, name := range clientEvents() {
+		if name == "config" {
+			t.Error("config listed in the events while disabled")
+		}
+	}
+}
+
+func TestClientJSKeepsConfig(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ConfigEvent = true })
+	if js := clientJS(t); !strings.Contains(js, `if (name === "config" && data) client.config = data;`) {
+		t.Error("client.js doesn't keep the config event")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// mergeBurst returns the messages to write after taking first from the
+// queue. When first starts a burst, at least cfg.BurstMin queued messages
+// of the same event and channel published within cfg.BurstWindow of it,
+// they're merged into one event whose data is the JSON array of their
+// payloads, so a backlog goes out in a few frames instead of being dropped.
+// Steady traffic doesn't queue up and is written as is. Only named events
+// are merged, the client's handler for the name gets the array; the
+// sidecar's own events never are, nor messages that need a frame of their
+// own, see mergeable.
+func (c *SSEClient) mergeBurst(first sseMessage) []sseMessage {
+	if cfg.BurstWindow <= 0 || first.event != "" || len(c.channel) < cfg.BurstMin-1 || !c.mergeable(first) {
+		return []sseMessage{first}
+	}
+	name := c.frameEvent(first)
+	if !c.mergesBurst(name) {
+		return []sseMessage{first}
+	}
+	burst := []sseMessage{first}
+	var next *sseMessage
+	for len(burst) < cfg.BurstMax {
+		var msg sseMessage
+		queued := true
+		select {
+		case msg = <-c.channel:
+		default:
+			queued = false
+		}
+		if !queued {
+			break
+		}
+		if msg.event != "" || msg.channel != first.channel || msg.enqueued.Sub(first.enqueued) > cfg.BurstWindow || c.frameEvent(msg) != name || !c.mergeable(msg) {
+			// Written after the burst, in queue order.
+			next = &msg
+			break
+		}
+		burst = append(burst, msg)
+	}
+	out := burst
+	if len(burst) >= cfg.BurstMin {
+		metrics.burstMerged.Add(int64(len(burst) - 1))
+		c.logf("Merging a burst of %d %q events for user %d", len(burst), name, c.userID)
+		out = []sseMessage{mergedMessage(name, burst)}
+	}
+	if next != nil {
+		out = append(out, *next)
+	}
+	return out
+}
+
+// mergeable reports whether msg may go out as part of an array. The receipt
+// id, the dedupe key and the event id are read from a payload of its own, so
+// a message carrying one isn't merged, and no message is with a dedupe
+// comparing whole payloads.
+func (c *SSEClient) mergeable(msg sseMessage) bool {
+	if (cfg.ReceiptChannel != "" || cfg.AckChannel != "") && payloadScalar(msg.payload, "receipt_id") != "" {
+		return false
+	}
+	if c.dedupe != nil && (c.dedupe.key == "" || c.dedupe.compareValue(msg.payload) != msg.payload) {
+		return false
+	}
+	return cfg.EventIDField == "" || payloadScalar(msg.payload, cfg.EventIDField) == ""
+}
+
+// mergesBurst reports whether events named name are merged, all named events
+// without cfg.BurstEvents.
+func (c *SSEClient) mergesBurst(name string) bool {
+	return name != "" && (len(cfg.BurstEvents) == 0 || slices.Contains(cfg.BurstEvents, name))
+}
+
+// mergedMessage returns the message of a burst: the array of the payloads,
+// transformed one by one, JSON ones embedded as-is and anything else as a
+// string. It's named like the messages it merges and has the queue position
+// of the last one. It's marked transformed, so the write pipeline doesn't
+// transform the array again.
+func mergedMessage(name string, burst []sseMessage) sseMessage {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, msg := range burst {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		payload := cfg.Transform.apply(msg.payload)
+		if json.Valid([]byte(payload)) {
+			b.WriteString(payload)
+		} else {
+			s, _ := json.Marshal(payload)
+			b.Write(s)
+		}
+	}
+	b.WriteByte(']')
+	last := burst[len(burst)-1]
+	return sseMessage{
+		channel:     last.channel,
+		pattern:     last.pattern,
+		payload:     b.String(),
+		event:       name,
+		enqueued:    burst[0].enqueued,
+		seq:         last.seq,
+		transformed: true,
+		published:   b.String(),
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// burstSidecar merges bursts of 3 to 4 messages named by their `type`.
+func burstSidecar(t *testing.T, set func(c *Config)) (*sseStream, string) {
+	t.Helper()
+	_, srv := newSidecar(t, func(c *Config) {
+		c.EventField = "type"
+		c.BurstWindow = time.Second
+		c.BurstMin = 3
+		c.BurstMax = 4
+		if set != nil {
+			set(c)
+		}
+	})
+	return connect(t, srv, 2371, nil)
+}
+
+// queueBurst publishes payloads while delivery is paused, so they're all
+// queued when it resumes.
+func queueBurst(t *testing.T, conn string, payloads ...string) {
+	t.Helper()
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	for _, payload := range payloads {
+		rdb.Publish(ctx, "events:user:2371", payload)
+	}
+	waitFor(t, "the burst queued", func() bool { return registry.get(conn).queued() == len(payloads) })
+	delivery.set(false)
+}
+
+func TestBurstMergedIntoArray(t *testing.T) {
+	s, conn := burstSidecar(t, nil)
+	merged := metrics.burstMerged.Load()
+	var burst []string
+	for i := 0; i < 6; i++ {
+		burst = append(burst, fmt.Sprintf(`{"type": "tick", "n": %d}`, i))
+	}
+	queueBurst(t, conn, append(burst, `{"type": "note"}`)...)
+
+	// Four at most, then two left: too few to merge.
+	want := []sseEvent{
+		{event: "tick", data: `[{"type": "tick", "n": 0},{"type": "tick", "n": 1},{"type": "tick", "n": 2},{"type": "tick", "n": 3}]`},
+		{event: "tick", data: `{"type": "tick", "n": 4}`},
+		{event: "tick", data: `{"type": "tick", "n": 5}`},
+		{event: "note", data: `{"type": "note"}`},
+	}
+	for _, w := range want {
+		if ev := s.nextData(t); ev.event != w.event || ev.data != w.data {
+			t.Errorf("got %s %s, want %s %s", ev.event, ev.data, w.event, w.data)
+		}
+	}
+	if n := metrics.burstMerged.Load() - merged; n != 3 {
+		t.Errorf("%d merged, want 3", n)
+	}
+}
+
+func TestBurstOfOtherEventsNotMerged(t *testing.T) {
+	s, conn := burstSidecar(t, func(c *Config) { c.BurstEvents = []string{"tick"} })
+	queueBurst(t, conn, `{"type": "chat", "n": 1}`, `{"type": "chat", "n": 2}`, `{"type": "chat", "n": 3}`, "not json")
+	for _, want := range []string{`{"type": "chat", "n": 1}`, `{"type": "chat", "n": 2}`, `{"type": "chat", "n": 3}`, "not json"} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Errorf("got %s, want %s", ev.data, want)
+		}
+	}
+}
+
+func TestSteadyTrafficNotMerged(t *testing.T) {
+	s, _ := burstSidecar(t, nil)
+	merged := metrics.burstMerged.Load()
+	for i := 0; i < 5; i++ {
+		payload := fmt.Sprintf(`{"type": "tick", "n": %d}`, i)
+		rdb.Publish(ctx, "events:user:2371", payload)
+		if ev := s.nextData(t); ev.data != payload {
+			t.Fatalf("got %s, want %s", ev.data, payload)
+		}
+	}
+	if metrics.burstMerged.Load() != merged {
+		t.Error("steady traffic merged")
+	}
+}
+
+func TestBurstMergedWithTransform(t *testing.T) {
+	s, conn := burstSidecar(t, func(c *Config) { c.Transform = parseTransform("", "secret", "n=num") })
+	queueBurst(t, conn, `{"type": "tick", "n": 1, "secret": "x"}`, `{"type": "tick", "n": 2}`, `{"type": "tick", "n": 3}`)
+	want := `[{"num":1,"type":"tick"},{"num":2,"type":"tick"},{"num":3,"type":"tick"}]`
+	if ev := s.nextData(t); ev.event != "tick" || ev.data != want {
+		t.Errorf("got %s %s, want tick %s", ev.event, ev.data, want)
+	}
+}
+
+func TestEnvelopedBurstTransformedOnce(t *testing.T) {
+	// The payloads are transformed as they're merged, the envelope of the
+	// array isn't transformed on top.
+	s, conn := burstSidecar(t, func(c *Config) {
+		c.Transform = parseTransform("", "", "data=body")
+		c.WritePipeline = parsePipeline("GO_SSE_SIDECAR_WRITE_PIPELINE", "dedupe,envelope,transform", writeStages, defaultWritePipeline)
+		c.Envelope = true
+	})
+	queueBurst(t, conn, `{"type": "tick", "data": 1}`, `{"type": "tick", "data": 2}`, `{"type": "tick", "data": 3}`)
+	want := `{"channel":"events:user:2371","content_type":"application/json","data":[{"body":1,"type":"tick"},{"body":2,"type":"tick"},{"body":3,"type":"tick"}]}`
+	if ev := s.nextData(t); ev.data != want {
+		t.Errorf("enveloped burst\n%s\nwant\n%s", ev.data, want)
+	}
+}
+
+func TestBurstOfReceiptsNotMerged(t *testing.T) {
+	s, conn := burstSidecar(t, func(c *Config) { c.ReceiptChannel = "receipts" })
+	startReceipts(t)
+	published := subscribeTo(t, "receipts")
+	burst := []string{`{"type": "tick", "n": 0}`}
+	for i := 1; i <= 3; i++ {
+		burst = append(burst, fmt.Sprintf(`{"type": "tick", "receipt_id": "r-%d"}`, i))
+	}
+	queueBurst(t, conn, burst...)
+
+	for _, want := range burst {
+		if ev := s.nextData(t); ev.data != want {
+			t.Errorf("got %s, want %s on its own", ev.data, want)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		if r := decodeReceipt(t, receive(t, published)); r.ReceiptID != fmt.Sprintf("r-%d", i) {
+			t.Errorf("receipt %+v, want r-%d", r, i)
+		}
+	}
+}
+
+func TestBurstOfDedupedOrIdentifiedNotMerged(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(c *Config)
+		burst []string
+		want  []sseEvent
+	}{
+		{
+			"dedupe key",
+			func(c *Config) { c.DedupeWindow, c.DedupeKey = time.Second, "k" },
+			[]string{`{"type": "tick", "k": 1}`, `{"type": "tick", "k": 1, "n": 2}`, `{"type": "tick", "k": 2}`, `{"type": "tick", "k": 3}`},
+			[]sseEvent{{data: `{"type": "tick", "k": 1}`}, {data: `{"type": "tick", "k": 2}`}, {data: `{"type": "tick", "k": 3}`}},
+		},
+		{
+			"whole payload dedupe",
+			func(c *Config) { c.DedupeWindow = time.Second },
+			[]string{`{"type": "tick"}`, `{"type": "tick"}`, `{"type": "tick", "n": 1}`, `{"type": "tick", "n": 2}`},
+			[]sseEvent{{data: `{"type": "tick"}`}, {data: `{"type": "tick", "n": 1}`}, {data: `{"type": "tick", "n": 2}`}},
+		},
+		{
+			"event id",
+			func(c *Config) { c.EventIDField = "id" },
+			[]string{`{"type": "tick", "id": "e-1"}`, `{"type": "tick", "id": "e-2"}`, `{"type": "tick", "id": "e-3"}`},
+			[]sseEvent{{id: "e-1", data: `{"type": "tick", "id": "e-1"}`}, {id: "e-2", data: `{"type": "tick", "id": "e-2"}`}, {id: "e-3", data: `{"type": "tick", "id": "e-3"}`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, conn := burstSidecar(t, tt.set)
+			merged := metrics.burstMerged.Load()
+			queueBurst(t, conn, tt.burst...)
+			for _, w := range tt.want {
+				if ev := s.nextData(t); ev.data != w.data || ev.id != w.id {
+					t.Errorf("got id %q %s, want id %q %s", ev.id, ev.data, w.id, w.data)
+				}
+			}
+			if metrics.burstMerged.Load() != merged {
+				t.Error("merged")
+			}
+		})
+	}
+}
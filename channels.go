@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// channelMatcher matches channel names against a list of prefixes and
+// regular expressions (written as `/expr/`, which must match the full name).
+type channelMatcher struct {
+	prefixes []string
+	patterns []*regexp.Regexp
+}
+
+func parseChannelMatcher(name, v string) *channelMatcher {
+	m, err := compileChannelMatcher(strings.Split(v, ","))
+	if err != nil {
+		log.Fatalf("Invalid %s %v", name, err)
+	}
+	return m
+}
+
+// compileChannelMatcher builds a matcher from its entries, nil when there
+// are none.
+func compileChannelMatcher(entries []string) (*channelMatcher, error) {
+	m := &channelMatcher{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			re, err := regexp.Compile("^(?:" + entry[1:len(entry)-1] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("pattern %q: %v", entry, err)
+			}
+			m.patterns = append(m.patterns, re)
+			continue
+		}
+		m.prefixes = append(m.prefixes, entry)
+	}
+	if len(m.prefixes) == 0 && len(m.patterns) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+func (m *channelMatcher) match(channel string) bool {
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(channel, p) {
+			return true
+		}
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateChannels is run on every channel before subscribing to it, however
+// the name was derived. Denied channels always fail; when an allowlist is
+// configured the channel must also match it.
+func validateChannels(channels []string) error {
+	for _, ch := range channels {
+		if ch == "" || strings.ContainsAny(ch, "*?[") {
+			return fmt.Errorf("invalid channel name %q", ch)
+		}
+		if deny := allowlists.channelDeny(); deny != nil && deny.match(ch) {
+			return fmt.Errorf("channel %q is denied", ch)
+		}
+		if allow := allowlists.channelAllow(); allow != nil && !allow.match(ch) {
+			return fmt.Errorf("channel %q is not allowed", ch)
+		}
+	}
+	return nil
+}
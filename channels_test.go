@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func mustMatcher(t *testing.T, v string) *channelMatcher {
+	t.Helper()
+	m, err := compileChannelMatcher(strings.Split(v, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestValidateChannels(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.ChannelAllow = mustMatcher(t, `events:user:,/news:[a-z]+/`)
+		c.ChannelDeny = mustMatcher(t, `events:user:0,/.*:internal/`)
+	})
+	tests := []struct {
+		channel string
+		ok      bool
+	}{
+		{"events:user:42", true},
+		{"news:sports", true},
+		// Patterns match the whole name, not a part of it.
+		{"news:sports:1", false},
+		{"breaking-news:sports", false},
+		{"news:", false},
+		// The denylist wins over a matching allowlist entry.
+		{"events:user:0", false},
+		{"events:user:007", false},
+		{"events:user:1:internal", false},
+		{"admin:reload", false},
+		// Redis patterns aren't channel names.
+		{"events:user:*", false},
+		{"events:user:[12]", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := validateChannels([]string{tt.channel}); (err == nil) != tt.ok {
+			t.Errorf("%q: err = %v, want allowed=%v", tt.channel, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateChannelsWithoutAllowlist(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ChannelDeny = mustMatcher(t, "internal:") })
+	if err := validateChannels([]string{"anything:goes", "events:user:1"}); err != nil {
+		t.Errorf("without an allowlist, non-denied channels are refused: %v", err)
+	}
+	if err := validateChannels([]string{"events:user:1", "internal:jobs"}); err == nil {
+		t.Error("one denied channel doesn't fail the set")
+	}
+}
+
+func TestChannelMatcherRefusesBadPattern(t *testing.T) {
+	if _, err := compileChannelMatcher([]string{"/events:(/"}); err == nil {
+		t.Error("invalid pattern compiled")
+	}
+	if m, _ := compileChannelMatcher([]string{" ", ""}); m != nil {
+		t.Error("empty entries make a matcher")
+	}
+}
+
+func TestDeniedChannelRefusedOnConnect(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.BroadcastChannel = "internal:broadcast"
+		c.ChannelDeny = mustMatcher(t, "internal:")
+	})
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, 1311, nil)}}.Encode(), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %s, want 403", resp.Status)
+	}
+	if n := len(registry.forUser("", 1311)); n != 0 {
+		t.Errorf("%d connections registered", n)
+	}
+}
+
+func TestDeniedChannelRefusedOnSubscribe(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.ChannelDeny = mustMatcher(t, `/.*:internal/`) })
+	// The claim lets the user subscribe to it, the denylist still applies.
+	tok := token(t, 1312, jwt.MapClaims{"channels": []string{"jobs:internal"}})
+	_, id := connect(t, srv, 1312, url.Values{"ssetoken": {tok}})
+
+	resp := post(t, srv.URL+"/control/"+id, `{"action": "subscribe", "channels": ["jobs:internal"]}`, tok)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %s, want 403", resp.Status)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var errNoUserID = errors.New("no claim schema yields a user id")
+
+// claimSchema says where the tokens of an issuer hold the user id: a claim,
+// or a path through nested objects, ex: `sub` or `user.id`. The issuer `*`
+// matches every token.
+type claimSchema struct {
+	issuer string
+	path   []string
+}
+
+// parseClaimSchemas reads a list of `issuer=path` entries, tried in order.
+func parseClaimSchemas(name string, list []string) []claimSchema {
+	var schemas []claimSchema
+	for _, entry := range list {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			log.Fatalf("Invalid %s entry %q, expected issuer=claim", name, entry)
+		}
+		path := strings.Split(entry[i+1:], ".")
+		for _, p := range path {
+			if p == "" {
+				log.Fatalf("Invalid %s entry %q: empty claim name in the path", name, entry)
+			}
+		}
+		schemas = append(schemas, claimSchema{issuer: entry[:i], path: path})
+	}
+	return schemas
+}
+
+// applyClaimSchemas sets the user id from the first of cfg.ClaimSchemas
+// matching the token's issuer that yields one: a positive integer, or a
+// string holding one. Without schemas the `user_id` claim is used as is.
+func (c *SSETokenClaims) applyClaimSchemas() error {
+	if len(cfg.ClaimSchemas) == 0 {
+		return nil
+	}
+	for _, s := range cfg.ClaimSchemas {
+		if s.issuer != "*" && s.issuer != c.Issuer {
+			continue
+		}
+		if id, ok := userIDValue(claimAt(c.raw, s.path)); ok {
+			c.UserID = id
+			return nil
+		}
+	}
+	return fmt.Errorf("%w for issuer %q", errNoUserID, c.Issuer)
+}
+
+// claimAt returns the value at path in the claims, nil when there is none.
+func claimAt(claims map[string]interface{}, path []string) interface{} {
+	var v interface{} = claims
+	for _, name := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[name]
+	}
+	return v
+}
+
+func userIDValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case float64:
+		if v >= 1 && v == math.Trunc(v) && v <= math.MaxInt64 {
+			return int64(v), true
+		}
+	case string:
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil && id > 0 {
+			return id, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// issuerToken signs claims as an identity provider would, with no user_id
+// unless claims has one.
+func issuerToken(t *testing.T, claims jwt.MapClaims) url.Values {
+	t.Helper()
+	c := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range claims {
+		c[k] = v
+	}
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url.Values{"ssetoken": {s}}
+}
+
+func TestTokensOfTwoIssuers(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.ClaimSchemas = parseClaimSchemas("test", []string{"https://a.example=sub", "https://b.example=user.id"})
+	})
+	// One puts it in `sub` as a string, the other nested as a number.
+	a, _ := connect(t, srv, 0, issuerToken(t, jwt.MapClaims{"iss": "https://a.example", "sub": "2281"}))
+	b, _ := connect(t, srv, 0, issuerToken(t, jwt.MapClaims{"iss": "https://b.example", "user": map[string]interface{}{"id": 2282}}))
+	rdb.Publish(ctx, "events:user:2281", "to a")
+	rdb.Publish(ctx, "events:user:2282", "to b")
+	if ev := a.nextData(t); ev.data != "to a" {
+		t.Errorf("issuer a's user got %q", ev.data)
+	}
+	if ev := b.nextData(t); ev.data != "to b" {
+		t.Errorf("issuer b's user got %q", ev.data)
+	}
+
+	// Each issuer's tokens are read by its own schema only.
+	for name, q := range map[string]url.Values{
+		"a's shape from b":  issuerToken(t, jwt.MapClaims{"iss": "https://b.example", "sub": "2281"}),
+		"unknown issuer":    issuerToken(t, jwt.MapClaims{"iss": "https://c.example", "sub": "2281"}),
+		"no issuer":         issuerToken(t, jwt.MapClaims{"sub": "2281"}),
+		"not an id":         issuerToken(t, jwt.MapClaims{"iss": "https://a.example", "sub": "alice"}),
+		"fractional":        issuerToken(t, jwt.MapClaims{"iss": "https://b.example", "user": map[string]interface{}{"id": 2.5}}),
+		"user_id ignored":   issuerToken(t, jwt.MapClaims{"iss": "https://c.example", "user_id": 2281}),
+		"nested not object": issuerToken(t, jwt.MapClaims{"iss": "https://b.example", "user": "2282"}),
+	} {
+		resp := get(t, srv.URL+"/sse-events?"+q.Encode(), nil)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("%s: connected", name)
+		}
+	}
+}
+
+func TestStringUserIDReadBySchema(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.ClaimSchemas = parseClaimSchemas("test", []string{"*=user_id"})
+	})
+	s, conn := connect(t, srv, 0, issuerToken(t, jwt.MapClaims{"user_id": "2283"}))
+	if c := registry.get(conn); c == nil || c.userID != 2283 {
+		t.Fatalf("connected as %+v, want user 2283", c)
+	}
+	rdb.Publish(ctx, "events:user:2283", "hi")
+	if ev := s.nextData(t); ev.data != "hi" {
+		t.Errorf("got %q", ev.data)
+	}
+	// A number still is.
+	connect(t, srv, 2284, nil)
+
+	// Without schemas, user_id must be a number.
+	endConnections(t)
+	useConfig(t, nil)
+	if _, err := verifySseToken(issuerToken(t, jwt.MapClaims{"user_id": "2283"}).Get("ssetoken"), testSecret); err == nil {
+		t.Error("string user_id accepted without GO_SSE_SIDECAR_CLAIM_SCHEMAS")
+	}
+}
+
+func TestSchemaOrderAndWildcard(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.ClaimSchemas = parseClaimSchemas("test", []string{"https://a.example=uid", "*=sub", "https://a.example=sub"})
+	})
+	for _, tt := range []struct {
+		claims map[string]interface{}
+		want   int64
+	}{
+		// The first schema of the issuer that yields an id.
+		{map[string]interface{}{"iss": "https://a.example", "uid": 1.0, "sub": "2"}, 1},
+		{map[string]interface{}{"iss": "https://a.example", "sub": "2"}, 2},
+		{map[string]interface{}{"iss": "https://z.example", "uid": 1.0, "sub": "3"}, 3},
+	} {
+		c := &SSETokenClaims{raw: tt.claims}
+		c.Issuer, _ = tt.claims["iss"].(string)
+		if err := c.applyClaimSchemas(); err != nil || c.UserID != tt.want {
+			t.Errorf("%v: user %d, %v, want %d", tt.claims, c.UserID, err, tt.want)
+		}
+	}
+}
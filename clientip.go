@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP returns the address of the client. Behind the proxies of
+// cfg.TrustedProxies it's the last X-Forwarded-For entry they didn't add:
+// entries before it are set by the client and can't be trusted.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r.RemoteAddr)
+	if !trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// remoteIP returns the host of a RemoteAddr.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range cfg.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes reads a list of CIDR ranges or single addresses.
+func parsePrefixes(name string, list []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range list {
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(entry)
+			if aerr != nil {
+				log.Fatalf("Invalid %s: %q is not an address or CIDR range", name, entry)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"text/template"
+)
+
+// clientJSTemplate is a small EventSource wrapper for the frontend. Values
+// are inserted as JSON, which is valid (and safely escaped) JavaScript.
+var clientJSTemplate = template.Must(template.New("client.js").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}).Parse(`// go-sse-wsgi-sidecar client {{.Version}}, generated for this server's settings.
+(function (global) {
+  var PATH = {{json .Path}};
+  var RETRY_MS = {{json .RetryMS}};
+  var MAX_RETRY_MS = {{json .MaxRetryMS}};
+  var ENVELOPE = {{json .Envelope}};
+  var EVENTS = {{json .Events}};
+  var TRANSPORTS = {{json .Transports}};
+  var POLL_PATH = {{json .PollPath}};
+  // SSE_ATTEMPTS is how many times the stream may fail without ever
+  // connecting before the next transport is tried.
+  var SSE_ATTEMPTS = 2;
+
+  // connect opens the stream and keeps it open. options:
+  //   baseUrl  - sidecar URL, ex: "http://localhost:5687" (default: this script's origin)
+  //   getToken - async function returning a fresh ssetoken
+  //   onEvent  - function (name, data, event) called for every event, data is
+  //              parsed from JSON when possible (the envelope when enabled)
+  //   events   - extra event names to listen to
+  //   query    - extra query parameters, ex: {framing: "envelope"} (SSE only)
+  //   transport - "sse" or "poll" to use only that one
+  function connect(options) {
+    // envelope tells whether data is {"channel", "content_type", "data"}.
+    var client = { lastEventId: "", source: null, closed: false, envelope: ENVELOPE };
+    var baseUrl = options.baseUrl || SCRIPT_ORIGIN;
+    var attempt = 0;
+    if (options.query && options.query.framing) client.envelope = options.query.framing === "envelope";
+
+    // The transports are tried in order, SSE only where EventSource exists.
+    var transports = options.transport ? [options.transport] : TRANSPORTS.filter(function (name) {
+      return name !== "sse" || typeof EventSource !== "undefined";
+    });
+    client.transport = transports[0];
+    var streamed = false, failures = 0;
+
+    function dispatch(name, e) {
+      if (e.lastEventId) client.lastEventId = e.lastEventId;
+      var data = e.data;
+      try { data = JSON.parse(e.data); } catch (err) {}
+      if (name === "config" && data) client.config = data;
+      if (name === "connected" && data) {
+        client.connectionId = data.connection_id;
+        client.options = data.options;
+      }
+      if (options.onEvent) options.onEvent(name, data, e);
+    }
+
+    function reconnect(delay) {
+      if (client.source) client.source.close();
+      if (client.closed) return;
+      setTimeout(open, delay);
+    }
+
+    function backoff() {
+      var delay = Math.min(RETRY_MS * Math.pow(2, attempt++), MAX_RETRY_MS);
+      return delay / 2 + Math.random() * delay / 2;
+    }
+
+    function sleep(ms) {
+      return new Promise(function (resolve) { setTimeout(resolve, ms); });
+    }
+
+    // poll long-polls until closed, reusing the token until it's refused.
+    async function poll() {
+      var token = null, cursor = "";
+      client.controller = new AbortController();
+      while (!client.closed) {
+        try {
+          if (!token) token = await options.getToken();
+          var params = new URLSearchParams({ ssetoken: token, cursor: cursor });
+          var res = await fetch(baseUrl + POLL_PATH + "?" + params.toString(), { signal: client.controller.signal });
+          if (res.status === 429) {
+            dispatch("quota_exceeded", { data: "{}", lastEventId: "" });
+            return client.close();
+          }
+          if (res.status === 401 || res.status === 403) token = null;
+          if (!res.ok) throw new Error("poll failed with " + res.status);
+          attempt = 0;
+          var next = res.headers.get("X-Poll-Cursor") || cursor;
+          if (next !== cursor) {
+            cursor = next;
+            dispatch("connected", { data: JSON.stringify({ connection_id: cursor }), lastEventId: "" });
+          }
+          (await res.json()).forEach(function (e) {
+            dispatch(e.event || "message", { data: e.data, lastEventId: e.id || "" });
+          });
+        } catch (err) {
+          if (!client.closed) await sleep(backoff());
+        }
+      }
+    }
+
+    async function open() {
+      if (client.transport === "poll") return poll();
+      var token;
+      try {
+        token = await options.getToken();
+      } catch (err) {
+        return reconnect(backoff());
+      }
+      var params = new URLSearchParams(options.query || {});
+      params.set("ssetoken", token);
+      var source = new EventSource(baseUrl + PATH + "?" + params.toString());
+      client.source = source;
+
+      source.onmessage = function (e) { dispatch("message", e); };
+      EVENTS.concat(options.events || []).forEach(function (name) {
+        source.addEventListener(name, function (e) { dispatch(name, e); });
+      });
+      source.addEventListener("connected", function (e) {
+        attempt = 0;
+        streamed = true;
+        dispatch("connected", e);
+      });
+      source.addEventListener("reconnect", function (e) {
+        dispatch("reconnect", e);
+        var retry = RETRY_MS;
+        try { retry = JSON.parse(e.data).retry_after_ms; } catch (err) {}
+        reconnect(retry);
+      });
+      source.addEventListener("migrate", function (e) {
+        dispatch("migrate", e);
+        try { baseUrl = JSON.parse(e.data).url || baseUrl; } catch (err) {}
+        reconnect(0);
+      });
+      source.addEventListener("token_expiring", function (e) {
+        dispatch("token_expiring", e);
+        client.refresh().catch(function () {});
+      });
+      source.addEventListener("token_expired", function (e) {
+        dispatch("token_expired", e);
+        reconnect(0);
+      });
+      source.addEventListener("quota_exceeded", function (e) {
+        dispatch("quota_exceeded", e);
+        client.close();
+      });
+      source.addEventListener("superseded", function (e) {
+        dispatch("superseded", e);
+        client.close();
+      });
+      source.onerror = function () {
+        if (!streamed && ++failures >= SSE_ATTEMPTS && transports.length > 1) {
+          source.close();
+          transports.shift();
+          client.transport = transports[0];
+          attempt = 0;
+          return open();
+        }
+        reconnect(backoff());
+      };
+    }
+
+    // ack confirms that a message with a receipt_id was handled, without a
+    // preflight: the token is in the query and the body is text/plain.
+    client.ack = async function (receiptId) {
+      var params = new URLSearchParams({ ssetoken: await options.getToken() });
+      var res = await fetch(baseUrl + "/ack/" + encodeURIComponent(client.connectionId) + "?" + params.toString(), {
+        method: "POST",
+        body: JSON.stringify({ receipt_id: receiptId }),
+      });
+      return res.ok;
+    };
+
+    // refresh sends a fresh token for the open stream, asked for with
+    // token_expiring, so it isn't closed when the current one expires.
+    client.refresh = async function () {
+      var params = new URLSearchParams({ ssetoken: await options.getToken() });
+      var res = await fetch(baseUrl + "/refresh/" + encodeURIComponent(client.connectionId) + "?" + params.toString(), { method: "POST" });
+      return res.ok;
+    };
+
+    client.close = function () {
+      client.closed = true;
+      if (client.source) client.source.close();
+      if (client.controller) client.controller.abort();
+    };
+    open();
+    return client;
+  }
+
+  var SCRIPT_ORIGIN = document.currentScript ? new URL(document.currentScript.src).origin : "";
+  global.SSESidecar = { connect: connect };
+})(window);
+`))
+
+type clientJSValues struct {
+	Version    string
+	Path       string
+	RetryMS    int64
+	MaxRetryMS int64
+	Envelope   bool
+	Events     []string
+	Transports []string
+	PollPath   string
+}
+
+// clientEvents lists the named events the server can send with the current
+// settings. Names derived by stripping the channel prefix can't be known in
+// advance, the page passes those with the `events` option.
+func clientEvents() []string {
+	seen := make(map[string]bool)
+	var events []string
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			events = append(events, name)
+		}
+	}
+	if cfg.ChannelEventNames {
+		for _, rule := range cfg.ChannelEventMap {
+			add(rule.value)
+		}
+	}
+	add(cfg.DefaultEvent)
+	if cfg.ConfigEvent {
+		add("config")
+	}
+	if cfg.TimeSyncInterval > 0 {
+		add("time")
+	}
+	if cfg.StatsInterval > 0 {
+		add("stats")
+	}
+	if cfg.KeepaliveInterval > 0 && cfg.KeepaliveFormat == "event" {
+		add("ping")
+	}
+	if cfg.SnapshotKey != "" {
+		add("snapshot")
+	}
+	if cfg.CaughtUp {
+		add("caught_up")
+	}
+	if cfg.MemoryPressureMB > 0 || cfg.SlowFlushThreshold > 0 {
+		add("degraded")
+	}
+	if cfg.SegmentBytes > 0 {
+		add("chunk")
+	}
+	if cfg.PresenceChannel != "" {
+		add("presence")
+	}
+	return events
+}
+
+// clientJSHandler serves the JavaScript client, templated with this server's
+// path, retry and framing settings.
+func clientJSHandler(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	err := clientJSTemplate.Execute(&b, clientJSValues{
+		Version:    version,
+		Path:       "/sse-events",
+		RetryMS:    cfg.ClientRetry.Milliseconds(),
+		MaxRetryMS: cfg.ClientMaxRetry.Milliseconds(),
+		Envelope:   cfg.Envelope,
+		Events:     clientEvents(),
+		Transports: cfg.ClientTransports,
+		PollPath:   "/poll",
+	})
+	if err != nil {
+		log.Printf("[SSE-SIDECAR] Failed to render client.js: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func clientJS(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	clientJSHandler(rec, httptest.NewRequest(http.MethodGet, "/client.js", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	b, _ := io.ReadAll(rec.Body)
+	return string(b)
+}
+
+func TestClientJSReflectsConfig(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.ClientRetry = 1500 * time.Millisecond
+		c.ClientMaxRetry = 20 * time.Second
+		c.Envelope = true
+		c.DefaultEvent = "message"
+		c.ChannelEventNames = true
+		c.ChannelEventMap = parseChannelMap("GO_SSE_SIDECAR_CHANNEL_EVENT_MAP", "events:team:*=team")
+		c.ClientTransports = []string{"sse", "poll"}
+	})
+	js := clientJS(t)
+	for _, want := range []string{
+		`var PATH = "/sse-events";`,
+		`var RETRY_MS = 1500;`,
+		`var MAX_RETRY_MS = 20000;`,
+		`var ENVELOPE = true;`,
+		`var EVENTS = ["team","message"];`,
+		`var TRANSPORTS = ["sse","poll"];`,
+		`var POLL_PATH = "/poll";`,
+	} {
+		if !strings.Contains(js, want) {
+			t.Errorf("client.js lacks %s", want)
+		}
+	}
+}
+
+func TestClientJSListensToEnabledEvents(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.TimeSyncInterval = time.Second
+		c.PresenceChannel = "presence"
+	})
+	js := clientJS(t)
+	if !strings.Contains(js, `var EVENTS = ["time","presence"];`) {
+		t.Errorf("events not the enabled ones:\n%s", js[:min(len(js), 600)])
+	}
+	if !strings.Contains(js, `var ENVELOPE = false;`) {
+		t.Error("envelope on by default")
+	}
+}
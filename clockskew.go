@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// clockSkew is the last measured offset of Redis's clock from the local one,
+// in nanoseconds, positive when Redis is ahead.
+var clockSkew atomic.Int64
+
+// measureClockSkew compares the local time to Redis TIME, taking the middle
+// of the round trip as the local time of the reply.
+func measureClockSkew(ctx context.Context, rdb *redis.Client) (time.Duration, error) {
+	before := time.Now()
+	remote, err := rdb.Time(ctx).Result()
+	if err != nil {
+		return 0, err
+	}
+	after := time.Now()
+	local := before.Add(after.Sub(before) / 2)
+	return remote.Sub(local), nil
+}
+
+// checkClockSkew measures the skew and reports whether it is within
+// cfg.MaxClockSkew, logging it otherwise.
+func checkClockSkew(ctx context.Context, rdb *redis.Client) bool {
+	cctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	skew, err := measureClockSkew(cctx, rdb)
+	if err != nil {
+		log.Printf("[SSE-SIDECAR] Failed to read the Redis time: %v", err)
+		return true
+	}
+	clockSkew.Store(int64(skew))
+	if skew.Abs() <= cfg.MaxClockSkew {
+		return true
+	}
+	log.Printf("[SSE-SIDECAR] WARNING: the clock is %v off the Redis server's, over GO_SSE_SIDECAR_MAX_CLOCK_SKEW %v: TTLs, presence and replay ages may be wrong", skew, cfg.MaxClockSkew)
+	return false
+}
+
+var errClockSkew = errors.New("refusing to start with the clock off the Redis server's")
+
+// startClockSkewCheck checks the skew once cfg.MaxClockSkew is set, and keeps
+// watching it. Over the threshold with cfg.ClockSkewFatal, it fails.
+func startClockSkewCheck(rdb *redis.Client) error {
+	if cfg.MaxClockSkew <= 0 {
+		return nil
+	}
+	if !checkClockSkew(ctx, rdb) && cfg.ClockSkewFatal {
+		return errClockSkew
+	}
+	if cfg.ClockSkewInterval > 0 {
+		go watchClockSkew(rdb)
+	}
+	return nil
+}
+
+// watchClockSkew checks the skew again every cfg.ClockSkewInterval.
+func watchClockSkew(rdb *redis.Client) {
+	ticker := time.NewTicker(cfg.ClockSkewInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkClockSkew(ctx, rdb)
+	}
+}
+
+func clockSkewSeconds() float64 {
+	return math.Round(time.Duration(clockSkew.Load()).Seconds()*1000) / 1000
+}
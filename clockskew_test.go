@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClockSkewAgainstRedisTime(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		offset time.Duration
+		within bool
+	}{
+		{"ahead", 90 * time.Second, false},
+		{"behind", -90 * time.Second, false},
+		{"close", 2 * time.Second, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mr, srv := newSidecar(t, func(c *Config) { c.MaxClockSkew = 30 * time.Second })
+			var logs lockedBuffer
+			old := log.Writer()
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(old) })
+
+			mr.SetTime(time.Now().Add(tt.offset))
+			if got := checkClockSkew(ctx, rdb); got != tt.within {
+				t.Errorf("within the threshold: %v, want %v", got, tt.within)
+			}
+			if warned := strings.Contains(logs.String(), "GO_SSE_SIDECAR_MAX_CLOCK_SKEW"); warned == tt.within {
+				t.Errorf("warned %v, logs %q", warned, logs.String())
+			}
+			// The reply is whole seconds, so the measure is within one.
+			if skew := scrape(t, srv)["sse_clock_skew_seconds"]; math.Abs(skew-tt.offset.Seconds()) > 1 {
+				t.Errorf("sse_clock_skew_seconds %v, want about %v", skew, tt.offset.Seconds())
+			}
+		})
+	}
+}
+
+func TestClockSkewRefusesStartWhenFatal(t *testing.T) {
+	mr, _ := newSidecar(t, func(c *Config) {
+		c.MaxClockSkew = 30 * time.Second
+		c.ClockSkewInterval = 0
+	})
+	mr.SetTime(time.Now().Add(time.Hour))
+	if err := startClockSkewCheck(rdb); err != nil {
+		t.Errorf("refused to start without GO_SSE_SIDECAR_CLOCK_SKEW_FATAL: %v", err)
+	}
+	cfg.ClockSkewFatal = true
+	if err := startClockSkewCheck(rdb); !errors.Is(err, errClockSkew) {
+		t.Errorf("started an hour off Redis: %v", err)
+	}
+	mr.SetTime(time.Now())
+	if err := startClockSkewCheck(rdb); err != nil {
+		t.Errorf("refused to start in sync: %v", err)
+	}
+}
+
+func TestClockSkewUnreadableDoesNotRefuse(t *testing.T) {
+	mr, _ := newSidecar(t, func(c *Config) {
+		c.MaxClockSkew = time.Second
+		c.ClockSkewFatal = true
+		c.ClockSkewInterval = 0
+	})
+	mr.SetError("ERR unknown command 'time'")
+	if err := startClockSkewCheck(rdb); err != nil {
+		t.Errorf("refused to start without the Redis time: %v", err)
+	}
+}
+
+func TestNoClockSkewCheckByDefault(t *testing.T) {
+	mr, _ := newSidecar(t, func(c *Config) { c.ClockSkewFatal = true })
+	mr.SetTime(time.Now().Add(time.Hour))
+	if err := startClockSkewCheck(rdb); err != nil {
+		t.Errorf("checked without GO_SSE_SIDECAR_MAX_CLOCK_SKEW: %v", err)
+	}
+}
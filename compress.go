@@ -0,0 +1,191 @@
+package main
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// compressedEventWriter compresses an event stream one event (one Write) at
+// a time, flushing after each so events aren't held back. Events smaller
+// than minBytes are written as stored (uncompressed) deflate blocks:
+// compressing tiny events costs CPU and the flush overhead can even make
+// them bigger.
+//
+// Both block kinds live in the same deflate stream, so the browser decodes
+// it as a normal gzip response, or zlib one for `deflate`. The compressor is
+// reset after a stored block because its back-references must not span
+// bytes it didn't write.
+type compressedEventWriter struct {
+	w        io.Writer
+	fw       *flate.Writer
+	minBytes int
+	reset    bool
+
+	// sum is the checksum of the format, CRC-32 for gzip and Adler-32 for
+	// zlib, written by trailer with size at the end of the stream.
+	sum     hash.Hash32
+	size    uint32
+	trailer func(sum, size uint32) []byte
+}
+
+// uncompressedFeed reports whether every channel of a connection is in
+// cfg.UncompressedChannels, ex: presence pings, whose events are too small
+// for gzip to pay off.
+func uncompressedFeed(channels []string) bool {
+	if cfg.UncompressedChannels == nil {
+		return false
+	}
+	for _, ch := range channels {
+		if !cfg.UncompressedChannels.match(ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// gzipHeader is a minimal gzip member header: deflate, no name, no mtime.
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+
+// zlibHeader is the zlib header of HTTP's `deflate`: deflate with a 32K
+// window, no dictionary.
+var zlibHeader = []byte{0x78, 0x01}
+
+// compressionEncodings are the values of GO_SSE_SIDECAR_COMPRESSION.
+var compressionEncodings = []string{"gzip", "deflate"}
+
+// newEventCompressor starts a stream in encoding, `gzip` or `deflate`.
+func newEventCompressor(w io.Writer, encoding string, minBytes int) (*compressedEventWriter, error) {
+	g := &compressedEventWriter{w: w, minBytes: minBytes}
+	var header []byte
+	switch encoding {
+	case "gzip":
+		header, g.sum = gzipHeader, crc32.NewIEEE()
+		g.trailer = func(sum, size uint32) []byte {
+			return binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, sum), size)
+		}
+	case "deflate":
+		header, g.sum = zlibHeader, adler32.New()
+		g.trailer = func(sum, _ uint32) []byte {
+			return binary.BigEndian.AppendUint32(nil, sum)
+		}
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	fw, err := flate.NewWriter(w, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	g.fw = fw
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *compressedEventWriter) Write(p []byte) (int, error) {
+	g.sum.Write(p)
+	g.size += uint32(len(p))
+
+	if len(p) < g.minBytes {
+		g.reset = true
+		return len(p), writeStoredBlocks(g.w, p, false)
+	}
+
+	if g.reset {
+		g.fw.Reset(g.w)
+		g.reset = false
+	}
+	if _, err := g.fw.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), g.fw.Flush()
+}
+
+// Close ends the deflate stream and writes the trailer of the format.
+func (g *compressedEventWriter) Close() error {
+	if err := writeStoredBlocks(g.w, nil, true); err != nil {
+		return err
+	}
+	_, err := g.w.Write(g.trailer(g.sum.Sum32(), g.size))
+	return err
+}
+
+// writeStoredBlocks writes p as byte aligned stored deflate blocks (the
+// stream is byte aligned after every flush).
+func writeStoredBlocks(w io.Writer, p []byte, final bool) error {
+	for {
+		n := min(len(p), 0xffff)
+		var header [5]byte
+		if final && n == len(p) {
+			header[0] = 1
+		}
+		binary.LittleEndian.PutUint16(header[1:3], uint16(n))
+		binary.LittleEndian.PutUint16(header[3:5], ^uint16(n))
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// countingWriter adds the bytes written through it to a counter.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// negotiateEncoding returns the one of encodings the request's
+// Accept-Encoding prefers, the first listed on a tie, or "" when it accepts
+// none.
+func negotiateEncoding(r *http.Request, encodings []string) string {
+	best, bestQ := "", 0.0
+	for _, enc := range encodings {
+		if q := acceptedQuality(r, enc); q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// acceptedQuality returns the q value the request's Accept-Encoding gives
+// enc, or `*` when it doesn't list enc, 0 when it accepts neither.
+func acceptedQuality(r *http.Request, enc string) float64 {
+	star := 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.ReplaceAll(params, " ", ""), "="); ok && strings.EqualFold(k, "q") {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch name = strings.TrimSpace(name); {
+		case strings.EqualFold(name, enc):
+			return q
+		case name == "*":
+			star = q
+		}
+	}
+	return star
+}
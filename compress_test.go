@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// compressEvents writes events through a compressor and returns the stream
+// and what each event added to it.
+func compressEvents(t *testing.T, encoding string, minBytes int, events ...string) ([]byte, []int) {
+	t.Helper()
+	var buf bytes.Buffer
+	g, err := newEventCompressor(&buf, encoding, minBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make([]int, len(events))
+	for i, ev := range events {
+		before := buf.Len()
+		if _, err := g.Write([]byte(ev)); err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = buf.Len() - before
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), sizes
+}
+
+func TestCompressedStreamDecodes(t *testing.T) {
+	large := "data: " + strings.Repeat(`{"price": 10.5, "symbol": "ACME"}`, 40) + "\n\n"
+	events := []string{"data: 1\n\n", large, ": ping\n\n", large, "data: 2\n\n"}
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		t.Run(encoding, func(t *testing.T) {
+			stream, _ := compressEvents(t, encoding, 64, events...)
+			r, err := decode(bytes.NewReader(stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The readers check the trailer's checksum and size.
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(events, ""); string(got) != want {
+				t.Errorf("decoded %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestSmallEventsNotPenalized(t *testing.T) {
+	small := "data: {\"n\": 1}\n\n"
+	_, uncompressed := compressEvents(t, "gzip", 256, small, small, small)
+	_, compressed := compressEvents(t, "gzip", 0, small, small, small)
+	for i := range uncompressed {
+		// A stored block adds its 5 byte header and nothing else.
+		if uncompressed[i] != len(small)+5 {
+			t.Errorf("small event %d took %d bytes, want %d", i, uncompressed[i], len(small)+5)
+		}
+	}
+	// Compressed, each one also pays for the flush's empty stored block.
+	if compressed[0] < uncompressed[0] {
+		t.Errorf("compressing a small event took %d bytes, storing it %d", compressed[0], uncompressed[0])
+	}
+}
+
+func TestLargeEventsCompressed(t *testing.T) {
+	large := "data: " + strings.Repeat(`{"price": 10.5, "symbol": "ACME"}`, 40) + "\n\n"
+	_, sizes := compressEvents(t, "gzip", 256, "data: 1\n\n", large)
+	if sizes[1] >= len(large)/2 {
+		t.Errorf("a %d byte event compressed to %d bytes", len(large), sizes[1])
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	both := []string{"gzip", "deflate"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0", ""},
+		{"br", ""},
+		{"*", "gzip"},
+		{"*;q=0.2, gzip;q=0", "deflate"},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.accept)
+		if got := negotiateEncoding(r, both); got != tt.want {
+			t.Errorf("Accept-Encoding %q: %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestGzipStreamSendsSmallEventsStored(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.Compression = []string{"gzip"} })
+	q := url.Values{"ssetoken": {token(t, 1321, nil)}}
+	// Set by hand, Go's client doesn't decode the response then.
+	resp := get(t, srv.URL+"/sse-events?"+q.Encode(), http.Header{"Accept-Encoding": {"gzip"}})
+	defer resp.Body.Close()
+	if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q", enc)
+	}
+
+	// Under GO_SSE_SIDECAR_COMPRESS_MIN_BYTES the events are in stored
+	// blocks, readable in the raw stream as soon as they're written.
+	raw := make(chan []byte, 100)
+	go func() {
+		defer close(raw)
+		for {
+			buf := make([]byte, 4096)
+			n, err := resp.Body.Read(buf)
+			raw <- buf[:n]
+			if err != nil {
+				return
+			}
+		}
+	}()
+	var seen []byte
+	expect := func(want string) {
+		t.Helper()
+		timeout := time.After(2 * time.Second)
+		for !bytes.Contains(seen, []byte(want)) {
+			select {
+			case b, ok := <-raw:
+				if !ok {
+					t.Fatalf("stream ended before %q", want)
+				}
+				seen = append(seen, b...)
+			case <-timeout:
+				t.Fatalf("timed out waiting for %q", want)
+			}
+		}
+	}
+	expect(string(gzipHeader))
+	expect("event: connected\n")
+	rdb.Publish(ctx, "events:user:1321", "tiny")
+	expect("data: tiny\n\n")
+}
+
+func TestCompressionRatioMetrics(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.Compression = []string{"gzip"} })
+	q := url.Values{"ssetoken": {token(t, 1851, nil)}}
+	resp := get(t, srv.URL+"/sse-events?"+q.Encode(), http.Header{"Accept-Encoding": {"gzip"}})
+	defer resp.Body.Close()
+	go io.Copy(io.Discard, resp.Body)
+	waitFor(t, "the connection", func() bool { return len(registry.forUser("", 1851)) == 1 })
+
+	in, out, sent := metrics.gzipInBytes.Load(), metrics.gzipOutBytes.Load(), metrics.bytesSent.Load()
+	payload := strings.Repeat(`{"symbol": "ACME", "price": 10.5}`, 100)
+	for i := 0; i < 20; i++ {
+		rdb.Publish(ctx, "events:user:1851", payload)
+	}
+	waitFor(t, "the events to be written", func() bool { return metrics.gzipInBytes.Load()-in >= int64(20*len(payload)) })
+	// The bandwidth served is after compression.
+	if n, m := metrics.bytesSent.Load()-sent, metrics.gzipOutBytes.Load()-out; n != m {
+		t.Errorf("%d bytes sent, %d compressed", n, m)
+	}
+
+	ratio := float64(metrics.gzipOutBytes.Load()-out) / float64(metrics.gzipInBytes.Load()-in)
+	if ratio >= 0.1 {
+		t.Errorf("compression ratio %.3f for repetitive payloads", ratio)
+	}
+	m := scrape(t, srv)
+	for _, name := range []string{"sse_gzip_input_bytes_total", "sse_gzip_output_bytes_total", "sse_bytes_sent_total"} {
+		if m[name] == 0 {
+			t.Errorf("%s not in /metrics", name)
+		}
+	}
+}
+
+func TestUncompressedStreamsCountBandwidthOnly(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 1852, nil)
+	in, sent := metrics.gzipInBytes.Load(), metrics.bytesSent.Load()
+	rdb.Publish(ctx, "events:user:1852", strings.Repeat("x", 1000))
+	s.nextData(t)
+	if n := metrics.bytesSent.Load() - sent; n < 1000 {
+		t.Errorf("%d bytes sent counted for a 1000 bytes event", n)
+	}
+	if metrics.gzipInBytes.Load() != in {
+		t.Error("uncompressed stream counted as compressed")
+	}
+}
+
+func TestUncompressedFeed(t *testing.T) {
+	useConfig(t, func(c *Config) { c.UncompressedChannels = mustMatcher(t, "presence, pings:") })
+	for _, tt := range []struct {
+		channels []string
+		want     bool
+	}{
+		{[]string{"presence"}, true},
+		{[]string{"presence", "pings:7"}, true},
+		// One channel worth compressing is enough.
+		{[]string{"presence", "events:user:1"}, false},
+	} {
+		if got := uncompressedFeed(tt.channels); got != tt.want {
+			t.Errorf("%v: %v, want %v", tt.channels, got, tt.want)
+		}
+	}
+	useConfig(t, nil)
+	if uncompressedFeed([]string{"presence"}) {
+		t.Error("feed uncompressed by default")
+	}
+}
+
+func TestStreamOfTinyFeedNotCompressed(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.Compression = []string{"gzip"}
+		c.UncompressedChannels = mustMatcher(t, "events:user:, events:team:5")
+	})
+	gzipped := http.Header{"Accept-Encoding": {"gzip"}}
+	for _, tt := range []struct {
+		userID int64
+		teams  []int64
+		want   string
+	}{
+		{2161, nil, ""},
+		{2162, []int64{5}, ""},
+		// Messages of the other team are worth compressing.
+		{2163, []int64{5, 7}, "gzip"},
+	} {
+		claims := jwt.MapClaims{}
+		if tt.teams != nil {
+			claims["teams"] = tt.teams
+		}
+		q := url.Values{"ssetoken": {token(t, tt.userID, claims)}}
+		resp := get(t, srv.URL+"/sse-events?"+q.Encode(), gzipped)
+		if enc := resp.Header.Get("Content-Encoding"); enc != tt.want {
+			t.Errorf("teams %v: Content-Encoding %q, want %q", tt.teams, enc, tt.want)
+		}
+		if tt.want == "" {
+			s := readStream(t, resp)
+			s.nextEvent(t, "connected")
+			rdb.Publish(ctx, userChannel(tt.userID), "tiny")
+			if ev := s.nextData(t); ev.data != "tiny" {
+				t.Errorf("got %q", ev.data)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+// zlibBody decodes resp's body as `deflate` as it arrives.
+type zlibBody struct {
+	io.Reader
+	io.Closer
+}
+
+func TestDeflateStreamFlushedPerEvent(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.Compression = []string{"gzip", "deflate"}
+		// Every event through the compressor, not stored.
+		c.CompressMinBytes = 0
+	})
+	q := url.Values{"ssetoken": {token(t, 2321, nil)}}
+	resp := get(t, srv.URL+"/sse-events?"+q.Encode(), http.Header{"Accept-Encoding": {"gzip;q=0.5, deflate"}})
+	if enc := resp.Header.Get("Content-Encoding"); enc != "deflate" {
+		resp.Body.Close()
+		t.Fatalf("Content-Encoding %q, want the preferred deflate", enc)
+	}
+	zr, err := zlib.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		t.Fatal(err)
+	}
+	resp.Body = zlibBody{zr, resp.Body}
+	s := readStream(t, resp)
+	s.nextEvent(t, "connected")
+
+	// Each event decodes while the stream is still open.
+	large := strings.Repeat(`{"symbol": "ACME", "price": 10.5}`, 40)
+	for _, payload := range []string{"tiny", large, "after"} {
+		rdb.Publish(ctx, "events:user:2321", payload)
+		if ev := s.nextData(t); ev.data != payload {
+			t.Fatalf("got %d bytes, want %d", len(ev.data), len(payload))
+		}
+	}
+}
+
+func TestStreamEncodingNegotiated(t *testing.T) {
+	tests := []struct {
+		enabled []string
+		accept  string
+		query   string
+		want    string
+	}{
+		{[]string{"gzip", "deflate"}, "deflate", "", "deflate"},
+		// A tie goes to the server's order.
+		{[]string{"deflate", "gzip"}, "gzip, deflate", "", "deflate"},
+		{[]string{"gzip", "deflate"}, "gzip, deflate", "", "gzip"},
+		// Deflate only when enabled.
+		{[]string{"gzip"}, "deflate", "", ""},
+		{nil, "gzip, deflate", "", ""},
+		// Asked for in the query, it wins over the header.
+		{[]string{"gzip", "deflate"}, "gzip", "deflate", "deflate"},
+		{[]string{"gzip", "deflate"}, "deflate", "identity", ""},
+	}
+	for i, tt := range tests {
+		_, srv := newSidecar(t, func(c *Config) { c.Compression = tt.enabled })
+		id := int64(2322 + i)
+		q := url.Values{"ssetoken": {token(t, id, nil)}}
+		if tt.query != "" {
+			q.Set("encoding", tt.query)
+		}
+		resp := get(t, srv.URL+"/sse-events?"+q.Encode(), http.Header{"Accept-Encoding": {tt.accept}})
+		resp.Body.Close()
+		if enc := resp.Header.Get("Content-Encoding"); enc != tt.want {
+			t.Errorf("%v, Accept-Encoding %q, encoding=%s: %q, want %q", tt.enabled, tt.accept, tt.query, enc, tt.want)
+		}
+	}
+}
+
+func TestCompressionListFromEnvironment(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_COMPRESSION", "deflate, gzip")
+	if c := loadConfig(); !reflect.DeepEqual(c.Compression, []string{"deflate", "gzip"}) {
+		t.Errorf("GO_SSE_SIDECAR_COMPRESSION read as %q", c.Compression)
+	}
+}
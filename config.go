@@ -0,0 +1,964 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Config holds the optional settings read from the environment at startup.
+// The required settings (Redis URL, token) are still read where they are used.
+type Config struct {
+	// DedupeWindow suppresses an event identical to the previous one sent on
+	// the same connection within this window. Zero disables deduplication.
+	DedupeWindow time.Duration
+	// DedupeKey, when set, compares this JSON field instead of the full payload.
+	DedupeKey string
+	// DedupeIDs is how many recent event ids a connection remembers, to
+	// never send the same id twice. Zero disables it.
+	DedupeIDs int
+
+	// Envelope wraps payloads in a JSON object with the source channel and a
+	// content type, looked up in ContentTypeMap or detected from the payload.
+	Envelope         bool
+	ContentTypeField string
+	ContentTypeMap   []channelRule
+	// Transform reshapes JSON payloads before they are sent, nil when off.
+	Transform *payloadTransform
+
+	// ChannelAllow and ChannelDeny are checked for every channel before
+	// subscribing to it.
+	ChannelAllow *channelMatcher
+	ChannelDeny  *channelMatcher
+	// PriorityChannels are delivered before, and dropped after, the other
+	// channels of a connection.
+	PriorityChannels *channelMatcher
+	// PriorityField is the payload field marking a message's priority,
+	// which takes precedence over PriorityChannels.
+	PriorityField string
+
+	// RedisDBs are the logical databases a token's `db` claim may select.
+	RedisDBs map[int]bool
+	// TenantRedis are the dedicated Redis servers of tenants, by the value
+	// of their TenantClaim. At most MaxTenantClients are open at once, each
+	// closed after TenantRedisIdle without connections.
+	TenantRedis      map[string]*redis.Options
+	TenantClaim      string
+	MaxTenantClients int
+	TenantRedisIdle  time.Duration
+	// Namespaces are the namespaces a token's `namespace` claim may select.
+	Namespaces map[string]bool
+	// ChannelAllowKey, ChannelDenyKey and NamespacesKey are Redis sets
+	// replacing the lists above while not empty, read every
+	// AllowlistRefresh, see redisAllowlists.
+	ChannelAllowKey  string
+	ChannelDenyKey   string
+	NamespacesKey    string
+	AllowlistRefresh time.Duration
+	// RedisURLs are Redis endpoints in order of preference, failed over to
+	// when the one in use is unreachable. RedisProbeInterval is how often the
+	// preferred ones are tried again.
+	RedisURLs          []string
+	RedisProbeInterval time.Duration
+	// BackgroundTimeout bounds the Redis calls streaming doesn't depend on,
+	// which RedisShed skips while the connection pool is saturated.
+	BackgroundTimeout time.Duration
+	RedisShed         bool
+	// MemoryPressureMB is the heap size, checked every MemoryCheckInterval,
+	// over which low priority events are dropped and the background Redis
+	// calls skipped. Zero disables it.
+	MemoryPressureMB    int
+	MemoryCheckInterval time.Duration
+	// MaxClockSkew is how far the local clock may be off Redis TIME, checked
+	// at startup and every ClockSkewInterval. Over it the sidecar warns, or
+	// with ClockSkewFatal refuses to start. Zero disables the check.
+	MaxClockSkew      time.Duration
+	ClockSkewInterval time.Duration
+	ClockSkewFatal    bool
+
+	// BroadcastChannel, when set, is subscribed by every connection in
+	// addition to the user's own channel.
+	BroadcastChannel string
+
+	// ChannelEventNames sets the SSE `event:` field from the source channel,
+	// using ChannelEventMap first and stripping ChannelEventPrefix otherwise.
+	ChannelEventNames  bool
+	ChannelEventPrefix string
+	ChannelEventMap    []channelRule
+	// EventField names the JSON payload field holding the event name.
+	EventField string
+	// MissingEventField is what happens to an enveloped payload without
+	// EventField: missingEventDefault, missingEventDrop or missingEventRaw.
+	MissingEventField string
+	// EventIDField names the JSON payload field sent as the SSE `id:`.
+	EventIDField string
+	// MaxEventIDBytes is the longest payload id sent, longer ones are ignored.
+	MaxEventIDBytes int
+	// EventIDSequence sends a per-connection sequence number as `id:` when
+	// the payload has no id.
+	EventIDSequence bool
+	// SourceSeqField names the JSON payload field with the publisher's
+	// sequence number, checked for gaps and reordering.
+	SourceSeqField string
+	// HybridDelivery also polls the user's history list every
+	// HybridInterval, reading the newest HybridDepth entries, to deliver what
+	// pub/sub missed.
+	HybridDelivery bool
+	HybridInterval time.Duration
+	HybridDepth    int
+	// Feeds are the named feeds a connection selects with `feed=`, each with
+	// its own channel and history keys, see feedConfig.
+	Feeds map[string]*feedConfig
+
+	// PubSubChannelSize and PubSubSendTimeout configure go-redis's buffer
+	// between the Redis connection and the subscription goroutine.
+	PubSubChannelSize int
+	PubSubSendTimeout time.Duration
+	// PubSubMaxChannels caps the channels per Redis pub/sub connection, a
+	// connection subscribed to more is spread over several. 0 is unlimited.
+	PubSubMaxChannels int
+	// SubscribeBatch is how many channels go in one SUBSCRIBE command, and
+	// MaxChannels caps the channels of a connection (0 is unlimited).
+	SubscribeBatch int
+	MaxChannels    int
+	// ReorderWindow enables holding messages that arrive ahead of their
+	// source sequence number for up to that long, at most ReorderMax per
+	// channel, so they are delivered in order.
+	ReorderWindow time.Duration
+	ReorderMax    int
+	// DefaultEvent is used when no other event name applies. Empty keeps
+	// such events anonymous.
+	DefaultEvent string
+
+	// JWTAlgs is the allowlist of accepted token `alg` headers.
+	JWTAlgs []string
+	// JWTPublicKey verifies ES256/ES384/ES512 tokens.
+	JWTPublicKey *ecdsa.PublicKey
+	// TokenFile and JWTPublicKeyFile load the token secret and EC public key
+	// from files, read again on a bad signature at most once per
+	// SecretReloadInterval.
+	TokenFile            string
+	JWTPublicKeyFile     string
+	SecretReloadInterval time.Duration
+	// JWKSURL enables fetching the verification keys (by `kid`) from a JWKS
+	// endpoint. The set is cached for JWKSTTL and refreshed at most once per
+	// JWKSMinRefresh.
+	JWKSURL        string
+	JWKSTTL        time.Duration
+	JWKSMinRefresh time.Duration
+	// CloseOnExpiry ends streams when their token expires.
+	CloseOnExpiry bool
+	// ExpiryWarning sends an `event: token_expiring` this long before the
+	// token expires, for the client to refresh it. Zero disables it.
+	ExpiryWarning time.Duration
+	// RequiredClaim rejects tokens without a matching claim with 403.
+	RequiredClaim *requiredClaim
+	// ClaimSchemas say where the tokens of each issuer hold the user id,
+	// for identity providers not using `user_id`.
+	ClaimSchemas []claimSchema
+	// AuthzWebhook is asked to allow every new connection, within
+	// AuthzTimeout. AuthzFailOpen accepts connections when it fails.
+	AuthzWebhook  string
+	AuthzTimeout  time.Duration
+	AuthzFailOpen bool
+	// MetadataClaims are the claims copied into the presence, receipt and
+	// dead-letter records of a connection.
+	MetadataClaims []string
+	// EventClaims are the claims added as "metadata" to the envelope of
+	// every event of the connection.
+	EventClaims []string
+
+	// ResponseHeaders are added to every SSE response before the stream starts.
+	ResponseHeaders http.Header
+	// StreamHeaders are the caching/buffering headers of the event stream.
+	StreamHeaders http.Header
+
+	// HistoryBackfill delivers the last N entries of `history:user:<id>` on
+	// connect, before live messages. Zero disables it.
+	HistoryBackfill int
+	// ReplayChunk is how many history entries are read and queued at a
+	// time, ReplayMax how many are replayed at most.
+	ReplayChunk int
+	ReplayMax   int
+	// PersistOnShutdown is how many of a connection's undelivered messages
+	// are written to `pending:user:<id>` on shutdown, replayed by the next
+	// connection after the history. Zero disables it.
+	PersistOnShutdown int
+	// SnapshotKey is the key template (`{user_id}`) of the state sent as an
+	// `event: snapshot` on connect.
+	SnapshotKey string
+	// MaxReplayAge skips history entries whose ReplayTimeField is older than
+	// this, in the backfill and hybrid delivery. Zero disables it.
+	MaxReplayAge    time.Duration
+	ReplayTimeField string
+
+	// ControlChannel is a Redis channel the sidecar listens on for signed
+	// operational commands, see control.go.
+	ControlChannel string
+	ControlSecret  string
+
+	// SegmentBytes splits payloads larger than this into ordered `chunk`
+	// events the client reassembles. Zero disables segmentation.
+	SegmentBytes int
+	// MaxLineBytes bounds a single `data:` line, which some proxies truncate
+	// when too long. LongLines is what happens to a longer line: split into
+	// several `data:` lines, truncate, or reject the event. Zero disables it.
+	MaxLineBytes int
+	LongLines    string
+	// EventSizeBuckets are the bounds (in bytes) of the delivered event size
+	// histogram.
+	EventSizeBuckets []float64
+	// MetricLabelLimit caps the distinct values of a metric label that aren't
+	// preset, the others being counted as "other".
+	MetricLabelLimit int
+	// MetricsByTransport also exports the core connection and delivery
+	// metrics with a `transport` label.
+	MetricsByTransport bool
+
+	// FlushInterval coalesces the flushes of a burst of messages. Zero
+	// flushes after every message.
+	FlushInterval time.Duration
+
+	// TimeSyncInterval sends an `event: time` frame with the server time at
+	// this interval. Zero disables it.
+	TimeSyncInterval time.Duration
+	// StatsInterval sends an `event: stats` frame with the connection's
+	// delivered and dropped counts at this interval. Zero disables it.
+	StatsInterval time.Duration
+	// Diagnostics lets connections ask for `: diag` comments after every
+	// event with `diag=1`.
+	Diagnostics bool
+	// KeepaliveInterval sends a keepalive at this interval, as a comment or
+	// (KeepaliveFormat `event`) an `event: ping`. Zero disables it. With
+	// KeepaliveIdleOnly, only after that long without any write.
+	KeepaliveInterval time.Duration
+	KeepaliveFormat   string
+	KeepaliveIdleOnly bool
+	// ProxyIdleTimeout is the idle timeout of the proxy in front, the
+	// keepalive interval defaulting to half of it.
+	ProxyIdleTimeout time.Duration
+	// TCPKeepalive is the interval of TCP keepalive probes on accepted
+	// connections. Zero disables them.
+	TCPKeepalive time.Duration
+	// ReusePort listens with SO_REUSEPORT, for handoffs to a new process.
+	ReusePort bool
+
+	// MaxURLBytes rejects SSE requests with longer URLs with 414.
+	MaxURLBytes int
+	// MaxBodyBytes rejects larger bodies on the POST endpoints with 413.
+	MaxBodyBytes int64
+
+	// PresenceChannel receives a connect/disconnect record for every
+	// connection. PresenceDebounce holds back disconnects to absorb reloads.
+	PresenceChannel  string
+	PresenceDebounce time.Duration
+	// PresenceTTL is the TTL of the `online:user:<id>` key refreshed every
+	// PresenceRefresh while the user is connected. Zero disables it.
+	PresenceTTL     time.Duration
+	PresenceRefresh time.Duration
+	// FairInterleave writes a backlog round robin across its channels.
+	FairInterleave bool
+	// CoalesceKey is the payload field by which a backlog is coalesced: of
+	// the messages of a channel with the same value, only the newest is
+	// written. Empty disables it.
+	CoalesceKey string
+	// SlowFlushThreshold is the average flush latency over which a
+	// connection also coalesces the messages without a CoalesceKey, by
+	// channel. Zero disables it.
+	SlowFlushThreshold time.Duration
+	// BurstWindow merges queued messages of one named event and channel
+	// published within this window of each other, at least BurstMin and at
+	// most BurstMax, into one array event. BurstEvents limits it to these
+	// event names. Zero disables it.
+	BurstWindow time.Duration
+	BurstMin    int
+	BurstMax    int
+	BurstEvents []string
+	// FairShareRate caps the events per second of the instance, shared
+	// round robin across users when more are waiting. Zero disables it.
+	FairShareRate int
+	// Tiers are the limits by `tier` claim, see tierFor.
+	Tiers map[string]tierLimits
+	// SingleSession closes a user's older connections when a new one is
+	// live, newest wins.
+	SingleSession bool
+
+	// MaxQueueAge drops messages that waited longer than this in a slow
+	// connection's queue. Zero disables it.
+	MaxQueueAge time.Duration
+	// MaxEventsPerConn asks a connection to reconnect once it received that
+	// many events. Zero disables it.
+	MaxEventsPerConn int
+
+	// LoadTest runs the built-in load test instead of the server.
+	LoadTest            bool
+	LoadTestConnections int
+	LoadTestMessages    int
+	LoadTestRate        int
+
+	// TLSCert and TLSKey serve HTTPS directly. ClientCA additionally requires
+	// client certificates signed by it, and ClientCertUser (`cn` or `san`)
+	// takes the user ID from the certificate instead of a JWT.
+	TLSCert        string
+	TLSKey         string
+	ClientCA       string
+	ClientCertUser string
+	// TLSMinVersion and TLSCipherSuites (nil for Go's secure defaults)
+	// restrict the accepted TLS connections.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+
+	// ConnLogSample is the fraction of connections whose lifecycle events
+	// are logged. Errors are always logged.
+	ConnLogSample float64
+	// LogRedact matches the JSON fields masked in logs, nil for none.
+	LogRedact *regexp.Regexp
+
+	// ShardHash names the hash spreading keys over shards, see shardOf.
+	ShardHash string
+
+	// Compression lists the encodings (`gzip`, `deflate`) streams are
+	// compressed with for clients accepting them, in order of preference.
+	// Events smaller than CompressMinBytes are sent uncompressed within the
+	// stream.
+	Compression      []string
+	CompressMinBytes int
+	// UncompressedChannels are feeds never worth compressing: connections
+	// whose channels all match aren't compressed.
+	UncompressedChannels *channelMatcher
+
+	// DailyEventQuota caps the events a user receives per UTC day across
+	// all instances, counted in Redis in batches of QuotaBatch.
+	DailyEventQuota int64
+	QuotaBatch      int
+
+	// CloseFlushTimeout enables sending the queued messages, for up to that
+	// long, when the server closes a connection on purpose.
+	CloseFlushTimeout time.Duration
+
+	// ClientJS serves GET /client.js, which reconnects after ClientRetry,
+	// doubling up to ClientMaxRetry.
+	ClientJS       bool
+	ClientRetry    time.Duration
+	ClientMaxRetry time.Duration
+	// ConfigEvent starts every stream with an `event: config` of the
+	// settings a client follows, see configEventData.
+	ConfigEvent bool
+	// ClientTransports are the transports client.js tries, in order.
+	ClientTransports []string
+	// WebSocket lets clients stream over a WebSocket in the compact
+	// framing, see ws.go.
+	WebSocket bool
+
+	// StrictQuery refuses unknown query parameters, except ExtraQueryParams.
+	StrictQuery      bool
+	ExtraQueryParams map[string]bool
+	// UnsupportedOptions is the policy for each connection option asked for
+	// while disabled on the server: reject, ignore or downgrade.
+	UnsupportedOptions map[string]string
+
+	// WarmupTimeout enables checking, with a probe message, that a new
+	// subscription delivers before the connection goes live.
+	WarmupTimeout time.Duration
+
+	// CORSMaxAge is how long browsers may cache the preflight answer of the
+	// stream routes, 0 to leave it to the browser.
+	CORSMaxAge time.Duration
+
+	// EmptyPayload is what happens to empty or whitespace only payloads:
+	// skip, forward, or placeholder to send EmptyPlaceholder instead.
+	EmptyPayload     string
+	EmptyPlaceholder string
+	// StripBOM removes a UTF-8 byte order mark at the start of payloads.
+	StripBOM bool
+	// CaughtUp sends `event: caught_up` between the snapshot and history
+	// replayed on connect and the live messages.
+	CaughtUp bool
+	// NormalizeNewlines frames `\r\n` and `\r` in payloads as `\n`.
+	NormalizeNewlines bool
+
+	// EventSchemaFile holds a JSON Schema JSON payloads must match to be
+	// delivered.
+	EventSchemaFile string
+	// Plugin names the EventPlugin run on every event, see plugin.go.
+	Plugin string
+	// Pipeline is the order of the stages received messages go through
+	// before they are queued, see pipeline.go.
+	Pipeline []pipelineStage
+	// WritePipeline is the order of the stages queued messages go through
+	// before they are written.
+	WritePipeline []pipelineStage
+
+	// TrustedProxies are the proxies whose X-Forwarded-For gives the client
+	// address.
+	TrustedProxies []netip.Prefix
+	// MaintenanceWindows are the UTC time ranges during which new
+	// connections are refused. MaintenanceClose also closes the open ones
+	// when a window starts.
+	MaintenanceWindows []maintenanceWindow
+	MaintenanceClose   bool
+	// AuthFailThreshold invalid tokens from an address block it for
+	// AuthFailBlock, doubled on every further failure. Failures are forgotten
+	// AuthFailWindow after the last one. Zero disables it.
+	AuthFailThreshold int
+	AuthFailBlock     time.Duration
+	AuthFailWindow    time.Duration
+	// MaxConnPerIP and MaxConnPerSubnet limit the connections from an
+	// address and from its /SubnetPrefixV4 or /SubnetPrefixV6 network.
+	// Zero disables them.
+	MaxConnPerIP     int
+	MaxConnPerSubnet int
+	SubnetPrefixV4   int
+	SubnetPrefixV6   int
+
+	// RequestIDHeader names a request header whose value, set by the
+	// gateway, becomes the connection ID.
+	RequestIDHeader string
+
+	// AllowHTTP10 streams to HTTP/1.0 requests instead of answering 505.
+	AllowHTTP10 bool
+
+	// WriteTimeout bounds every write to a client, 0 for none.
+	WriteTimeout time.Duration
+	// StallTimeout closes a connection whose write or flush has been blocked
+	// that long, 0 to never.
+	StallTimeout time.Duration
+
+	// ConnectTimeout bounds the time from request start to the live
+	// subscription; slower setups are aborted with 504.
+	ConnectTimeout time.Duration
+	// MaxConcurrentSubscribes bounds the subscriptions set up at once, the
+	// others waiting up to SubscribeQueueTimeout. Zero is no limit.
+	MaxConcurrentSubscribes int
+	SubscribeQueueTimeout   time.Duration
+	// SubscriberStopTimeout bounds how long a closing connection waits for
+	// its subscription to stop.
+	SubscriberStopTimeout time.Duration
+
+	// PollTimeout is how long GET /poll waits for an event, and
+	// PollSessionTTL how long a poll session stays subscribed between polls.
+	PollTimeout    time.Duration
+	PollSessionTTL time.Duration
+
+	// DeadLetterChannel receives a record for every undelivered message, at
+	// most DeadLetterRate per second.
+	DeadLetterChannel string
+	DeadLetterRate    int
+
+	// ReceiptChannel receives a receipt for every flushed message that has a
+	// receipt_id.
+	ReceiptChannel string
+	// AckChannel receives the acks sent by browsers to POST /ack/{conn_id}
+	// for flushed messages with a receipt_id, at most AckRate per second
+	// per connection.
+	AckChannel string
+	AckRate    int
+	// ConfirmTimeout holds receipts back until the message is acked, and
+	// sends them as unconfirmed when no ack came within it. Zero disables it.
+	ConfirmTimeout time.Duration
+
+	// QueueSize is how many messages wait for a connection's writer, also
+	// while delivery is paused.
+	QueueSize int
+	// MaxPause resumes delivery paused with POST /pause after that long.
+	MaxPause time.Duration
+
+	// DrainRetry is how long clients are told to wait before reconnecting
+	// when the instance drains.
+	DrainRetry time.Duration
+	// CloseSpread staggers the closes of a drain or POST /disconnect over
+	// this window, to avoid a reconnect spike.
+	CloseSpread time.Duration
+	// MigrateTargets are the base URLs of the sidecars clients can be moved
+	// to with POST /migrate or the `migrate` command.
+	MigrateTargets []string
+
+	// StatsDAddr enables pushing the metrics to a StatsD agent over UDP.
+	StatsDAddr     string
+	StatsDPrefix   string
+	StatsDInterval time.Duration
+	// MetricsStrict reports a failing metrics exporter as degraded health.
+	MetricsStrict bool
+
+	// Loopback exposes POST /loopback to publish test events. Development/CI only.
+	Loopback bool
+}
+
+var cfg Config
+
+func loadConfig() Config {
+	c := Config{
+		DedupeWindow: envDuration("GO_SSE_SIDECAR_DEDUPE_WINDOW", 0),
+		DedupeKey:    os.Getenv("GO_SSE_SIDECAR_DEDUPE_KEY"),
+		DedupeIDs:    envIntRange("GO_SSE_SIDECAR_DEDUPE_IDS", 0, 0, 100000),
+
+		Envelope:         envBool("GO_SSE_SIDECAR_ENVELOPE", false),
+		ContentTypeField: envString("GO_SSE_SIDECAR_CONTENT_TYPE_FIELD", "content_type"),
+		ContentTypeMap:   parseChannelMap("GO_SSE_SIDECAR_CONTENT_TYPE_MAP", os.Getenv("GO_SSE_SIDECAR_CONTENT_TYPE_MAP")),
+		Transform: parseTransform(
+			os.Getenv("GO_SSE_SIDECAR_TRANSFORM_INCLUDE"),
+			os.Getenv("GO_SSE_SIDECAR_TRANSFORM_EXCLUDE"),
+			os.Getenv("GO_SSE_SIDECAR_TRANSFORM_RENAME"),
+		),
+
+		ChannelAllow: parseChannelMatcher("GO_SSE_SIDECAR_CHANNEL_ALLOW", os.Getenv("GO_SSE_SIDECAR_CHANNEL_ALLOW")),
+		ChannelDeny:  parseChannelMatcher("GO_SSE_SIDECAR_CHANNEL_DENY", os.Getenv("GO_SSE_SIDECAR_CHANNEL_DENY")),
+
+		PriorityChannels: parseChannelMatcher("GO_SSE_SIDECAR_PRIORITY_CHANNELS", os.Getenv("GO_SSE_SIDECAR_PRIORITY_CHANNELS")),
+		PriorityField:    os.Getenv("GO_SSE_SIDECAR_PRIORITY_FIELD"),
+
+		RedisDBs: parseRedisDBs("GO_SSE_SIDECAR_REDIS_DBS", envList("GO_SSE_SIDECAR_REDIS_DBS")),
+
+		TenantRedis: parseTenantRedis("GO_SSE_SIDECAR_TENANT_REDIS_URLS", envList("GO_SSE_SIDECAR_TENANT_REDIS_URLS")),
+
+		TenantClaim: envString("GO_SSE_SIDECAR_TENANT_CLAIM", "tenant"),
+
+		MaxTenantClients: envIntRange("GO_SSE_SIDECAR_MAX_TENANT_CLIENTS", 100, 1, 100000),
+
+		TenantRedisIdle: envDuration("GO_SSE_SIDECAR_TENANT_REDIS_IDLE", 5*time.Minute),
+		Namespaces:      parseNamespaces("GO_SSE_SIDECAR_NAMESPACES", envList("GO_SSE_SIDECAR_NAMESPACES")),
+
+		ChannelAllowKey:  os.Getenv("GO_SSE_SIDECAR_CHANNEL_ALLOW_KEY"),
+		ChannelDenyKey:   os.Getenv("GO_SSE_SIDECAR_CHANNEL_DENY_KEY"),
+		NamespacesKey:    os.Getenv("GO_SSE_SIDECAR_NAMESPACES_KEY"),
+		AllowlistRefresh: envDuration("GO_SSE_SIDECAR_ALLOWLIST_REFRESH", 30*time.Second),
+
+		RedisURLs:           envList("GO_SSE_SIDECAR_REDIS_URLS"),
+		RedisProbeInterval:  envDuration("GO_SSE_SIDECAR_REDIS_PROBE_INTERVAL", 10*time.Second),
+		BackgroundTimeout:   envDuration("GO_SSE_SIDECAR_REDIS_BACKGROUND_TIMEOUT", time.Second),
+		RedisShed:           envBool("GO_SSE_SIDECAR_REDIS_SHED", false),
+		MemoryPressureMB:    envIntRange("GO_SSE_SIDECAR_MEMORY_PRESSURE_MB", 0, 0, 1<<20),
+		MemoryCheckInterval: envDuration("GO_SSE_SIDECAR_MEMORY_CHECK_INTERVAL", time.Second),
+		MaxClockSkew:        envDuration("GO_SSE_SIDECAR_MAX_CLOCK_SKEW", 0),
+		ClockSkewInterval:   envDuration("GO_SSE_SIDECAR_CLOCK_SKEW_INTERVAL", 5*time.Minute),
+		ClockSkewFatal:      envBool("GO_SSE_SIDECAR_CLOCK_SKEW_FATAL", false),
+
+		BroadcastChannel: os.Getenv("GO_SSE_SIDECAR_BROADCAST_CHANNEL"),
+
+		ChannelEventNames:  envBool("GO_SSE_SIDECAR_CHANNEL_EVENT_NAMES", false),
+		ChannelEventPrefix: os.Getenv("GO_SSE_SIDECAR_CHANNEL_EVENT_PREFIX"),
+		ChannelEventMap:    parseChannelMap("GO_SSE_SIDECAR_CHANNEL_EVENT_MAP", os.Getenv("GO_SSE_SIDECAR_CHANNEL_EVENT_MAP")),
+		EventField:         os.Getenv("GO_SSE_SIDECAR_EVENT_FIELD"),
+		MissingEventField:  envString("GO_SSE_SIDECAR_MISSING_EVENT_FIELD", missingEventDefault),
+		EventIDField:       os.Getenv("GO_SSE_SIDECAR_EVENT_ID_FIELD"),
+		MaxEventIDBytes:    envIntRange("GO_SSE_SIDECAR_MAX_EVENT_ID_BYTES", 256, 1, 1<<20),
+		EventIDSequence:    envBool("GO_SSE_SIDECAR_EVENT_ID_SEQUENCE", false),
+		SourceSeqField:     os.Getenv("GO_SSE_SIDECAR_SOURCE_SEQ_FIELD"),
+		HybridDelivery:     envBool("GO_SSE_SIDECAR_HYBRID_DELIVERY", false),
+		HybridInterval:     envDuration("GO_SSE_SIDECAR_HYBRID_INTERVAL", 5*time.Second),
+		HybridDepth:        envIntRange("GO_SSE_SIDECAR_HYBRID_DEPTH", 100, 1, 10000),
+		Feeds:              parseFeeds("GO_SSE_SIDECAR_FEEDS", envList("GO_SSE_SIDECAR_FEEDS")),
+		PubSubChannelSize:  envIntRange("GO_SSE_SIDECAR_PUBSUB_CHANNEL_SIZE", 100, 1, 1000000),
+		PubSubSendTimeout:  envDuration("GO_SSE_SIDECAR_PUBSUB_SEND_TIMEOUT", time.Minute),
+		PubSubMaxChannels:  envIntRange("GO_SSE_SIDECAR_PUBSUB_MAX_CHANNELS", 0, 0, 100000),
+		SubscribeBatch:     envIntRange("GO_SSE_SIDECAR_SUBSCRIBE_BATCH", 100, 1, 10000),
+		MaxChannels:        envIntRange("GO_SSE_SIDECAR_MAX_CHANNELS", 0, 0, 1000000),
+		ReorderWindow:      envDuration("GO_SSE_SIDECAR_REORDER_WINDOW", 0),
+		ReorderMax:         envIntRange("GO_SSE_SIDECAR_REORDER_MAX", 100, 1, 10000),
+		DefaultEvent:       os.Getenv("GO_SSE_SIDECAR_DEFAULT_EVENT"),
+
+		JWTAlgs:      parseJWTAlgs("GO_SSE_SIDECAR_JWT_ALGS", envString("GO_SSE_SIDECAR_JWT_ALGS", "HS256")),
+		JWTPublicKey: parseECPublicKey("GO_SSE_SIDECAR_JWT_PUBLIC_KEY", os.Getenv("GO_SSE_SIDECAR_JWT_PUBLIC_KEY")),
+		JWKSURL:      os.Getenv("GO_SSE_SIDECAR_JWKS_URL"),
+
+		TokenFile:            os.Getenv("GO_SSE_SIDECAR_TOKEN_FILE"),
+		JWTPublicKeyFile:     os.Getenv("GO_SSE_SIDECAR_JWT_PUBLIC_KEY_FILE"),
+		SecretReloadInterval: envDuration("GO_SSE_SIDECAR_SECRET_RELOAD_INTERVAL", 10*time.Second),
+
+		JWKSTTL:        envDuration("GO_SSE_SIDECAR_JWKS_TTL", time.Hour),
+		JWKSMinRefresh: envDuration("GO_SSE_SIDECAR_JWKS_MIN_REFRESH", 30*time.Second),
+		CloseOnExpiry:  envBool("GO_SSE_SIDECAR_CLOSE_ON_EXPIRY", false),
+		ExpiryWarning:  envDuration("GO_SSE_SIDECAR_EXPIRY_WARNING", 0),
+		RequiredClaim:  parseRequiredClaim("GO_SSE_SIDECAR_REQUIRED_CLAIM", os.Getenv("GO_SSE_SIDECAR_REQUIRED_CLAIM")),
+		ClaimSchemas:   parseClaimSchemas("GO_SSE_SIDECAR_CLAIM_SCHEMAS", envList("GO_SSE_SIDECAR_CLAIM_SCHEMAS")),
+		MetadataClaims: envList("GO_SSE_SIDECAR_METADATA_CLAIMS"),
+		EventClaims:    envList("GO_SSE_SIDECAR_EVENT_CLAIMS"),
+		AuthzWebhook:   os.Getenv("GO_SSE_SIDECAR_AUTHZ_WEBHOOK"),
+		AuthzTimeout:   envDuration("GO_SSE_SIDECAR_AUTHZ_TIMEOUT", time.Second),
+		AuthzFailOpen:  envBool("GO_SSE_SIDECAR_AUTHZ_FAIL_OPEN", false),
+
+		ResponseHeaders: parseResponseHeaders("GO_SSE_SIDECAR_RESPONSE_HEADERS", os.Getenv("GO_SSE_SIDECAR_RESPONSE_HEADERS")),
+		StreamHeaders:   parseStreamHeaders("GO_SSE_SIDECAR_STREAM_HEADERS", os.Getenv("GO_SSE_SIDECAR_STREAM_HEADERS")),
+
+		HistoryBackfill:   envIntRange("GO_SSE_SIDECAR_HISTORY_BACKFILL", 0, 0, 100000),
+		PersistOnShutdown: envIntRange("GO_SSE_SIDECAR_PERSIST_ON_SHUTDOWN", 0, 0, 100000),
+		ReplayChunk:       envIntRange("GO_SSE_SIDECAR_REPLAY_CHUNK", 100, 1, 10000),
+		ReplayMax:         envIntRange("GO_SSE_SIDECAR_REPLAY_MAX", 1000, 1, 100000),
+		SnapshotKey:       os.Getenv("GO_SSE_SIDECAR_SNAPSHOT_KEY"),
+		MaxReplayAge:      envDuration("GO_SSE_SIDECAR_MAX_REPLAY_AGE", 0),
+		ReplayTimeField:   envString("GO_SSE_SIDECAR_REPLAY_TIME_FIELD", "ts"),
+
+		ControlChannel: os.Getenv("GO_SSE_SIDECAR_CONTROL_CHANNEL"),
+		ControlSecret:  os.Getenv("GO_SSE_SIDECAR_CONTROL_SECRET"),
+
+		SegmentBytes: envIntRange("GO_SSE_SIDECAR_SEGMENT_BYTES", 0, 0, 1<<30),
+		MaxLineBytes: envIntRange("GO_SSE_SIDECAR_MAX_LINE_BYTES", 65536, 0, 1<<30),
+		LongLines:    envString("GO_SSE_SIDECAR_LONG_LINES", "split"),
+
+		MetricLabelLimit:   envIntRange("GO_SSE_SIDECAR_METRIC_LABEL_LIMIT", 100, 1, 10000),
+		MetricsByTransport: envBool("GO_SSE_SIDECAR_METRICS_BY_TRANSPORT", false),
+		EventSizeBuckets:   parseBuckets("GO_SSE_SIDECAR_EVENT_SIZE_BUCKETS", envString("GO_SSE_SIDECAR_EVENT_SIZE_BUCKETS", "64,256,1024,4096,16384,65536,262144,1048576")),
+
+		FlushInterval: envDuration("GO_SSE_SIDECAR_FLUSH_INTERVAL", 0),
+
+		TimeSyncInterval: envDuration("GO_SSE_SIDECAR_TIME_SYNC_INTERVAL", 0),
+		StatsInterval:    envDuration("GO_SSE_SIDECAR_STATS_INTERVAL", 0),
+		Diagnostics:      envBool("GO_SSE_SIDECAR_DIAGNOSTICS", false),
+
+		KeepaliveInterval: envDuration("GO_SSE_SIDECAR_KEEPALIVE_INTERVAL", 0),
+		KeepaliveFormat:   envString("GO_SSE_SIDECAR_KEEPALIVE_FORMAT", "comment"),
+		KeepaliveIdleOnly: envBool("GO_SSE_SIDECAR_KEEPALIVE_IDLE_ONLY", false),
+		ProxyIdleTimeout:  envDuration("GO_SSE_SIDECAR_PROXY_IDLE_TIMEOUT", 0),
+		TCPKeepalive:      envDuration("GO_SSE_SIDECAR_TCP_KEEPALIVE", 15*time.Second),
+		ReusePort:         envBool("GO_SSE_SIDECAR_REUSEPORT", false),
+
+		MaxURLBytes:  envIntRange("GO_SSE_SIDECAR_MAX_URL_BYTES", 8192, 1, 1<<20),
+		MaxBodyBytes: int64(envIntRange("GO_SSE_SIDECAR_MAX_BODY_BYTES", 1<<20, 1, 1<<30)),
+
+		PresenceChannel:    os.Getenv("GO_SSE_SIDECAR_PRESENCE_CHANNEL"),
+		PresenceDebounce:   envDuration("GO_SSE_SIDECAR_PRESENCE_DEBOUNCE", 0),
+		PresenceTTL:        envDuration("GO_SSE_SIDECAR_PRESENCE_TTL", 0),
+		PresenceRefresh:    envDuration("GO_SSE_SIDECAR_PRESENCE_REFRESH", 0),
+		SingleSession:      envBool("GO_SSE_SIDECAR_SINGLE_SESSION", false),
+		FairInterleave:     envBool("GO_SSE_SIDECAR_FAIR_INTERLEAVE", false),
+		CoalesceKey:        os.Getenv("GO_SSE_SIDECAR_COALESCE_KEY"),
+		SlowFlushThreshold: envDuration("GO_SSE_SIDECAR_SLOW_FLUSH_THRESHOLD", 0),
+		BurstWindow:        envDuration("GO_SSE_SIDECAR_BURST_WINDOW", 0),
+		BurstMin:           envIntRange("GO_SSE_SIDECAR_BURST_MIN", 3, 2, 10000),
+		BurstMax:           envIntRange("GO_SSE_SIDECAR_BURST_MAX", 100, 2, 10000),
+		BurstEvents:        envList("GO_SSE_SIDECAR_BURST_EVENTS"),
+		FairShareRate:      envIntRange("GO_SSE_SIDECAR_FAIR_SHARE_RATE", 0, 0, 10000000),
+		Tiers:              parseTiers("GO_SSE_SIDECAR_TIERS", os.Getenv("GO_SSE_SIDECAR_TIERS")),
+
+		MaxQueueAge:      time.Duration(envIntRange("GO_SSE_SIDECAR_MAX_QUEUE_AGE_MS", 0, 0, 1<<30)) * time.Millisecond,
+		MaxEventsPerConn: envIntRange("GO_SSE_SIDECAR_MAX_EVENTS_PER_CONN", 0, 0, 1<<30),
+
+		LoadTest:            envBool("GO_SSE_SIDECAR_LOADTEST", false),
+		LoadTestConnections: envIntRange("GO_SSE_SIDECAR_LOADTEST_CONNECTIONS", 100, 1, 100000),
+		LoadTestMessages:    envIntRange("GO_SSE_SIDECAR_LOADTEST_MESSAGES", 100, 1, 1000000),
+		LoadTestRate:        envIntRange("GO_SSE_SIDECAR_LOADTEST_RATE", 1000, 1, 1000000),
+
+		TLSCert:        os.Getenv("GO_SSE_SIDECAR_TLS_CERT"),
+		TLSKey:         os.Getenv("GO_SSE_SIDECAR_TLS_KEY"),
+		ClientCA:       os.Getenv("GO_SSE_SIDECAR_CLIENT_CA"),
+		ClientCertUser: os.Getenv("GO_SSE_SIDECAR_CLIENT_CERT_USER"),
+
+		TLSMinVersion:   parseTLSVersion(envString("GO_SSE_SIDECAR_TLS_MIN_VERSION", "1.2")),
+		TLSCipherSuites: parseCipherSuites(os.Getenv("GO_SSE_SIDECAR_TLS_CIPHER_SUITES")),
+
+		ConnLogSample: envFloatRange("GO_SSE_SIDECAR_CONN_LOG_SAMPLE", 1, 0, 1),
+		LogRedact:     parseRedactFields("GO_SSE_SIDECAR_LOG_REDACT"),
+
+		ShardHash: parseShardHash("GO_SSE_SIDECAR_SHARD_HASH", envString("GO_SSE_SIDECAR_SHARD_HASH", "fnv1a")),
+
+		Compression:          envList("GO_SSE_SIDECAR_COMPRESSION"),
+		CompressMinBytes:     envIntRange("GO_SSE_SIDECAR_COMPRESS_MIN_BYTES", 256, 0, 1<<30),
+		UncompressedChannels: parseChannelMatcher("GO_SSE_SIDECAR_UNCOMPRESSED_CHANNELS", os.Getenv("GO_SSE_SIDECAR_UNCOMPRESSED_CHANNELS")),
+
+		DailyEventQuota: int64(envIntRange("GO_SSE_SIDECAR_DAILY_EVENT_QUOTA", 0, 0, 1<<31-1)),
+		QuotaBatch:      envIntRange("GO_SSE_SIDECAR_QUOTA_BATCH", 10, 1, 10000),
+
+		CloseFlushTimeout: envDuration("GO_SSE_SIDECAR_CLOSE_FLUSH_TIMEOUT", 0),
+
+		ClientJS:       envBool("GO_SSE_SIDECAR_CLIENT_JS", false),
+		ClientRetry:    envDuration("GO_SSE_SIDECAR_CLIENT_RETRY", time.Second),
+		ClientMaxRetry: envDuration("GO_SSE_SIDECAR_CLIENT_MAX_RETRY", 30*time.Second),
+		ConfigEvent:    envBool("GO_SSE_SIDECAR_CONFIG_EVENT", false),
+
+		ClientTransports: envList("GO_SSE_SIDECAR_CLIENT_TRANSPORTS"),
+		WebSocket:        envBool("GO_SSE_SIDECAR_WEBSOCKET", false),
+
+		StrictQuery:        envBool("GO_SSE_SIDECAR_STRICT_QUERY", false),
+		ExtraQueryParams:   parseFieldSet(os.Getenv("GO_SSE_SIDECAR_EXTRA_QUERY_PARAMS")),
+		UnsupportedOptions: parseUnsupportedPolicies("GO_SSE_SIDECAR_UNSUPPORTED_OPTIONS", os.Getenv("GO_SSE_SIDECAR_UNSUPPORTED_OPTIONS")),
+
+		WarmupTimeout: envDuration("GO_SSE_SIDECAR_WARMUP_TIMEOUT", 0),
+
+		CORSMaxAge: envDuration("GO_SSE_SIDECAR_CORS_MAX_AGE", 10*time.Minute),
+
+		EmptyPayload:      envString("GO_SSE_SIDECAR_EMPTY_PAYLOAD", "skip"),
+		EmptyPlaceholder:  envString("GO_SSE_SIDECAR_EMPTY_PLACEHOLDER", "{}"),
+		StripBOM:          envBool("GO_SSE_SIDECAR_STRIP_BOM", true),
+		CaughtUp:          envBool("GO_SSE_SIDECAR_CAUGHT_UP", false),
+		NormalizeNewlines: envBool("GO_SSE_SIDECAR_NORMALIZE_NEWLINES", true),
+
+		TrustedProxies:     parsePrefixes("GO_SSE_SIDECAR_TRUSTED_PROXIES", envList("GO_SSE_SIDECAR_TRUSTED_PROXIES")),
+		MaintenanceWindows: parseMaintenanceWindows("GO_SSE_SIDECAR_MAINTENANCE_WINDOWS", envList("GO_SSE_SIDECAR_MAINTENANCE_WINDOWS")),
+		MaintenanceClose:   envBool("GO_SSE_SIDECAR_MAINTENANCE_CLOSE", false),
+		AuthFailThreshold:  envIntRange("GO_SSE_SIDECAR_AUTH_FAIL_THRESHOLD", 0, 0, 1000000),
+		AuthFailBlock:      envDuration("GO_SSE_SIDECAR_AUTH_FAIL_BLOCK", 10*time.Second),
+		AuthFailWindow:     envDuration("GO_SSE_SIDECAR_AUTH_FAIL_WINDOW", 10*time.Minute),
+		MaxConnPerIP:       envIntRange("GO_SSE_SIDECAR_MAX_CONN_PER_IP", 0, 0, 1000000),
+		MaxConnPerSubnet:   envIntRange("GO_SSE_SIDECAR_MAX_CONN_PER_SUBNET", 0, 0, 1000000),
+		SubnetPrefixV4:     envIntRange("GO_SSE_SIDECAR_SUBNET_PREFIX", 24, 8, 32),
+		SubnetPrefixV6:     envIntRange("GO_SSE_SIDECAR_SUBNET_PREFIX_V6", 64, 16, 128),
+
+		EventSchemaFile: os.Getenv("GO_SSE_SIDECAR_EVENT_SCHEMA_FILE"),
+		Plugin:          os.Getenv("GO_SSE_SIDECAR_PLUGIN"),
+		Pipeline:        parsePipeline("GO_SSE_SIDECAR_PIPELINE", envString("GO_SSE_SIDECAR_PIPELINE", defaultPipeline), pipelineStages, defaultPipeline),
+		WritePipeline:   parsePipeline("GO_SSE_SIDECAR_WRITE_PIPELINE", envString("GO_SSE_SIDECAR_WRITE_PIPELINE", defaultWritePipeline), writeStages, defaultWritePipeline),
+
+		RequestIDHeader: os.Getenv("GO_SSE_SIDECAR_REQUEST_ID_HEADER"),
+
+		AllowHTTP10: envBool("GO_SSE_SIDECAR_ALLOW_HTTP10", false),
+
+		WriteTimeout: envDuration("GO_SSE_SIDECAR_WRITE_TIMEOUT", 0),
+		StallTimeout: envDuration("GO_SSE_SIDECAR_STALL_TIMEOUT", time.Minute),
+
+		ConnectTimeout: envDuration("GO_SSE_SIDECAR_CONNECT_TIMEOUT", 10*time.Second),
+
+		MaxConcurrentSubscribes: envIntRange("GO_SSE_SIDECAR_MAX_CONCURRENT_SUBSCRIBES", 0, 0, 100000),
+		SubscribeQueueTimeout:   envDuration("GO_SSE_SIDECAR_SUBSCRIBE_QUEUE_TIMEOUT", 2*time.Second),
+		SubscriberStopTimeout:   envDuration("GO_SSE_SIDECAR_SUBSCRIBER_STOP_TIMEOUT", 5*time.Second),
+
+		PollTimeout:    envDuration("GO_SSE_SIDECAR_POLL_TIMEOUT", 25*time.Second),
+		PollSessionTTL: envDuration("GO_SSE_SIDECAR_POLL_SESSION_TTL", time.Minute),
+
+		DeadLetterChannel: os.Getenv("GO_SSE_SIDECAR_DEADLETTER_CHANNEL"),
+		DeadLetterRate:    envIntRange("GO_SSE_SIDECAR_DEADLETTER_RATE", 100, 1, 1000000),
+
+		ReceiptChannel: os.Getenv("GO_SSE_SIDECAR_RECEIPT_CHANNEL"),
+		AckChannel:     os.Getenv("GO_SSE_SIDECAR_ACK_CHANNEL"),
+		AckRate:        envIntRange("GO_SSE_SIDECAR_ACK_RATE", 10, 1, 10000),
+		ConfirmTimeout: envDuration("GO_SSE_SIDECAR_CONFIRM_TIMEOUT", 0),
+
+		QueueSize: envIntRange("GO_SSE_SIDECAR_QUEUE_SIZE", 10, 1, 100000),
+		MaxPause:  envDuration("GO_SSE_SIDECAR_MAX_PAUSE", time.Minute),
+
+		DrainRetry: envDuration("GO_SSE_SIDECAR_DRAIN_RETRY", 5*time.Second),
+
+		MigrateTargets: parseMigrateTargets("GO_SSE_SIDECAR_MIGRATE_TARGETS", envList("GO_SSE_SIDECAR_MIGRATE_TARGETS")),
+		CloseSpread:    envDuration("GO_SSE_SIDECAR_CLOSE_SPREAD", 0),
+
+		StatsDAddr:     os.Getenv("GO_SSE_SIDECAR_STATSD_ADDR"),
+		StatsDPrefix:   envString("GO_SSE_SIDECAR_STATSD_PREFIX", "sse_sidecar."),
+		StatsDInterval: envDuration("GO_SSE_SIDECAR_STATSD_INTERVAL", 10*time.Second),
+		MetricsStrict:  envBool("GO_SSE_SIDECAR_METRICS_STRICT", false),
+
+		Loopback: envBool("GO_SSE_SIDECAR_LOOPBACK", false),
+	}
+
+	for i, enc := range c.Compression {
+		if !slices.Contains(compressionEncodings, enc) || slices.Contains(c.Compression[:i], enc) {
+			log.Fatalf("Invalid GO_SSE_SIDECAR_COMPRESSION %q: %q is unknown or repeated, expected gzip and/or deflate", strings.Join(c.Compression, ","), enc)
+		}
+	}
+
+	if c.MemoryPressureMB > 0 && c.MemoryCheckInterval <= 0 {
+		log.Fatalf("GO_SSE_SIDECAR_MEMORY_CHECK_INTERVAL must be positive")
+	}
+	if c.MaintenanceClose && len(c.MaintenanceWindows) == 0 {
+		log.Fatalf("GO_SSE_SIDECAR_MAINTENANCE_CLOSE requires GO_SSE_SIDECAR_MAINTENANCE_WINDOWS")
+	}
+	if c.BurstWindow > 0 && (c.FairInterleave || c.CoalesceKey != "" || c.SlowFlushThreshold > 0) {
+		log.Fatalf("GO_SSE_SIDECAR_BURST_WINDOW can't be combined with GO_SSE_SIDECAR_FAIR_INTERLEAVE, GO_SSE_SIDECAR_COALESCE_KEY or GO_SSE_SIDECAR_SLOW_FLUSH_THRESHOLD")
+	}
+	if c.BurstMax < c.BurstMin {
+		log.Fatalf("GO_SSE_SIDECAR_BURST_MAX must be at least GO_SSE_SIDECAR_BURST_MIN")
+	}
+	if c.ExpiryWarning > 0 && !c.CloseOnExpiry {
+		log.Fatalf("GO_SSE_SIDECAR_EXPIRY_WARNING requires GO_SSE_SIDECAR_CLOSE_ON_EXPIRY")
+	}
+	if c.PersistOnShutdown > 0 && c.HistoryBackfill == 0 {
+		log.Fatalf("GO_SSE_SIDECAR_PERSIST_ON_SHUTDOWN requires GO_SSE_SIDECAR_HISTORY_BACKFILL")
+	}
+	switch c.MissingEventField {
+	case missingEventDefault, missingEventDrop, missingEventRaw:
+	default:
+		log.Fatalf("Invalid GO_SSE_SIDECAR_MISSING_EVENT_FIELD %q, expected default, drop or raw", c.MissingEventField)
+	}
+	if c.KeepaliveFormat != "comment" && c.KeepaliveFormat != "event" {
+		log.Fatalf("Invalid GO_SSE_SIDECAR_KEEPALIVE_FORMAT %q, expected comment or event", c.KeepaliveFormat)
+	}
+	if c.ProxyIdleTimeout > 0 {
+		_, explicit := os.LookupEnv("GO_SSE_SIDECAR_KEEPALIVE_INTERVAL")
+		c.KeepaliveInterval = keepaliveBelow(c.ProxyIdleTimeout, c.KeepaliveInterval, explicit)
+	}
+	if c.ConfirmTimeout > 0 && (c.ReceiptChannel == "" || c.AckChannel == "") {
+		log.Fatal("GO_SSE_SIDECAR_CONFIRM_TIMEOUT requires GO_SSE_SIDECAR_RECEIPT_CHANNEL and GO_SSE_SIDECAR_ACK_CHANNEL")
+	}
+	if c.ReusePort && !reusePortSupported {
+		log.Fatalf("GO_SSE_SIDECAR_REUSEPORT is not supported on %s", runtime.GOOS)
+	}
+
+	if len(c.ClientTransports) == 0 {
+		c.ClientTransports = []string{"sse", "poll"}
+	}
+	for _, name := range c.ClientTransports {
+		if name != "sse" && name != "poll" {
+			log.Fatalf("Invalid GO_SSE_SIDECAR_CLIENT_TRANSPORTS %q, expected sse or poll", name)
+		}
+	}
+
+	if c.AllowlistRefresh < minAllowlistRefresh {
+		log.Fatalf("Invalid GO_SSE_SIDECAR_ALLOWLIST_REFRESH: %v is below %v", c.AllowlistRefresh, minAllowlistRefresh)
+	}
+
+	if c.CloseSpread < 0 || c.CloseSpread > maxCloseSpread {
+		log.Fatalf("Invalid GO_SSE_SIDECAR_CLOSE_SPREAD: %v is not between 0 and %v", c.CloseSpread, maxCloseSpread)
+	}
+
+	if c.PresenceTTL > 0 {
+		if c.PresenceRefresh == 0 {
+			c.PresenceRefresh = c.PresenceTTL / 3
+		}
+		if c.PresenceRefresh <= 0 || c.PresenceRefresh >= c.PresenceTTL {
+			log.Fatalf("Invalid GO_SSE_SIDECAR_PRESENCE_REFRESH: %v must be positive and below GO_SSE_SIDECAR_PRESENCE_TTL (%v)", c.PresenceRefresh, c.PresenceTTL)
+		}
+	}
+
+	switch c.LongLines {
+	case "split", "truncate", "reject":
+	default:
+		log.Fatalf("Invalid GO_SSE_SIDECAR_LONG_LINES %q, expected split, truncate or reject", c.LongLines)
+	}
+	if c.MaxLineBytes > 0 && c.MaxLineBytes < 16 {
+		log.Fatalf("Invalid GO_SSE_SIDECAR_MAX_LINE_BYTES: %d is below 16", c.MaxLineBytes)
+	}
+
+	switch c.EmptyPayload {
+	case "skip", "forward", "placeholder":
+	default:
+		log.Fatalf("Invalid GO_SSE_SIDECAR_EMPTY_PAYLOAD %q, expected skip, forward or placeholder", c.EmptyPayload)
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		log.Fatal("GO_SSE_SIDECAR_TLS_CERT and GO_SSE_SIDECAR_TLS_KEY must be set together")
+	}
+	if c.ClientCA != "" && c.TLSCert == "" {
+		log.Fatal("GO_SSE_SIDECAR_CLIENT_CA requires GO_SSE_SIDECAR_TLS_CERT and GO_SSE_SIDECAR_TLS_KEY")
+	}
+	if c.ClientCertUser != "" && (c.ClientCA == "" || (c.ClientCertUser != "cn" && c.ClientCertUser != "san")) {
+		log.Fatal("GO_SSE_SIDECAR_CLIENT_CERT_USER must be cn or san and requires GO_SSE_SIDECAR_CLIENT_CA")
+	}
+
+	hybridFeed := false
+	for _, f := range c.Feeds {
+		hybridFeed = hybridFeed || f.hybrid
+	}
+	if (c.HybridDelivery || hybridFeed) && c.HybridInterval <= 0 {
+		log.Fatal("GO_SSE_SIDECAR_HYBRID_INTERVAL must be positive")
+	}
+
+	if c.ReorderWindow > 0 && c.SourceSeqField == "" {
+		log.Fatal("GO_SSE_SIDECAR_REORDER_WINDOW requires GO_SSE_SIDECAR_SOURCE_SEQ_FIELD to be set")
+	}
+
+	if c.ControlChannel != "" && c.ControlSecret == "" {
+		log.Fatal("GO_SSE_SIDECAR_CONTROL_CHANNEL requires GO_SSE_SIDECAR_CONTROL_SECRET to be set")
+	}
+
+	for _, alg := range c.JWTAlgs {
+		if c.JWKSURL != "" || strings.HasPrefix(alg, "HS") {
+			continue
+		}
+		if strings.HasPrefix(alg, "ES") && c.JWTPublicKey == nil && c.JWTPublicKeyFile == "" {
+			log.Fatalf("GO_SSE_SIDECAR_JWT_ALGS allows %s but none of GO_SSE_SIDECAR_JWT_PUBLIC_KEY, GO_SSE_SIDECAR_JWT_PUBLIC_KEY_FILE or GO_SSE_SIDECAR_JWKS_URL is set", alg)
+		}
+		if strings.HasPrefix(alg, "RS") {
+			log.Fatalf("GO_SSE_SIDECAR_JWT_ALGS allows %s but GO_SSE_SIDECAR_JWKS_URL is not set", alg)
+		}
+	}
+
+	return c
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
+}
+
+// envIntRange is envInt restricted to [min, max].
+func envIntRange(name string, def, min, max int) int {
+	n := envInt(name, def)
+	if n < min || n > max {
+		log.Fatalf("Invalid %s: %d is not between %d and %d", name, n, min, max)
+	}
+	return n
+}
+
+// envFloatRange reads a float restricted to [min, max].
+func envFloatRange(name string, def, min, max float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < min || f > max {
+		log.Fatalf("Invalid %s: %q is not a number between %v and %v", name, v, min, max)
+	}
+	return f
+}
+
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return b
+}
+
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList reads a comma-separated list, ignoring empty entries.
+func envList(name string) []string {
+	var list []string
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// keepaliveBelow returns the keepalive interval for a proxy closing streams
+// idle for proxyIdle: half of it, unless an interval was set explicitly, in
+// which case it's kept with a warning if it doesn't beat the proxy.
+func keepaliveBelow(proxyIdle, interval time.Duration, explicit bool) time.Duration {
+	if !explicit {
+		interval = proxyIdle / 2
+	} else if interval <= 0 || interval >= proxyIdle {
+		log.Printf("[SSE-SIDECAR] WARNING: GO_SSE_SIDECAR_KEEPALIVE_INTERVAL %v doesn't keep streams alive through GO_SSE_SIDECAR_PROXY_IDLE_TIMEOUT %v", interval, proxyIdle)
+		return interval
+	}
+	log.Printf("[SSE-SIDECAR] Keepalive every %v, below the proxy idle timeout of %v", interval, proxyIdle)
+	return interval
+}
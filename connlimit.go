@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+)
+
+var (
+	errIPLimit     = errors.New("too many connections from this address")
+	errSubnetLimit = errors.New("too many connections from this network")
+)
+
+// parseClientAddr parses the address clientIP returns. It's invalid, and
+// not limited, when the client isn't on IP (ex: a unix socket).
+func parseClientAddr(ip string) netip.Addr {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// subnetOf returns the network an address is counted in for
+// cfg.MaxConnPerSubnet, a /SubnetPrefixV4 or /SubnetPrefixV6.
+func subnetOf(addr netip.Addr) netip.Prefix {
+	bits := cfg.SubnetPrefixV6
+	if addr.Is4() {
+		bits = cfg.SubnetPrefixV4
+	}
+	p, _ := addr.Prefix(bits)
+	return p
+}
+
+// addressSlots counts the connections of each address and subnet. A slot is
+// reserved before the connection is set up, so concurrent connections can't
+// all take the last one.
+type addressSlots struct {
+	mu       sync.Mutex
+	byAddr   map[netip.Addr]int
+	bySubnet map[netip.Prefix]int
+}
+
+var addressConns = &addressSlots{byAddr: make(map[netip.Addr]int), bySubnet: make(map[netip.Prefix]int)}
+
+// reserve takes a slot for a new connection from addr, unless it would go
+// over cfg.MaxConnPerIP or cfg.MaxConnPerSubnet. The subnet limit can be set
+// higher than the per-IP one, so clients behind one NAT address aren't
+// refused while a block of addresses is still capped. The returned func
+// releases the slot, once the connection is refused later on or closed.
+func (s *addressSlots) reserve(addr netip.Addr) (func(), error) {
+	if !addr.IsValid() || (cfg.MaxConnPerIP <= 0 && cfg.MaxConnPerSubnet <= 0) {
+		return func() {}, nil
+	}
+	subnet := subnetOf(addr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.byAddr[addr]; cfg.MaxConnPerIP > 0 && n >= cfg.MaxConnPerIP {
+		return nil, fmt.Errorf("%w %s: %d connections, max %d", errIPLimit, addr, n, cfg.MaxConnPerIP)
+	}
+	if n := s.bySubnet[subnet]; cfg.MaxConnPerSubnet > 0 && n >= cfg.MaxConnPerSubnet {
+		return nil, fmt.Errorf("%w %s: %d connections, max %d", errSubnetLimit, subnet, n, cfg.MaxConnPerSubnet)
+	}
+	s.byAddr[addr]++
+	s.bySubnet[subnet]++
+	var once sync.Once
+	return func() { once.Do(func() { s.release(addr, subnet) }) }, nil
+}
+
+func (s *addressSlots) release(addr netip.Addr, subnet netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byAddr[addr]--; s.byAddr[addr] <= 0 {
+		delete(s.byAddr, addr)
+	}
+	if s.bySubnet[subnet]--; s.bySubnet[subnet] <= 0 {
+		delete(s.bySubnet, subnet)
+	}
+}
+
+// counts returns the connections counted for addr and its subnet.
+func (s *addressSlots) counts(addr netip.Addr) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byAddr[addr], s.bySubnet[subnetOf(addr)]
+}
+
+// refuseAddressLimit answers a connection refused by reserve.
+func refuseAddressLimit(w http.ResponseWriter, err error) {
+	metrics.addressLimited.Add(1)
+	if errors.Is(err, errSubnetLimit) {
+		http.Error(w, "Too many connections from this network", http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, "Too many connections from this address", http.StatusTooManyRequests)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubnetOf(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SubnetPrefixV4, c.SubnetPrefixV6 = 24, 48 })
+	for ip, want := range map[string]string{
+		"198.51.100.7":        "198.51.100.0/24",
+		"::ffff:198.51.100.7": "198.51.100.0/24",
+		"2001:db8:1:2::7":     "2001:db8:1::/48",
+	} {
+		if got := subnetOf(parseClientAddr(ip)).String(); got != want {
+			t.Errorf("%s counted in %s, want %s", ip, got, want)
+		}
+	}
+	if parseClientAddr("@").IsValid() {
+		t.Error("a unix socket peer has an address")
+	}
+}
+
+func TestAddressSlots(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.MaxConnPerIP = 2
+		c.MaxConnPerSubnet = 3
+		c.SubnetPrefixV4 = 24
+	})
+	slots := &addressSlots{byAddr: make(map[netip.Addr]int), bySubnet: make(map[netip.Prefix]int)}
+	nat := netip.MustParseAddr("198.51.100.1")
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := slots.reserve(nat)
+		if err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := slots.reserve(nat); !errors.Is(err, errIPLimit) {
+		t.Errorf("third connection from one address: %v", err)
+	}
+	release, err := slots.reserve(netip.MustParseAddr("198.51.100.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slots.reserve(netip.MustParseAddr("198.51.100.3")); !errors.Is(err, errSubnetLimit) {
+		t.Errorf("fourth connection from the /24: %v", err)
+	}
+	if _, err := slots.reserve(netip.MustParseAddr("198.51.101.3")); err != nil {
+		t.Errorf("another /24 refused: %v", err)
+	}
+
+	// Released once, however many times it's called.
+	release()
+	release()
+	if ip, subnet := slots.counts(nat); ip != 2 || subnet != 2 {
+		t.Errorf("counted %d and %d after a release, want 2 and 2", ip, subnet)
+	}
+	for _, release := range releases {
+		release()
+	}
+	if len(slots.byAddr) != 1 || len(slots.bySubnet) != 1 {
+		t.Errorf("released addresses kept: %v %v", slots.byAddr, slots.bySubnet)
+	}
+}
+
+func TestAddressSlotsReservedAtomically(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MaxConnPerSubnet = 5 })
+	slots := &addressSlots{byAddr: make(map[netip.Addr]int), bySubnet: make(map[netip.Prefix]int)}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := slots.reserve(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})); err == nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 5 {
+		t.Errorf("%d concurrent connections reserved, max 5", reserved)
+	}
+}
+
+// limitedSidecar serves behind the test server as a trusted proxy, so each
+// request names its client address in X-Forwarded-For.
+func limitedSidecar(t *testing.T) *httptest.Server {
+	t.Helper()
+	_, srv := pollSidecar(t, func(c *Config) {
+		c.MaxConnPerIP = 1
+		c.MaxConnPerSubnet = 3
+		c.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+		c.PollTimeout = 50 * time.Millisecond
+	})
+	return srv
+}
+
+func streamFrom(t *testing.T, srv *httptest.Server, ip string, userID int64) *http.Response {
+	t.Helper()
+	q := url.Values{"ssetoken": {token(t, userID, nil)}}
+	return get(t, srv.URL+"/sse-events?"+q.Encode(), http.Header{"X-Forwarded-For": {ip}})
+}
+
+func TestSubnetLimitAcrossAddresses(t *testing.T) {
+	srv := limitedSidecar(t)
+	limited := metrics.addressLimited.Load()
+	var open []*http.Response
+	for i, ip := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		resp := streamFrom(t, srv, ip, int64(2351+i))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s, want one connection per address", ip, resp.Status)
+		}
+		readStream(t, resp).nextEvent(t, "connected")
+		open = append(open, resp)
+	}
+	for _, ip := range []string{"203.0.113.1", "203.0.113.4"} {
+		resp := streamFrom(t, srv, ip, 2354)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("%s: %s, want 429", ip, resp.Status)
+		}
+	}
+	// Other networks aren't counted with it.
+	resp := streamFrom(t, srv, "192.0.2.1", 2355)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("another network: %s", resp.Status)
+	}
+	if n := metrics.addressLimited.Load() - limited; n != 2 {
+		t.Errorf("%d refusals counted, want 2", n)
+	}
+
+	// A closed connection gives its slot back.
+	open[0].Body.Close()
+	waitFor(t, "the slot released", func() bool {
+		_, subnet := addressConns.counts(parseClientAddr("203.0.113.1"))
+		return subnet == 2
+	})
+	resp = streamFrom(t, srv, "203.0.113.4", 2354)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("after a close: %s", resp.Status)
+	}
+}
+
+func TestSlotReleasedWhenRefusedAfterReserving(t *testing.T) {
+	srv := limitedSidecar(t)
+	// Refused after the address limit, by a quota over for today.
+	cfg.DailyEventQuota = 1
+	rdb.Set(ctx, quotaKey(2356, time.Now()), 1, time.Hour)
+	resp := streamFrom(t, srv, "203.0.113.9", 2356)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("over quota: %s", resp.Status)
+	}
+	if ip, subnet := addressConns.counts(parseClientAddr("203.0.113.9")); ip != 0 || subnet != 0 {
+		t.Errorf("refused connection kept %d and %d slots", ip, subnet)
+	}
+}
+
+func TestPollSessionHoldsItsSlot(t *testing.T) {
+	srv := limitedSidecar(t)
+	cfg.PollSessionTTL = 200 * time.Millisecond
+	pollFrom := func(userID int64) int {
+		q := url.Values{"ssetoken": {token(t, userID, nil)}}
+		resp := get(t, srv.URL+"/poll?"+q.Encode(), http.Header{"X-Forwarded-For": {"203.0.113.20"}})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := pollFrom(2357); code != http.StatusOK {
+		t.Fatalf("first session: %d", code)
+	}
+	// Between polls, the session still counts.
+	if code := pollFrom(2358); code != http.StatusTooManyRequests {
+		t.Errorf("second session from the address: %d, want 429", code)
+	}
+	closed := func() bool {
+		ip, _ := addressConns.counts(parseClientAddr("203.0.113.20"))
+		return ip == 0
+	}
+	waitFor(t, "the idle session closed", closed)
+	if code := pollFrom(2358); code != http.StatusOK {
+		t.Errorf("after the session ended: %d", code)
+	}
+	waitFor(t, "the second session closed", closed)
+}
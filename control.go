@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// controlMaxAge bounds how old a signed command may be, so a captured
+// command can't be replayed later. Within it, the command's nonce is what
+// stops a replay.
+const controlMaxAge = time.Minute
+
+// maxControlNonces bounds the nonces remembered for controlMaxAge. Commands
+// are refused while it is full rather than forgetting a nonce early.
+const maxControlNonces = 10000
+
+// nonceSet remembers the nonces of accepted commands until their ts is out
+// of the controlMaxAge window, after which the command is stale anyway.
+// It's only used by the control channel's subscription.
+type nonceSet struct {
+	expires map[string]time.Time
+}
+
+var controlNonces = &nonceSet{expires: make(map[string]time.Time)}
+
+// add records nonce until expires, failing when it was seen before.
+func (s *nonceSet) add(nonce string, expires, now time.Time) error {
+	if t, ok := s.expires[nonce]; ok && now.Before(t) {
+		return fmt.Errorf("replayed nonce %q", nonce)
+	}
+	if len(s.expires) >= maxControlNonces {
+		for n, t := range s.expires {
+			if !now.Before(t) {
+				delete(s.expires, n)
+			}
+		}
+		if len(s.expires) >= maxControlNonces {
+			return fmt.Errorf("too many commands in the last %v", controlMaxAge)
+		}
+	}
+	s.expires[nonce] = expires
+	return nil
+}
+
+// controlEnvelope is the message published on the control channel. Command
+// is the command JSON as a string and Signature its hex HMAC-SHA256 with
+// GO_SSE_SIDECAR_CONTROL_SECRET, ex (Python):
+//
+//	cmd = json.dumps({"type": "disconnect", "user_id": 1, "ts": int(time.time()), "nonce": secrets.token_hex(16)})
+//	sig = hmac.new(secret, cmd.encode(), hashlib.sha256).hexdigest()
+//	r.publish(channel, json.dumps({"command": cmd, "signature": sig}))
+type controlEnvelope struct {
+	Command   string `json:"command"`
+	Signature string `json:"signature"`
+}
+
+// controlCommand is one of the commands below. Each also has the unix time
+// it was sent in "ts" and a "nonce" unique to it, ex: 16 random bytes in hex.
+//
+//	{"type": "disconnect", "user_id": 1}  close the user's connections
+//	  (add "namespace" for the user of a namespace)
+//	{"type": "broadcast", "payload": "..."}  send payload to every connection
+//	{"type": "drain"}  stop accepting connections and close the open ones
+//	{"type": "migrate", "url": "..."}  move the open connections to
+//	  another sidecar of GO_SSE_SIDECAR_MIGRATE_TARGETS
+type controlCommand struct {
+	Type      string `json:"type"`
+	TS        int64  `json:"ts"`
+	Nonce     string `json:"nonce"`
+	UserID    int64  `json:"user_id"`
+	Namespace string `json:"namespace"`
+	Payload   string `json:"payload"`
+	URL       string `json:"url"`
+}
+
+func subscribeToControlChannel(rdb *redis.Client, channel string) {
+	log.Printf("[CONTROL] Subscribing to Redis channel: %s", channel)
+
+	pubsub := rdb.Subscribe(ctx, channel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		if err := handleControlMessage(msg.Payload, cfg.ControlSecret, time.Now()); err != nil {
+			log.Printf("[CONTROL] Rejected command: %v", err)
+		}
+	}
+}
+
+func handleControlMessage(payload, secret string, now time.Time) error {
+	var env controlEnvelope
+	if err := json.Unmarshal([]byte(payload), &env); err != nil {
+		return fmt.Errorf("invalid envelope: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(env.Command))
+	sig, err := hex.DecodeString(env.Signature)
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	var cmd controlCommand
+	if err := json.Unmarshal([]byte(env.Command), &cmd); err != nil {
+		return fmt.Errorf("invalid command: %v", err)
+	}
+	if age := now.Sub(time.Unix(cmd.TS, 0)); age > controlMaxAge || age < -controlMaxAge {
+		return fmt.Errorf("stale command %q (ts %d)", cmd.Type, cmd.TS)
+	}
+	if cmd.Nonce == "" {
+		return fmt.Errorf("command %q without a nonce", cmd.Type)
+	}
+	if err := controlNonces.add(cmd.Nonce, time.Unix(cmd.TS, 0).Add(controlMaxAge), now); err != nil {
+		return err
+	}
+
+	switch cmd.Type {
+	case "disconnect":
+		conns := registry.forUser(cmd.Namespace, cmd.UserID)
+		log.Printf("[CONTROL] Disconnecting user %d (%d connections)", cmd.UserID, len(conns))
+		for _, c := range conns {
+			c.closeWith("control_disconnect")
+		}
+	case "broadcast":
+		conns := registry.all()
+		log.Printf("[CONTROL] Broadcasting to %d connections", len(conns))
+		for _, c := range conns {
+			c.enqueue(sseMessage{payload: cmd.Payload})
+		}
+	case "drain":
+		log.Printf("[CONTROL] Drain requested")
+		startDraining()
+	case "migrate":
+		target, err := migrateTarget(cmd.URL)
+		if err != nil {
+			return err
+		}
+		log.Printf("[CONTROL] Migrating %d connections to %s", migrate(registry.all(), target), target)
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Type)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testControlSecret = "control-secret"
+
+// freshNonces gives the test an empty nonce set, so reruns can reuse their
+// nonces.
+func freshNonces(t *testing.T) {
+	old := controlNonces
+	controlNonces = &nonceSet{expires: make(map[string]time.Time)}
+	t.Cleanup(func() { controlNonces = old })
+}
+
+// signedCommand returns the control channel message for cmd.
+func signedCommand(t *testing.T, cmd map[string]interface{}) string {
+	t.Helper()
+	b, _ := json.Marshal(cmd)
+	mac := hmac.New(sha256.New, []byte(testControlSecret))
+	mac.Write(b)
+	env, _ := json.Marshal(controlEnvelope{Command: string(b), Signature: hex.EncodeToString(mac.Sum(nil))})
+	return string(env)
+}
+
+func TestControlDisconnectClosesUserStreams(t *testing.T) {
+	freshNonces(t)
+	_, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 7, nil)
+	other, _ := connect(t, srv, 8, nil)
+
+	msg := signedCommand(t, map[string]interface{}{"type": "disconnect", "user_id": 7, "ts": time.Now().Unix(), "nonce": t.Name()})
+	if err := handleControlMessage(msg, testControlSecret, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !s.ended(t) {
+		t.Fatal("stream of user 7 still open")
+	}
+	if len(registry.forUser("", 8)) != 1 {
+		t.Error("user 8 was disconnected too")
+	}
+	other.resp.Body.Close()
+}
+
+func TestControlRejectsReplayedNonce(t *testing.T) {
+	freshNonces(t)
+	now := time.Now()
+	msg := signedCommand(t, map[string]interface{}{"type": "broadcast", "payload": "x", "ts": now.Unix(), "nonce": t.Name()})
+
+	if err := handleControlMessage(msg, testControlSecret, now); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	err := handleControlMessage(msg, testControlSecret, now.Add(30*time.Second))
+	if err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("replay within the window: err = %v", err)
+	}
+	// Past the window the command is stale before its nonce is looked at.
+	if err := handleControlMessage(msg, testControlSecret, now.Add(2*time.Minute)); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Fatalf("replay after the window: err = %v", err)
+	}
+}
+
+func TestControlRejectsInvalidCommands(t *testing.T) {
+	freshNonces(t)
+	now := time.Now()
+	tests := map[string]string{
+		"without a nonce": signedCommand(t, map[string]interface{}{"type": "drain", "ts": now.Unix()}),
+		"stale":           signedCommand(t, map[string]interface{}{"type": "drain", "ts": now.Add(-2 * time.Minute).Unix(), "nonce": "n1"}),
+		"from the future": signedCommand(t, map[string]interface{}{"type": "drain", "ts": now.Add(2 * time.Minute).Unix(), "nonce": "n2"}),
+		"bad signature":   `{"command": "{\"type\": \"drain\"}", "signature": "00"}`,
+		"unknown type":    signedCommand(t, map[string]interface{}{"type": "reboot", "ts": now.Unix(), "nonce": t.Name()}),
+	}
+	for name, msg := range tests {
+		if err := handleControlMessage(msg, testControlSecret, now); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if draining.Load() {
+		t.Fatal("a rejected drain command was run")
+	}
+}
+
+func TestNonceSetIsBounded(t *testing.T) {
+	s := &nonceSet{expires: make(map[string]time.Time)}
+	now := time.Now()
+	for i := 0; i < maxControlNonces; i++ {
+		if err := s.add(fmt.Sprint(i), now.Add(time.Minute), now); err != nil {
+			t.Fatalf("nonce %d: %v", i, err)
+		}
+	}
+	if err := s.add("one more", now.Add(time.Minute), now); err == nil {
+		t.Fatal("nonce accepted with the set full of live nonces")
+	}
+	// Once they expire they make room, and can't be replayed anyway.
+	later := now.Add(time.Minute)
+	if err := s.add("one more", later.Add(time.Minute), later); err != nil {
+		t.Fatalf("after expiry: %v", err)
+	}
+	if len(s.expires) != 1 {
+		t.Errorf("%d nonces kept, want the expired ones pruned", len(s.expires))
+	}
+}
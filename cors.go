@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// preflightHeaders are the request headers browsers may send to the stream
+// and ack routes: EventSource sends Last-Event-ID and Cache-Control on
+// reconnect, fetch based clients usually add Authorization and Content-Type.
+const preflightHeaders = "Authorization, Cache-Control, Content-Type, Last-Event-ID"
+
+// preflightHandler answers the CORS preflight of the stream and ack routes. Without
+// an Access-Control-Max-Age browsers only cache the answer for a few seconds
+// and preflight again on almost every reconnect.
+func preflightHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", preflightHeaders)
+	if cfg.CORSMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(cfg.CORSMaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func preflight(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sse-events", sseHandler)
+	mux.HandleFunc("OPTIONS /sse-events", preflightHandler)
+	r := httptest.NewRequest(http.MethodOptions, "/sse-events", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	r.Header.Set("Access-Control-Request-Headers", "last-event-id")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestPreflightResponse(t *testing.T) {
+	useConfig(t, func(c *Config) { c.CORSMaxAge = 2 * time.Minute })
+	rec := preflight(t)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204", rec.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "*",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, POST, OPTIONS",
+		"Access-Control-Allow-Headers":     preflightHeaders,
+		"Access-Control-Max-Age":           "120",
+	}
+	for name, v := range want {
+		if got := rec.Header().Get(name); got != v {
+			t.Errorf("%s = %q, want %q", name, got, v)
+		}
+	}
+}
+
+func TestPreflightWithoutMaxAge(t *testing.T) {
+	useConfig(t, func(c *Config) { c.CORSMaxAge = 0 })
+	rec := preflight(t)
+	if _, ok := rec.Header()["Access-Control-Max-Age"]; ok {
+		t.Errorf("Access-Control-Max-Age %q with GO_SSE_SIDECAR_CORS_MAX_AGE=0", rec.Header().Get("Access-Control-Max-Age"))
+	}
+	if rec.Header().Get("Access-Control-Allow-Headers") == "" {
+		t.Error("no Access-Control-Allow-Headers")
+	}
+}
+
+func TestPreflightCachedByDefault(t *testing.T) {
+	useConfig(t, nil)
+	if got := preflight(t).Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want 600 by default", got)
+	}
+}
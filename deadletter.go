@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// deadLetterBuffer is how many dead-letter records can wait to be published.
+const deadLetterBuffer = 1000
+
+type deadLetterRecord struct {
+	UserID       int64  `json:"user_id"`
+	ConnectionID string `json:"connection_id"`
+	Channel      string `json:"channel"`
+	Reason       string `json:"reason"`
+	Payload      string `json:"payload"`
+	TS           int64  `json:"ts"`
+
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
+	// namespace selects the dead-letter channel of the connection's namespace,
+	// db the Redis it's published to.
+	namespace string
+	db        *redis.Client
+}
+
+// deadLetterQueue publishes a record to the dead-letter channel for every
+// message that could not be delivered, so the app can retry it another way.
+// Records are published from a single goroutine and limited to cfg.
+// DeadLetterRate per second, so a flood of drops can't flood Redis in turn.
+type deadLetterQueue struct {
+	records chan deadLetterRecord
+
+	mu          sync.Mutex
+	windowStart time.Time
+	sent        int
+}
+
+var deadLetters = &deadLetterQueue{records: make(chan deadLetterRecord, deadLetterBuffer)}
+
+// add records msg as undelivered with reason, without blocking.
+func (q *deadLetterQueue) add(c *SSEClient, msg sseMessage, reason string) {
+	if cfg.DeadLetterChannel == "" {
+		return
+	}
+	if !q.allow(time.Now()) {
+		metrics.deadLettersSuppressed.Add(1)
+		return
+	}
+	select {
+	case q.records <- deadLetterRecord{
+		UserID:       c.userID,
+		namespace:    c.namespace,
+		db:           c.redisDB(),
+		ConnectionID: c.id,
+		Channel:      msg.channel,
+		Reason:       reason,
+		Payload:      msg.payload,
+		TS:           time.Now().Unix(),
+		Metadata:     c.metadata,
+	}:
+	default:
+		metrics.deadLettersSuppressed.Add(1)
+	}
+}
+
+// deadLetterPending records the messages still queued when the connection
+// closes.
+func (c *SSEClient) deadLetterPending() {
+	for {
+		msg, ok := c.next()
+		if !ok {
+			return
+		}
+		deadLetters.add(c, msg, "disconnected")
+	}
+}
+
+// allow reports whether another record fits in the current one second window.
+func (q *deadLetterQueue) allow(now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now.Sub(q.windowStart) >= time.Second {
+		q.windowStart, q.sent = now, 0
+	}
+	if q.sent >= cfg.DeadLetterRate {
+		return false
+	}
+	q.sent++
+	return true
+}
+
+// run publishes the queued records to the dead-letter channel.
+func (q *deadLetterQueue) run() {
+	log.Printf("[DEADLETTER] Publishing undelivered messages to %s (max %d/s)", cfg.DeadLetterChannel, cfg.DeadLetterRate)
+	for record := range q.records {
+		b, _ := json.Marshal(record)
+		pctx, cancel, ok := backgroundRedis(ctx)
+		if !ok {
+			metrics.deadLettersSuppressed.Add(1)
+			continue
+		}
+		if err := record.db.Publish(pctx, qualify(record.namespace, cfg.DeadLetterChannel), b).Err(); err != nil {
+			log.Printf("[DEADLETTER] Failed to publish %s record for user %d: %v", record.Reason, record.UserID, redisErr(err))
+		} else {
+			metrics.deadLetters.Add(1)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// useDeadLetters publishes the test's dead-letter records to the test's
+// Redis, and returns the records received on the channel.
+func useDeadLetters(t *testing.T, set func(c *Config)) <-chan string {
+	t.Helper()
+	useConfig(t, func(c *Config) {
+		c.DeadLetterChannel = "deadletters"
+		if set != nil {
+			set(c)
+		}
+	})
+	useRedis(t)
+	records := subscribeTo(t, "deadletters")
+	startDeadLetters(t)
+	return records
+}
+
+// startDeadLetters publishes the dead-letter records of the test with a
+// queue of its own.
+func startDeadLetters(t *testing.T) {
+	t.Helper()
+	old := deadLetters
+	q := &deadLetterQueue{records: make(chan deadLetterRecord, deadLetterBuffer)}
+	deadLetters = q
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.run()
+	}()
+	t.Cleanup(func() {
+		// Once nothing can add to it, the publisher is stopped before the
+		// config it reads is restored.
+		endConnections(t)
+		deadLetters = old
+		close(q.records)
+		<-done
+	})
+}
+
+func decodeDeadLetter(t *testing.T, payload string) deadLetterRecord {
+	t.Helper()
+	var r deadLetterRecord
+	if err := json.Unmarshal([]byte(payload), &r); err != nil {
+		t.Fatalf("%s: %v", payload, err)
+	}
+	return r
+}
+
+func TestDroppedMessagesDeadLettered(t *testing.T) {
+	records := useDeadLetters(t, nil)
+	c := &SSEClient{
+		id:       "dl-conn",
+		userID:   1421,
+		channel:  make(chan sseMessage, 1),
+		metadata: map[string]interface{}{"tenant": "acme"},
+	}
+	c.enqueue(sseMessage{channel: "events:user:1421", payload: "kept"})
+	if c.enqueue(sseMessage{channel: "events:user:1421", payload: "dropped"}) {
+		t.Fatal("queued over its size")
+	}
+
+	r := decodeDeadLetter(t, receive(t, records))
+	if r.Reason != "slow_client" || r.UserID != 1421 || r.ConnectionID != "dl-conn" {
+		t.Errorf("record %+v", r)
+	}
+	if r.Channel != "events:user:1421" || r.Payload != "dropped" {
+		t.Errorf("record for %s %q, want the dropped message", r.Channel, r.Payload)
+	}
+	if r.Metadata["tenant"] != "acme" {
+		t.Errorf("metadata %v", r.Metadata)
+	}
+	if time.Since(time.Unix(r.TS, 0)) > time.Minute {
+		t.Errorf("ts %d", r.TS)
+	}
+
+	// What's still queued when the connection goes is dead-lettered too.
+	c.deadLetterPending()
+	if r := decodeDeadLetter(t, receive(t, records)); r.Reason != "disconnected" || r.Payload != "kept" {
+		t.Errorf("record %+v, want the queued message as disconnected", r)
+	}
+}
+
+func TestDroppedWhilePausedDeadLettered(t *testing.T) {
+	records := useDeadLetters(t, nil)
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	c := &SSEClient{id: "dl-paused", userID: 1422, channel: make(chan sseMessage, 1)}
+	c.enqueue(sseMessage{payload: "a"})
+	c.enqueue(sseMessage{payload: "b"})
+	if r := decodeDeadLetter(t, receive(t, records)); r.Reason != "paused" || r.Payload != "b" {
+		t.Errorf("record %+v", r)
+	}
+}
+
+func TestDeadLettersRateLimited(t *testing.T) {
+	records := useDeadLetters(t, func(c *Config) { c.DeadLetterRate = 2 })
+	suppressed := metrics.deadLettersSuppressed.Load()
+	c := &SSEClient{id: "dl-flood", userID: 1423}
+	for i := 0; i < 5; i++ {
+		deadLetters.add(c, sseMessage{payload: "x"}, "stale")
+	}
+	receive(t, records)
+	receive(t, records)
+	select {
+	case p := <-records:
+		t.Errorf("record %s over the rate", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := metrics.deadLettersSuppressed.Load() - suppressed; n != 3 {
+		t.Errorf("%d suppressed, want 3", n)
+	}
+}
+
+func TestDeadLettersOffByDefault(t *testing.T) {
+	useConfig(t, nil)
+	q := &deadLetterQueue{records: make(chan deadLetterRecord, 1)}
+	q.add(&SSEClient{id: "dl-off", userID: 1424}, sseMessage{payload: "x"}, "slow_client")
+	if len(q.records) != 0 {
+		t.Error("recorded without GO_SSE_SIDECAR_DEADLETTER_CHANNEL")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deadlineUnsupported logs only once that the response writer can't take
+// write deadlines, since every connection goes through the same wrappers.
+var deadlineUnsupported sync.Once
+
+// deadlineWriter sets a write deadline before every write, so a client that
+// stopped reading is detected in timeout instead of when the kernel buffers
+// are full. The first failed write closes the connection.
+type deadlineWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+	onError func()
+}
+
+// newDeadlineWriter wraps w with write deadlines. It returns w unchanged when
+// timeout is zero or w (ex: behind a middleware wrapper) doesn't support
+// deadlines. Dead clients are then only detected by the request context and
+// the failing writes of the time events.
+func newDeadlineWriter(w http.ResponseWriter, timeout time.Duration, onError func()) io.Writer {
+	if timeout <= 0 {
+		return w
+	}
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		if errors.Is(err, http.ErrNotSupported) {
+			deadlineUnsupported.Do(func() {
+				log.Printf("[SSE] Response writer doesn't support write deadlines, GO_SSE_SIDECAR_WRITE_TIMEOUT is ignored")
+			})
+		} else {
+			log.Printf("[SSE] Failed to clear write deadline: %v", err)
+		}
+		return w
+	}
+	return &deadlineWriter{w: w, rc: rc, timeout: timeout, onError: onError}
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	if err := d.rc.SetWriteDeadline(time.Now().Add(d.timeout)); err != nil {
+		d.onError()
+		return 0, err
+	}
+	n, err := d.w.Write(p)
+	if err != nil {
+		d.onError()
+	}
+	return n, err
+}
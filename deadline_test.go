@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// wrappedWriter is a middleware's response writer: it can flush, but hides
+// the connection, so it has no write deadlines.
+type wrappedWriter struct {
+	http.ResponseWriter
+}
+
+func (w wrappedWriter) Flush() { w.ResponseWriter.(http.Flusher).Flush() }
+
+func TestDeadlineWriterFallsBack(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if out := newDeadlineWriter(rec, time.Second, func() { t.Error("closed") }); out != http.ResponseWriter(rec) {
+		t.Errorf("got %T, want the writer without deadlines as is", out)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := newDeadlineWriter(w, time.Second, func() {}).(*deadlineWriter); !ok {
+			t.Error("no deadlines on the server's own writer")
+		}
+		if _, ok := newDeadlineWriter(w, 0, func() {}).(*deadlineWriter); ok {
+			t.Error("deadlines without GO_SSE_SIDECAR_WRITE_TIMEOUT")
+		}
+	}))
+	defer srv.Close()
+	resp := get(t, srv.URL, nil)
+	resp.Body.Close()
+}
+
+func TestStreamWorksBehindWriterWithoutDeadlines(t *testing.T) {
+	useConfig(t, func(c *Config) { c.WriteTimeout = 50 * time.Millisecond })
+	useRedis(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sseHandler(wrappedWriter{w}, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	s := openStream(t, srv, url.Values{"ssetoken": {token(t, 1461, nil)}})
+	s.nextEvent(t, "connected")
+	rdb.Publish(ctx, "events:user:1461", "first")
+	if ev := s.nextData(t); ev.data != "first" {
+		t.Fatalf("got %+v", ev)
+	}
+	// Well past the write timeout, the connection is still up.
+	time.Sleep(150 * time.Millisecond)
+	rdb.Publish(ctx, "events:user:1461", "second")
+	if ev := s.nextData(t); ev.data != "second" {
+		t.Errorf("got %+v after the write timeout", ev)
+	}
+}
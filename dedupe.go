@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// dedupeFilter drops an event when it is identical to the last event sent on
+// the connection and arrives within the configured window. Unlike coalescing,
+// distinct payloads are never dropped.
+type dedupeFilter struct {
+	window time.Duration
+	key    string
+
+	last   string
+	lastAt time.Time
+	seen   bool
+}
+
+func newDedupeFilter(window time.Duration, key string) *dedupeFilter {
+	if window <= 0 {
+		return nil
+	}
+	return &dedupeFilter{window: window, key: key}
+}
+
+// duplicate reports whether payload should be suppressed and otherwise
+// records it as the last sent event. A nil filter never suppresses.
+func (d *dedupeFilter) duplicate(payload string, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+
+	k := d.compareValue(payload)
+	if d.seen && k == d.last && now.Sub(d.lastAt) < d.window {
+		return true
+	}
+
+	d.last, d.lastAt, d.seen = k, now, true
+	return false
+}
+
+// compareValue returns the configured JSON field of payload, falling back to
+// the full payload when no key is configured or the field is missing.
+func (d *dedupeFilter) compareValue(payload string) string {
+	if d.key == "" {
+		return payload
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return payload
+	}
+	if v, ok := fields[d.key]; ok {
+		return string(v)
+	}
+	return payload
+}
+
+// idFilter drops an event whose id was already sent on the connection, ex:
+// received both from the history backfill and live. Only the last max ids
+// are remembered.
+type idFilter struct {
+	seen *seenSet
+}
+
+func newIDFilter(max int) *idFilter {
+	if max <= 0 || cfg.EventIDField == "" {
+		return nil
+	}
+	return &idFilter{seen: newSeenSet(max)}
+}
+
+// duplicate reports whether payload's id was sent before and otherwise
+// records it. Payloads without an id, and a nil filter, never match.
+func (f *idFilter) duplicate(payload string) bool {
+	if f == nil {
+		return false
+	}
+	id := payloadScalar(payload, cfg.EventIDField)
+	return id != "" && !f.seen.add(id)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupeFilterDropsRepeatsWithinWindow(t *testing.T) {
+	d := newDedupeFilter(time.Second, "")
+	now := time.Now()
+
+	if d.duplicate(`{"n":1}`, now) {
+		t.Fatal("first event suppressed")
+	}
+	if !d.duplicate(`{"n":1}`, now.Add(500*time.Millisecond)) {
+		t.Fatal("identical event within the window delivered")
+	}
+	if d.duplicate(`{"n":2}`, now.Add(600*time.Millisecond)) {
+		t.Fatal("distinct event suppressed")
+	}
+	// Only consecutive duplicates are dropped: n=1 is no longer the last.
+	if d.duplicate(`{"n":1}`, now.Add(700*time.Millisecond)) {
+		t.Fatal("non-consecutive repeat suppressed")
+	}
+	if d.duplicate(`{"n":1}`, now.Add(2*time.Second)) {
+		t.Fatal("repeat after the window suppressed")
+	}
+}
+
+func TestDedupeFilterComparesKeyField(t *testing.T) {
+	d := newDedupeFilter(time.Minute, "state")
+	now := time.Now()
+
+	d.duplicate(`{"state":"busy","at":1}`, now)
+	if !d.duplicate(`{"state":"busy","at":2}`, now) {
+		t.Error("same key field with other fields changed was delivered")
+	}
+	if d.duplicate(`{"state":"idle","at":3}`, now) {
+		t.Error("changed key field suppressed")
+	}
+	// Payloads without the field are compared whole.
+	if d.duplicate("plain", now) || !d.duplicate("plain", now) {
+		t.Error("payload without the key field not compared as a whole")
+	}
+}
+
+func TestDedupeFilterDisabled(t *testing.T) {
+	d := newDedupeFilter(0, "")
+	if d != nil {
+		t.Fatal("filter created without a window")
+	}
+	if d.duplicate("x", time.Now()) || d.duplicate("x", time.Now()) {
+		t.Fatal("nil filter suppressed an event")
+	}
+}
+
+func TestStreamSuppressesConsecutiveDuplicates(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.DedupeWindow = time.Minute })
+	s, _ := connect(t, srv, 7, nil)
+
+	for _, payload := range []string{`{"v":1}`, `{"v":1}`, `{"v":2}`} {
+		mr.Publish("events:user:7", payload)
+	}
+	if ev := s.nextData(t); ev.data != `{"v":1}` {
+		t.Fatalf("first event = %q", ev.data)
+	}
+	if ev := s.nextData(t); ev.data != `{"v":2}` {
+		t.Fatalf("second event = %q, want the duplicate skipped", ev.data)
+	}
+}
+
+func TestIDFilterDropsRepeatedIDs(t *testing.T) {
+	useConfig(t, func(c *Config) { c.EventIDField = "id" })
+	f := newIDFilter(2)
+	for _, tt := range []struct {
+		payload string
+		dup     bool
+	}{
+		{`{"id": "a", "v": 1}`, false},
+		{`{"id": "a", "v": 2}`, true},
+		{`{"id": "b"}`, false},
+		{`{"v": 3}`, false},
+		{`{"v": 3}`, false},
+		// Over 2 ids, the oldest is forgotten.
+		{`{"id": "c"}`, false},
+		{`{"id": "a"}`, false},
+		{`{"id": "c"}`, true},
+	} {
+		if got := f.duplicate(tt.payload); got != tt.dup {
+			t.Errorf("%s: duplicate %v, want %v", tt.payload, got, tt.dup)
+		}
+	}
+	if n := len(f.seen.order); n != 2 {
+		t.Errorf("%d ids remembered, want at most 2", n)
+	}
+}
+
+func TestIDFilterOff(t *testing.T) {
+	useConfig(t, func(c *Config) { c.EventIDField = "id" })
+	if newIDFilter(0) != nil {
+		t.Error("filter without GO_SSE_SIDECAR_DEDUPE_IDS")
+	}
+	useConfig(t, nil)
+	if newIDFilter(10) != nil {
+		t.Error("filter without GO_SSE_SIDECAR_EVENT_ID_FIELD")
+	}
+	var f *idFilter
+	if f.duplicate(`{"id": "a"}`) {
+		t.Error("nil filter matched")
+	}
+}
+
+func TestStreamSendsReplayedIDOnce(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.EventIDField = "id"
+		c.DedupeIDs = 100
+		c.HistoryBackfill = 2
+	})
+	mr.RPush("history:user:1791", `{"id": "e1"}`)
+	mr.RPush("history:user:1791", `{"id": "e2"}`)
+
+	s, _ := connect(t, srv, 1791, nil)
+	// Published again after the replay, with other payloads so the history
+	// handoff doesn't take them for the replayed ones, and a new one.
+	for _, p := range []string{`{"id": "e2", "retry": 1}`, `{"id": "e1", "retry": 1}`, `{"id": "e3"}`} {
+		mr.Publish("events:user:1791", p)
+	}
+	for _, want := range []string{"e1", "e2", "e3"} {
+		if ev := s.nextData(t); ev.id != want {
+			t.Fatalf("got id %q (%s), want %s once each", ev.id, ev.data, want)
+		}
+	}
+}
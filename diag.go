@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// writeDiagComment follows a delivered message with a `: diag` comment, for
+// connections with `diag=1`: its sequence number, channel, time in the queue
+// and the messages still queued behind it. EventSource ignores comments, so
+// they only show in the devtools' view of the stream. The channel is the
+// only value not generated here, its line breaks are removed so the comment
+// can't end early.
+func writeDiagComment(w io.Writer, msg sseMessage, queued int) error {
+	_, err := fmt.Fprintf(w, ": diag seq=%d channel=%s latency_ms=%d queued=%d\n\n",
+		msg.seq, fieldValue(msg.channel), time.Since(msg.enqueued).Milliseconds(), queued)
+	return err
+}
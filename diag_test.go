@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseDiag reads the fields of a `: diag` comment, or nil for another one.
+func parseDiag(comment string) map[string]string {
+	rest, ok := strings.CutPrefix(comment, "diag ")
+	if !ok {
+		return nil
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(rest) {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+	return fields
+}
+
+// nextDiag returns the fields of the next frame, which must be a diag
+// comment and nothing else.
+func (s *sseStream) nextDiag(t *testing.T) map[string]string {
+	t.Helper()
+	ev := s.next(t)
+	// Without data, EventSource dispatches nothing for the frame.
+	if ev.event != "" || ev.data != "" || ev.id != "" || len(ev.comments) != 1 {
+		t.Fatalf("got %+v, want a lone diag comment", ev)
+	}
+	fields := parseDiag(ev.comments[0])
+	if fields == nil {
+		t.Fatalf("comment %q isn't diag", ev.comments[0])
+	}
+	return fields
+}
+
+func TestDiagCommentsFollowEvents(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.Diagnostics = true
+		c.QueueSize = 10
+	})
+	s, conn := connect(t, srv, 2361, url.Values{"diag": {"1"}})
+
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	for _, payload := range []string{"a", "b", "c"} {
+		rdb.Publish(ctx, "events:user:2361", payload)
+	}
+	waitFor(t, "the backlog queued", func() bool { return registry.get(conn).queued() == 3 })
+	time.Sleep(20 * time.Millisecond)
+	delivery.set(false)
+
+	lastSeq := 0
+	for i, want := range []string{"a", "b", "c"} {
+		if ev := s.next(t); ev.data != want {
+			t.Fatalf("got %+v, want %s", ev, want)
+		}
+		diag := s.nextDiag(t)
+		seq, err := strconv.Atoi(diag["seq"])
+		if err != nil || seq <= lastSeq {
+			t.Errorf("seq %q after %d", diag["seq"], lastSeq)
+		}
+		lastSeq = seq
+		if diag["channel"] != "events:user:2361" {
+			t.Errorf("channel %q", diag["channel"])
+		}
+		if latency, err := strconv.Atoi(diag["latency_ms"]); err != nil || latency < 20 {
+			t.Errorf("latency_ms %q for an event held 20ms", diag["latency_ms"])
+		}
+		if queued := diag["queued"]; queued != strconv.Itoa(2-i) {
+			t.Errorf("queued %s behind %s, want %d", queued, want, 2-i)
+		}
+	}
+}
+
+func TestDiagCommentStaysOneLine(t *testing.T) {
+	var b bytes.Buffer
+	writeDiagComment(&b, sseMessage{seq: 7, channel: "rooms:\r\n\nevil", enqueued: time.Now()}, 0)
+	lines := strings.Split(b.String(), "\n")
+	if len(lines) != 3 || lines[1] != "" || lines[2] != "" {
+		t.Fatalf("comment %q isn't a single line", b.String())
+	}
+	if diag := parseDiag(strings.TrimPrefix(lines[0], ": ")); diag["channel"] != "rooms:evil" || diag["seq"] != "7" {
+		t.Errorf("parsed %v", diag)
+	}
+}
+
+func TestDiagOnlyWhenAsked(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.Diagnostics = true })
+	s, _ := connect(t, srv, 2362, nil)
+	rdb.Publish(ctx, "events:user:2362", "one")
+	rdb.Publish(ctx, "events:user:2362", "two")
+	for _, want := range []string{"one", "two"} {
+		if ev := s.next(t); ev.data != want {
+			t.Errorf("got %+v without diag=1, want %s", ev, want)
+		}
+	}
+
+	if status, body := queryStatus(t, srv, "/sse-events", 2362, "&diag=yes"); status != http.StatusBadRequest {
+		t.Errorf("diag=yes: %d %s", status, body)
+	}
+}
+
+func TestDiagRefusedWhileDisabled(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	if status, _ := queryStatus(t, srv, "/sse-events", 2364, "&diag=1"); status != http.StatusBadRequest {
+		t.Errorf("diag=1 while disabled: %d, want 400", status)
+	}
+	useConfig(t, func(c *Config) {
+		c.UnsupportedOptions = parseUnsupportedPolicies("GO_SSE_SIDECAR_UNSUPPORTED_OPTIONS", "diag=downgrade")
+	})
+	s := openStream(t, srv, url.Values{"ssetoken": {token(t, 2364, nil)}, "diag": {"1"}})
+	var data struct {
+		Options    map[string]any `json:"options"`
+		Downgraded []string       `json:"downgraded"`
+	}
+	json.Unmarshal([]byte(s.nextEvent(t, "connected").data), &data)
+	if data.Options["diag"] != false || len(data.Downgraded) != 1 || data.Downgraded[0] != "diag" {
+		t.Errorf("connected %+v, want diag downgraded", data)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type disconnectRequest struct {
+	// Claims must all match a connection's token, with the same rules as
+	// GO_SSE_SIDECAR_REQUIRED_CLAIM (a list claim matches when it contains
+	// the value).
+	Claims map[string]string `json:"claims"`
+}
+
+// matchesClaims reports whether the connection's current token matches
+// every claim of the filter.
+func (c *SSEClient) matchesClaims(filter map[string]string) bool {
+	c.mu.Lock()
+	claims := c.claims
+	c.mu.Unlock()
+
+	for name, value := range filter {
+		if !claims.claimMatches(name, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// disconnectHandler closes the connections of this instance whose token
+// matches a claim filter, ex: `{"claims": {"tenant": "acme"}}`, sending them a
+// reconnect event. It returns how many matched.
+func disconnectHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req disconnectRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	if err != nil || len(req.Claims) == 0 {
+		http.Error(w, "Expected JSON body with a non-empty claims filter", http.StatusBadRequest)
+		return
+	}
+
+	var matched []*SSEClient
+	for _, c := range registry.all() {
+		if c.matchesClaims(req.Claims) {
+			matched = append(matched, c)
+		}
+	}
+	closeSpread(matched, "disconnected")
+
+	filter, _ := json.Marshal(req.Claims)
+	log.Printf("[SSE-SIDECAR] Disconnected %d connections matching %s", len(matched), filter)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"matched": len(matched)})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// adminDisconnect sends a POST /disconnect with the body and returns the
+// recorded response.
+func adminDisconnect(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/disconnect", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	limitBody(disconnectHandler)(rec, r)
+	return rec
+}
+
+func TestDisconnectByClaim(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin-secret")
+	_, srv := newSidecar(t, nil)
+	acme, _ := connect(t, srv, 1411, url.Values{"ssetoken": {token(t, 1411, jwt.MapClaims{"tenant": "acme", "roles": []string{"beta", "staff"}})}})
+	other, _ := connect(t, srv, 1412, url.Values{"ssetoken": {token(t, 1412, jwt.MapClaims{"tenant": "globex", "roles": []string{"beta"}})}})
+
+	tests := []struct {
+		filter  string
+		matched int
+	}{
+		{`{"claims": {"tenant": "initech"}}`, 0},
+		{`{"claims": {"tenant": "acme", "roles": "admin"}}`, 0},
+		// A list claim matches when it has the value.
+		{`{"claims": {"tenant": "acme", "roles": "staff"}}`, 1},
+	}
+	for _, tt := range tests {
+		rec := adminDisconnect(t, tt.filter)
+		var body struct {
+			Matched int `json:"matched"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", tt.filter, err)
+		}
+		if body.Matched != tt.matched {
+			t.Errorf("%s matched %d, want %d", tt.filter, body.Matched, tt.matched)
+		}
+	}
+
+	ev := acme.nextEvent(t, "reconnect")
+	if !strings.Contains(ev.data, `"reason":"disconnected"`) {
+		t.Errorf("reconnect data %s", ev.data)
+	}
+	if !acme.ended(t) {
+		t.Error("matching stream still open")
+	}
+
+	// The other tenant's stream is still live.
+	rdb.Publish(ctx, "events:user:1412", "still here")
+	if ev := other.nextData(t); ev.data != "still here" {
+		t.Errorf("non-matching stream got %+v", ev)
+	}
+}
+
+func TestDisconnectRefusals(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin-secret")
+	useConfig(t, nil)
+	for _, body := range []string{``, `{}`, `{"claims": {}}`, `{"claims": ["tenant"]}`} {
+		if rec := adminDisconnect(t, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: %d, want 400", body, rec.Code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/disconnect", strings.NewReader(`{"claims": {"tenant": "acme"}}`))
+	r.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	disconnectHandler(rec, r)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong admin token: %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// The policies for an enveloped payload without cfg.EventField: the event
+// keeps the name derived from the channel or cfg.DefaultEvent, is dropped,
+// or is delivered as published, without the envelope.
+const (
+	missingEventDefault = "default"
+	missingEventDrop    = "drop"
+	missingEventRaw     = "raw"
+)
+
+// errMissingEventField rejects an enveloped payload without cfg.EventField
+// under the drop policy.
+var errMissingEventField = errors.New("payload has no event field")
+
+// missingEventField reports whether msg would be enveloped without the
+// event name the publisher is expected to set in cfg.EventField. The
+// sidecar's own events are named already.
+func (c *SSEClient) missingEventField(msg sseMessage) bool {
+	if !c.opts.envelope || cfg.EventField == "" || msg.event != "" {
+		return false
+	}
+	if cfg.PresenceChannel != "" && msg.channel == cfg.PresenceChannel {
+		return false
+	}
+	return payloadString(msg.asPublished().payload, cfg.EventField) == ""
+}
+
+// envelopes reports whether msg is still to be enveloped for the client:
+// not with GO_SSE_SIDECAR_MISSING_EVENT_FIELD=raw when it has no event name.
+func (c *SSEClient) envelopes(msg sseMessage) bool {
+	if !c.opts.envelope || msg.enveloped {
+		return false
+	}
+	return !c.missingEventField(msg) || cfg.MissingEventField != missingEventRaw
+}
+
+// envelopeData wraps a payload as `{"channel": ..., "<content type field>":
+// ..., "data": ...}`, with the matching `pattern` for pattern subscriptions
+// and the connection's `metadata` claims. JSON payloads are embedded as-is,
+// anything else as a string, so the client can route rendering on the
+// content type.
+func envelopeData(msg sseMessage, metadata map[string]interface{}) string {
+	data := json.RawMessage(msg.payload)
+	if !json.Valid(data) {
+		data, _ = json.Marshal(msg.payload)
+	}
+
+	fields := map[string]interface{}{
+		"channel":            msg.channel,
+		cfg.ContentTypeField: contentType(msg),
+		"data":               data,
+	}
+	if msg.pattern != "" {
+		fields["pattern"] = msg.pattern
+	}
+	if metadata != nil {
+		fields["metadata"] = metadata
+	}
+	b, _ := json.Marshal(fields)
+	return string(b)
+}
+
+// contentType returns the configured content type of the message's channel,
+// or application/json / text/plain depending on the payload.
+func contentType(msg sseMessage) string {
+	if ct, ok := matchChannel(cfg.ContentTypeMap, msg.channel); ok {
+		return ct
+	}
+	if json.Valid([]byte(msg.payload)) {
+		return "application/json"
+	}
+	return "text/plain"
+}
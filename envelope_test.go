@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestEnvelopeContentTypes(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.ContentTypeMap = parseChannelMap("map", "files:*=application/vnd.file+json")
+	})
+
+	tests := []struct {
+		msg      sseMessage
+		wantType string
+		wantData string
+	}{
+		{sseMessage{channel: "events:user:1", payload: `{"a":1}`}, "application/json", `{"a":1}`},
+		{sseMessage{channel: "events:user:1", payload: "hello"}, "text/plain", `"hello"`},
+		{sseMessage{channel: "files:7", payload: `{"name":"x"}`}, "application/vnd.file+json", `{"name":"x"}`},
+	}
+	for _, tt := range tests {
+		var got map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(envelopeData(tt.msg, nil)), &got); err != nil {
+			t.Fatal(err)
+		}
+		var ct, channel string
+		json.Unmarshal(got["content_type"], &ct)
+		json.Unmarshal(got["channel"], &channel)
+		if ct != tt.wantType || channel != tt.msg.channel || string(got["data"]) != tt.wantData {
+			t.Errorf("envelope of %q = %s", tt.msg.payload, envelopeData(tt.msg, nil))
+		}
+	}
+}
+
+func TestEnvelopeFieldNameAndMetadata(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ContentTypeField = "mime" })
+	data := envelopeData(sseMessage{channel: "c", payload: "1"}, map[string]interface{}{"org": "acme"})
+	want := `{"channel":"c","data":1,"metadata":{"org":"acme"},"mime":"application/json"}`
+	if data != want {
+		t.Errorf("envelope = %s, want %s", data, want)
+	}
+}
+
+func TestStreamEnvelopeFraming(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 7, url.Values{"framing": {"envelope"}})
+
+	mr.Publish("events:user:7", "plain")
+	want := `{"channel":"events:user:7","content_type":"text/plain","data":"plain"}`
+	if ev := s.nextData(t); ev.data != want {
+		t.Errorf("data = %s, want %s", ev.data, want)
+	}
+}
+
+func TestEnvelopeCarriesSourceAndPattern(t *testing.T) {
+	useConfig(t, nil)
+	var got map[string]string
+	json.Unmarshal([]byte(envelopeData(sseMessage{channel: "rooms:7", pattern: "rooms:*", payload: `"hi"`}, nil)), &got)
+	if got["channel"] != "rooms:7" || got["pattern"] != "rooms:*" {
+		t.Errorf("envelope %v, want the published channel and the pattern", got)
+	}
+	got = nil
+	json.Unmarshal([]byte(envelopeData(sseMessage{channel: "rooms:7", payload: `"hi"`}, nil)), &got)
+	if _, ok := got["pattern"]; ok {
+		t.Errorf("envelope %v has a pattern for a plain subscription", got)
+	}
+}
+
+func TestMessagesOfBothSubscriptionTypes(t *testing.T) {
+	useConfig(t, nil)
+	mr := useRedis(t)
+	s := &subscriber{client: &SSEClient{id: "pattern-sub", userID: 1861, namespace: "prod"}}
+	receiveOne := func(sub *redis.PubSub) sseMessage {
+		t.Helper()
+		defer sub.Close()
+		if _, err := sub.Receive(ctx); err != nil {
+			t.Fatal(err)
+		}
+		mr.Publish("prod:rooms:7", "hi")
+		msg, err := sub.ReceiveMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := s.local(msg)
+		return sseMessage{channel: m.Channel, pattern: m.Pattern, payload: m.Payload}
+	}
+
+	// message: the channel subscribed to, no pattern.
+	if msg := receiveOne(rdb.Subscribe(ctx, "prod:rooms:7")); msg.channel != "rooms:7" || msg.pattern != "" {
+		t.Errorf("SUBSCRIBE: channel %q pattern %q", msg.channel, msg.pattern)
+	}
+	// pmessage: the channel published on, and the pattern that matched it,
+	// both without the namespace.
+	if msg := receiveOne(rdb.PSubscribe(ctx, "prod:rooms:*")); msg.channel != "rooms:7" || msg.pattern != "rooms:*" {
+		t.Errorf("PSUBSCRIBE: channel %q pattern %q", msg.channel, msg.pattern)
+	}
+}
+
+func TestStreamEnvelopeNamesPublishedChannel(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 1862, url.Values{"framing": {"envelope"}})
+	mr.Publish("events:user:1862", `{"n":1}`)
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s.nextData(t).data), &got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got["channel"]) != `"events:user:1862"` {
+		t.Errorf("channel %s, want the one published on", got["channel"])
+	}
+	if _, ok := got["pattern"]; ok {
+		t.Error("pattern in the envelope of a plain subscription")
+	}
+}
+
+func TestMissingEventFieldPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		// want is the event written for the payload without a type, none
+		// when dropped.
+		want *sseEvent
+	}{
+		{missingEventDefault, &sseEvent{event: "update", data: `{"channel":"events:user:2231","content_type":"application/json","data":{"text":"no type"}}`}},
+		{missingEventDrop, nil},
+		{missingEventRaw, &sseEvent{event: "update", data: `{"text": "no type"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			_, srv := newSidecar(t, func(c *Config) {
+				c.EventField = "type"
+				c.DefaultEvent = "update"
+				c.MissingEventField = tt.policy
+				c.DeadLetterChannel = "deadletters"
+			})
+			records := subscribeTo(t, "deadletters")
+			startDeadLetters(t)
+			dropped := metrics.dropped.Load()
+			s, _ := connect(t, srv, 2231, url.Values{"framing": {"envelope"}})
+
+			rdb.Publish(ctx, "events:user:2231", `{"text": "no type"}`)
+			rdb.Publish(ctx, "events:user:2231", `{"type": "typed", "text": "next"}`)
+			if tt.want != nil {
+				if ev := s.nextData(t); ev.event != tt.want.event || ev.data != tt.want.data {
+					t.Errorf("event %q data %s, want %q %s", ev.event, ev.data, tt.want.event, tt.want.data)
+				}
+			}
+			// The payload with its type is enveloped under every policy.
+			ev := s.nextData(t)
+			if want := `{"channel":"events:user:2231","content_type":"application/json","data":{"type":"typed","text":"next"}}`; ev.event != "typed" || ev.data != want {
+				t.Errorf("typed payload written as %q %s", ev.event, ev.data)
+			}
+
+			if tt.want != nil {
+				return
+			}
+			if n := metrics.dropped.Load() - dropped; n != 1 {
+				t.Errorf("%d dropped, want 1", n)
+			}
+			if r := decodeDeadLetter(t, receive(t, records)); r.Reason != "missing_event" || r.Payload != `{"text": "no type"}` {
+				t.Errorf("dead letter %+v", r)
+			}
+		})
+	}
+}
+
+func TestMissingEventFieldOnlyForEnvelopes(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.EventField = "type"
+		c.MissingEventField = missingEventDrop
+		c.PresenceChannel = "presence"
+	})
+	untyped := `{"text": "no type"}`
+	for _, tt := range []struct {
+		name string
+		c    *SSEClient
+		msg  sseMessage
+	}{
+		{"not enveloped", &SSEClient{}, sseMessage{channel: "c", payload: untyped}},
+		{"sidecar event", &SSEClient{opts: connOptions{envelope: true}}, sseMessage{channel: "c", event: "catchup", payload: untyped}},
+		{"presence", &SSEClient{opts: connOptions{envelope: true}}, sseMessage{channel: "presence", payload: untyped}},
+	} {
+		if tt.c.missingEventField(tt.msg) {
+			t.Errorf("%s: taken for a missing event field", tt.name)
+		}
+		if err := tt.c.writeMessage(io.Discard, tt.msg); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+	c := &SSEClient{opts: connOptions{envelope: true}}
+	if err := c.writeMessage(io.Discard, sseMessage{channel: "c", payload: untyped}); !errors.Is(err, errMissingEventField) {
+		t.Errorf("err = %v, want errMissingEventField", err)
+	}
+}
+
+func TestEventClaimsInDeliveredEvents(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) {
+		c.EventClaims = []string{"session_id", "tenant"}
+		c.PollTimeout = 100 * time.Millisecond
+	})
+	claims := jwt.MapClaims{"session_id": "s-42", "tenant": "acme", "email": "a@example.com"}
+	enveloped, _ := connect(t, srv, 2261, url.Values{"framing": {"envelope"}, "ssetoken": {token(t, 2261, claims)}})
+	raw, _ := connect(t, srv, 2261, url.Values{"ssetoken": {token(t, 2261, claims)}})
+	// Only the claims in the token are added.
+	partial, _ := connect(t, srv, 2261, url.Values{"framing": {"envelope"}, "ssetoken": {token(t, 2261, jwt.MapClaims{"tenant": "acme"})}})
+	none, _ := connect(t, srv, 2261, url.Values{"framing": {"envelope"}})
+	pollEvents := func(q url.Values) ([]pollEvent, string) {
+		resp := get(t, srv.URL+"/poll?"+q.Encode(), nil)
+		defer resp.Body.Close()
+		var events []pollEvent
+		json.NewDecoder(resp.Body).Decode(&events)
+		return events, resp.Header.Get("X-Poll-Cursor")
+	}
+	q := url.Values{"ssetoken": {token(t, 2262, claims)}}
+	_, cursor := pollEvents(q)
+
+	rdb.Publish(ctx, "events:user:2261", `{"n":1}`)
+	rdb.Publish(ctx, "events:user:2262", `{"n":1}`)
+	for _, tt := range []struct {
+		name string
+		s    *sseStream
+		want string
+	}{
+		{"enveloped", enveloped, `{"channel":"events:user:2261","content_type":"application/json","data":{"n":1},"metadata":{"session_id":"s-42","tenant":"acme"}}`},
+		{"raw", raw, `{"n":1}`},
+		{"partial", partial, `{"channel":"events:user:2261","content_type":"application/json","data":{"n":1},"metadata":{"tenant":"acme"}}`},
+		{"none", none, `{"channel":"events:user:2261","content_type":"application/json","data":{"n":1}}`},
+	} {
+		if ev := tt.s.nextData(t); ev.data != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, ev.data, tt.want)
+		}
+	}
+
+	q.Set("cursor", cursor)
+	events, _ := pollEvents(q)
+	if len(events) != 1 || !reflect.DeepEqual(events[0].Metadata, map[string]interface{}{"session_id": "s-42", "tenant": "acme"}) {
+		t.Errorf("poll events %+v, want the claims as metadata", events)
+	}
+}
+
+func TestNoEventClaimsByDefault(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MetadataClaims = []string{"tenant"} })
+	claims := &SSETokenClaims{raw: map[string]interface{}{"tenant": "acme"}}
+	if m := eventMetadata(claims); m != nil {
+		t.Errorf("event metadata %v without GO_SSE_SIDECAR_EVENT_CLAIMS", m)
+	}
+	if m := connectionMetadata(claims); m["tenant"] != "acme" {
+		t.Errorf("connection metadata %v", m)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// channelRule maps a Redis channel (or, with a trailing `*`, any channel
+// with that prefix) to a value, ex: an SSE event name.
+type channelRule struct {
+	pattern string
+	prefix  bool
+	value   string
+}
+
+// parseChannelMap parses `pattern=value` pairs separated by commas, ex:
+// `events:user:*=user,events:broadcast=broadcast`.
+func parseChannelMap(name, v string) []channelRule {
+	var rules []channelRule
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(entry, "=")
+		if !ok || pattern == "" || value == "" {
+			log.Fatalf("Invalid %s entry %q, expected pattern=value", name, entry)
+		}
+		rule := channelRule{pattern: pattern, value: value}
+		if strings.HasSuffix(pattern, "*") {
+			rule.pattern, rule.prefix = strings.TrimSuffix(pattern, "*"), true
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matchChannel returns the value of the first rule matching channel.
+func matchChannel(rules []channelRule, channel string) (string, bool) {
+	for _, rule := range rules {
+		if channel == rule.pattern || (rule.prefix && strings.HasPrefix(channel, rule.pattern)) {
+			return rule.value, true
+		}
+	}
+	return "", false
+}
+
+// channelEventName returns the SSE event name for messages from channel, or
+// "" (an anonymous event) when channel event names are disabled. The first
+// matching mapping rule wins, otherwise the configured prefix is stripped.
+func channelEventName(channel string) string {
+	if !cfg.ChannelEventNames {
+		return ""
+	}
+	return mappedChannelName(channel)
+}
+
+// mappedChannelName applies the channel event map and prefix to channel.
+func mappedChannelName(channel string) string {
+	if name, ok := matchChannel(cfg.ChannelEventMap, channel); ok {
+		return name
+	}
+	return strings.TrimPrefix(channel, cfg.ChannelEventPrefix)
+}
+
+// eventName returns the SSE event name for msg: the payload's event field
+// when configured and present, then the name derived from the channel, then
+// the configured default. "" sends an anonymous event.
+func eventName(msg sseMessage) string {
+	if cfg.EventField != "" {
+		if name := payloadString(msg.payload, cfg.EventField); name != "" {
+			return name
+		}
+	}
+	if name := channelEventName(msg.channel); name != "" {
+		return name
+	}
+	return cfg.DefaultEvent
+}
+
+// payloadScalar returns a string or number field of a JSON object payload,
+// or "" when there is none.
+func payloadScalar(payload, field string) string {
+	if v := payloadString(payload, field); v != "" {
+		return v
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return ""
+	}
+	var n json.Number
+	if err := json.Unmarshal(fields[field], &n); err != nil {
+		return ""
+	}
+	return n.String()
+}
+
+// payloadString returns the string field of a JSON object payload, or "" when
+// the payload isn't a JSON object or the field isn't a string.
+func payloadString(payload, field string) string {
+	if !strings.HasPrefix(strings.TrimSpace(payload), "{") {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return ""
+	}
+	var v string
+	if err := json.Unmarshal(fields[field], &v); err != nil {
+		return ""
+	}
+	return v
+}
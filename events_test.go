@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestChannelEventName(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.ChannelEventNames = true
+		c.ChannelEventPrefix = "events:"
+		c.ChannelEventMap = parseChannelMap("map", "events:user:*=user, orders=order_update")
+	})
+
+	tests := []struct {
+		channel, want string
+	}{
+		{"events:user:7", "user"},
+		{"orders", "order_update"},
+		{"events:billing", "billing"},
+		{"other", "other"},
+	}
+	for _, tt := range tests {
+		if got := channelEventName(tt.channel); got != tt.want {
+			t.Errorf("channelEventName(%q) = %q, want %q", tt.channel, got, tt.want)
+		}
+	}
+}
+
+func TestChannelEventNameDisabled(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ChannelEventPrefix = "events:" })
+	if got := channelEventName("events:user:7"); got != "" {
+		t.Errorf("channelEventName = %q without GO_SSE_SIDECAR_CHANNEL_EVENT_NAMES", got)
+	}
+}
+
+func TestStreamNamesEventsAfterChannel(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.ChannelEventNames = true
+		c.ChannelEventMap = parseChannelMap("map", "events:user:*=notification")
+	})
+	s, _ := connect(t, srv, 7, nil)
+
+	mr.Publish("events:user:7", `{"n":1}`)
+	ev := s.nextData(t)
+	if ev.event != "notification" || ev.data != `{"n":1}` {
+		t.Errorf("got event %q data %q", ev.event, ev.data)
+	}
+}
+
+func TestEventNameFallsBackToDefault(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.EventField = "event_type"
+		c.DefaultEvent = "update"
+	})
+
+	tests := []struct {
+		payload, want string
+	}{
+		{`{"event_type": "order_paid", "id": 1}`, "order_paid"},
+		{`{"id": 1}`, "update"},
+		{`{"event_type": 42}`, "update"},
+		{`not json`, "update"},
+		{`["event_type"]`, "update"},
+	}
+	for _, tt := range tests {
+		if got := eventName(sseMessage{channel: "events:user:1", payload: tt.payload}); got != tt.want {
+			t.Errorf("eventName(%s) = %q, want %q", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestStreamUsesDefaultEventName(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.EventField = "type"
+		c.DefaultEvent = "message_default"
+	})
+	s, _ := connect(t, srv, 7, nil)
+
+	mr.Publish("events:user:7", `{"type": "named"}`)
+	mr.Publish("events:user:7", `{"other": true}`)
+	if ev := s.nextData(t); ev.event != "named" {
+		t.Errorf("event with a name field sent as %q", ev.event)
+	}
+	if ev := s.nextData(t); ev.event != "message_default" {
+		t.Errorf("event without a name field sent as %q", ev.event)
+	}
+}
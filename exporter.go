@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// exporterWarnInterval limits the exporter failure warnings in the log.
+const exporterWarnInterval = time.Minute
+
+// exporterHealth tracks whether the metrics exporter reaches its backend.
+// With cfg.MetricsStrict a failing exporter shows up as degraded in /healthz
+// and /status; connections are never affected.
+var exporterHealth struct {
+	mu       sync.Mutex
+	err      error
+	since    time.Time
+	lastWarn time.Time
+}
+
+// recordExport records the outcome of an export, nil for success.
+func recordExport(name string, err error) {
+	exporterHealth.mu.Lock()
+	defer exporterHealth.mu.Unlock()
+	if err == nil {
+		if exporterHealth.err != nil {
+			log.Printf("[METRICS] %s export recovered after %v", name, time.Since(exporterHealth.since).Round(time.Second))
+		}
+		exporterHealth.err = nil
+		return
+	}
+	now := time.Now()
+	if exporterHealth.err == nil {
+		exporterHealth.since = now
+	}
+	exporterHealth.err = err
+	if now.Sub(exporterHealth.lastWarn) >= exporterWarnInterval {
+		exporterHealth.lastWarn = now
+		log.Printf("[METRICS] %s export failing since %v: %v", name, exporterHealth.since.Format(time.RFC3339), err)
+	}
+}
+
+// exporterError returns the current export failure, or nil. It's always nil
+// unless cfg.MetricsStrict is set.
+func exporterError() error {
+	if !cfg.MetricsStrict {
+		return nil
+	}
+	exporterHealth.mu.Lock()
+	defer exporterHealth.mu.Unlock()
+	return exporterHealth.err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetExporterHealth forgets the export failures of the test.
+func resetExporterHealth(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		exporterHealth.mu.Lock()
+		defer exporterHealth.mu.Unlock()
+		exporterHealth.err, exporterHealth.lastWarn = nil, time.Time{}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func healthz(t *testing.T) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestUnreachableExporterDegradesHealth(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MetricsStrict = true })
+	useRedis(t)
+	resetExporterHealth(t)
+
+	stop, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The port can't be dialed, every push fails.
+		runStatsD(stop, "127.0.0.1:no-port", "test.", 10*time.Millisecond)
+	}()
+	waitFor(t, "the failing export", func() bool { return exporterError() != nil })
+	cancel()
+	<-done
+
+	code, body := healthz(t)
+	if code != http.StatusOK || !strings.HasPrefix(body, "degraded: metrics exporter: ") {
+		t.Errorf("healthz %d %q, want 200 with the exporter degraded", code, body)
+	}
+	if code, resp := getStatus(t); code != http.StatusOK || resp.Status != "degraded" || resp.MetricsExporter == "" {
+		t.Errorf("status %d %+v, want degraded with the exporter error", code, resp)
+	}
+
+	recordExport("StatsD", nil)
+	if _, body := healthz(t); body != "ok" {
+		t.Errorf("healthz %q after the export recovered", body)
+	}
+}
+
+func TestExporterFailureIgnoredByDefault(t *testing.T) {
+	useConfig(t, nil)
+	useRedis(t)
+	resetExporterHealth(t)
+
+	recordExport("StatsD", errors.New("connection refused"))
+	if _, body := healthz(t); body != "ok" {
+		t.Errorf("healthz %q without GO_SSE_SIDECAR_METRICS_STRICT", body)
+	}
+	if _, resp := getStatus(t); resp.Status != "ok" || resp.MetricsExporter != "" {
+		t.Errorf("status %+v without GO_SSE_SIDECAR_METRICS_STRICT", resp)
+	}
+}
+
+func TestExporterWarningsRateLimited(t *testing.T) {
+	useConfig(t, nil)
+	resetExporterHealth(t)
+	var logs lockedBuffer
+	old := log.Writer()
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(old) })
+
+	for i := 0; i < 5; i++ {
+		recordExport("StatsD", errors.New("connection refused"))
+	}
+	if n := strings.Count(logs.String(), "StatsD export failing"); n != 1 {
+		t.Errorf("%d warnings for 5 failed exports within a minute", n)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisFailover dials the Redis endpoints of GO_SSE_SIDECAR_REDIS_URLS in
+// order of preference. New connections go to the endpoint in use until it
+// can't be reached, then to the first of the others that can. The preferred
+// endpoints are probed every cfg.RedisProbeInterval, and once one is back the
+// connections to the fallback are closed: go-redis reopens them, and
+// subscriptions resubscribe, on the preferred endpoint.
+type redisFailover struct {
+	endpoints []*redis.Options
+
+	mu     sync.Mutex
+	active int
+	conns  map[*failoverConn]struct{}
+}
+
+// failover is nil unless GO_SSE_SIDECAR_REDIS_URLS is set.
+var failover *redisFailover
+
+func newRedisFailover(urls []string) *redisFailover {
+	f := &redisFailover{conns: make(map[*failoverConn]struct{})}
+	for _, url := range urls {
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			log.Fatalf("Failed to parse Redis URL in GO_SSE_SIDECAR_REDIS_URLS: %v", err)
+		}
+		if opts.DialTimeout == 0 {
+			// The default of go-redis, which only applies to its own dialer.
+			opts.DialTimeout = 5 * time.Second
+		}
+		f.endpoints = append(f.endpoints, opts)
+	}
+	return f
+}
+
+// options returns the client options: those of the first URL (credentials,
+// database, timeouts), dialing through the failover.
+func (f *redisFailover) options() *redis.Options {
+	opts := *f.endpoints[0]
+	opts.Dialer = f.dial
+	return &opts
+}
+
+// current returns the address of the endpoint in use.
+func (f *redisFailover) current() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.endpoints[f.active].Addr
+}
+
+// dial connects to the endpoint in use, or fails over to the first other
+// endpoint reachable.
+func (f *redisFailover) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	f.mu.Lock()
+	start := f.active
+	f.mu.Unlock()
+
+	order := []int{start}
+	for i := range f.endpoints {
+		if i != start {
+			order = append(order, i)
+		}
+	}
+	var err error
+	for _, i := range order {
+		var conn net.Conn
+		if conn, err = dialEndpoint(ctx, f.endpoints[i]); err == nil {
+			return f.track(conn, i), nil
+		}
+		log.Printf("[SSE-SIDECAR] Redis endpoint %s unreachable: %v", f.endpoints[i].Addr, err)
+	}
+	return nil, err
+}
+
+func dialEndpoint(ctx context.Context, opts *redis.Options) (net.Conn, error) {
+	return redis.NewDialer(opts)(ctx, opts.Network, opts.Addr)
+}
+
+// track records a connection to endpoint i, which becomes the one in use.
+func (f *redisFailover) track(conn net.Conn, i int) net.Conn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i != f.active {
+		log.Printf("[SSE-SIDECAR] Failing over from Redis %s to %s", f.endpoints[f.active].Addr, f.endpoints[i].Addr)
+		metrics.redisFailovers.Add(1)
+		f.active = i
+	}
+	c := &failoverConn{Conn: conn, f: f, endpoint: i}
+	f.conns[c] = struct{}{}
+	return c
+}
+
+// runFailback probes the endpoints preferred over the one in use, and moves
+// back to the first one answering PING with base's credentials.
+func (f *redisFailover) runFailback(base *redis.Client) {
+	ticker := time.NewTicker(cfg.RedisProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.mu.Lock()
+		active := f.active
+		f.mu.Unlock()
+		for i := 0; i < active; i++ {
+			if f.probe(base, i) == nil {
+				f.failBack(i)
+				break
+			}
+		}
+	}
+}
+
+func (f *redisFailover) probe(base *redis.Client, i int) error {
+	opts := *base.Options()
+	opts.Dialer = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialEndpoint(ctx, f.endpoints[i])
+	}
+	opts.MaxRetries = -1
+	c := redis.NewClient(&opts)
+	defer c.Close()
+	pctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return c.Ping(pctx).Err()
+}
+
+// failBack makes endpoint i the one in use and closes the connections to the
+// others.
+func (f *redisFailover) failBack(i int) {
+	f.mu.Lock()
+	from := f.endpoints[f.active].Addr
+	f.active = i
+	var stale []*failoverConn
+	for c := range f.conns {
+		if c.endpoint != i {
+			stale = append(stale, c)
+		}
+	}
+	f.mu.Unlock()
+
+	log.Printf("[SSE-SIDECAR] Redis %s is back, failing back from %s (%d connections)", f.endpoints[i].Addr, from, len(stale))
+	metrics.redisFailovers.Add(1)
+	for _, c := range stale {
+		c.Close()
+	}
+}
+
+// failoverConn is a connection to one of the endpoints, forgotten once
+// closed.
+type failoverConn struct {
+	net.Conn
+	f        *redisFailover
+	endpoint int
+	once     sync.Once
+}
+
+func (c *failoverConn) Close() error {
+	c.once.Do(func() {
+		c.f.mu.Lock()
+		delete(c.f.conns, c)
+		c.f.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
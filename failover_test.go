@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// failoverClient returns a client failing over from primary to secondary.
+func failoverClient(t *testing.T, primary, secondary *miniredis.Miniredis) (*redisFailover, *redis.Client) {
+	t.Helper()
+	f := newRedisFailover([]string{"redis://" + primary.Addr(), "redis://" + secondary.Addr()})
+	c := redis.NewClient(f.options())
+	t.Cleanup(func() { c.Close() })
+	return f, c
+}
+
+// subscribeThrough subscribes to channel with c, and returns the payloads
+// received on it. go-redis resubscribes in the background.
+func subscribeThrough(t *testing.T, c *redis.Client, channel string) <-chan string {
+	t.Helper()
+	sub := c.Subscribe(ctx, channel)
+	t.Cleanup(func() { sub.Close() })
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	payloads := make(chan string, 10)
+	go func() {
+		for msg := range sub.Channel() {
+			payloads <- msg.Payload
+		}
+	}()
+	return payloads
+}
+
+func TestRedisFailoverToSecondary(t *testing.T) {
+	useConfig(t, nil)
+	primary, secondary := miniredis.RunT(t), miniredis.RunT(t)
+	f, c := failoverClient(t, primary, secondary)
+	if err := c.Set(ctx, "k", "primary", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := primary.Get("k"); v != "primary" || f.current() != primary.Addr() {
+		t.Fatalf("written to %s, want the primary first", f.current())
+	}
+	payloads := subscribeThrough(t, c, "events:user:1811")
+
+	failovers := metrics.redisFailovers.Load()
+	primary.Close()
+	// The first command after the failure may still hit the closed
+	// connection, go-redis retries it on a new one.
+	if err := c.Set(ctx, "k", "secondary", 0).Err(); err != nil {
+		t.Fatalf("command after the primary failed: %v", err)
+	}
+	if v, _ := secondary.Get("k"); v != "secondary" || f.current() != secondary.Addr() {
+		t.Errorf("written to %s, want the secondary", f.current())
+	}
+	if n := metrics.redisFailovers.Load() - failovers; n != 1 {
+		t.Errorf("%d failovers counted", n)
+	}
+
+	// The subscription comes back on the secondary.
+	waitFor(t, "the resubscribe", func() bool { return secondary.PubSubNumSub("events:user:1811")["events:user:1811"] == 1 })
+	secondary.Publish("events:user:1811", "after failover")
+	if got := receive(t, payloads); got != "after failover" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRedisFailbackToPrimary(t *testing.T) {
+	useConfig(t, nil)
+	primary, secondary := miniredis.RunT(t), miniredis.RunT(t)
+	f, c := failoverClient(t, primary, secondary)
+	primary.Close()
+	payloads := subscribeThrough(t, c, "events:user:1812")
+	if f.current() != secondary.Addr() {
+		t.Fatalf("on %s with the primary down", f.current())
+	}
+
+	if f.probe(c, 0) == nil {
+		t.Fatal("probe of the closed primary succeeded")
+	}
+	if err := primary.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.probe(c, 0); err != nil {
+		t.Fatalf("probe of the restarted primary: %v", err)
+	}
+	f.failBack(0)
+	if f.current() != primary.Addr() {
+		t.Errorf("on %s after the failback", f.current())
+	}
+	// The connections to the secondary were closed, the subscription moves.
+	waitFor(t, "the resubscribe", func() bool { return primary.PubSubNumSub("events:user:1812")["events:user:1812"] == 1 })
+	primary.Publish("events:user:1812", "back on primary")
+	if got := receive(t, payloads); got != "back on primary" {
+		t.Errorf("got %q", got)
+	}
+	if err := c.Set(ctx, "k", "v", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := primary.Get("k"); v != "v" {
+		t.Error("command not sent to the primary")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+// fairQueue holds messages taken off a connection's queue to write them
+// round robin across their channels, so a burst on one channel doesn't hold
+// back the others. The messages of a channel keep their order. Without
+// cfg.FairInterleave it only coalesces, and all messages share one turn.
+type fairQueue struct {
+	max    int
+	byChan map[string][]*sseMessage
+	// turns are the channels with messages, the next one to write first.
+	turns []string
+	n     int
+	// keyed are the messages held by channel and cfg.CoalesceKey value: a
+	// newer message with the same key replaces the one held, in its place.
+	keyed map[string]*sseMessage
+	// coalesceAll also coalesces the messages without a key, by channel,
+	// once the connection is downgraded for slow flushes.
+	coalesceAll bool
+}
+
+// alwaysReady is a closed channel, ready in every select.
+var alwaysReady = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// newFairQueue returns nil unless cfg.FairInterleave, cfg.CoalesceKey or
+// cfg.SlowFlushThreshold is set.
+func newFairQueue(max int) *fairQueue {
+	if !cfg.FairInterleave && cfg.CoalesceKey == "" && cfg.SlowFlushThreshold == 0 {
+		return nil
+	}
+	return &fairQueue{max: max, byChan: make(map[string][]*sseMessage), keyed: make(map[string]*sseMessage)}
+}
+
+func (q *fairQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	return q.n
+}
+
+// coalesceKey returns the key msg is coalesced by, empty for none. The
+// sidecar's own events aren't coalesced.
+func (q *fairQueue) coalesceKey(msg sseMessage) string {
+	if msg.event != "" {
+		return ""
+	}
+	if cfg.CoalesceKey != "" {
+		if v := payloadScalar(msg.payload, cfg.CoalesceKey); v != "" {
+			return msg.channel + "\x00" + v
+		}
+	}
+	if q.coalesceAll {
+		return msg.channel + "\x01"
+	}
+	return ""
+}
+
+func (q *fairQueue) push(msg sseMessage) {
+	key := q.coalesceKey(msg)
+	if held, ok := q.keyed[key]; ok {
+		metrics.coalesced.Add(1)
+		*held = msg
+		return
+	}
+	turn := ""
+	if cfg.FairInterleave {
+		turn = msg.channel
+	}
+	if len(q.byChan[turn]) == 0 {
+		q.turns = append(q.turns, turn)
+	}
+	p := &msg
+	q.byChan[turn] = append(q.byChan[turn], p)
+	if key != "" {
+		q.keyed[key] = p
+	}
+	q.n++
+}
+
+// fill adds first and takes more messages from queue without blocking,
+// while there is room. Coalesced messages take no room, so it stops after
+// max messages taken in any case.
+func (q *fairQueue) fill(first sseMessage, queue chan sseMessage) {
+	q.push(first)
+	for taken := 0; q.n < q.max && taken < q.max; taken++ {
+		select {
+		case msg := <-queue:
+			q.push(msg)
+		default:
+			return
+		}
+	}
+}
+
+// pop returns the oldest message of the channel whose turn it is.
+func (q *fairQueue) pop() (sseMessage, bool) {
+	if q.len() == 0 {
+		return sseMessage{}, false
+	}
+	ch := q.turns[0]
+	msgs := q.byChan[ch]
+	msg := *msgs[0]
+	if key := q.coalesceKey(msg); q.keyed[key] == msgs[0] {
+		delete(q.keyed, key)
+	}
+	q.turns = q.turns[1:]
+	if len(msgs) > 1 {
+		q.byChan[ch] = msgs[1:]
+		q.turns = append(q.turns, ch)
+	} else {
+		delete(q.byChan, ch)
+	}
+	q.n--
+	return msg, true
+}
+
+// deadLetter drops the messages still held when the connection closes.
+func (q *fairQueue) deadLetter(c *SSEClient) {
+	for msg, ok := q.pop(); ok; msg, ok = q.pop() {
+		deadLetters.add(c, msg, "disconnected")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func popAll(q *fairQueue) []string {
+	var got []string
+	for msg, ok := q.pop(); ok; msg, ok = q.pop() {
+		got = append(got, msg.payload)
+	}
+	return got
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	useConfig(t, func(c *Config) { c.FairInterleave = true })
+	q := newFairQueue(10)
+	for _, m := range []struct{ channel, payload string }{
+		{"a", "a1"}, {"a", "a2"}, {"a", "a3"}, {"b", "b1"}, {"c", "c1"}, {"b", "b2"},
+	} {
+		q.push(sseMessage{channel: m.channel, payload: m.payload})
+	}
+	// One per channel in turn, each channel in its own order.
+	if got, want := popAll(q), []string{"a1", "b1", "c1", "a2", "b2", "a3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written %v, want %v", got, want)
+	}
+}
+
+func TestFairQueueKeepsArrivalOrderWithoutInterleave(t *testing.T) {
+	// Coalescing alone holds messages too, in one turn.
+	useConfig(t, func(c *Config) { c.CoalesceKey = "key" })
+	q := newFairQueue(10)
+	for _, m := range []struct{ channel, payload string }{{"a", "a1"}, {"a", "a2"}, {"b", "b1"}, {"a", "a3"}} {
+		q.push(sseMessage{channel: m.channel, payload: m.payload})
+	}
+	if got, want := popAll(q), []string{"a1", "a2", "b1", "a3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written %v, want %v", got, want)
+	}
+	useConfig(t, nil)
+	if newFairQueue(10) != nil {
+		t.Error("messages held by default")
+	}
+}
+
+func TestPerChannelOrderUnderConcurrentPublishes(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.FairInterleave = true
+		c.BroadcastChannel = "broadcast"
+		// Room for every message, the test is about order not drops.
+		c.QueueSize = 200
+	})
+	s, _ := connect(t, srv, 2051, nil)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for _, channel := range []string{"events:user:2051", "broadcast"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				rdb.Publish(ctx, channel, fmt.Sprintf("%s %d", channel, i))
+			}
+		}()
+	}
+	wg.Wait()
+
+	next := map[string]int{}
+	for i := 0; i < 2*n; i++ {
+		ev := s.nextData(t)
+		channel, seq, _ := strings.Cut(ev.data, " ")
+		if got, _ := strconv.Atoi(seq); got != next[channel] {
+			t.Fatalf("%s: got %d, want %d", channel, got, next[channel])
+		}
+		next[channel]++
+	}
+}
+
+func TestCoalesceKeepsLatestPerKey(t *testing.T) {
+	useConfig(t, func(c *Config) { c.CoalesceKey = "game" })
+	coalesced := metrics.coalesced.Load()
+	q := newFairQueue(20)
+	for _, m := range []struct{ channel, payload string }{
+		{"scores", `{"game": "g1", "score": "0-0"}`},
+		{"scores", `{"game": "g2", "score": "0-0"}`},
+		{"scores", `{"game": "g1", "score": "1-0"}`},
+		{"scores", `{"note": "half time"}`},
+		{"scores", `{"game": 3, "score": "0-0"}`},
+		{"scores", `{"game": "g2", "score": "0-1"}`},
+		{"scores", `{"note": "full time"}`},
+		{"scores", `{"game": "g1", "score": "2-0"}`},
+		{"scores", `{"game": 3, "score": "1-1"}`},
+		// Same key on another channel: not the same entity.
+		{"replays", `{"game": "g1", "score": "0-0"}`},
+	} {
+		q.push(sseMessage{channel: m.channel, payload: m.payload})
+	}
+	// The newest per key, where its first one was; unkeyed messages all kept.
+	want := []string{
+		`{"game": "g1", "score": "2-0"}`,
+		`{"game": "g2", "score": "0-1"}`,
+		`{"note": "half time"}`,
+		`{"game": 3, "score": "1-1"}`,
+		`{"note": "full time"}`,
+		`{"game": "g1", "score": "0-0"}`,
+	}
+	if got := popAll(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("written\n%q\nwant\n%q", got, want)
+	}
+	if n := metrics.coalesced.Load() - coalesced; n != 4 {
+		t.Errorf("%d coalesced, want 4", n)
+	}
+
+	// Once written, a key starts over.
+	q.push(sseMessage{channel: "scores", payload: `{"game": "g1", "score": "3-0"}`})
+	if got := popAll(q); !reflect.DeepEqual(got, []string{`{"game": "g1", "score": "3-0"}`}) {
+		t.Errorf("after the backlog: %q", got)
+	}
+}
+
+func TestCoalesceWithInterleave(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.CoalesceKey = "id"
+		c.FairInterleave = true
+	})
+	q := newFairQueue(20)
+	for _, m := range []struct{ channel, payload string }{
+		{"a", `{"id": 1, "v": 1}`}, {"a", `{"id": 1, "v": 2}`}, {"a", `{"id": 2, "v": 1}`},
+		{"b", `{"id": 1, "v": 1}`}, {"a", `{"id": 1, "v": 3}`}, {"b", `{"id": 1, "v": 2}`},
+	} {
+		q.push(sseMessage{channel: m.channel, payload: m.payload})
+	}
+	want := []string{`{"id": 1, "v": 3}`, `{"id": 1, "v": 2}`, `{"id": 2, "v": 1}`}
+	if got := popAll(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("written %q, want %q", got, want)
+	}
+}
+
+func TestCoalesceFillBounded(t *testing.T) {
+	useConfig(t, func(c *Config) { c.CoalesceKey = "k" })
+	queue := make(chan sseMessage, 10)
+	for i := 0; i < 10; i++ {
+		queue <- sseMessage{channel: "c", payload: fmt.Sprintf(`{"k": "same", "n": %d}`, i)}
+	}
+	q := newFairQueue(4)
+	q.fill(sseMessage{channel: "c", payload: `{"k": "same", "n": -1}`}, queue)
+	// Coalesced messages take no room, but fill stops after max taken.
+	if q.len() != 1 || len(queue) != 6 {
+		t.Errorf("%d held and %d left queued, want 1 and 6", q.len(), len(queue))
+	}
+	if got := popAll(q); !reflect.DeepEqual(got, []string{`{"k": "same", "n": 3}`}) {
+		t.Errorf("written %q", got)
+	}
+}
+
+func TestSlowClientGetsLatestPerKey(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.CoalesceKey = "game"
+		c.QueueSize = 20
+	})
+	s, conn := connect(t, srv, 2211, nil)
+
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	for i := 0; i < 4; i++ {
+		for _, game := range []string{"g1", "g2", "g3"} {
+			rdb.Publish(ctx, "events:user:2211", fmt.Sprintf(`{"game": %q, "n": %d}`, game, i))
+		}
+	}
+	waitFor(t, "the burst queued", func() bool { return registry.get(conn).queued() == 12 })
+
+	delivery.set(false)
+	for _, game := range []string{"g1", "g2", "g3"} {
+		if ev := s.nextData(t); ev.data != fmt.Sprintf(`{"game": %q, "n": 3}`, game) {
+			t.Errorf("got %s, want the latest of %s", ev.data, game)
+		}
+	}
+	rdb.Publish(ctx, "events:user:2211", `{"game": "g1", "n": 4}`)
+	if ev := s.nextData(t); ev.data != `{"game": "g1", "n": 4}` {
+		t.Errorf("got %s after the burst, want the next update", ev.data)
+	}
+}
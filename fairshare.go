@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// shareScheduler holds the instance to cfg.FairShareRate events per second.
+// When more events are waiting than that, it hands the capacity out round
+// robin across the users, weight events per turn, instead of to whichever
+// connection asks first, so a few noisy users can't starve the others.
+type shareScheduler struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	users  map[string]*shareUser
+	// ring holds the waiting users in turn order, next is the current one.
+	ring []*shareUser
+	next int
+	wake chan struct{}
+}
+
+// shareUser is a user waiting to send, with the connections' turns in the
+// order they asked.
+type shareUser struct {
+	key    string
+	weight int
+	// turns is how many events the user sent in its current turn.
+	turns   int
+	waiters []chan struct{}
+}
+
+// shares is nil unless cfg.FairShareRate is set.
+var shares *shareScheduler
+
+func newShareScheduler(rate int) *shareScheduler {
+	if rate <= 0 {
+		return nil
+	}
+	s := &shareScheduler{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+		users:  make(map[string]*shareUser),
+		wake:   make(chan struct{}, 1),
+	}
+	go s.run()
+	return s
+}
+
+// refill adds the capacity accumulated since the last call, up to a second
+// of it.
+func (s *shareScheduler) refill(now time.Time) {
+	s.tokens = min(s.rate, s.tokens+now.Sub(s.last).Seconds()*s.rate)
+	s.last = now
+}
+
+// wait returns once the connection may send an event, right away unless
+// other users are waiting or the instance is at its rate, or with ctx's
+// error.
+func (s *shareScheduler) wait(ctx context.Context, c *SSEClient, weight int) error {
+	if s == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.refill(time.Now())
+	if len(s.ring) == 0 && s.tokens >= 1 {
+		s.tokens--
+		s.mu.Unlock()
+		return nil
+	}
+	key := qualify(c.namespace, strconv.FormatInt(c.userID, 10))
+	u, ok := s.users[key]
+	if !ok {
+		u = &shareUser{key: key, weight: max(weight, 1)}
+		s.users[key] = u
+		s.ring = append(s.ring, u)
+	}
+	turn := make(chan struct{})
+	u.waiters = append(u.waiters, turn)
+	s.mu.Unlock()
+	metrics.fairShareWaits.Add(1)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range u.waiters {
+		if w == turn {
+			u.waiters = append(u.waiters[:i], u.waiters[i+1:]...)
+			if len(u.waiters) == 0 {
+				s.drop(u)
+			}
+			break
+		}
+	}
+	return ctx.Err()
+}
+
+// drop removes a user without waiters from the ring, the next user getting
+// its turn.
+func (s *shareScheduler) drop(u *shareUser) {
+	delete(s.users, u.key)
+	for i, r := range s.ring {
+		if r == u {
+			s.ring = append(s.ring[:i], s.ring[i+1:]...)
+			if i < s.next {
+				s.next--
+			}
+			break
+		}
+	}
+	if s.next >= len(s.ring) {
+		s.next = 0
+	}
+}
+
+// run hands out the capacity to the waiting users as it accumulates.
+func (s *shareScheduler) run() {
+	for {
+		s.mu.Lock()
+		s.refill(time.Now())
+		for s.tokens >= 1 && len(s.ring) > 0 {
+			u := s.ring[s.next]
+			close(u.waiters[0])
+			u.waiters = u.waiters[1:]
+			s.tokens--
+			u.turns++
+			switch {
+			case len(u.waiters) == 0:
+				s.drop(u)
+			case u.turns >= u.weight:
+				u.turns = 0
+				s.next = (s.next + 1) % len(s.ring)
+			}
+		}
+		waiting := len(s.ring) > 0
+		delay := time.Duration((1 - s.tokens) / s.rate * float64(time.Second))
+		s.mu.Unlock()
+
+		if !waiting {
+			<-s.wake
+			continue
+		}
+		timer := time.NewTimer(max(delay, time.Millisecond))
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idleScheduler is a scheduler at rate with no capacity left, not handing
+// any out until it's run.
+func idleScheduler(rate int) *shareScheduler {
+	return &shareScheduler{
+		rate:  float64(rate),
+		last:  time.Now(),
+		users: make(map[string]*shareUser),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// queueTurns has n connections of userID wait for their turn on s, and
+// returns once they're all waiting. Each records userID in order when it
+// gets its turn.
+func queueTurns(t *testing.T, s *shareScheduler, userID int64, weight, n int, mu *sync.Mutex, order *[]int64) {
+	t.Helper()
+	c := &SSEClient{userID: userID}
+	for i := 0; i < n; i++ {
+		go func() {
+			if s.wait(ctx, c, weight) == nil {
+				mu.Lock()
+				*order = append(*order, userID)
+				mu.Unlock()
+			}
+		}()
+	}
+	waitFor(t, "the connections waiting", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		u := s.users[strconv.FormatInt(userID, 10)]
+		return u != nil && len(u.waiters) == n
+	})
+}
+
+func TestNoisyUserDoesNotStarveQuietOne(t *testing.T) {
+	useConfig(t, nil)
+	s := idleScheduler(200)
+	var mu sync.Mutex
+	var order []int64
+	queueTurns(t, s, 2141, 1, 20, &mu, &order)
+	queueTurns(t, s, 2142, 1, 2, &mu, &order)
+	go s.run()
+
+	waitFor(t, "every turn", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) == 22
+	})
+	// The quiet user is served in turn, not after the noisy backlog.
+	var quiet []int
+	for i, id := range order {
+		if id == 2142 {
+			quiet = append(quiet, i)
+		}
+	}
+	if len(quiet) != 2 || quiet[1] > 4 {
+		t.Errorf("quiet user served at %v of %v", quiet, order)
+	}
+}
+
+func TestFairShareWeights(t *testing.T) {
+	useConfig(t, nil)
+	s := idleScheduler(200)
+	var mu sync.Mutex
+	var order []int64
+	queueTurns(t, s, 2143, 3, 12, &mu, &order)
+	queueTurns(t, s, 2144, 1, 12, &mu, &order)
+	go s.run()
+
+	waitFor(t, "eight turns", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) >= 8
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	heavy := 0
+	for _, id := range order[:8] {
+		if id == 2143 {
+			heavy++
+		}
+	}
+	if heavy != 6 {
+		t.Errorf("weight 3 user got %d of the first 8 turns, want 6: %v", heavy, order[:8])
+	}
+}
+
+func TestFairShareNoWaitBelowRate(t *testing.T) {
+	useConfig(t, nil)
+	s := newShareScheduler(1000)
+	waits := metrics.fairShareWaits.Load()
+	for i := 0; i < 10; i++ {
+		if err := s.wait(ctx, &SSEClient{userID: 2145}, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := metrics.fairShareWaits.Load() - waits; n != 0 {
+		t.Errorf("%d waits below the rate", n)
+	}
+	if newShareScheduler(0) != nil {
+		t.Error("scheduler without GO_SSE_SIDECAR_FAIR_SHARE_RATE")
+	}
+}
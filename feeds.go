@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var errUnknownFeed = errors.New("unknown feed")
+
+// feedNamePattern keeps feed names usable in Redis keys and query strings.
+var feedNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// feedConfig is a named feed a connection selects with `feed=`: its own
+// user channel and history list, with its own delivery settings. A
+// connection to a named feed subscribes to its channel only, without the
+// team and broadcast channels of the default feed.
+type feedConfig struct {
+	name string
+	// channel and history are the key templates, with `{user_id}`.
+	channel string
+	history string
+	// backfill is the history replayed on connect, -1 for
+	// cfg.HistoryBackfill. queue is the default queue size, 0 for
+	// cfg.QueueSize.
+	backfill int
+	queue    int
+	// hybrid also polls the history list, see hybridPoller.
+	hybrid bool
+}
+
+// parseFeeds reads `name:setting=value;...` entries separated by commas,
+// ex: `activity:channel=activity:user:{user_id};history=activity:history:{user_id};backfill=50;mode=hybrid`.
+func parseFeeds(name string, list []string) map[string]*feedConfig {
+	feeds := make(map[string]*feedConfig, len(list))
+	for _, entry := range list {
+		f, err := parseFeed(entry)
+		if err != nil {
+			log.Fatalf("Invalid %s entry %q: %v", name, entry, err)
+		}
+		if feeds[f.name] != nil {
+			log.Fatalf("Invalid %s: feed %q is listed twice", name, f.name)
+		}
+		feeds[f.name] = f
+	}
+	return feeds
+}
+
+func parseFeed(entry string) (*feedConfig, error) {
+	name, settings, _ := strings.Cut(entry, ":")
+	if !feedNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("the name %q must be 1 to 64 letters, digits or -_", name)
+	}
+	f := &feedConfig{name: name, backfill: -1}
+	for _, setting := range strings.Split(settings, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected setting=value, got %q", setting)
+		}
+		var err error
+		switch key {
+		case "channel":
+			f.channel = value
+		case "history":
+			f.history = value
+		case "backfill":
+			f.backfill, err = strconv.Atoi(value)
+			if err == nil && (f.backfill < 0 || f.backfill > 100000) {
+				err = fmt.Errorf("backfill must be between 0 and 100000")
+			}
+		case "queue":
+			f.queue, err = strconv.Atoi(value)
+			if err == nil && (f.queue < 1 || f.queue > 100000) {
+				err = fmt.Errorf("queue must be between 1 and 100000")
+			}
+		case "mode":
+			switch value {
+			case "pubsub":
+			case "hybrid":
+				f.hybrid = true
+			default:
+				err = fmt.Errorf("unknown mode %q, expected pubsub or hybrid", value)
+			}
+		default:
+			err = fmt.Errorf("unknown setting %q, expected channel, history, backfill, queue or mode", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !strings.Contains(f.channel, "{user_id}") {
+		return nil, fmt.Errorf("the channel must be set and hold {user_id}")
+	}
+	if f.history != "" && !strings.Contains(f.history, "{user_id}") {
+		return nil, fmt.Errorf("the history must hold {user_id}")
+	}
+	if f.history == "" && (f.backfill > 0 || f.hybrid) {
+		return nil, fmt.Errorf("backfill and mode=hybrid need a history")
+	}
+	return f, nil
+}
+
+// feedFor returns the feed of the request's `feed` parameter, nil for the
+// default one.
+func feedFor(r *http.Request) (*feedConfig, error) {
+	name := r.URL.Query().Get("feed")
+	if name == "" {
+		return nil, nil
+	}
+	f, ok := cfg.Feeds[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownFeed, name)
+	}
+	return f, nil
+}
+
+func expandUserID(template string, userID int64) string {
+	return strings.ReplaceAll(template, "{user_id}", strconv.FormatInt(userID, 10))
+}
+
+// userChannel returns the user's channel in the connection's feed.
+func (c *SSEClient) userChannel() string {
+	if c.feed == nil {
+		return userChannel(c.userID)
+	}
+	return expandUserID(c.feed.channel, c.userID)
+}
+
+// historyKey returns the user's history list in the connection's feed.
+func (c *SSEClient) historyKey() string {
+	if c.feed == nil {
+		return historyKey(c.userID)
+	}
+	return expandUserID(c.feed.history, c.userID)
+}
+
+// pendingKey returns the list of the messages persisted on shutdown for the
+// user's next connection to the feed.
+func (c *SSEClient) pendingKey() string {
+	if c.feed == nil {
+		return pendingKey(c.userID)
+	}
+	return fmt.Sprintf("pending:%s:user:%d", c.feed.name, c.userID)
+}
+
+// backfill returns how much history the connection replays.
+func (c *SSEClient) backfill() int {
+	if c.feed == nil || c.feed.backfill < 0 {
+		if c.feed != nil && c.feed.history == "" {
+			return 0
+		}
+		return cfg.HistoryBackfill
+	}
+	return c.feed.backfill
+}
+
+// hybridDelivery reports whether the connection also polls its history.
+func (c *SSEClient) hybridDelivery() bool {
+	if c.feed == nil {
+		return cfg.HybridDelivery
+	}
+	return c.feed.hybrid
+}
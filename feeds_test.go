@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestParseFeed(t *testing.T) {
+	f, err := parseFeed("activity:channel=activity:user:{user_id}; history=activity:history:{user_id};backfill=50;queue=20;mode=hybrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.name != "activity" || f.channel != "activity:user:{user_id}" || f.history != "activity:history:{user_id}" ||
+		f.backfill != 50 || f.queue != 20 || !f.hybrid {
+		t.Errorf("parsed %+v", f)
+	}
+	if f, _ := parseFeed("notifications:channel=notif:{user_id}"); f.backfill != -1 || f.hybrid {
+		t.Errorf("defaults %+v", f)
+	}
+
+	for _, entry := range []string{
+		"bad name:channel=c:{user_id}",
+		"a:channel=c:1",
+		"a:channel=c:{user_id};history=h",
+		"a:channel=c:{user_id};backfill=5",
+		"a:channel=c:{user_id};mode=hybrid",
+		"a:channel=c:{user_id};mode=stream",
+		"a:channel=c:{user_id};queue=0",
+		"a:channel=c:{user_id};buffer=5",
+	} {
+		if _, err := parseFeed(entry); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+}
+
+// feedSidecar serves a pub/sub `notifications` feed and an `activity` feed
+// replaying and polling its history, next to the default feed replaying
+// one entry.
+func feedSidecar(t *testing.T) (*miniredis.Miniredis, *httptest.Server) {
+	t.Helper()
+	return pollSidecar(t, func(c *Config) {
+		c.Feeds = parseFeeds("GO_SSE_SIDECAR_FEEDS", []string{
+			"notifications:channel=notif:user:{user_id};queue=3",
+			"activity:channel=activity:user:{user_id};history=activity:history:{user_id};backfill=2;mode=hybrid",
+		})
+		c.HistoryBackfill = 1
+		c.HybridInterval = 20 * time.Millisecond
+		c.PollTimeout = 100 * time.Millisecond
+	})
+}
+
+func TestTwoFeedsOnOneInstance(t *testing.T) {
+	mr, srv := feedSidecar(t)
+	for _, entry := range []string{"a1", "a2", "a3"} {
+		mr.RPush("activity:history:2341", entry)
+	}
+	// Without a history, notifications replay nothing.
+	mr.RPush(historyKey(2341), "default history")
+
+	activity, _ := connect(t, srv, 2341, url.Values{"feed": {"activity"}})
+	notifications, notifConn := connect(t, srv, 2341, url.Values{"feed": {"notifications"}})
+	plain, _ := connect(t, srv, 2341, nil)
+	for _, want := range []string{"a2", "a3"} {
+		if ev := activity.nextData(t); ev.data != want {
+			t.Fatalf("activity replayed %q, want %q", ev.data, want)
+		}
+	}
+	if ev := plain.nextData(t); ev.data != "default history" {
+		t.Fatalf("default feed replayed %q", ev.data)
+	}
+
+	// Each connection gets its feed's channel only.
+	rdb.Publish(ctx, "notif:user:2341", "n1")
+	rdb.Publish(ctx, "activity:user:2341", "a4")
+	rdb.Publish(ctx, "events:user:2341", "e1")
+	if ev := notifications.nextData(t); ev.data != "n1" {
+		t.Errorf("notifications got %q", ev.data)
+	}
+	if ev := activity.nextData(t); ev.data != "a4" {
+		t.Errorf("activity got %q", ev.data)
+	}
+	if ev := plain.nextData(t); ev.data != "e1" {
+		t.Errorf("default feed got %q", ev.data)
+	}
+
+	// Only activity recovers from its history what pub/sub lost.
+	mr.RPush("activity:history:2341", "a5")
+	if ev := activity.nextData(t); ev.data != "a5" {
+		t.Errorf("activity got %q, want the entry polled from its history", ev.data)
+	}
+	rdb.Publish(ctx, "notif:user:2341", "n2")
+	if ev := notifications.nextData(t); ev.data != "n2" {
+		t.Errorf("notifications got %q, want n2", ev.data)
+	}
+
+	if got := cap(registry.get(notifConn).channel); got != 3 {
+		t.Errorf("notifications queue of %d, want the feed's 3", got)
+	}
+}
+
+func TestUnknownFeedRefused(t *testing.T) {
+	_, srv := feedSidecar(t)
+	for _, path := range []string{"/sse-events", "/poll"} {
+		if status, body := queryStatus(t, srv, path, 2342, "&feed=billing"); status != http.StatusBadRequest {
+			t.Errorf("%s?feed=billing: %d %s, want 400", path, status, body)
+		}
+	}
+}
+
+func TestPollFeed(t *testing.T) {
+	mr, srv := feedSidecar(t)
+	pollFeed := func(feed, cursor string) ([]pollEvent, string) {
+		t.Helper()
+		q := url.Values{"ssetoken": {token(t, 2343, nil)}, "feed": {feed}, "cursor": {cursor}}
+		resp := get(t, srv.URL+"/poll?"+q.Encode(), nil)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("poll %s: %s", feed, resp.Status)
+		}
+		var events []pollEvent
+		if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+			t.Fatal(err)
+		}
+		return events, resp.Header.Get("X-Poll-Cursor")
+	}
+
+	_, cursor := pollFeed("notifications", "")
+	rdb.Publish(ctx, "notif:user:2343", "n1")
+	rdb.Publish(ctx, "events:user:2343", "e1")
+	events, _ := pollFeed("notifications", cursor)
+	if len(events) != 1 || events[0].Data != "n1" {
+		t.Errorf("notifications polled %+v", events)
+	}
+
+	// The cursor of another feed starts a session of its own.
+	mr.RPush("activity:history:2343", "a1")
+	if events, _ := pollFeed("activity", cursor); len(events) != 1 || events[0].Data != "a1" {
+		t.Errorf("activity polled %+v, want its backfill", events)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFlusher counts the flushes of the stream it wraps.
+type countingFlusher struct {
+	http.ResponseWriter
+	flushes *atomic.Int64
+}
+
+func (f countingFlusher) Flush() {
+	f.flushes.Add(1)
+	f.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (f countingFlusher) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// flushCountingStream opens a stream whose flushes are counted, and returns
+// its client once connected.
+func flushCountingStream(t testing.TB, set func(c *Config)) (*SSEClient, *atomic.Int64, *sseStream) {
+	t.Helper()
+	useConfig(t, set)
+	useRedis(t)
+	var flushes atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sseHandler(countingFlusher{w, &flushes}, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	s := openStream(t, srv, url.Values{"ssetoken": {token(t, 7, nil)}})
+	s.nextEvent(t, "connected")
+	client := registry.forUser("", 7)[0]
+	return client, &flushes, s
+}
+
+// deliverHeld queues n messages while delivery is paused, then resumes it
+// and waits until they're written, returning the flushes that took.
+func deliverHeld(t *testing.T, client *SSEClient, flushes *atomic.Int64, s *sseStream, n int) int64 {
+	t.Helper()
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	for i := 0; i < n; i++ {
+		client.enqueue(sseMessage{channel: "events:user:7", payload: fmt.Sprint(i)})
+	}
+	before := flushes.Load()
+	delivery.set(false)
+	for i := 0; i < n; i++ {
+		if ev := s.nextData(t); ev.data != fmt.Sprint(i) {
+			t.Fatalf("message %d = %q", i, ev.data)
+		}
+	}
+	return flushes.Load() - before
+}
+
+func TestImmediateFlushPerMessage(t *testing.T) {
+	client, flushes, s := flushCountingStream(t, func(c *Config) { c.QueueSize = 100 })
+	if n := deliverHeld(t, client, flushes, s, 20); n != 20 {
+		t.Errorf("%d flushes for 20 messages, want one each", n)
+	}
+}
+
+func TestFlushIntervalCoalescesQueuedMessages(t *testing.T) {
+	client, flushes, s := flushCountingStream(t, func(c *Config) {
+		c.FlushInterval = time.Second
+		c.QueueSize = 100
+	})
+	// The queue is empty after the last message, so it's flushed at once
+	// rather than after the interval.
+	if n := deliverHeld(t, client, flushes, s, 20); n != 1 {
+		t.Errorf("%d flushes for a backlog of 20, want 1", n)
+	}
+}
+
+// BenchmarkFlushCoalescing compares the flushes per delivered message with
+// immediate flushing and with GO_SSE_SIDECAR_FLUSH_INTERVAL, the messages
+// being queued as fast as they can be.
+func BenchmarkFlushCoalescing(b *testing.B) {
+	for _, bm := range []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"immediate", 0},
+		{"coalesced", 5 * time.Millisecond},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var flushes atomic.Int64
+			useConfig(b, func(c *Config) {
+				c.FlushInterval = bm.interval
+				c.QueueSize = 10000
+			})
+			useRedis(b)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sseHandler(countingFlusher{w, &flushes}, r)
+			}))
+			defer srv.Close()
+			resp := get(b, srv.URL+"/sse-events?ssetoken="+token(b, 7, nil), nil)
+			defer resp.Body.Close()
+			var client *SSEClient
+			waitFor(b, "the connection", func() bool {
+				conns := registry.forUser("", 7)
+				if len(conns) == 1 {
+					client = conns[0]
+				}
+				return client != nil
+			})
+			go io.Copy(io.Discard, resp.Body)
+			start := client.delivered.Load()
+			before := flushes.Load()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for !client.enqueue(sseMessage{channel: "events:user:7", payload: `{"n":1}`}) {
+					runtime.Gosched() // queue full, let the writer catch up
+				}
+			}
+			for client.delivered.Load()-start < int64(b.N) {
+				time.Sleep(time.Millisecond)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(flushes.Load()-before)/float64(b.N), "flushes/op")
+		})
+	}
+}
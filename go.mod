@@ -2,11 +2,15 @@ module github.com/ClimenteA/go-sse-wsgi-sidecar
 
 go 1.22.2
 
-require github.com/redis/go-redis/v9 v9.16.0
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/golang-jwt/jwt/v5 v5.3.0
+	github.com/joho/godotenv v1.5.1
+	github.com/redis/go-redis/v9 v9.16.0
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"hash/crc32"
+	"hash/fnv"
+	"log"
+)
+
+// shardHashes are the hashes cfg.ShardHash can name. Both are fixed by their
+// spec, so a key lands on the same shard on every instance and after restarts.
+var shardHashes = map[string]func([]byte) uint32{
+	"fnv1a": func(b []byte) uint32 {
+		h := fnv.New32a()
+		h.Write(b)
+		return h.Sum32()
+	},
+	"crc32": crc32.ChecksumIEEE,
+}
+
+// shardOf maps key (ex: a connection ID, or a user ID in decimal) to one of
+// n shards with cfg.ShardHash.
+func shardOf(key string, n int) int {
+	return int(shardHashes[cfg.ShardHash]([]byte(key)) % uint32(n))
+}
+
+func parseShardHash(name, v string) string {
+	if _, ok := shardHashes[v]; !ok {
+		log.Fatalf("Invalid %s %q, expected fnv1a or crc32", name, v)
+	}
+	return v
+}
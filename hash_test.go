@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestShardHashesMatchTheirSpec(t *testing.T) {
+	// The check values of the specs: a different implementation would move
+	// keys to other shards.
+	if h := shardHashes["fnv1a"]([]byte("")); h != 0x811c9dc5 {
+		t.Errorf("fnv1a of \"\" = %#x", h)
+	}
+	if h := shardHashes["fnv1a"]([]byte("a")); h != 0xe40c292c {
+		t.Errorf("fnv1a of \"a\" = %#x", h)
+	}
+	if h := shardHashes["crc32"]([]byte("123456789")); h != 0xcbf43926 {
+		t.Errorf("crc32 of \"123456789\" = %#x", h)
+	}
+}
+
+func TestShardOfStable(t *testing.T) {
+	for _, tt := range []struct {
+		hash, key string
+		want      int
+	}{
+		{"fnv1a", "1", 12},
+		{"fnv1a", "42", 3},
+		{"fnv1a", "1741", 10},
+		{"crc32", "1", 7},
+		{"crc32", "42", 8},
+		{"crc32", "1741", 0},
+	} {
+		useConfig(t, func(c *Config) { c.ShardHash = tt.hash })
+		if got := shardOf(tt.key, 16); got != tt.want {
+			t.Errorf("%s: %s on shard %d of 16, want %d", tt.hash, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestShardOfEvenlyDistributed(t *testing.T) {
+	const users, shards = 16000, 16
+	for hash := range shardHashes {
+		useConfig(t, func(c *Config) { c.ShardHash = hash })
+		counts := make([]int, shards)
+		for id := 1; id <= users; id++ {
+			counts[shardOf(strconv.Itoa(id), shards)]++
+		}
+		for shard, n := range counts {
+			if n < users/shards*8/10 || n > users/shards*12/10 {
+				t.Errorf("%s: %d of %d user IDs on shard %d, want about %d", hash, n, users, shard, users/shards)
+			}
+		}
+	}
+}
+
+func TestShardHashDefault(t *testing.T) {
+	useConfig(t, nil)
+	if cfg.ShardHash != "fnv1a" {
+		t.Errorf("GO_SSE_SIDECAR_SHARD_HASH defaults to %q", cfg.ShardHash)
+	}
+}
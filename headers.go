@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// reservedHeaders are set by the SSE handler itself and can't be overridden
+// through GO_SSE_SIDECAR_RESPONSE_HEADERS without breaking the stream.
+var reservedHeaders = []string{"Content-Type", "Cache-Control", "Connection", "X-Accel-Buffering", "X-Connection-ID"}
+
+// defaultStreamHeaders are sent with every event stream. X-Accel-Buffering
+// stops nginx from buffering the stream, which otherwise delays events by
+// minutes.
+var defaultStreamHeaders = http.Header{
+	"Cache-Control":     {"no-cache"},
+	"Connection":        {"keep-alive"},
+	"X-Accel-Buffering": {"no"},
+}
+
+func parseResponseHeaders(name, v string) http.Header {
+	return parseHeaderList(name, v, reservedHeaders)
+}
+
+// parseStreamHeaders returns the streaming headers with the overrides from
+// v applied. An empty value removes a default header.
+func parseStreamHeaders(name, v string) http.Header {
+	headers := defaultStreamHeaders.Clone()
+	for key, values := range parseHeaderList(name, v, []string{"Content-Type", "X-Connection-ID"}) {
+		if len(values) == 1 && values[0] == "" {
+			headers.Del(key)
+			continue
+		}
+		headers[key] = values
+	}
+	return headers
+}
+
+// parseHeaderList parses `Name: value` pairs separated by `|`, ex:
+// `X-Content-Type-Options: nosniff|Strict-Transport-Security: max-age=63072000`.
+func parseHeaderList(name, v string, reserved []string) http.Header {
+	headers := http.Header{}
+	for _, entry := range strings.Split(v, "|") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			log.Fatalf("Invalid %s entry %q, expected Name: value", name, entry)
+		}
+		for _, r := range reserved {
+			if strings.EqualFold(key, r) {
+				log.Fatalf("Invalid %s: %s is set by the sidecar and can't be overridden", name, r)
+			}
+		}
+		headers.Add(key, value)
+	}
+	return headers
+}
+
+// applyResponseHeaders copies the configured extra headers onto the response.
+func applyResponseHeaders(w http.ResponseWriter) {
+	for key, values := range cfg.ResponseHeaders {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
+}
+
+// applyStreamHeaders sets the headers of an event stream response.
+func applyStreamHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	for key, values := range cfg.StreamHeaders {
+		w.Header()[key] = values
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseResponseHeaders(t *testing.T) {
+	got := parseResponseHeaders("headers", "X-Frame-Options: DENY | Link: <a>; rel=preload|Link: <b>; rel=preload|")
+	want := http.Header{
+		"X-Frame-Options": {"DENY"},
+		"Link":            {"<a>; rel=preload", "<b>; rel=preload"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseResponseHeaders = %v, want %v", got, want)
+	}
+}
+
+func TestResponseHeadersOnStreamAndErrors(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.ResponseHeaders = parseResponseHeaders("headers", "Strict-Transport-Security: max-age=63072000")
+	})
+
+	s, _ := connect(t, srv, 7, nil)
+	if got := s.resp.Header.Get("Strict-Transport-Security"); got != "max-age=63072000" {
+		t.Errorf("stream response header = %q", got)
+	}
+
+	// Refused requests get them too, they're set before any check.
+	resp := get(t, srv.URL+"/sse-events?ssetoken=bad", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad token: %s", resp.Status)
+	}
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=63072000" {
+		t.Errorf("401 response header = %q", got)
+	}
+}
+
+func TestParseStreamHeadersOverridesDefaults(t *testing.T) {
+	got := parseStreamHeaders("headers", "Cache-Control: no-cache, no-transform|X-Accel-Buffering:|X-Stream: 1")
+	want := http.Header{
+		"Cache-Control": {"no-cache, no-transform"},
+		"Connection":    {"keep-alive"},
+		"X-Stream":      {"1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStreamHeaders = %v, want %v", got, want)
+	}
+	if len(defaultStreamHeaders["X-Accel-Buffering"]) != 1 {
+		t.Error("the defaults were changed")
+	}
+}
+
+func TestStreamHeaders(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.StreamHeaders = parseStreamHeaders("headers", "Cache-Control: private, no-store|Connection:")
+	})
+	s, _ := connect(t, srv, 7, nil)
+
+	h := s.resp.Header
+	if got := h.Get("Content-Type"); got != "text/event-stream; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := h.Get("Cache-Control"); got != "private, no-store" {
+		t.Errorf("Cache-Control = %q, want the override", got)
+	}
+	if got := h.Get("X-Accel-Buffering"); got != "no" {
+		t.Errorf("X-Accel-Buffering = %q, want the default kept", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// version is the build version, set with `-ldflags "-X main.version=..."`.
+var version = "dev"
+
+var startedAt = time.Now()
+
+// lastPingRTT holds the duration of the last successful Redis ping.
+var lastPingRTT atomic.Int64
+
+// pingRedis checks Redis with a short timeout and records the round trip.
+func pingRedis(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return err
+	}
+	lastPingRTT.Store(int64(time.Since(start)))
+	return nil
+}
+
+// healthzHandler is the lightweight probe endpoint: 200 when Redis answers,
+// 503 otherwise. A failing metrics exporter (in strict mode) is reported in
+// the body but keeps the 200, it doesn't affect the connections.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := pingRedis(r.Context()); err != nil {
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err := exporterError(); err != nil {
+		w.Write([]byte("degraded: metrics exporter: " + err.Error()))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+type statusResponse struct {
+	Status            string  `json:"status"`
+	Redis             string  `json:"redis"`
+	RedisRTTMs        float64 `json:"redis_rtt_ms"`
+	RedisEndpoint     string  `json:"redis_endpoint,omitempty"`
+	ActiveConnections int     `json:"active_connections"`
+	Goroutines        int     `json:"goroutines"`
+	UptimeSeconds     int64   `json:"uptime_seconds"`
+	Version           string  `json:"version"`
+	Draining          bool    `json:"draining"`
+	UnsignedTokens    int64   `json:"unsigned_token_rejections"`
+	SequenceGaps      int64   `json:"sequence_gaps"`
+	SequenceReordered int64   `json:"sequence_out_of_order"`
+	MetricsExporter   string  `json:"metrics_exporter,omitempty"`
+}
+
+// statusHandler reports the detailed state of the instance for humans.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	resp := statusResponse{
+		Status:            "ok",
+		Redis:             "ok",
+		ActiveConnections: len(registry.all()),
+		Goroutines:        runtime.NumGoroutine(),
+		UptimeSeconds:     int64(time.Since(startedAt).Seconds()),
+		Version:           version,
+		Draining:          draining.Load(),
+		UnsignedTokens:    metrics.unsignedTokens.Load(),
+		SequenceGaps:      metrics.sequenceGaps.Load(),
+		SequenceReordered: metrics.sequenceOutOfOrder.Load(),
+	}
+
+	code := http.StatusOK
+	if err := exporterError(); err != nil {
+		resp.Status, resp.MetricsExporter = "degraded", err.Error()
+	}
+	if err := pingRedis(r.Context()); err != nil {
+		resp.Status, resp.Redis = "degraded", err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	resp.RedisRTTMs = float64(lastPingRTT.Load()) / float64(time.Millisecond)
+	if failover != nil {
+		resp.RedisEndpoint = failover.current()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
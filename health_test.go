@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func getStatus(t *testing.T) (int, statusResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var resp statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("status body %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, resp
+}
+
+func TestStatusReportsSubsystems(t *testing.T) {
+	useConfig(t, nil)
+	useRedis(t)
+
+	code, resp := getStatus(t)
+	if code != http.StatusOK || resp.Status != "ok" || resp.Redis != "ok" {
+		t.Fatalf("status %d %+v, want ok", code, resp)
+	}
+	if resp.Goroutines == 0 || resp.Version != version {
+		t.Errorf("runtime fields missing: %+v", resp)
+	}
+	if resp.RedisRTTMs <= 0 {
+		t.Errorf("redis_rtt_ms = %v, want the ping measured", resp.RedisRTTMs)
+	}
+}
+
+func TestStatusDegradedWithoutRedis(t *testing.T) {
+	useConfig(t, nil)
+	old := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() {
+		rdb.Close()
+		rdb = old
+	})
+
+	code, resp := getStatus(t)
+	if code != http.StatusServiceUnavailable || resp.Status != "degraded" || resp.Redis == "ok" {
+		t.Fatalf("status %d %+v, want degraded with the Redis error", code, resp)
+	}
+
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("healthz = %d, want 503", rec.Code)
+	}
+}
+
+func TestStatusCountsOpenConnections(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	before := len(registry.all())
+	connect(t, srv, 7, nil)
+
+	_, resp := getStatus(t)
+	if resp.ActiveConnections != before+1 {
+		t.Errorf("active_connections = %d, want %d", resp.ActiveConnections, before+1)
+	}
+}
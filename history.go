@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func historyKey(userID int64) string {
+	return fmt.Sprintf("history:user:%d", userID)
+}
+
+// backfillHistory delivers the last n entries of the user's history list
+// (oldest first, publishers are expected to RPUSH + LTRIM) before live
+// messages, at most cfg.ReplayMax. It runs after subscribing so nothing
+// published in between is missed, and returns the delivered payloads so the
+// live messages that were also read from the list can be skipped once during
+// the handoff.
+//
+// The list is read cfg.ReplayChunk entries at a time, the next chunk once
+// the writer took the previous one off the queue, so a long replay neither
+// sits in memory at once nor holds back the first events. An entry published
+// meanwhile shifts the list by one, which can send the entry at a chunk
+// boundary twice (see GO_SSE_SIDECAR_DEDUPE_IDS).
+func backfillHistory(ctx context.Context, rdb *redis.Client, client *SSEClient, n int) map[string]int {
+	key := client.qualify(client.historyKey())
+	length, err := rdb.LLen(ctx, key).Result()
+	if err != nil {
+		client.logf("Failed to read history %s: %v", key, err)
+		return nil
+	}
+	n = int(min(int64(n), int64(cfg.ReplayMax), length))
+
+	client.logf("Backfilling %d messages from %s", n, key)
+	delivered := make(map[string]int, min(n, cfg.ReplayChunk))
+	for start := -n; start < 0; start += cfg.ReplayChunk {
+		if start > -n && !awaitDrained(ctx, client) {
+			return nil
+		}
+		end := min(start+cfg.ReplayChunk, 0) - 1
+		entries, err := rdb.LRange(ctx, key, int64(start), int64(end)).Result()
+		if err != nil {
+			client.logf("Failed to read history %s: %v", key, err)
+			return delivered
+		}
+		now := time.Now()
+		for _, payload := range entries {
+			if tooOldToReplay(payload, now) {
+				continue
+			}
+			msg, ok := client.receive(sseMessage{channel: client.userChannel(), payload: payload})
+			if !ok {
+				continue
+			}
+			msg.enqueued, msg.seq = time.Now(), client.enqueueSeq.Add(1)
+			select {
+			case client.channel <- msg:
+				delivered[payload]++
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	return delivered
+}
+
+// sendCaughtUp queues the `caught_up` event, between the replayed messages
+// and the live ones, which are only forwarded after it. It waits for the
+// writer to take the replay off the queue first, so the event can't be
+// overtaken by live messages of priority channels either. It's on the
+// user's channel like the replay, which GO_SSE_SIDECAR_FAIR_INTERLEAVE
+// keeps in order.
+func sendCaughtUp(ctx context.Context, client *SSEClient, backfilled map[string]int) {
+	if !awaitDrained(ctx, client) {
+		return
+	}
+	replayed := 0
+	for _, n := range backfilled {
+		replayed += n
+	}
+	client.enqueue(sseMessage{channel: client.userChannel(), event: "caught_up", payload: fmt.Sprintf(`{"replayed":%d}`, replayed)})
+}
+
+// awaitDrained waits until the writer took every queued message, which it
+// flushes once the queue is empty. It returns false when ctx is done first.
+func awaitDrained(ctx context.Context, client *SSEClient) bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for len(client.channel) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// tooOldToReplay reports whether a history entry is older than
+// cfg.MaxReplayAge, from the time in its cfg.ReplayTimeField: Unix seconds,
+// Unix milliseconds or an RFC 3339 string. Entries without a readable time
+// are replayed.
+func tooOldToReplay(payload string, now time.Time) bool {
+	if cfg.MaxReplayAge <= 0 {
+		return false
+	}
+	v := payloadScalar(payload, cfg.ReplayTimeField)
+	if v == "" {
+		return false
+	}
+	var at time.Time
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		// Unix seconds stay below 1e12 until the year 33658.
+		if n >= 1e12 {
+			at = time.UnixMilli(int64(n))
+		} else {
+			at = time.Unix(0, int64(n*float64(time.Second)))
+		}
+	} else if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		at = t
+	} else {
+		return false
+	}
+	return now.Sub(at) > cfg.MaxReplayAge
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfillReplaysLastEntriesBeforeLive(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.HistoryBackfill = 3 })
+	for i := 1; i <= 5; i++ {
+		mr.RPush("history:user:7", fmt.Sprintf(`{"n":%d}`, i))
+	}
+
+	s, _ := connect(t, srv, 7, nil)
+	for _, want := range []string{`{"n":3}`, `{"n":4}`, `{"n":5}`} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Fatalf("replayed %q, want %q", ev.data, want)
+		}
+	}
+	mr.Publish("events:user:7", `{"n":6}`)
+	if ev := s.nextData(t); ev.data != `{"n":6}` {
+		t.Fatalf("live event %q after the backfill", ev.data)
+	}
+}
+
+func TestBackfillIsCappedByReplayMaxAndChunked(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.HistoryBackfill = 10
+		c.ReplayMax = 4
+		c.ReplayChunk = 2
+	})
+	for i := 1; i <= 6; i++ {
+		mr.RPush("history:user:7", fmt.Sprintf("%d", i))
+	}
+
+	s, _ := connect(t, srv, 7, nil)
+	// Chunks are read oldest first, so the order survives the chunking.
+	for _, want := range []string{"3", "4", "5", "6"} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Fatalf("replayed %q, want %q", ev.data, want)
+		}
+	}
+}
+
+func TestBackfillWaitsForWriterBetweenChunks(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ReplayChunk = 3 })
+	mr := useRedis(t)
+	for i := 1; i <= 7; i++ {
+		mr.RPush("history:user:1921", fmt.Sprintf("%d", i))
+	}
+	// No writer: the queue is drained by the test, a chunk at a time.
+	client := &SSEClient{id: "backfill", userID: 1921, channel: make(chan sseMessage, 10)}
+	done := make(chan map[string]int, 1)
+	go func() { done <- backfillHistory(ctx, rdb, client, 7) }()
+
+	for _, chunk := range [][]string{{"1", "2", "3"}, {"4", "5", "6"}, {"7"}} {
+		waitFor(t, "the chunk", func() bool { return len(client.channel) == len(chunk) })
+		// The next chunk isn't read until this one is taken.
+		time.Sleep(50 * time.Millisecond)
+		if n := len(client.channel); n != len(chunk) {
+			t.Fatalf("%d queued, want the chunk of %d", n, len(chunk))
+		}
+		for _, want := range chunk {
+			if msg := <-client.channel; msg.payload != want {
+				t.Errorf("queued %q, want %q", msg.payload, want)
+			}
+		}
+	}
+	if delivered := <-done; len(delivered) != 7 {
+		t.Errorf("%d payloads reported delivered, want 7", len(delivered))
+	}
+}
+
+func TestBackfillOtherUsersHistoryNotReplayed(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.HistoryBackfill = 5 })
+	mr.RPush("history:user:8", "not yours")
+
+	s, _ := connect(t, srv, 7, nil)
+	mr.Publish("events:user:7", "live")
+	if ev := s.nextData(t); ev.data != "live" {
+		t.Fatalf("first event %q, want only the live one", ev.data)
+	}
+}
+
+func TestTooOldToReplay(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MaxReplayAge = time.Hour })
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for payload, want := range map[string]bool{
+		fmt.Sprintf(`{"ts": %d}`, now.Add(-2*time.Hour).Unix()):      true,
+		fmt.Sprintf(`{"ts": %d}`, now.Add(-time.Minute).Unix()):      false,
+		fmt.Sprintf(`{"ts": %d}`, now.Add(-2*time.Hour).UnixMilli()): true,
+		fmt.Sprintf(`{"ts": %d}`, now.Add(-time.Minute).UnixMilli()): false,
+		`{"ts": "2024-05-01T09:00:00Z"}`:                             true,
+		`{"ts": "2024-05-01T11:30:00.5+00:00"}`:                      false,
+		`{"ts": "yesterday"}`:                                        false,
+		`{"text": "no time"}`:                                        false,
+		"not json":                                                   false,
+	} {
+		if got := tooOldToReplay(payload, now); got != want {
+			t.Errorf("%s: too old %v, want %v", payload, got, want)
+		}
+	}
+}
+
+func TestBackfillSkipsEntriesOverMaxReplayAge(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.HistoryBackfill = 10
+		c.MaxReplayAge = time.Hour
+	})
+	now := time.Now()
+	mr.RPush("history:user:1751", fmt.Sprintf(`{"ts": %d, "n": 1}`, now.Add(-3*time.Hour).Unix()))
+	mr.RPush("history:user:1751", fmt.Sprintf(`{"ts": %d, "n": 2}`, now.Add(-10*time.Minute).Unix()))
+	mr.RPush("history:user:1751", fmt.Sprintf(`{"ts": "%s", "n": 3}`, now.Add(-2*time.Hour).Format(time.RFC3339)))
+	mr.RPush("history:user:1751", `{"n": 4}`)
+
+	s, _ := connect(t, srv, 1751, nil)
+	for _, want := range []string{`"n": 2}`, `{"n": 4}`} {
+		if ev := s.nextData(t); !strings.HasSuffix(ev.data, want) {
+			t.Fatalf("replayed %s, want the entry ending %s", ev.data, want)
+		}
+	}
+	mr.Publish("events:user:1751", "live")
+	if ev := s.nextData(t); ev.data != "live" {
+		t.Errorf("got %q after the replay, want the live event", ev.data)
+	}
+}
+
+func TestBackfillReplaysOldEntriesByDefault(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.HistoryBackfill = 10 })
+	old := fmt.Sprintf(`{"ts": %d}`, time.Now().Add(-30*24*time.Hour).Unix())
+	mr.RPush("history:user:1752", old)
+
+	s, _ := connect(t, srv, 1752, nil)
+	if ev := s.nextData(t); ev.data != old {
+		t.Errorf("replayed %q, want the old entry without GO_SSE_SIDECAR_MAX_REPLAY_AGE", ev.data)
+	}
+}
+
+func TestCaughtUpBetweenReplayAndLive(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.HistoryBackfill = 3
+		c.CaughtUp = true
+	})
+	for i := 1; i <= 3; i++ {
+		mr.RPush("history:user:2151", fmt.Sprintf("old %d", i))
+	}
+	// Live messages keep coming while the history is replayed.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				rdb.Publish(ctx, "events:user:2151", fmt.Sprintf("live %d", i))
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	s := openStream(t, srv, url.Values{"ssetoken": {token(t, 2151, nil)}})
+	var got []string
+	live := 0
+	for live < 3 {
+		ev := s.next(t)
+		switch {
+		case ev.event == "caught_up":
+			got = append(got, "caught_up "+ev.data)
+		case strings.HasPrefix(ev.data, "live"):
+			got = append(got, "live")
+			live++
+		case strings.HasPrefix(ev.data, "old"):
+			got = append(got, ev.data)
+		}
+	}
+	want := []string{"old 1", "old 2", "old 3", `caught_up {"replayed":3}`, "live", "live", "live"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
+
+func TestCaughtUpWithoutHistory(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.CaughtUp = true })
+	s, _ := connect(t, srv, 2152, nil)
+	if ev := s.nextEvent(t, "caught_up"); ev.data != `{"replayed":0}` {
+		t.Errorf("caught_up %q", ev.data)
+	}
+	rdb.Publish(ctx, "events:user:2152", "live")
+	if ev := s.nextData(t); ev.data != "live" {
+		t.Errorf("got %q", ev.data)
+	}
+}
+
+func TestNoCaughtUpByDefault(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.HistoryBackfill = 3 })
+	mr.RPush("history:user:2153", "old")
+	s, _ := connect(t, srv, 2153, nil)
+	rdb.Publish(ctx, "events:user:2153", "live")
+	for _, want := range []string{"old", "live"} {
+		ev := s.next(t)
+		for ev.data == "" {
+			ev = s.next(t)
+		}
+		if ev.event == "caught_up" || ev.data != want {
+			t.Errorf("got %s %q, want %q", ev.event, ev.data, want)
+		}
+	}
+}
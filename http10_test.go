@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getHTTP10 sends an HTTP/1.0 GET of path to srv.
+func getHTTP10(t *testing.T, srv *httptest.Server, path string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET %s HTTP/1.0\r\nHost: sidecar\r\n\r\n", path)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHTTP10StreamRefused(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	resp := getHTTP10(t, srv, "/sse-events?"+url.Values{"ssetoken": {token(t, 1711, nil)}}.Encode())
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Fatalf("status %s, want 505", resp.Status)
+	}
+	if !strings.Contains(string(body), "HTTP/1.1") || !strings.Contains(string(body), "/poll") {
+		t.Errorf("body %q doesn't explain the refusal", body)
+	}
+	if len(registry.forUser("", 1711)) != 0 {
+		t.Error("connection registered for the refused request")
+	}
+}
+
+func TestHTTP10StreamAllowed(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.AllowHTTP10 = true })
+	resp := getHTTP10(t, srv, "/sse-events?"+url.Values{"ssetoken": {token(t, 1712, nil)}}.Encode())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s with GO_SSE_SIDECAR_ALLOW_HTTP10", resp.Status)
+	}
+	if te := resp.TransferEncoding; len(te) != 0 {
+		t.Errorf("transfer encoding %v over HTTP/1.0", te)
+	}
+	s := readStream(t, resp)
+	// The body only ends with the connection, closed before the body is.
+	t.Cleanup(srv.CloseClientConnections)
+	s.nextEvent(t, "connected")
+	rdb.Publish(ctx, "events:user:1712", "over 1.0")
+	if ev := s.nextData(t); ev.data != "over 1.0" {
+		t.Errorf("got %q", ev.data)
+	}
+}
+
+func TestHTTP10PollAccepted(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.PollTimeout = 10 * time.Millisecond })
+	resp := getHTTP10(t, srv, "/poll?"+url.Values{"ssetoken": {token(t, 1713, nil)}}.Encode())
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusHTTPVersionNotSupported {
+		t.Error("long-polling refused over HTTP/1.0")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// hybridPoller catches the user channel messages pub/sub missed by reading
+// the newest entries of the user's history list (see backfillHistory) every
+// cfg.HybridInterval. Messages are deduped by their id field
+// (GO_SSE_SIDECAR_EVENT_ID_FIELD), or their payload without one.
+type hybridPoller struct {
+	key   string
+	depth int
+	seen  *seenSet
+}
+
+// newHybridPoller reads the current entries of the list as already seen: they
+// were published before the connection. It must run before subscribing, so
+// nothing published in between is taken for seen without being received.
+func newHybridPoller(ctx context.Context, rdb *redis.Client, client *SSEClient) *hybridPoller {
+	if !client.hybridDelivery() {
+		return nil
+	}
+	h := &hybridPoller{key: client.qualify(client.historyKey()), depth: cfg.HybridDepth, seen: newSeenSet(2 * cfg.HybridDepth)}
+	entries, err := rdb.LRange(ctx, h.key, int64(-h.depth), -1).Result()
+	if err != nil {
+		client.logf("Failed to read %s for hybrid delivery: %v", h.key, err)
+	}
+	for _, payload := range entries {
+		h.seen.add(messageKey(payload))
+	}
+	return h
+}
+
+// first reports whether payload is seen for the first time.
+func (h *hybridPoller) first(payload string) bool {
+	return h == nil || h.seen.add(messageKey(payload))
+}
+
+// poll returns the list entries not seen yet, oldest first.
+func (h *hybridPoller) poll(ctx context.Context, rdb *redis.Client, client *SSEClient) []string {
+	entries, err := rdb.LRange(ctx, h.key, int64(-h.depth), -1).Result()
+	if err != nil {
+		client.logf("Failed to poll %s: %v", h.key, err)
+		return nil
+	}
+	var missed []string
+	now := time.Now()
+	for _, payload := range entries {
+		if h.seen.add(messageKey(payload)) && !tooOldToReplay(payload, now) {
+			missed = append(missed, payload)
+		}
+	}
+	return missed
+}
+
+func messageKey(payload string) string {
+	if cfg.EventIDField != "" {
+		if id := payloadScalar(payload, cfg.EventIDField); id != "" {
+			return id
+		}
+	}
+	return payload
+}
+
+// seenSet remembers the last max keys added.
+type seenSet struct {
+	max   int
+	keys  map[string]bool
+	order []string
+}
+
+func newSeenSet(max int) *seenSet {
+	return &seenSet{max: max, keys: make(map[string]bool, max)}
+}
+
+// add records key, reporting whether it was new.
+func (s *seenSet) add(key string) bool {
+	if s.keys[key] {
+		return false
+	}
+	s.keys[key] = true
+	s.order = append(s.order, key)
+	if len(s.order) > s.max {
+		delete(s.keys, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+// remove forgets key, reporting whether it was there.
+func (s *seenSet) remove(key string) bool {
+	if !s.keys[key] {
+		return false
+	}
+	delete(s.keys, key)
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
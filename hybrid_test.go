@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func hybridSidecar(t *testing.T) (*sseStream, func(payload string, published bool)) {
+	t.Helper()
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.HybridDelivery = true
+		c.HybridInterval = 20 * time.Millisecond
+		c.EventIDField = "id"
+	})
+	mr.RPush(historyKey(1571), `{"id": "old"}`)
+	s, _ := connect(t, srv, 1571, nil)
+	// send is the app's publish: the history entry, then the pub/sub message,
+	// unless it's lost on the way.
+	send := func(payload string, published bool) {
+		mr.RPush(historyKey(1571), payload)
+		if published {
+			mr.Publish("events:user:1571", payload)
+		}
+	}
+	return s, send
+}
+
+func TestHybridRecoversDroppedMessage(t *testing.T) {
+	s, send := hybridSidecar(t)
+	send(`{"id": "1"}`, true)
+	s.nextData(t)
+
+	recovered := metrics.hybridRecovered.Load()
+	send(`{"id": "2"}`, false)
+	if ev := s.nextData(t); ev.id != "2" {
+		t.Fatalf("got %+v, want the message pub/sub dropped", ev)
+	}
+	if n := metrics.hybridRecovered.Load() - recovered; n != 1 {
+		t.Errorf("%d recovered, want 1", n)
+	}
+	send(`{"id": "3"}`, true)
+	if ev := s.nextData(t); ev.id != "3" {
+		t.Errorf("got %+v after the recovered one", ev)
+	}
+}
+
+func TestHybridDeliversOnce(t *testing.T) {
+	s, send := hybridSidecar(t)
+	send(`{"id": "a"}`, true)
+	if ev := s.nextData(t); ev.id != "a" {
+		t.Fatalf("got %+v", ev)
+	}
+	// Several polls later, neither the live message nor the entry listed
+	// before the connection was sent again.
+	time.Sleep(100 * time.Millisecond)
+	send(`{"id": "b"}`, true)
+	if ev := s.nextData(t); ev.id != "b" {
+		t.Errorf("got %+v, want the next live message", ev)
+	}
+}
+
+func TestSeenSetBounded(t *testing.T) {
+	s := newSeenSet(2)
+	for _, key := range []string{"a", "b", "c"} {
+		if !s.add(key) {
+			t.Fatalf("%s not new", key)
+		}
+	}
+	if s.add("c") {
+		t.Error("c new again")
+	}
+	// a was forgotten to make room.
+	if !s.add("a") {
+		t.Error("a still remembered past the bound")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxJWKSBytes bounds the key set read from the JWKS URL.
+const maxJWKSBytes = 1 << 20
+
+// jwksCache fetches a remote JSON Web Key Set and caches its keys by `kid`.
+// The set is refreshed when it is older than ttl or when an unknown kid is
+// requested, but never more often than minRefresh. When a refresh fails the
+// previously fetched keys keep being served.
+type jwksCache struct {
+	url        string
+	ttl        time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]jwk
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	// fetching is closed once the refresh in progress is done, nil without
+	// one. The fetch itself runs without mu held.
+	fetching chan struct{}
+}
+
+type jwk struct {
+	alg string
+	key interface{}
+}
+
+func newJWKSCache(url string, ttl, minRefresh time.Duration) *jwksCache {
+	return &jwksCache{
+		url:        url,
+		ttl:        ttl,
+		minRefresh: minRefresh,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// jwks is set in main when GO_SSE_SIDECAR_JWKS_URL is configured.
+var jwks *jwksCache
+
+// key returns the verification key for kid, to be used with alg. A known key
+// is served while the set is refreshed in the background, an unknown kid
+// waits for the refresh.
+func (c *jwksCache) key(kid, alg string) (interface{}, error) {
+	c.mu.Lock()
+	now := time.Now()
+	k, ok := c.keys[kid]
+	stale := now.Sub(c.fetchedAt) > c.ttl
+	done := c.fetching
+	if done == nil && (!ok || stale) && now.Sub(c.lastAttempt) >= c.minRefresh {
+		c.lastAttempt = now
+		done = make(chan struct{})
+		c.fetching = done
+		go c.refresh(done)
+	}
+	c.mu.Unlock()
+
+	if !ok && done != nil {
+		<-done
+		c.mu.Lock()
+		k, ok = c.keys[kid]
+		c.mu.Unlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if k.alg != "" && k.alg != alg {
+		return nil, fmt.Errorf("kid %q is for %s, not %s", kid, k.alg, alg)
+	}
+	return k.key, nil
+}
+
+// refresh fetches the set and swaps the keys in, then closes done.
+func (c *jwksCache) refresh(done chan struct{}) {
+	keys, err := c.fetch()
+
+	c.mu.Lock()
+	if err != nil {
+		log.Printf("[JWKS] Refresh from %s failed, serving cached keys: %v", c.url, err)
+	} else {
+		c.keys = keys
+		c.fetchedAt = time.Now()
+		log.Printf("[JWKS] Loaded %d keys from %s", len(keys), c.url)
+	}
+	c.fetching = nil
+	c.mu.Unlock()
+	close(done)
+}
+
+func (c *jwksCache) fetch() (map[string]jwk, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode: %v", err)
+	}
+
+	keys := make(map[string]jwk, len(set.Keys))
+	for _, raw := range set.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		key, err := raw.publicKey()
+		if err != nil {
+			log.Printf("[JWKS] Skipping key %q: %v", raw.Kid, err)
+			continue
+		}
+		keys[raw.Kid] = jwk{alg: raw.Alg, key: key}
+	}
+	return keys, nil
+}
+
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (k rawJWK) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeJWKInt(v string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
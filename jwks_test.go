@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksServer serves the keys by kid, and counts the fetches. Fetches block
+// while hold is set.
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*ecdsa.PublicKey
+	fetches atomic.Int32
+	hold    chan struct{}
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	s := &jwksServer{keys: make(map[string]*ecdsa.PublicKey)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		hold := s.hold
+		var set []map[string]string
+		for kid, key := range s.keys {
+			set = append(set, map[string]string{
+				"kty": "EC", "crv": "P-256", "kid": kid, "alg": "ES256", "use": "sig",
+				"x": base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+				"y": base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+			})
+		}
+		s.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) add(kid string, key *ecdsa.PublicKey) {
+	s.mu.Lock()
+	s.keys[kid] = key
+	s.mu.Unlock()
+}
+
+func TestJWKSVerifiesRotatedKey(t *testing.T) {
+	useConfig(t, func(c *Config) { c.JWTAlgs = []string{"ES256"} })
+	srv := newJWKSServer(t)
+	old := jwks
+	jwks = newJWKSCache(srv.URL, time.Hour, 0)
+	t.Cleanup(func() { jwks = old })
+
+	first := newECKey(t)
+	srv.add("k1", &first.PublicKey)
+	sign := func(kid string, key *ecdsa.PrivateKey) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"user_id": 3})
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if _, err := verifySseToken(sign("k1", first), ""); err != nil {
+		t.Fatalf("k1: %v", err)
+	}
+
+	// An unknown kid fetches the set again.
+	second := newECKey(t)
+	srv.add("k2", &second.PublicKey)
+	if _, err := verifySseToken(sign("k2", second), ""); err != nil {
+		t.Fatalf("k2 after rotation: %v", err)
+	}
+	if n := srv.fetches.Load(); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+	if _, err := verifySseToken(sign("k2", first), ""); err == nil {
+		t.Error("token signed by k1's key accepted as k2")
+	}
+}
+
+func TestJWKSServesKnownKeysDuringRefresh(t *testing.T) {
+	srv := newJWKSServer(t)
+	key := newECKey(t)
+	srv.add("k1", &key.PublicKey)
+	c := newJWKSCache(srv.URL, time.Millisecond, 0)
+	if _, err := c.key("k1", "ES256"); err != nil {
+		t.Fatal(err)
+	}
+
+	hold := make(chan struct{})
+	srv.mu.Lock()
+	srv.hold = hold
+	srv.mu.Unlock()
+	defer close(hold)
+	time.Sleep(2 * time.Millisecond)
+
+	// The stale set starts a refresh which blocks, the cached key is still
+	// served meanwhile.
+	got := make(chan error, 1)
+	go func() {
+		_, err := c.key("k1", "ES256")
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("key lookup blocked by the refresh")
+	}
+	waitFor(t, "the refresh fetch", func() bool { return srv.fetches.Load() == 2 })
+	if _, err := c.key("k1", "ES256"); err != nil {
+		t.Fatalf("lookup during the refresh: %v", err)
+	}
+}
+
+func TestJWKSConcurrentUnknownKidFetchesOnce(t *testing.T) {
+	srv := newJWKSServer(t)
+	key := newECKey(t)
+	srv.add("k1", &key.PublicKey)
+	hold := make(chan struct{})
+	srv.hold = hold
+	c := newJWKSCache(srv.URL, time.Hour, 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.key("k1", "ES256")
+			errs <- err
+		}()
+	}
+	waitFor(t, "the first fetch", func() bool { return srv.fetches.Load() == 1 })
+	time.Sleep(10 * time.Millisecond)
+	close(hold)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("waiting lookup: %v", err)
+		}
+	}
+	if n := srv.fetches.Load(); n != 1 {
+		t.Errorf("%d fetches for concurrent lookups, want 1", n)
+	}
+}
+
+func TestJWKSRejectsOversizedSet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys": [], "padding": "` + strings.Repeat("x", maxJWKSBytes) + `"}`))
+	}))
+	defer srv.Close()
+	c := newJWKSCache(srv.URL, time.Hour, 0)
+
+	if _, err := c.fetch(); err == nil {
+		t.Fatal("set larger than maxJWKSBytes decoded")
+	}
+}
+
+func TestJWKSKeyAlgorithmMismatch(t *testing.T) {
+	srv := newJWKSServer(t)
+	key := newECKey(t)
+	srv.add("k1", &key.PublicKey)
+	c := newJWKSCache(srv.URL, time.Hour, 0)
+
+	if _, err := c.key("k1", "RS256"); err == nil {
+		t.Error("ES256 key returned for RS256")
+	}
+}
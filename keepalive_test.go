@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveFrames(t *testing.T) {
+	now := time.UnixMilli(1700000000123)
+	for format, want := range map[string]string{
+		"comment": ": keepalive\n\n",
+		"event":   "event: ping\ndata: {\"unix_ms\":1700000000123}\n\n",
+	} {
+		useConfig(t, func(c *Config) { c.KeepaliveFormat = format })
+		var b strings.Builder
+		if err := writeKeepalive(&b, now); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Errorf("%s: wrote %q, want %q", format, b.String(), want)
+		}
+	}
+}
+
+func TestStreamKeepaliveComment(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.KeepaliveInterval = 20 * time.Millisecond })
+	s, _ := connect(t, srv, 1731, nil)
+	ev := s.next(t)
+	if ev.event != "" || ev.data != "" || len(ev.comments) != 1 || ev.comments[0] != "keepalive" {
+		t.Fatalf("got %+v, want a keepalive comment", ev)
+	}
+	// EventSource dispatches nothing for it, the next event is the message.
+	rdb.Publish(ctx, "events:user:1731", "after")
+	if ev := s.nextData(t); ev.data != "after" {
+		t.Errorf("got %q", ev.data)
+	}
+}
+
+func TestStreamKeepaliveEvent(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.KeepaliveInterval = 20 * time.Millisecond
+		c.KeepaliveFormat = "event"
+	})
+	s, _ := connect(t, srv, 1732, nil)
+	ev := s.nextEvent(t, "ping")
+	var data struct {
+		UnixMs int64 `json:"unix_ms"`
+	}
+	if err := json.Unmarshal([]byte(ev.data), &data); err != nil {
+		t.Fatalf("ping data %q: %v", ev.data, err)
+	}
+	if d := time.Since(time.UnixMilli(data.UnixMs)); d < 0 || d > time.Second {
+		t.Errorf("ping at %v, want the server time", time.UnixMilli(data.UnixMs))
+	}
+	if len(ev.comments) != 0 {
+		t.Errorf("ping with comments %q", ev.comments)
+	}
+}
+
+func TestKeepaliveCommentByDefault(t *testing.T) {
+	useConfig(t, nil)
+	if cfg.KeepaliveFormat != "comment" {
+		t.Errorf("GO_SSE_SIDECAR_KEEPALIVE_FORMAT defaults to %q", cfg.KeepaliveFormat)
+	}
+}
+
+func TestKeepaliveDerivedFromProxyIdleTimeout(t *testing.T) {
+	var logs strings.Builder
+	old := log.Writer()
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(old) })
+
+	for _, tt := range []struct {
+		proxy, interval time.Duration
+		explicit        bool
+		want            time.Duration
+		warned          bool
+	}{
+		// nginx's proxy_read_timeout, and a cloud load balancer's.
+		{60 * time.Second, 0, false, 30 * time.Second, false},
+		{350 * time.Second, 0, false, 175 * time.Second, false},
+		// Set below the proxy timeout, it's kept.
+		{60 * time.Second, 15 * time.Second, true, 15 * time.Second, false},
+		// Kept too, but it doesn't beat the proxy.
+		{60 * time.Second, 90 * time.Second, true, 90 * time.Second, true},
+		{60 * time.Second, 0, true, 0, true},
+	} {
+		logs.Reset()
+		if got := keepaliveBelow(tt.proxy, tt.interval, tt.explicit); got != tt.want {
+			t.Errorf("proxy %v, interval %v (explicit %v): %v, want %v", tt.proxy, tt.interval, tt.explicit, got, tt.want)
+		}
+		if warned := strings.Contains(logs.String(), "WARNING"); warned != tt.warned {
+			t.Errorf("proxy %v, interval %v: warned %v, logged %q", tt.proxy, tt.interval, warned, logs.String())
+		}
+		if !tt.warned && !strings.Contains(logs.String(), "Keepalive every "+tt.want.String()) {
+			t.Errorf("effective interval not logged: %q", logs.String())
+		}
+	}
+}
+
+func TestProxyIdleTimeoutFromEnv(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_PROXY_IDLE_TIMEOUT", "60s")
+	useConfig(t, nil)
+	if cfg.KeepaliveInterval != 30*time.Second {
+		t.Errorf("keepalive %v, want half the proxy idle timeout", cfg.KeepaliveInterval)
+	}
+	t.Setenv("GO_SSE_SIDECAR_KEEPALIVE_INTERVAL", "10s")
+	useConfig(t, nil)
+	if cfg.KeepaliveInterval != 10*time.Second {
+		t.Errorf("keepalive %v, want the explicit interval", cfg.KeepaliveInterval)
+	}
+	t.Setenv("GO_SSE_SIDECAR_PROXY_IDLE_TIMEOUT", "")
+	useConfig(t, nil)
+	if cfg.ProxyIdleTimeout != 0 {
+		t.Errorf("proxy idle timeout %v by default", cfg.ProxyIdleTimeout)
+	}
+}
+
+// keepalivesWhileBusy publishes to the user every 40ms for 600ms, with a
+// keepalive interval of 150ms, and returns the stream and the keepalives
+// read meanwhile.
+func keepalivesWhileBusy(t *testing.T, userID int64, idleOnly bool) (*sseStream, int) {
+	t.Helper()
+	_, srv := newSidecar(t, func(c *Config) {
+		c.KeepaliveInterval = 150 * time.Millisecond
+		c.KeepaliveIdleOnly = idleOnly
+	})
+	s, _ := connect(t, srv, userID, nil)
+	channel := userChannel(userID)
+	const events = 15
+	go func() {
+		for i := 0; i < events; i++ {
+			rdb.Publish(ctx, channel, "busy")
+			time.Sleep(40 * time.Millisecond)
+		}
+	}()
+	keepalives := 0
+	for received := 0; received < events; {
+		ev := s.next(t)
+		if len(ev.comments) == 1 && ev.comments[0] == "keepalive" {
+			keepalives++
+		} else if ev.data == "busy" {
+			received++
+		}
+	}
+	return s, keepalives
+}
+
+func TestNoKeepaliveWhileEventsFlow(t *testing.T) {
+	s, keepalives := keepalivesWhileBusy(t, 2291, true)
+	if keepalives != 0 {
+		t.Errorf("%d keepalives while events flowed", keepalives)
+	}
+	// Idle, one comes an interval after the last event.
+	last := time.Now()
+	ev := s.next(t)
+	if len(ev.comments) != 1 || ev.comments[0] != "keepalive" {
+		t.Fatalf("got %+v once idle, want a keepalive", ev)
+	}
+	if d := time.Since(last); d < 100*time.Millisecond {
+		t.Errorf("keepalive %v after the last event, want about the interval", d)
+	}
+}
+
+func TestKeepaliveTickerByDefault(t *testing.T) {
+	if _, keepalives := keepalivesWhileBusy(t, 2292, false); keepalives < 2 {
+		t.Errorf("%d keepalives in 600ms at a 150ms interval, want them sent while busy", keepalives)
+	}
+}
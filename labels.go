@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// otherLabel is the label value the values past cfg.MetricLabelLimit are
+// counted under.
+const otherLabel = "other"
+
+// labeledCounter is a counter with one label whose values aren't all known
+// in advance. Past cfg.MetricLabelLimit distinct values, new ones are
+// counted as "other", so a label derived from input can't grow the metrics
+// without bound. Preset values are never capped, which is all the reason of
+// sse_streams_closed_total takes: closeCounts never collapses, the limit is
+// there for labels that come from input.
+type labeledCounter struct {
+	name, label, help string
+
+	mu     sync.Mutex
+	values []string
+	counts map[string]*atomic.Int64
+	// collapsing logs once that values are counted as "other".
+	collapsing sync.Once
+}
+
+// labeledCounters are exported after metricDefs.
+var labeledCounters []*labeledCounter
+
+// newLabeledCounter registers a counter, with a series for each of values
+// from the start, whatever the limit.
+func newLabeledCounter(name, label, help string, values []string) *labeledCounter {
+	l := &labeledCounter{name: name, label: label, help: help, counts: make(map[string]*atomic.Int64)}
+	for _, v := range values {
+		l.values = append(l.values, v)
+		l.counts[v] = new(atomic.Int64)
+	}
+	labeledCounters = append(labeledCounters, l)
+	return l
+}
+
+func (l *labeledCounter) add(value string) {
+	l.counter(value).Add(1)
+}
+
+func (l *labeledCounter) counter(value string) *atomic.Int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.counts[value]; ok {
+		return c
+	}
+	if len(l.values) >= cfg.MetricLabelLimit {
+		l.collapsing.Do(func() {
+			log.Printf("[METRICS] %s has %d %s values, counting new ones as %q", l.name, len(l.values), l.label, otherLabel)
+		})
+		value = otherLabel
+		if c, ok := l.counts[value]; ok {
+			return c
+		}
+	}
+	c := new(atomic.Int64)
+	l.values = append(l.values, value)
+	l.counts[value] = c
+	return c
+}
+
+// defs describes the counter's series for the exporters.
+func (l *labeledCounter) defs() []metricDef {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defs := make([]metricDef, 0, len(l.values))
+	for _, v := range l.values {
+		defs = append(defs, metricDef{fmt.Sprintf("%s{%s=%q}", l.name, l.label, v), l.help, counterMetric, counterValue(l.counts[v])})
+	}
+	return defs
+}
+
+// allMetrics returns metricDefs, the series of the labeled counters and the
+// per-transport ones.
+func allMetrics() []metricDef {
+	defs := metricDefs[:len(metricDefs):len(metricDefs)]
+	for _, l := range labeledCounters {
+		defs = append(defs, l.defs()...)
+	}
+	return append(defs, transportDefs()...)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLabeledCounterCapped(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MetricLabelLimit = 5 })
+	var logs bytes.Buffer
+	old := log.Writer()
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(old) })
+
+	l := &labeledCounter{name: "sse_test_total", label: "reason", counts: make(map[string]*atomic.Int64)}
+	l.add("known")
+	for i := 0; i < 1000; i++ {
+		l.add(fmt.Sprintf("reason-%d", i))
+	}
+	l.add("known")
+
+	// The limit, plus the other bucket.
+	if defs := l.defs(); len(defs) != 6 {
+		t.Errorf("%d series, want 6", len(defs))
+	}
+	if n := l.counts["known"].Load(); n != 2 {
+		t.Errorf("known value counted %d times, want 2", n)
+	}
+	if n := l.counts[otherLabel].Load(); n != 996 {
+		t.Errorf("%d counted as other, want 996", n)
+	}
+	if n := strings.Count(logs.String(), "counting new ones as"); n != 1 {
+		t.Errorf("collapsing logged %d times, want once", n)
+	}
+}
+
+func TestLabeledCounterKeepsPresetValues(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MetricLabelLimit = 1 })
+	before := len(labeledCounters)
+	l := newLabeledCounter("sse_test_total", "reason", "Test.", []string{"a", "b", "c"})
+	t.Cleanup(func() { labeledCounters = labeledCounters[:before] })
+	l.add("c")
+	l.add("d")
+	if got := len(l.defs()); got != 4 {
+		t.Errorf("%d series, want the 3 preset and other", got)
+	}
+	if l.counts["c"].Load() != 1 || l.counts[otherLabel].Load() != 1 {
+		t.Error("values miscounted")
+	}
+}
+
+func TestCloseReasonsNeverCollapse(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MetricLabelLimit = 1 })
+	for _, reason := range closeReasons {
+		if closeCounts.counter(reason) != closeCounts.counts[reason] {
+			t.Errorf("close reason %s not counted in its own series", reason)
+		}
+	}
+	closeCounts.mu.Lock()
+	defer closeCounts.mu.Unlock()
+	if _, ok := closeCounts.counts[otherLabel]; ok || len(closeCounts.values) != len(closeReasons) {
+		t.Errorf("sse_streams_closed_total has values %v, want only the close reasons", closeCounts.values)
+	}
+}
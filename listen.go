@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// handOffGrace is how long the connections closed by a handoff get to end,
+// after cfg.CloseSpread.
+const handOffGrace = 10 * time.Second
+
+// listen opens the listener of srv. Accepted connections get TCP keepalive
+// probes every cfg.TCPKeepalive, so the OS notices a peer that vanished
+// without a FIN (ex: a laptop put to sleep) even between heartbeats. With
+// cfg.ReusePort another process can listen on the same port.
+func listen(srv *http.Server) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: cfg.TCPKeepalive}
+	if cfg.TCPKeepalive == 0 {
+		// Zero would be Go's default of 15s, negative disables keepalive.
+		lc.KeepAlive = -1
+	}
+	if cfg.ReusePort {
+		lc.Control = reusePort
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", srv.Addr)
+	if err != nil || cfg.TCPKeepalive <= 0 {
+		return ln, err
+	}
+	return keepaliveListener{ln, cfg.TCPKeepalive}, nil
+}
+
+// keepaliveListener probes accepted connections every interval once idle,
+// not only after the idle time the listener sets.
+type keepaliveListener struct {
+	net.Listener
+	interval time.Duration
+}
+
+func (l keepaliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if err := setKeepaliveInterval(tc, l.interval); err != nil {
+			log.Printf("[SSE-SIDECAR] Failed to set the TCP keepalive interval: %v", err)
+		}
+	}
+	return conn, err
+}
+
+func serve(srv *http.Server) error {
+	ln, err := listen(srv)
+	if err != nil {
+		return err
+	}
+	handedOff := make(chan struct{})
+	if cfg.ReusePort {
+		go handOffOnSignal(srv, handedOff)
+	}
+	if cfg.TLSCert != "" {
+		err = srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+	} else {
+		err = srv.Serve(ln)
+	}
+	// With cfg.ReusePort, a handoff shuts the server down and then drains.
+	if cfg.ReusePort && errors.Is(err, http.ErrServerClosed) {
+		<-handedOff
+		return nil
+	}
+	return err
+}
+
+// handOffOnSignal hands the port over to the other processes listening on
+// it on SIGTERM: it stops accepting, so the kernel sends new connections to
+// them, and drains the open ones, which reconnect there.
+func handOffOnSignal(srv *http.Server, done chan<- struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	<-sig
+
+	log.Printf("[SSE-SIDECAR] SIGTERM, handing the port over")
+	startDraining()
+	ctx, cancel := context.WithTimeout(context.Background(), min(cfg.CloseSpread, maxCloseSpread)+handOffGrace)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = waitWebSockets(ctx)
+	}
+	if err == nil {
+		// Long-poll sessions and closing subscriptions outlive their requests.
+		err = waitConnWork(ctx)
+	}
+	if err != nil {
+		log.Printf("[SSE-SIDECAR] Handoff ended with connections still open: %v", err)
+	}
+	close(done)
+}
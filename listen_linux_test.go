@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// acceptedKeepalive accepts a connection on a listener opened by listen and
+// returns its SO_KEEPALIVE, TCP_KEEPIDLE and TCP_KEEPINTVL (in seconds)
+// options.
+func acceptedKeepalive(t *testing.T) (on, idle, interval int) {
+	t.Helper()
+	ln, err := listen(&http.Server{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		on, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		idle, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		interval, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+	})
+	return on, idle, interval
+}
+
+func TestAcceptedConnectionsKeptAlive(t *testing.T) {
+	useConfig(t, func(c *Config) { c.TCPKeepalive = 7 * time.Second })
+	if on, idle, interval := acceptedKeepalive(t); on != 1 || idle != 7 || interval != 7 {
+		t.Errorf("SO_KEEPALIVE %d, idle %ds, interval %ds; want probes every 7s", on, idle, interval)
+	}
+}
+
+func TestTCPKeepaliveDisabled(t *testing.T) {
+	useConfig(t, func(c *Config) { c.TCPKeepalive = 0 })
+	if on, _, _ := acceptedKeepalive(t); on != 0 {
+		t.Error("keepalive set with GO_SSE_SIDECAR_TCP_KEEPALIVE=0")
+	}
+}
+
+func TestTCPKeepaliveDefault(t *testing.T) {
+	useConfig(t, nil)
+	if cfg.TCPKeepalive != 15*time.Second {
+		t.Errorf("default %v, want 15s", cfg.TCPKeepalive)
+	}
+}
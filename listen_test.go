@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestListenHelperProcess listens on GO_SSE_SIDECAR_TEST_LISTEN for
+// listenInOtherProcess, and reports how that went on stdout.
+func TestListenHelperProcess(t *testing.T) {
+	addr := os.Getenv("GO_SSE_SIDECAR_TEST_LISTEN")
+	if addr == "" {
+		t.Skip("only run as a helper process")
+	}
+	useConfig(t, nil)
+	ln, err := listen(&http.Server{Addr: addr})
+	if err != nil {
+		os.Stdout.WriteString("error: " + err.Error() + "\n")
+		return
+	}
+	defer ln.Close()
+	os.Stdout.WriteString("listening\n")
+	// Serve a connection, so the parent knows the port is shared.
+	if conn, err := ln.Accept(); err == nil {
+		conn.Write([]byte("child\n"))
+		conn.Close()
+	}
+}
+
+// listenInOtherProcess listens on addr in another process, with reuseport
+// as given, and returns its first line of output.
+func listenInOtherProcess(t *testing.T, addr string, reuseport bool) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenHelperProcess$")
+	cmd.Env = append(os.Environ(), "GO_SSE_SIDECAR_TEST_LISTEN="+addr, "GO_SSE_SIDECAR_REUSEPORT="+map[bool]string{true: "true", false: "false"}[reuseport])
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	line, _ := bufio.NewReader(out).ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+func TestReusePortSharedWithOtherProcess(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT not supported")
+	}
+	useConfig(t, func(c *Config) { c.ReusePort = true })
+	ln, err := listen(&http.Server{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if got := listenInOtherProcess(t, addr, true); got != "listening" {
+		t.Fatalf("other process: %s", got)
+	}
+
+	// Once this process stops accepting, the other one gets the connections.
+	ln.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+			if line == "child\n" {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no connection handed over: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPortNotSharedWithoutReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT not supported")
+	}
+	useConfig(t, func(c *Config) { c.ReusePort = true })
+	ln, err := listen(&http.Server{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if got := listenInOtherProcess(t, ln.Addr().String(), false); !strings.Contains(got, "address already in use") {
+		t.Errorf("other process without reuseport: %q, want the bind refused", got)
+	}
+}
+
+func TestServeReturnsWhenClosed(t *testing.T) {
+	srv := &http.Server{Addr: "127.0.0.1:0"}
+	useConfig(t, nil)
+	done := make(chan error, 1)
+	go func() { done <- serve(srv) }()
+	time.Sleep(50 * time.Millisecond)
+	srv.Close()
+	if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("serve without reuseport: %v, want ErrServerClosed", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// loadTestUserBase keeps the load test users away from real user IDs.
+const loadTestUserBase = 900_000_000
+
+type loadTestPayload struct {
+	Seq    int   `json:"loadtest_seq"`
+	SentNs int64 `json:"sent_ns"`
+}
+
+// runLoadTest serves the registered handlers on a local port, opens
+// cfg.LoadTestConnections SSE connections, publishes cfg.LoadTestMessages
+// messages to each of them through Redis and prints throughput, drop rate
+// and latency percentiles. It never runs as part of the normal server.
+func runLoadTest() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("[LOADTEST] Listen: %v", err)
+	}
+	go http.Serve(ln, nil)
+
+	n, perConn := cfg.LoadTestConnections, cfg.LoadTestMessages
+	fmt.Printf("Load test: %d connections, %d messages each, %d msg/s\n", n, perConn, cfg.LoadTestRate)
+
+	// The per-message logs would dominate the measurement.
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var (
+		received  atomic.Int64
+		mu        sync.Mutex
+		latencies []time.Duration
+		ready     sync.WaitGroup
+		done      sync.WaitGroup
+	)
+	ready.Add(n)
+	done.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func(userID int64) {
+			defer done.Done()
+			if err := loadTestClient(ln.Addr().String(), userID, perConn, &ready, func(latency time.Duration) {
+				received.Add(1)
+				mu.Lock()
+				latencies = append(latencies, latency)
+				mu.Unlock()
+			}); err != nil {
+				fmt.Printf("client %d: %v\n", userID, err)
+			}
+		}(int64(loadTestUserBase + i))
+	}
+	ready.Wait()
+	// Give the subscriptions a moment to be confirmed by Redis.
+	time.Sleep(500 * time.Millisecond)
+
+	start := time.Now()
+	interval := time.Second / time.Duration(cfg.LoadTestRate)
+	published := 0
+	for seq := 0; seq < perConn; seq++ {
+		for i := 0; i < n; i++ {
+			b, _ := json.Marshal(loadTestPayload{Seq: seq, SentNs: time.Now().UnixNano()})
+			if err := rdb.Publish(ctx, userChannel(int64(loadTestUserBase+i)), b).Err(); err != nil {
+				fmt.Printf("publish: %v\n", err)
+				continue
+			}
+			published++
+			time.Sleep(time.Until(start.Add(time.Duration(published) * interval)))
+		}
+	}
+	publishTime := time.Since(start)
+
+	waitDone := make(chan struct{})
+	go func() { done.Wait(); close(waitDone) }()
+	select {
+	case <-waitDone:
+	case <-time.After(5 * time.Second):
+	}
+	elapsed := time.Since(start)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	got := received.Load()
+
+	fmt.Printf("published:  %d in %v\n", published, publishTime.Round(time.Millisecond))
+	fmt.Printf("received:   %d (%.2f msg/s)\n", got, float64(got)/elapsed.Seconds())
+	fmt.Printf("drop rate:  %.2f%%\n", 100*(1-float64(got)/float64(max(published, 1))))
+	if len(latencies) > 0 {
+		fmt.Printf("latency:    p50 %v  p90 %v  p99 %v  max %v\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	}
+}
+
+// loadTestClient reads an SSE stream until it got want messages, reporting
+// the latency of each.
+func loadTestClient(addr string, userID int64, want int, ready *sync.WaitGroup, observe func(time.Duration)) error {
+	signalled := false
+	signal := func() {
+		if !signalled {
+			signalled = true
+			ready.Done()
+		}
+	}
+	defer signal()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, SSETokenClaims{
+		UserID:           userID,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}).SignedString([]byte(signingKeys.hmacSecret()))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 0}
+	resp, err := client.Get(fmt.Sprintf("http://%s/sse-events?ssetoken=%s", addr, token))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	signal()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for got := 0; got < want && scanner.Scan(); {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var p loadTestPayload
+		if json.Unmarshal([]byte(data), &p) != nil || p.SentNs == 0 {
+			continue
+		}
+		observe(time.Since(time.Unix(0, p.SentNs)))
+		got++
+	}
+	return scanner.Err()
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
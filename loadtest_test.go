@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var loadTestRoutes sync.Once
+
+func TestRunLoadTestReportsEveryMessage(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.LoadTestConnections = 2
+		c.LoadTestMessages = 3
+		c.LoadTestRate = 1000
+	})
+	useRedis(t)
+	// runLoadTest serves the default mux, as main sets it up.
+	loadTestRoutes.Do(func() { http.HandleFunc("/sse-events", sseHandler) })
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, logs := os.Stdout, log.Writer()
+	os.Stdout = w
+	runLoadTest()
+	os.Stdout = stdout
+	log.SetOutput(logs)
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	for _, want := range []string{"Load test: 2 connections, 3 messages each", "published:  6", "received:   6", "drop rate:  0.00%", "latency:    p50"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("report lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if p := percentile(sorted, 50); p != 5 {
+		t.Errorf("p50 = %v", p)
+	}
+	if p := percentile(sorted, 99); p != 9 {
+		t.Errorf("p99 = %v", p)
+	}
+	if p := percentile(sorted[:1], 90); p != 1 {
+		t.Errorf("p90 of one = %v", p)
+	}
+}
+
+// BenchmarkWriteMessage frames a message and flushes it, the work done for
+// every delivered event, for each framing.
+func BenchmarkWriteMessage(b *testing.B) {
+	payload := `{"event_type":"order_paid","id":"8c1f","amount":1250,"currency":"EUR"}`
+	for _, bm := range []struct {
+		name string
+		set  func(c *Config)
+		opts connOptions
+	}{
+		{"raw", nil, connOptions{}},
+		{"event_id", func(c *Config) { c.EventIDField = "id" }, connOptions{}},
+		{"envelope", func(c *Config) { c.EventField = "event_type" }, connOptions{envelope: true}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			useConfig(b, bm.set)
+			client := &SSEClient{id: "bench", userID: 1, opts: bm.opts}
+			msg := sseMessage{channel: "events:user:1", payload: payload, seq: 1}
+			rec := httptest.NewRecorder()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rec.Body.Reset()
+				if err := client.writeMessage(rec, msg); err != nil {
+					b.Fatal(err)
+				}
+				rec.Flush()
+			}
+		})
+	}
+}
+
+// BenchmarkDeliver queues a message for a connection, takes it off the
+// queue and writes and flushes it, as the stream's writer does.
+func BenchmarkDeliver(b *testing.B) {
+	useConfig(b, nil)
+	client := &SSEClient{
+		id:      "bench",
+		userID:  1,
+		channel: make(chan sseMessage, 1),
+	}
+	payload := `{"event_type":"order_paid","id":"8c1f","amount":1250,"currency":"EUR"}`
+	rec := httptest.NewRecorder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec.Body.Reset()
+		if !client.enqueue(sseMessage{channel: "events:user:1", payload: payload}) {
+			b.Fatal("message dropped")
+		}
+		msg, _ := client.next()
+		if err := client.writeMessage(rec, msg); err != nil {
+			b.Fatal(err)
+		}
+		client.countDelivered()
+		rec.Flush()
+	}
+}
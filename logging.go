@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging sends the log package's output through a slog handler, in
+// `json` or `text` format. With no format, text is used when stderr is a
+// terminal and json otherwise.
+func setupLogging(format string) {
+	if format == "" {
+		format = defaultLogFormat(os.Stderr)
+	}
+	h, ok := newLogHandler(format, os.Stderr)
+	if !ok {
+		log.Fatalf("Invalid GO_SSE_SIDECAR_LOG_FORMAT %q, expected json or text", format)
+	}
+	slog.SetDefault(slog.New(tagHandler{h}))
+}
+
+func defaultLogFormat(f *os.File) string {
+	if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return "text"
+	}
+	return "json"
+}
+
+// newLogHandler returns the handler of format writing to w, or false for an
+// unknown format.
+func newLogHandler(format string, w io.Writer) (slog.Handler, bool) {
+	switch format {
+	case "json":
+		return slog.NewJSONHandler(w, nil), true
+	case "text":
+		return slog.NewTextHandler(w, nil), true
+	}
+	return nil, false
+}
+
+// tagHandler turns the leading `[SSE]` style tags of a log line into
+// attributes: the first one into `component` and `[conn <id>]` into
+// `conn_id`, so structured logs can be filtered on them. It also masks the
+// redacted fields (see redactJSON).
+type tagHandler struct {
+	slog.Handler
+}
+
+func (h tagHandler) Handle(ctx context.Context, r slog.Record) error {
+	msg := redactJSON(r.Message)
+	var attrs []slog.Attr
+	for strings.HasPrefix(msg, "[") {
+		tag, rest, ok := strings.Cut(msg[1:], "]")
+		if !ok {
+			break
+		}
+		if id, ok := strings.CutPrefix(tag, "conn "); ok {
+			attrs = append(attrs, slog.String("conn_id", id))
+		} else if len(attrs) == 0 {
+			attrs = append(attrs, slog.String("component", tag))
+		} else {
+			break
+		}
+		msg = strings.TrimPrefix(rest, " ")
+	}
+	if len(attrs) == 0 && msg == r.Message {
+		return h.Handler.Handle(ctx, r)
+	}
+
+	out := slog.NewRecord(r.Time, r.Level, msg, r.PC)
+	out.AddAttrs(attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(a)
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h tagHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return tagHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h tagHandler) WithGroup(name string) slog.Handler {
+	return tagHandler{h.Handler.WithGroup(name)}
+}
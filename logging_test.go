@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// logLine logs msg in format and returns the output.
+func logLine(t *testing.T, format, msg string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	h, ok := newLogHandler(format, &buf)
+	if !ok {
+		t.Fatalf("format %q refused", format)
+	}
+	slog.New(tagHandler{h}).Info(msg)
+	return buf.String()
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	out := logLine(t, "json", "[SSE] [conn c-1] Delivered 3 events")
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &line); err != nil {
+		t.Fatalf("%q: %v", out, err)
+	}
+	want := map[string]string{"level": "INFO", "msg": "Delivered 3 events", "component": "SSE", "conn_id": "c-1"}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("%s = %v, want %q", k, line[k], v)
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Error("no time")
+	}
+}
+
+func TestTextLogFormat(t *testing.T) {
+	out := logLine(t, "text", "[REDIS] Connected")
+	for _, want := range []string{"level=INFO", "msg=Connected", "component=REDIS"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q lacks %s", out, want)
+		}
+	}
+	if strings.HasPrefix(out, "{") {
+		t.Errorf("text format gave %q", out)
+	}
+}
+
+func TestLogFormatDefault(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "sidecar.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := defaultLogFormat(f); got != "json" {
+		t.Errorf("%s to a file, want json", got)
+	}
+	if _, ok := newLogHandler("yaml", &bytes.Buffer{}); ok {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	// Unset, for the default fields.
+	t.Setenv("GO_SSE_SIDECAR_LOG_REDACT", "")
+	os.Unsetenv("GO_SSE_SIDECAR_LOG_REDACT")
+	useConfig(t, nil)
+	for in, want := range map[string]string{
+		`{"user": "ann", "password": "hunter2"}`:          `{"user": "ann", "password":"[REDACTED]"}`,
+		`{"Token": "a\"b", "ssetoken":"eyJ"}`:             `{"Token":"[REDACTED]", "ssetoken":"[REDACTED]"}`,
+		`{"secret": 42, "api_key": null, "n": 1}`:         `{"secret":"[REDACTED]", "api_key":"[REDACTED]", "n": 1}`,
+		`{"auth": {"authorization": "Bearer x"}}`:         `{"auth": {"authorization":"[REDACTED]"}}`,
+		`{"tokens": 3, "password_hint": "pet"}`:           `{"tokens": 3, "password_hint": "pet"}`,
+		`Refused ack with a token for user 7`:             `Refused ack with a token for user 7`,
+		`payload [{"password": "p"}, {"password": true}]`: `payload [{"password":"[REDACTED]"}, {"password":"[REDACTED]"}]`,
+	} {
+		if got := redactJSON(in); got != want {
+			t.Errorf("%s:\n got %s\nwant %s", in, got, want)
+		}
+	}
+}
+
+func TestRedactFieldsConfigured(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_LOG_REDACT", "email,phone")
+	useConfig(t, nil)
+	if got := redactJSON(`{"email": "a@b.c", "phone": "555", "password": "p"}`); got != `{"email":"[REDACTED]", "phone":"[REDACTED]", "password": "p"}` {
+		t.Errorf("got %s, want only the listed fields masked", got)
+	}
+	t.Setenv("GO_SSE_SIDECAR_LOG_REDACT", "")
+	useConfig(t, nil)
+	if got := redactJSON(`{"password": "p"}`); got != `{"password": "p"}` {
+		t.Errorf("got %s with redaction disabled", got)
+	}
+}
+
+func TestLogLinesRedacted(t *testing.T) {
+	useConfig(t, nil)
+	out := logLine(t, "json", `[SSE] [conn c-1] Dropping {"email": "a@b.c", "token": "t0p"}`)
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &line); err != nil {
+		t.Fatalf("%q: %v", out, err)
+	}
+	if line["msg"] != `Dropping {"email": "a@b.c", "token":"[REDACTED]"}` || line["conn_id"] != "c-1" {
+		t.Errorf("logged %v", line)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type loopbackRequest struct {
+	UserID  int64           `json:"user_id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// loopbackHandler publishes a payload to a user's channel, so an SSE client
+// can be exercised end-to-end without the real publisher. A JSON string
+// payload is published as-is, anything else is published as raw JSON.
+func loopbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req loopbackRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	if err != nil || req.UserID == 0 || len(req.Payload) == 0 {
+		http.Error(w, "Expected JSON body with user_id and payload", http.StatusBadRequest)
+		return
+	}
+
+	payload := string(req.Payload)
+	var s string
+	if err := json.Unmarshal(req.Payload, &s); err == nil {
+		payload = s
+	}
+
+	receivers, err := rdb.Publish(r.Context(), userChannel(req.UserID), payload).Result()
+	if err != nil {
+		log.Printf("[LOOPBACK] Publish for user %d failed: %v", req.UserID, err)
+		http.Error(w, "Publish failed", http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("[LOOPBACK] Published to user %d (%d receivers)", req.UserID, receivers)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"receivers": receivers})
+}
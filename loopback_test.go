@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestLoopbackDeliversToUserStream(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin")
+	_, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 7, nil)
+
+	resp := post(t, srv.URL+"/loopback", `{"user_id": 7, "payload": {"hello": "world"}}`, "admin")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /loopback: %s", resp.Status)
+	}
+	var body struct {
+		Receivers int64 `json:"receivers"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Receivers != 1 {
+		t.Errorf("receivers = %d, want the one open stream", body.Receivers)
+	}
+	if ev := s.nextData(t); ev.data != `{"hello": "world"}` {
+		t.Errorf("delivered %q", ev.data)
+	}
+}
+
+func TestLoopbackPublishesStringPayloadAsIs(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin")
+	_, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 7, nil)
+
+	post(t, srv.URL+"/loopback", `{"user_id": 7, "payload": "plain text"}`, "admin")
+	if ev := s.nextData(t); ev.data != "plain text" {
+		t.Errorf("delivered %q, want the unquoted string", ev.data)
+	}
+}
+
+func TestLoopbackRequiresAdminToken(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin")
+	_, srv := newSidecar(t, nil)
+
+	for _, given := range []string{"", "wrong"} {
+		resp := post(t, srv.URL+"/loopback", `{"user_id": 7, "payload": 1}`, given)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: %s, want 401", given, resp.Status)
+		}
+	}
+	if resp := post(t, srv.URL+"/loopback", `{"payload": 1}`, "admin"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("without user_id: %s, want 400", resp.Status)
+	}
+}
@@ -2,24 +2,219 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
 )
 
 var ctx = context.Background()
 
+// rdb is the Redis client shared by all handlers, created in main.
+var rdb *redis.Client
+
 type SSEClient struct {
-	channel chan string
+	id     string
+	userID int64
+	claims *SSETokenClaims
+	// channels are the Redis channels subscribed on connect.
+	channels []string
+	channel  chan sseMessage
+	// priority queues the messages of cfg.PriorityChannels, nil without.
+	priority chan sseMessage
+	// close ends the connection from the server side.
+	close context.CancelFunc
+	// closeReason is set (as a string) when the server closes the
+	// connection, and reconnectReason when it also wants the client to come
+	// back. See closeWith and closeForReconnect.
+	closeReason     atomic.Value
+	reconnectReason atomic.Value
+	// migrateTarget is set (as a string) when the client is told to
+	// reconnect to another sidecar instead, see migrate.
+	migrateTarget atomic.Value
+
+	// opts are the framing options negotiated in the query.
+	opts connOptions
+	// presenceWatch are the users whose presence records are delivered.
+	presenceWatch map[int64]bool
+
+	// namespace prefixes the connection's Redis channels and keys.
+	namespace string
+	// db is the Redis of the connection's tenant, nil for the sidecar's
+	// own; see redisDB.
+	db *redis.Client
+	// feed is the named feed of the connection, nil for the default one.
+	feed *feedConfig
+
+	// metadata are the token claims published with the connection's
+	// presence, receipt and dead-letter records, eventMetadata the ones
+	// added to its events.
+	metadata      map[string]interface{}
+	eventMetadata map[string]interface{}
+
+	// transport is how the connection receives its events, transportSSE,
+	// transportPoll or transportWS.
+	transport string
+
+	// logSampled is whether this connection's lifecycle events are logged.
+	logSampled bool
+
+	segmentSeq int
+	// dedupe and seenIDs suppress the duplicates of the messages written.
+	dedupe  *dedupeFilter
+	seenIDs *idFilter
+	// pendingReceipts are the receipt ids of the messages written since the
+	// last flush.
+	pendingReceipts []string
+	// acks are the flushed receipt ids the browser can still ack.
+	acks *ackTracker
+	// enqueueSeq numbers every message queued (or dropped) for the client.
+	enqueueSeq atomic.Int64
+	// degradedEpisode is the memory pressure episode the client was last
+	// told about.
+	degradedEpisode atomic.Int64
+	// delivered and dropped count the connection's messages, sent in
+	// `event: stats`.
+	delivered atomic.Int64
+	dropped   atomic.Int64
+
+	// mu guards the live subscription and the token, changed by control and
+	// refresh requests, and pendingReceipts.
+	mu            sync.Mutex
+	sub           *subscriber
+	extraChannels map[string]bool
+	expiresAt     time.Time
+	refreshed     chan struct{}
+}
+
+// enqueue queues a message for the client without blocking, dropping it when
+// the client is too slow to keep up.
+func (c *SSEClient) enqueue(msg sseMessage) bool {
+	msg.enqueued = time.Now()
+	msg.seq = c.enqueueSeq.Add(1)
+	queue := c.queueFor(msg)
+	if c.shedUnderPressure(msg, queue) {
+		c.countDropped()
+		metrics.pressureShed.Add(1)
+		deadLetters.add(c, msg, "memory_pressure")
+		c.logf("Dropping message for user %d (memory pressure)", c.userID)
+		c.notifyDegraded()
+		return false
+	}
+	select {
+	case queue <- msg:
+		return true
+	default:
+		c.countDropped()
+		if delivery.isPaused() {
+			deadLetters.add(c, msg, "paused")
+			c.logf("Dropping message for user %d (buffer full while paused)", c.userID)
+			return false
+		}
+		deadLetters.add(c, msg, "slow_client")
+		c.logf("Dropping message for user %d (client slow)", c.userID)
+		return false
+	}
+}
+
+// logf prefixes every log line with the connection ID so a single
+// connection can be traced through the logs from a support ticket.
+func (c *SSEClient) logf(format string, args ...interface{}) {
+	log.Printf("[SSE] [conn %s] "+format, append([]interface{}{c.id}, args...)...)
+}
+
+// lifecyclef logs connection lifecycle events (connect, subscribe,
+// disconnect), which are sampled with GO_SSE_SIDECAR_CONN_LOG_SAMPLE.
+// Errors should use logf so they are always logged.
+func (c *SSEClient) lifecyclef(format string, args ...interface{}) {
+	if c.logSampled {
+		c.logf(format, args...)
+	}
+}
+
+// newConnectionID returns a random (version 4) UUID.
+func newConnectionID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatalf("Failed to generate connection ID: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// maxRequestIDBytes bounds a connection ID taken from a request header.
+const maxRequestIDBytes = 128
+
+// requestConnectionID returns the request ID set by the gateway in
+// cfg.RequestIDHeader as the connection ID, so the connection can be
+// followed across systems, or a new ID. Values with other characters than
+// letters, digits and `-_.:` are ignored since they end up in logs and
+// response headers, and so are IDs of a connection already open.
+func requestConnectionID(r *http.Request) string {
+	if cfg.RequestIDHeader == "" {
+		return newConnectionID()
+	}
+	id := r.Header.Get(cfg.RequestIDHeader)
+	if id == "" {
+		return newConnectionID()
+	}
+	if !validRequestID(id) {
+		log.Printf("[SSE] Ignoring invalid %s header (%d bytes)", cfg.RequestIDHeader, len(id))
+		return newConnectionID()
+	}
+	if registry.get(id) != nil {
+		log.Printf("[SSE] Ignoring %s %s, already used by an open connection", cfg.RequestIDHeader, id)
+		return newConnectionID()
+	}
+	return id
+}
+
+func validRequestID(id string) bool {
+	if len(id) > maxRequestIDBytes {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sampleConnection deterministically picks a rate fraction of connections
+// from their ID, so the connect and disconnect of one connection are either
+// both logged or both skipped.
+func sampleConnection(connID string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	return float64(shardOf(connID, 10000)) < rate*10000
 }
 
 func getRedisClient() *redis.Client {
 	url := os.Getenv("GO_SSE_SIDECAR_REDIS_URL")
+	if len(cfg.RedisURLs) > 0 {
+		if url != "" {
+			log.Fatal("Only one of GO_SSE_SIDECAR_REDIS_URL and GO_SSE_SIDECAR_REDIS_URLS can be set")
+		}
+		failover = newRedisFailover(cfg.RedisURLs)
+		opts := failover.options()
+		applyRedisCredentials(opts)
+		return redis.NewClient(opts)
+	}
 	if url == "" {
 		log.Fatal("GO_SSE_SIDECAR_REDIS_URL not set")
 	}
@@ -28,84 +223,266 @@ func getRedisClient() *redis.Client {
 	if err != nil {
 		log.Fatalf("Failed to parse Redis URL: %v", err)
 	}
+	applyRedisCredentials(opts)
 
 	return redis.NewClient(opts)
 }
 
-func subscribeToUserChannel(rdb *redis.Client, userID int64, msgChan chan<- string, ctx context.Context) {
-	channelName := fmt.Sprintf("events:user:%d", userID)
-	log.Printf("[SSE] Subscribing to Redis channel: %s", channelName)
-
-	pubsub := rdb.Subscribe(ctx, channelName)
-	defer pubsub.Close()
-
-	// Wait for subscription confirmation
-	_, err := pubsub.Receive(ctx)
-	if err != nil {
-		log.Printf("[SSE] Failed to subscribe to %s: %v", channelName, err)
-		return
+// applyRedisCredentials overrides the credentials of the Redis URL with
+// GO_SSE_SIDECAR_REDIS_USERNAME and GO_SSE_SIDECAR_REDIS_PASSWORD, or
+// GO_SSE_SIDECAR_REDIS_PASSWORD_FILE. The file is read again for every new
+// Redis connection, so a rotated password is picked up by the reconnects
+// that follow an auth failure, without a restart.
+func applyRedisCredentials(opts *redis.Options) {
+	if username := os.Getenv("GO_SSE_SIDECAR_REDIS_USERNAME"); username != "" {
+		opts.Username = username
 	}
-
-	ch := pubsub.Channel()
-
-	for {
-		select {
-		case msg := <-ch:
-			if msg != nil {
-				log.Printf("[SSE] User %d received message: %s", userID, msg.Payload)
-				select {
-				case msgChan <- msg.Payload:
-				default:
-					log.Printf("[SSE] Dropping message for user %d (client slow)", userID)
-				}
-			}
-		case <-ctx.Done():
-			log.Printf("[SSE] Stopping subscription for user %d", userID)
-			return
+	password, passwordFile := os.Getenv("GO_SSE_SIDECAR_REDIS_PASSWORD"), os.Getenv("GO_SSE_SIDECAR_REDIS_PASSWORD_FILE")
+	switch {
+	case password != "" && passwordFile != "":
+		log.Fatal("Only one of GO_SSE_SIDECAR_REDIS_PASSWORD and GO_SSE_SIDECAR_REDIS_PASSWORD_FILE can be set")
+	case password != "":
+		opts.Password = password
+	case passwordFile != "":
+		if _, err := readSecretFile(passwordFile); err != nil {
+			log.Fatalf("Failed to read GO_SSE_SIDECAR_REDIS_PASSWORD_FILE: %v", err)
+		}
+		username := opts.Username
+		opts.CredentialsProviderContext = func(context.Context) (string, string, error) {
+			password, err := readSecretFile(passwordFile)
+			return username, password, err
 		}
 	}
 }
 
-type SSETokenClaims struct {
-	UserID int64 `json:"user_id"`
-	jwt.RegisteredClaims
+// readSecretFile reads a secret mounted as a file, without the trailing
+// newline most tools add.
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	return strings.TrimRight(string(b), "\r\n"), err
 }
 
-func verifySseToken(tokenString string, secret string) (*SSETokenClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &SSETokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// authenticate verifies the request's client certificate or `ssetoken`, and
+// the required claim. On failure it writes the error response and returns nil.
+func authenticate(w http.ResponseWriter, r *http.Request, connID string) *SSETokenClaims {
+	return checkCredentials(w, r, connID, func() (*SSETokenClaims, error) {
+		if cfg.ClientCertUser != "" {
+			return certClaims(r)
 		}
-		return []byte(secret), nil
+		return verifyToken(r.URL.Query().Get("ssetoken"))
 	})
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("token parse error: %v", err)
+// checkCredentials verifies the request's credentials with verify, unless
+// its address is blocked after failures, and the required claim. On failure
+// it writes the error response and returns nil.
+func checkCredentials(w http.ResponseWriter, r *http.Request, connID string, verify func() (*SSETokenClaims, error)) *SSETokenClaims {
+	ip := clientIP(r)
+	if retry, blocked := authLimiter.blocked(ip, time.Now()); blocked {
+		// Not logged, a blocked client may keep trying.
+		metrics.authBlocked.Add(1)
+		refuseBlocked(w, retry)
+		return nil
 	}
 
-	if claims, ok := token.Claims.(*SSETokenClaims); ok && token.Valid {
-		return claims, nil
+	claims, err := verify()
+	if err != nil {
+		if errors.Is(err, errUnsignedToken) {
+			log.Printf("[SECURITY] [conn %s] Unsigned token from %s rejected", connID, ip)
+		}
+		metrics.authFailures.Add(1)
+		authLimiter.fail(ip, time.Now())
+		log.Printf("[SSE] [conn %s] Token verification failed: %v", connID, err)
+		if errors.Is(err, errMalformedToken) {
+			http.Error(w, "Unauthorized: not a JWT", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+		return nil
 	}
 
-	return nil, fmt.Errorf("invalid token")
+	if rc := cfg.RequiredClaim; rc != nil && !claims.claimMatches(rc.name, rc.value) {
+		log.Printf("[SSE] [conn %s] User %d lacks required claim %s:%s", connID, claims.UserID, rc.name, rc.value)
+		http.Error(w, "Forbidden: required claim missing", http.StatusForbidden)
+		return nil
+	}
+	return claims
 }
 
 func sseHandler(w http.ResponseWriter, r *http.Request) {
+	connWork.Add(1)
+	defer connWork.Add(-1)
+	setupStart := time.Now()
+	connID := requestConnectionID(r)
+	applyResponseHeaders(w)
+
+	// Checked before any auth work. The URL itself is never logged since it is
+	// attacker controlled and may hold the token.
+	if n := len(r.URL.RequestURI()); n > cfg.MaxURLBytes {
+		log.Printf("[SSE] [conn %s] Rejecting request with %d byte URL (max %d)", connID, n, cfg.MaxURLBytes)
+		http.Error(w, "URI Too Long", http.StatusRequestURITooLong)
+		return
+	}
+
+	// HTTP/1.0 has no chunked encoding, so the stream can only end by closing
+	// and the proxies still speaking it usually buffer it whole: the client
+	// would just hang. Long-polling works over HTTP/1.0.
+	if r.ProtoMajor == 1 && r.ProtoMinor == 0 && !cfg.AllowHTTP10 {
+		log.Printf("[SSE] [conn %s] Rejecting HTTP/1.0 request", connID)
+		http.Error(w, "HTTP Version Not Supported: SSE streams need HTTP/1.1 or later, use GET /poll from HTTP/1.0 clients and proxies", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	if draining.Load() {
+		refuseDraining(w)
+		return
+	}
+	if until, ok := maintenanceUntil(maintenanceNow()); ok {
+		refuseMaintenance(w, until)
+		return
+	}
+
+	// Headers are only sent once for SSE, so the ID must be set before the first write.
+	w.Header().Set("X-Connection-ID", connID)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Connection-ID")
 
-	token := r.URL.Query().Get("ssetoken")
-	secret := os.Getenv("GO_SSE_SIDECAR_TOKEN")
+	if err := checkQueryParams(r, sseQueryParams); err != nil {
+		log.Printf("[SSE] [conn %s] Rejecting query: %v", connID, err)
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	claims, err := verifySseToken(token, secret)
+	opts, err := parseConnOptions(r)
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Rejecting connection options: %v", connID, err)
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.websocket {
+		webSockets.Add(1)
+		defer webSockets.Done()
+	}
+	feed, err := feedFor(r)
 	if err != nil {
-		log.Printf("Token verification failed: %v", err)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		log.Printf("[SSE] [conn %s] Rejecting connection: %v", connID, err)
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims := authenticate(w, r, connID)
+	if claims == nil {
+		return
+	}
+	if !authorize(w, r, connID, claims) {
 		return
 	}
 
 	userID := claims.UserID
-	log.Printf("Authenticated SSE connection for user %d (expires: %v)", userID, claims.ExpiresAt.Time)
+	channels := subscriptionChannels(claims, feed)
+
+	watch, err := parsePresenceWatch(r, claims)
+	if errors.Is(err, errPresenceDisabled) {
+		err = opts.unsupported("presence", err)
+	}
+	if errors.Is(err, errPresenceNotAllowed) {
+		log.Printf("[SSE] [conn %s] Refusing presence watch for user %d: %v", connID, userID, err)
+		http.Error(w, "Forbidden: presence not allowed", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(watch) > 0 {
+		channels = append(channels, cfg.PresenceChannel)
+	}
+	if err := validateChannels(channels); err != nil {
+		log.Printf("[SSE] [conn %s] Refusing subscription for user %d: %v", connID, userID, err)
+		http.Error(w, "Forbidden: channel not allowed", http.StatusForbidden)
+		return
+	}
+	if cfg.MaxChannels > 0 && len(channels) > cfg.MaxChannels {
+		log.Printf("[SSE] [conn %s] Refusing subscription for user %d: %d channels, max %d", connID, userID, len(channels), cfg.MaxChannels)
+		http.Error(w, "Forbidden: too many channels", http.StatusForbidden)
+		return
+	}
+	if opts.encoding != "" && uncompressedFeed(channels) {
+		opts.encoding = ""
+	}
+
+	tenantDB, releaseDB, err := redisFor(claims)
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Refusing user %d: %v", connID, userID, err)
+		refuseRedis(w, err)
+		return
+	}
+	// Runs last, once the subscription and the shutdown writes are done.
+	defer releaseDB()
+	namespace, err := namespaceFor(claims)
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Refusing user %d: %v", connID, userID, err)
+		http.Error(w, "Forbidden: namespace not allowed", http.StatusForbidden)
+		return
+	}
+
+	limits := tierFor(claims)
+	if limits.queueSize == 0 && feed != nil {
+		limits.queueSize = feed.queue
+	}
+	if n := len(registry.forUser(namespace, userID)); limits.maxConns > 0 && n >= limits.maxConns {
+		log.Printf("[SSE] [conn %s] Refusing user %d (tier %q): %d connections, max %d", connID, userID, claims.Tier, n, limits.maxConns)
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+	addr := parseClientAddr(clientIP(r))
+	releaseAddr, err := addressConns.reserve(addr)
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Refusing user %d: %v", connID, userID, err)
+		refuseAddressLimit(w, err)
+		return
+	}
+	defer releaseAddr()
+
+	quota, err := newQuotaCounter(r.Context(), tenantDB, namespace, userID)
+	if errors.Is(err, errQuotaExceeded) {
+		log.Printf("[SSE] [conn %s] User %d is over the daily event quota", connID, userID)
+		refuseQuota(w, time.Now())
+		return
+	}
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Failed to read the event quota of user %d: %v", connID, userID, err)
+		http.Error(w, "Quota check failed", http.StatusServiceUnavailable)
+		return
+	}
+	// The request context is done by then.
+	defer quota.flush(ctx)
+
+	client := &SSEClient{
+		id:            connID,
+		userID:        userID,
+		namespace:     namespace,
+		db:            tenantDB,
+		feed:          feed,
+		claims:        claims,
+		channels:      channels,
+		transport:     streamTransport(opts),
+		channel:       make(chan sseMessage, limits.queue()),
+		priority:      newPriorityQueue(limits.queue()),
+		opts:          opts,
+		presenceWatch: watch,
+		extraChannels: make(map[string]bool),
+		refreshed:     make(chan struct{}, 1),
+		logSampled:    sampleConnection(connID, cfg.ConnLogSample),
+		metadata:      connectionMetadata(claims),
+		eventMetadata: eventMetadata(claims),
+		acks:          newAckTracker(),
+	}
+	if claims.ExpiresAt != nil {
+		client.expiresAt = claims.ExpiresAt.Time
+	}
+	client.lifecyclef("Authenticated SSE connection for user %d (expires: %v)", userID, client.expiresAt)
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -113,30 +490,395 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A client that already went away (ex: a prefetch or a crawler closing
+	// at once) doesn't get a subscription set up for nothing.
+	if r.Context().Err() != nil {
+		metrics.abandoned.Add(1)
+		client.lifecyclef("Client of user %d went away before subscribing", userID)
+		return
+	}
+
+	// Runs after the subscription is cancelled below.
+	defer client.deadLetterPending()
+
 	// Create per-client context that respects request cancellation
 	clientCtx, cancel := context.WithCancel(r.Context())
 	defer cancel()
+	client.close = cancel
 
-	client := &SSEClient{
-		channel: make(chan string, 10),
+	registry.add(client)
+	client.counters().opened.Add(1)
+	defer registry.remove(client)
+
+	presence.connect(client)
+	defer presence.disconnect(client)
+	if cfg.PresenceTTL > 0 {
+		goConn(func() { keepOnline(clientCtx, tenantDB, client) })
+	}
+	if cfg.ConfirmTimeout > 0 {
+		goConn(func() { client.confirmDeliveries(clientCtx) })
 	}
 
-	rdb := getRedisClient()
-	go subscribeToUserChannel(rdb, userID, client.channel, clientCtx)
+	subscribed := make(chan error, 1)
+	subscription := runSubscription(tenantDB, client, clientCtx, subscribed)
+	defer stopSubscription(client, cancel, subscription)
+
+	// Nothing is sent before the subscription is live, and the whole setup
+	// is bounded so connections don't pile up half-open while Redis is slow.
+	setupTimeout := time.NewTimer(time.Until(setupStart.Add(cfg.ConnectTimeout)))
+	select {
+	case err := <-subscribed:
+		setupTimeout.Stop()
+		if err != nil {
+			client.logf("Subscription failed for user %d: %v", userID, err)
+			refuseSubscription(w, err)
+			return
+		}
+	case <-setupTimeout.C:
+		client.logf("Connection setup for user %d exceeded %v", userID, cfg.ConnectTimeout)
+		http.Error(w, "Connection setup timed out", http.StatusGatewayTimeout)
+		// Sent now, the subscription may take a while longer to stop.
+		flusher.Flush()
+		return
+	case <-clientCtx.Done():
+		setupTimeout.Stop()
+		metrics.abandoned.Add(1)
+		return
+	}
 
-	// Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	// The user's older connections give way once this one is live.
+	if cfg.SingleSession {
+		for _, old := range registry.forUser(client.namespace, userID) {
+			if old != client {
+				old.logf("Superseded by connection %s of user %d", client.id, userID)
+				old.closeWith("superseded")
+			}
+		}
+	}
+
+	// Set headers for SSE, or switch to the WebSocket
+	if opts.websocket {
+		ws, err := acceptWebSocket(w, r)
+		if err != nil {
+			client.logf("WebSocket handshake with user %d failed: %v", userID, err)
+			return
+		}
+		defer ws.close(1000)
+		goConn(func() { ws.readLoop(cancel) })
+		w, flusher = ws, ws
+	} else {
+		applyStreamHeaders(w)
+	}
+
+	out := newDeadlineWriter(w, cfg.WriteTimeout, func() {
+		client.logf("Write to user %d failed, closing SSE", userID)
+		client.closeWith("write_error")
+	})
+	if cfg.StallTimeout > 0 {
+		if stall := newStallGuard(w, out, flusher); stall != nil {
+			out, flusher = stall, stall
+			goConn(func() {
+				stall.watch(clientCtx, cfg.StallTimeout, func() {
+					client.logf("Write to user %d blocked for %v, closing stalled SSE", userID, cfg.StallTimeout)
+					client.closeWith("stalled")
+				})
+			})
+		}
+	}
+	out = countingWriter{out, &metrics.bytesSent}
+	if opts.encoding != "" {
+		w.Header().Set("Content-Encoding", opts.encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz, err := newEventCompressor(countingWriter{out, &metrics.gzipOutBytes}, opts.encoding, cfg.CompressMinBytes)
+		if err != nil {
+			client.logf("Failed to start %s stream: %v", opts.encoding, err)
+			return
+		}
+		defer gz.Close()
+		out = countingWriter{gz, &metrics.gzipInBytes}
+	}
+	if opts.websocket {
+		out = compactWriter{out}
+	}
+
+	if len(opts.downgraded) > 0 {
+		client.logf("Options %s are not enabled, downgraded for user %d", strings.Join(opts.downgraded, ", "), userID)
+	}
+	if cfg.ConfigEvent {
+		client.writeConfigEvent(out)
+	}
+	writeEvent(out, "connected", connectedData(connID, opts, len(watch) > 0))
+	flusher.Flush()
+
+	// Set by every return below, and by whoever cancels clientCtx.
+	closeReason := "client_disconnect"
+	defer func() {
+		countClose(closeReason)
+		client.lifecyclef("Closed SSE for user %d: %s", userID, closeReason)
+	}()
+
+	client.dedupe = newDedupeFilter(cfg.DedupeWindow, cfg.DedupeKey)
+	client.seenIDs = newIDFilter(cfg.DedupeIDs)
+
+	// With a flush interval, a burst of queued messages is written before a
+	// single flush. The flush happens as soon as the queue is empty, and at
+	// most FlushInterval after the first unflushed write.
+	var flushDue <-chan time.Time
+
+	var timeSync <-chan time.Time
+	if cfg.TimeSyncInterval > 0 {
+		ticker := time.NewTicker(cfg.TimeSyncInterval)
+		defer ticker.Stop()
+		timeSync = ticker.C
+	}
+
+	var stats <-chan time.Time
+	if cfg.StatsInterval > 0 {
+		ticker := time.NewTicker(cfg.StatsInterval)
+		defer ticker.Stop()
+		stats = ticker.C
+	}
+
+	var keepalive <-chan time.Time
+	var keepaliveTicker *time.Ticker
+	if cfg.KeepaliveInterval > 0 {
+		keepaliveTicker = time.NewTicker(cfg.KeepaliveInterval)
+		defer keepaliveTicker.Stop()
+		keepalive = keepaliveTicker.C
+	}
+
+	// With close on expiry the stream ends when the token expires, unless a
+	// fresh token is sent to POST /refresh/{conn_id} before that. With an
+	// expiry warning the client is asked for one first.
+	var expiry, warning *time.Timer
+	var expired, expiring <-chan time.Time
+	var refreshed <-chan struct{}
+	// The connection is registered, a refresh may already have changed it.
+	if expiresAt := client.tokenExpiry(); cfg.CloseOnExpiry && !expiresAt.IsZero() {
+		expiry = time.NewTimer(time.Until(expiresAt))
+		defer expiry.Stop()
+		expired, refreshed = expiry.C, client.refreshed
+		if cfg.ExpiryWarning > 0 {
+			warning = time.NewTimer(expiryWarningDelay(expiresAt, time.Now()))
+			defer warning.Stop()
+			expiring = warning.C
+		}
+	}
+
+	// written counts the events delivered, for cfg.MaxEventsPerConn.
+	written := 0
+	pace := newEventPacer(limits.rate)
+	// fair holds the messages written round robin across channels.
+	fair := newFairQueue(limits.queue())
+	defer fair.deadLetter(client)
+	// On shutdown, what can be persisted is before the rest is dead-lettered.
+	defer client.persistPending(tenantDB, fair)
+
+	// deliver writes a queued message, unless it's stale or a duplicate. It
+	// returns false when the user's quota is used up.
+	deliver := func(qctx context.Context, msg sseMessage) bool {
+		if cfg.MaxQueueAge > 0 && time.Since(msg.enqueued) > cfg.MaxQueueAge {
+			client.countDropped()
+			deadLetters.add(client, msg, "stale")
+			client.logf("Dropping stale message for user %d (queued %v)", userID, time.Since(msg.enqueued))
+			return true
+		}
+		// The records are about the message as queued.
+		prepared, ok := client.prepare(msg)
+		if !ok {
+			return true
+		}
+		if shares.wait(qctx, client, limits.weight) != nil {
+			deadLetters.add(client, msg, "disconnected")
+			return true
+		}
+		if !quota.allow(qctx, time.Now()) {
+			return false
+		}
+		if err := client.writeMessage(out, prepared); err == nil {
+			client.countDelivered()
+			if client.opts.diag {
+				writeDiagComment(out, msg, len(client.channel)+len(client.priority)+fair.len())
+			}
+			eventSizes.observe(len(msg.payload))
+			client.markReceipt(msg)
+			written++
+			pace.count()
+		} else if errors.Is(err, errLineTooLong) {
+			client.countDropped()
+			deadLetters.add(client, msg, "line_too_long")
+			client.logf("Rejecting message for user %d: %v", userID, err)
+		} else if errors.Is(err, errMissingEventField) {
+			client.countDropped()
+			deadLetters.add(client, msg, "missing_event")
+			client.logf("Dropping message for user %d: %v", userID, err)
+		}
+		return true
+	}
+
+	// slowFlush downgrades the connection to coalescing its backlog when its
+	// flushes are slow on average.
+	slowFlush := newFlushMonitor()
+
+	// flush also sends the receipts of the messages it pushed out. With
+	// cfg.KeepaliveIdleOnly, the next keepalive is due an interval after it.
+	flush := func() {
+		start := time.Now()
+		flusher.Flush()
+		if slowFlush.observe(time.Since(start)) {
+			fair.coalesceAll = true
+			metrics.slowFlushDowngrades.Add(1)
+			client.logf("Flushes to user %d average %v, coalescing its backlog", userID, slowFlush.avg)
+			writeEvent(out, "degraded", `{"reason":"slow_flush"}`)
+		}
+		client.sendReceipts()
+		if cfg.KeepaliveIdleOnly && keepaliveTicker != nil {
+			keepaliveTicker.Reset(cfg.KeepaliveInterval)
+		}
+	}
+
+	// write delivers a message taken from the queues and flushes when due.
+	// It returns false when the stream must end.
+	write := func(msg sseMessage) bool {
+		if !deliver(clientCtx, msg) {
+			closeReason = "quota_exceeded"
+			writeEvent(out, "quota_exceeded", fmt.Sprintf(`{"quota":%d}`, cfg.DailyEventQuota))
+			flush()
+			return false
+		}
+		if cfg.MaxEventsPerConn > 0 && written >= cfg.MaxEventsPerConn {
+			closeReason = "max_events"
+			writeReconnectEvent(out, closeReason, 0)
+			flush()
+			return false
+		}
+		if cfg.FlushInterval == 0 || client.queued()+fair.len() == 0 {
+			flush()
+			flushDue = nil
+		} else if flushDue == nil {
+			flushDue = time.After(cfg.FlushInterval)
+		}
+		return true
+	}
 
 	// Send messages to client
 	for {
+		// While delivery is paused, messages wait in the queues.
+		messages, priority := client.channel, client.priority
+		paused, pauseChanged := delivery.state()
+		if paused {
+			messages, priority = nil, nil
+		}
+		// Over the tier's rate, messages wait too.
+		var paced <-chan time.Time
+		if wait := pace.wait(time.Now()); wait > 0 {
+			messages, priority = nil, nil
+			paced = time.After(wait)
+		}
+		var fairReady <-chan struct{}
+		if messages != nil && fair.len() > 0 {
+			fairReady = alwaysReady
+		}
+
 		select {
-		case msg := <-client.channel:
-			fmt.Fprintf(w, "data: %s\n\n", msg)
-			flusher.Flush()
+		case msg := <-priority:
+			if !write(msg) {
+				return
+			}
+		case msg := <-messages:
+			// Priority messages queued meanwhile still go first.
+			for len(priority) > 0 {
+				if !write(<-priority) {
+					return
+				}
+			}
+			batch := []sseMessage{msg}
+			if fair != nil {
+				fair.fill(msg, client.channel)
+				batch[0], _ = fair.pop()
+			} else {
+				batch = client.mergeBurst(msg)
+			}
+			for _, msg := range batch {
+				if !write(msg) {
+					return
+				}
+			}
+		case <-fairReady:
+			for len(priority) > 0 {
+				if !write(<-priority) {
+					return
+				}
+			}
+			msg, _ := fair.pop()
+			if !write(msg) {
+				return
+			}
+		case <-flushDue:
+			flush()
+			flushDue = nil
+		case <-pauseChanged:
+		case <-paced:
+		case <-refreshed:
+			expiresAt := client.tokenExpiry()
+			resetTimer(expiry, time.Until(expiresAt))
+			if warning != nil {
+				resetTimer(warning, expiryWarningDelay(expiresAt, time.Now()))
+			}
+		case now := <-expiring:
+			writeExpiringEvent(out, client.tokenExpiry(), now)
+			flush()
+			flushDue = nil
+		case <-expired:
+			closeReason = "token_expired"
+			writeEvent(out, "token_expired", "{}")
+			flush()
+			return
+		case now := <-timeSync:
+			writeTimeEvent(out, now)
+			flush()
+			flushDue = nil
+		case <-stats:
+			client.writeStatsEvent(out)
+			flush()
+			flushDue = nil
+		case now := <-keepalive:
+			writeKeepalive(out, now)
+			flush()
+			flushDue = nil
 		case <-clientCtx.Done():
-			log.Printf("Closing SSE for user %d", userID)
+			if reason, ok := client.closeReason.Load().(string); ok {
+				closeReason = reason
+			}
+			if closeReason == "superseded" {
+				// Not a reconnect: the newer connection took over.
+				writeEvent(out, "superseded", "{}")
+				flush()
+				return
+			}
+			if reason, _ := client.reconnectReason.Load().(string); reason != "" {
+				// The server closes on purpose, so the client should get
+				// what is already queued, within a short deadline since the
+				// client may be the reason it's full.
+				if cfg.CloseFlushTimeout > 0 {
+					http.NewResponseController(w).SetWriteDeadline(time.Now().Add(cfg.CloseFlushTimeout))
+					for deadline := time.Now().Add(cfg.CloseFlushTimeout); time.Now().Before(deadline); {
+						msg, ok := fair.pop()
+						if !ok {
+							msg, ok = client.next()
+						}
+						if !ok || !deliver(ctx, msg) {
+							break
+						}
+					}
+				}
+				if target, _ := client.migrateTarget.Load().(string); target != "" {
+					writeMigrateEvent(out, target)
+				} else {
+					writeReconnectEvent(out, reason, cfg.DrainRetry)
+				}
+				flush()
+			}
 			return
 		}
 	}
@@ -144,20 +886,108 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	_ = godotenv.Load()
+	setupLogging(os.Getenv("GO_SSE_SIDECAR_LOG_FORMAT"))
+	cfg = loadConfig()
+	registerEventSizes()
+	configHash = computeConfigHash()
+	loadSigningKeys()
+	if cfg.EventSchemaFile != "" {
+		loadEventSchema(cfg.EventSchemaFile)
+	}
+	if cfg.Plugin != "" {
+		loadPlugin(cfg.Plugin)
+	}
 
-	rdb := getRedisClient()
+	if cfg.JWKSURL != "" {
+		jwks = newJWKSCache(cfg.JWKSURL, cfg.JWKSTTL, cfg.JWKSMinRefresh)
+	}
+
+	rdb = getRedisClient()
 	defer rdb.Close()
 	if err := rdb.Ping(ctx).Err(); err != nil {
 		log.Fatalf("Redis error: %v", err)
 	}
+	if err := startClockSkewCheck(rdb); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if allowlists.enabled() {
+		allowlists.load(ctx)
+		log.Printf("[SSE-SIDECAR] Allowlists: %v, refreshed from Redis every %v", allowlists, cfg.AllowlistRefresh)
+		go allowlists.run()
+	}
+	shares = newShareScheduler(cfg.FairShareRate)
+	if cfg.MaxConcurrentSubscribes > 0 {
+		subscribeSlots = make(chan struct{}, cfg.MaxConcurrentSubscribes)
+	}
+	if failover != nil && len(cfg.RedisURLs) > 1 {
+		go failover.runFailback(rdb)
+	}
+	if cfg.MaintenanceClose {
+		go closeForMaintenance()
+	}
+	if cfg.MemoryPressureMB > 0 {
+		go watchMemory()
+	}
 
 	http.HandleFunc("/sse-events", sseHandler)
+	http.HandleFunc("GET /poll", pollHandler)
+	http.HandleFunc("OPTIONS /sse-events", preflightHandler)
+	http.HandleFunc("OPTIONS /poll", preflightHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/version", versionHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("POST /control/{conn_id}", limitBody(controlHandler))
+	http.HandleFunc("POST /refresh/{conn_id}", limitBody(refreshHandler))
+	if cfg.AckChannel != "" {
+		http.HandleFunc("POST /ack/{conn_id}", limitBody(ackHandler))
+		http.HandleFunc("OPTIONS /ack/{conn_id}", preflightHandler)
+	}
+	http.HandleFunc("POST /disconnect", limitBody(disconnectHandler))
+	http.HandleFunc("POST /migrate", limitBody(migrateHandler))
+	http.HandleFunc("POST /pause", limitBody(pauseHandler(true)))
+	http.HandleFunc("POST /resume", limitBody(pauseHandler(false)))
+
+	if cfg.ClientJS {
+		http.HandleFunc("GET /client.js", clientJSHandler)
+	}
+
+	if cfg.DeadLetterChannel != "" {
+		go deadLetters.run()
+	}
+
+	if cfg.ReceiptChannel != "" {
+		go runReceipts(receipts)
+	}
+
+	if cfg.StatsDAddr != "" {
+		go runStatsD(ctx, cfg.StatsDAddr, cfg.StatsDPrefix, cfg.StatsDInterval)
+	}
+
+	if cfg.ControlChannel != "" {
+		go subscribeToControlChannel(rdb, cfg.ControlChannel)
+	}
+
+	if cfg.Loopback {
+		if os.Getenv("GO_SSE_SIDECAR_ADMIN_TOKEN") == "" {
+			log.Fatal("GO_SSE_SIDECAR_LOOPBACK requires GO_SSE_SIDECAR_ADMIN_TOKEN to be set")
+		}
+		log.Println("[SSE-SIDECAR] WARNING: loopback mode enabled, do not use in production")
+		http.HandleFunc("/loopback", limitBody(loopbackHandler))
+	}
+
+	if cfg.LoadTest {
+		runLoadTest()
+		return
+	}
 
 	port := os.Getenv("GO_SSE_SIDECAR_PORT")
 	if port == "" {
 		port = "5687"
 	}
 
-	log.Println("[SSE-SIDECAR] Server running on :" + port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Printf("[SSE-SIDECAR] Server %s (config %s) running on :%s", version, configHash, port)
+	if err := serve(newServer(":" + port)); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maintenanceNow is the clock the windows are checked against.
+var maintenanceNow = time.Now
+
+// maintenanceWindow is a daily range of UTC time, or a weekly one on
+// weekday. A range ending before it starts runs past midnight.
+type maintenanceWindow struct {
+	weekday    time.Weekday
+	anyDay     bool
+	start, end time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseMaintenanceWindows reads a list of `HH:MM-HH:MM` ranges, each
+// optionally after a weekday, ex: `sun 02:00-04:00,23:30-00:15`.
+func parseMaintenanceWindows(name string, list []string) []maintenanceWindow {
+	var windows []maintenanceWindow
+	for _, entry := range list {
+		w, err := parseMaintenanceWindow(entry)
+		if err != nil {
+			log.Fatalf("Invalid %s entry %q: %v", name, entry, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+func parseMaintenanceWindow(entry string) (maintenanceWindow, error) {
+	w := maintenanceWindow{anyDay: true}
+	fields := strings.Fields(entry)
+	if len(fields) == 2 {
+		day, ok := weekdays[strings.ToLower(fields[0])]
+		if !ok {
+			return w, fmt.Errorf("unknown weekday %q, expected sun to sat", fields[0])
+		}
+		w.weekday, w.anyDay = day, false
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return w, fmt.Errorf("expected [weekday] HH:MM-HH:MM")
+	}
+	from, to, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("expected [weekday] HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("empty range")
+	}
+	return w, nil
+}
+
+// parseClock reads an HH:MM time of day.
+func parseClock(v string) (time.Duration, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an HH:MM time", v)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// until returns when the window containing now ends.
+func (w maintenanceWindow) until(now time.Time) (time.Time, bool) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	// A range past midnight may have started the day before.
+	for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+		if !w.anyDay && day.Weekday() != w.weekday {
+			continue
+		}
+		start, end := day.Add(w.start), day.Add(w.end)
+		if w.end < w.start {
+			end = end.AddDate(0, 0, 1)
+		}
+		if !now.Before(start) && now.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// maintenanceUntil reports whether now is in a window of
+// cfg.MaintenanceWindows, and when the windows it's in end, following
+// the windows that continue one another.
+func maintenanceUntil(now time.Time) (time.Time, bool) {
+	until, in := now, false
+	for i := 0; i < 2*len(cfg.MaintenanceWindows); i++ {
+		found := false
+		for _, w := range cfg.MaintenanceWindows {
+			if end, ok := w.until(until); ok {
+				until, in, found = end, true, true
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return until, in
+}
+
+// refuseMaintenance answers a new connection during a maintenance window,
+// with a Retry-After past it.
+func refuseMaintenance(w http.ResponseWriter, until time.Time) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(until.Sub(maintenanceNow()).Seconds())))
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Server is in a maintenance window", http.StatusServiceUnavailable)
+}
+
+// closeForMaintenance closes the open connections for reconnect when a
+// maintenance window starts, once per window. Their clients are then refused
+// until it ends.
+func closeForMaintenance() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	in := false
+	for range ticker.C {
+		_, ok := maintenanceUntil(maintenanceNow())
+		if ok && !in {
+			conns := registry.all()
+			log.Printf("[SSE-SIDECAR] Maintenance window started, closing %d connections", len(conns))
+			closeSpread(conns, "maintenance")
+		}
+		in = ok
+	}
+}
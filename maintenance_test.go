@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// useMaintenanceClock sets the clock of the maintenance windows to *now,
+// for the test.
+func useMaintenanceClock(t *testing.T, now *time.Time) {
+	t.Helper()
+	old := maintenanceNow
+	maintenanceNow = func() time.Time { return *now }
+	t.Cleanup(func() { maintenanceNow = old })
+}
+
+// sunday2026 is Sunday, October 11 2026 at hh:mm UTC.
+func sunday2026(hh, mm int) time.Time {
+	return time.Date(2026, 10, 11, hh, mm, 0, 0, time.UTC)
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	for entry, want := range map[string]maintenanceWindow{
+		"02:00-04:30":     {anyDay: true, start: 2 * time.Hour, end: 4*time.Hour + 30*time.Minute},
+		"Sun 23:30-00:15": {weekday: time.Sunday, start: 23*time.Hour + 30*time.Minute, end: 15 * time.Minute},
+	} {
+		if got, err := parseMaintenanceWindow(entry); err != nil || got != want {
+			t.Errorf("%q: %+v, %v, want %+v", entry, got, err, want)
+		}
+	}
+	for _, entry := range []string{"", "02:00", "someday 02:00-03:00", "02:00-02:00", "2am-3am", "sun mon 02:00-03:00"} {
+		if _, err := parseMaintenanceWindow(entry); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+}
+
+func TestMaintenanceUntil(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.MaintenanceWindows = parseMaintenanceWindows("test", []string{"sun 02:00-04:00", "23:30-00:15", "10:00-11:00", "11:00-11:30"})
+	})
+	for _, tt := range []struct {
+		now   time.Time
+		until time.Time
+		in    bool
+	}{
+		{sunday2026(1, 59), time.Time{}, false},
+		{sunday2026(2, 0), sunday2026(4, 0), true},
+		{sunday2026(3, 59), sunday2026(4, 0), true},
+		{sunday2026(4, 0), time.Time{}, false},
+		// Weekly: not on Monday.
+		{sunday2026(2, 0).AddDate(0, 0, 1), time.Time{}, false},
+		// Past midnight, from either day.
+		{sunday2026(23, 45), sunday2026(0, 15).AddDate(0, 0, 1), true},
+		{sunday2026(0, 10), sunday2026(0, 15), true},
+		// Windows that continue one another end with the last.
+		{sunday2026(10, 30), sunday2026(11, 30), true},
+		// Other zones are read as UTC.
+		{sunday2026(2, 30).In(time.FixedZone("UTC+5", 5*3600)), sunday2026(4, 0), true},
+	} {
+		until, in := maintenanceUntil(tt.now)
+		if in != tt.in || (in && !until.Equal(tt.until)) {
+			t.Errorf("at %v: %v, %v, want %v, %v", tt.now, until, in, tt.until, tt.in)
+		}
+	}
+}
+
+func TestAcceptanceFlipsWithTheWindow(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) {
+		c.MaintenanceWindows = parseMaintenanceWindows("test", []string{"sun 02:00-04:00"})
+		c.PollTimeout = 100 * time.Millisecond
+	})
+	now := sunday2026(1, 30)
+	useMaintenanceClock(t, &now)
+
+	// Before the window: accepted.
+	open, _ := connect(t, srv, 2251, nil)
+
+	now = sunday2026(3, 59)
+	for _, path := range []string{"/sse-events", "/poll"} {
+		resp := get(t, srv.URL+path+"?"+url.Values{"ssetoken": {token(t, 2252, nil)}}.Encode(), nil)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s during the window: %s, want 503", path, resp.Status)
+		}
+		// A minute left, rounded up past the window.
+		if h := resp.Header.Get("Retry-After"); h != "60" {
+			t.Errorf("%s: Retry-After %q, want 60", path, h)
+		}
+	}
+	// The open connection is kept without GO_SSE_SIDECAR_MAINTENANCE_CLOSE.
+	rdb.Publish(ctx, "events:user:2251", "still here")
+	if ev := open.nextData(t); ev.data != "still here" {
+		t.Errorf("open stream got %q", ev.data)
+	}
+
+	// Over: accepted again.
+	now = sunday2026(4, 0)
+	connect(t, srv, 2252, nil)
+	if code, _, _ := poll(t, srv, 2252, ""); code != http.StatusOK {
+		t.Errorf("poll after the window: %d", code)
+	}
+}
+
+func TestOngoingPollSessionKeptDuringWindow(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) {
+		c.MaintenanceWindows = parseMaintenanceWindows("test", []string{"02:00-04:00"})
+		c.PollTimeout = 100 * time.Millisecond
+	})
+	now := sunday2026(1, 0)
+	useMaintenanceClock(t, &now)
+	_, _, cursor := poll(t, srv, 2253, "")
+
+	now = sunday2026(2, 0)
+	rdb.Publish(ctx, "events:user:2253", "during")
+	if code, events, _ := poll(t, srv, 2253, cursor); code != http.StatusOK || len(events) != 1 {
+		t.Errorf("session's poll during the window: %d %v", code, pollData(events))
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds the instance wide counters.
+var metrics struct {
+	// unsignedTokens counts tokens refused with errUnsignedToken.
+	unsignedTokens atomic.Int64
+	// malformedTokens counts tokens refused with errMalformedToken.
+	malformedTokens atomic.Int64
+	// sequenceGaps and sequenceOutOfOrder count messages whose source
+	// sequence number skipped ahead or went back, per connection and channel.
+	sequenceGaps       atomic.Int64
+	sequenceOutOfOrder atomic.Int64
+
+	authFailures atomic.Int64
+	delivered    atomic.Int64
+	dropped      atomic.Int64
+	// abandoned counts the SSE connections closed by the client before
+	// their setup finished.
+	abandoned atomic.Int64
+
+	// authBlocked counts the requests refused for an address's invalid
+	// tokens.
+	authBlocked atomic.Int64
+	// addressLimited counts the connections refused by
+	// GO_SSE_SIDECAR_MAX_CONN_PER_IP or GO_SSE_SIDECAR_MAX_CONN_PER_SUBNET.
+	addressLimited atomic.Int64
+
+	// pubsubBacklogWarnings counts the times a connection's go-redis
+	// subscription buffer was nearly full.
+	pubsubBacklogWarnings atomic.Int64
+
+	// hybridRecovered counts the messages pub/sub missed and hybrid delivery
+	// found in the history list.
+	hybridRecovered atomic.Int64
+
+	// deadLetters counts published dead-letter records, and
+	// deadLettersSuppressed the ones skipped by the rate limit.
+	deadLetters           atomic.Int64
+	deadLettersSuppressed atomic.Int64
+	// receipts counts published delivery receipts, and receiptsDropped the
+	// ones lost to a full queue, a failed write or a failed publish.
+	receipts        atomic.Int64
+	receiptsDropped atomic.Int64
+	// receiptsUnconfirmed counts the receipts not acked within
+	// GO_SSE_SIDECAR_CONFIRM_TIMEOUT.
+	receiptsUnconfirmed atomic.Int64
+	// acks counts published client acks, and acksRefused the unknown or
+	// rate-limited ones.
+	acks        atomic.Int64
+	acksRefused atomic.Int64
+
+	// subscribesQueued counts subscriptions that waited for a slot of
+	// GO_SSE_SIDECAR_MAX_CONCURRENT_SUBSCRIBES, subscribesRefused the ones
+	// that gave up.
+	subscribesQueued  atomic.Int64
+	subscribesRefused atomic.Int64
+	// subscribersLingering counts the subscriptions still running
+	// GO_SSE_SIDECAR_SUBSCRIBER_STOP_TIMEOUT after their connection closed.
+	subscribersLingering atomic.Int64
+
+	// redisPoolExhausted counts Redis calls failed for lack of a pooled
+	// connection, redisShed the background calls skipped with
+	// GO_SSE_SIDECAR_REDIS_SHED.
+	redisPoolExhausted atomic.Int64
+	redisShed          atomic.Int64
+
+	// redisFailovers counts the switches between GO_SSE_SIDECAR_REDIS_URLS.
+	redisFailovers atomic.Int64
+
+	// bytesSent counts the bytes written to event streams, after
+	// compression. gzipInBytes and gzipOutBytes are the bytes of
+	// compressed streams, gzip or deflate, before and after compression.
+	bytesSent    atomic.Int64
+	gzipInBytes  atomic.Int64
+	gzipOutBytes atomic.Int64
+
+	// schemaRejected counts the events not matching the event schema.
+	schemaRejected atomic.Int64
+	// pluginDropped counts the events dropped by GO_SSE_SIDECAR_PLUGIN, and
+	// pluginErrors the ones it failed on.
+	pluginDropped atomic.Int64
+	pluginErrors  atomic.Int64
+	// fairShareWaits counts the events that waited for their user's turn
+	// under GO_SSE_SIDECAR_FAIR_SHARE_RATE.
+	fairShareWaits atomic.Int64
+	// coalesced counts the events replaced by a newer one with the same
+	// GO_SSE_SIDECAR_COALESCE_KEY value before being written.
+	coalesced atomic.Int64
+	// persisted counts the undelivered messages written to the pending
+	// lists on shutdown.
+	persisted atomic.Int64
+	// pressureShed counts the events dropped under memory pressure.
+	pressureShed atomic.Int64
+	// slowFlushDowngrades counts the connections downgraded for flushes
+	// slower than GO_SSE_SIDECAR_SLOW_FLUSH_THRESHOLD.
+	slowFlushDowngrades atomic.Int64
+	// burstMerged counts the messages merged into the first of their burst.
+	burstMerged atomic.Int64
+}
+
+type metricKind string
+
+const (
+	counterMetric   metricKind = "counter"
+	gaugeMetric     metricKind = "gauge"
+	histogramMetric metricKind = "histogram"
+)
+
+// metricDef describes a metric once for every exporter (Prometheus scrape
+// at /metrics and StatsD push).
+type metricDef struct {
+	name  string
+	help  string
+	kind  metricKind
+	value func() float64
+}
+
+func counterValue(c *atomic.Int64) func() float64 {
+	return func() float64 { return float64(c.Load()) }
+}
+
+var metricDefs = []metricDef{
+	{"sse_connections", "Open SSE connections.", gaugeMetric, func() float64 { return float64(len(registry.all())) }},
+	{"sse_messages_delivered_total", "Messages written to clients.", counterMetric, counterValue(&metrics.delivered)},
+	{"sse_messages_dropped_total", "Messages dropped for slow clients or staleness.", counterMetric, counterValue(&metrics.dropped)},
+	{"sse_connections_abandoned_total", "SSE connections closed by the client before their setup finished.", counterMetric, counterValue(&metrics.abandoned)},
+	{"sse_auth_failures_total", "Rejected connection attempts.", counterMetric, counterValue(&metrics.authFailures)},
+	{"sse_auth_blocked_total", "Requests refused from addresses blocked for invalid tokens.", counterMetric, counterValue(&metrics.authBlocked)},
+	{"sse_address_limited_total", "Connections refused over the per-address or per-subnet limit.", counterMetric, counterValue(&metrics.addressLimited)},
+	{"sse_pubsub_backlog_warnings_total", "Times a Redis subscription buffer was nearly full.", counterMetric, counterValue(&metrics.pubsubBacklogWarnings)},
+	{"sse_hybrid_recovered_total", "Messages missed by pub/sub and recovered from the history list.", counterMetric, counterValue(&metrics.hybridRecovered)},
+	{"sse_dead_letters_total", "Dead-letter records published.", counterMetric, counterValue(&metrics.deadLetters)},
+	{"sse_dead_letters_suppressed_total", "Dead-letter records skipped by the rate limit.", counterMetric, counterValue(&metrics.deadLettersSuppressed)},
+	{"sse_receipts_total", "Delivery receipts published.", counterMetric, counterValue(&metrics.receipts)},
+	{"sse_receipts_dropped_total", "Delivery receipts not published.", counterMetric, counterValue(&metrics.receiptsDropped)},
+	{"sse_receipts_unconfirmed_total", "Delivery receipts not acked within the confirmation timeout.", counterMetric, counterValue(&metrics.receiptsUnconfirmed)},
+	{"sse_acks_total", "Client acks published.", counterMetric, counterValue(&metrics.acks)},
+	{"sse_acks_refused_total", "Client acks refused, unknown or over the rate limit.", counterMetric, counterValue(&metrics.acksRefused)},
+	{"sse_subscribes_queued_total", "Subscriptions that waited for a setup slot.", counterMetric, counterValue(&metrics.subscribesQueued)},
+	{"sse_subscribes_refused_total", "Subscriptions refused after waiting too long for a setup slot.", counterMetric, counterValue(&metrics.subscribesRefused)},
+	{"sse_subscribers_lingering_total", "Subscriptions still running after their connection closed.", counterMetric, counterValue(&metrics.subscribersLingering)},
+	{"sse_redis_pool_exhausted_total", "Redis calls failed for lack of a pooled connection.", counterMetric, counterValue(&metrics.redisPoolExhausted)},
+	{"sse_redis_shed_total", "Background Redis calls skipped while the pool was saturated.", counterMetric, counterValue(&metrics.redisShed)},
+	{"sse_redis_failovers_total", "Switches between Redis endpoints.", counterMetric, counterValue(&metrics.redisFailovers)},
+	{"sse_bytes_sent_total", "Bytes written to event streams, after compression.", counterMetric, counterValue(&metrics.bytesSent)},
+	{"sse_gzip_input_bytes_total", "Bytes of compressed (gzip or deflate) event streams before compression.", counterMetric, counterValue(&metrics.gzipInBytes)},
+	{"sse_gzip_output_bytes_total", "Bytes of compressed (gzip or deflate) event streams after compression.", counterMetric, counterValue(&metrics.gzipOutBytes)},
+	{"sse_schema_rejected_total", "Events dropped for not matching the event schema.", counterMetric, counterValue(&metrics.schemaRejected)},
+	{"sse_plugin_dropped_total", "Events dropped by the plugin.", counterMetric, counterValue(&metrics.pluginDropped)},
+	{"sse_plugin_errors_total", "Events the plugin failed on, delivered unchanged.", counterMetric, counterValue(&metrics.pluginErrors)},
+	{"sse_fair_share_waits_total", "Events that waited for their user's turn at the instance's rate.", counterMetric, counterValue(&metrics.fairShareWaits)},
+	{"sse_events_coalesced_total", "Events replaced by a newer one with the same coalesce key before being written.", counterMetric, counterValue(&metrics.coalesced)},
+	{"sse_messages_persisted_total", "Undelivered messages persisted on shutdown for the next connection.", counterMetric, counterValue(&metrics.persisted)},
+	{"sse_clock_skew_seconds", "Offset of the Redis server's clock from the local one, positive when ahead.", gaugeMetric, clockSkewSeconds},
+	{"sse_slow_flush_downgrades_total", "Connections downgraded to coalescing for slow flushes.", counterMetric, counterValue(&metrics.slowFlushDowngrades)},
+	{"sse_burst_merged_total", "Messages merged into the array event of their burst.", counterMetric, counterValue(&metrics.burstMerged)},
+	{"sse_memory_pressure_shed_total", "Events dropped under memory pressure.", counterMetric, counterValue(&metrics.pressureShed)},
+	{"sse_memory_pressure", "1 while the heap is over the memory pressure threshold.", gaugeMetric, func() float64 {
+		if memoryPressure.Load() {
+			return 1
+		}
+		return 0
+	}},
+	{"sse_unsigned_tokens_total", "Tokens rejected for alg none or no signature.", counterMetric, counterValue(&metrics.unsignedTokens)},
+	{"sse_malformed_tokens_total", "Tokens rejected for not being a JWT at all.", counterMetric, counterValue(&metrics.malformedTokens)},
+	{"sse_sequence_gaps_total", "Source sequence gaps detected.", counterMetric, counterValue(&metrics.sequenceGaps)},
+	{"sse_sequence_out_of_order_total", "Out of order source sequences detected.", counterMetric, counterValue(&metrics.sequenceOutOfOrder)},
+}
+
+// histogram counts observations in buckets, exported as the cumulative
+// `_bucket{le="..."}` counters and the `_sum` and `_count` of one histogram.
+type histogram struct {
+	bounds  []float64
+	buckets []atomic.Int64
+	sum     atomic.Int64
+	count   atomic.Int64
+}
+
+// eventSizes observes the payload size of every delivered event, in bytes.
+var eventSizes *histogram
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]atomic.Int64, len(bounds))}
+}
+
+func (h *histogram) observe(v int) {
+	for i, bound := range h.bounds {
+		if float64(v) <= bound {
+			h.buckets[i].Add(1)
+			break
+		}
+	}
+	h.sum.Add(int64(v))
+	h.count.Add(1)
+}
+
+// defs describes the histogram's series for the exporters.
+func (h *histogram) defs(name, help string) []metricDef {
+	var defs []metricDef
+	for i, bound := range h.bounds {
+		defs = append(defs, metricDef{fmt.Sprintf("%s_bucket{le=\"%g\"}", name, bound), help, histogramMetric, func() float64 {
+			var n int64
+			for j := 0; j <= i; j++ {
+				n += h.buckets[j].Load()
+			}
+			return float64(n)
+		}})
+	}
+	return append(defs,
+		metricDef{name + `_bucket{le="+Inf"}`, help, histogramMetric, counterValue(&h.count)},
+		metricDef{name + "_sum", help, histogramMetric, counterValue(&h.sum)},
+		metricDef{name + "_count", help, histogramMetric, counterValue(&h.count)},
+	)
+}
+
+// registerEventSizes sets up eventSizes with the configured buckets.
+func registerEventSizes() {
+	eventSizes = newHistogram(cfg.EventSizeBuckets)
+	metricDefs = append(metricDefs, eventSizes.defs("sse_event_bytes", "Payload size of delivered events.")...)
+}
+
+// parseBuckets reads comma-separated, increasing histogram bucket bounds.
+func parseBuckets(name, v string) []float64 {
+	var bounds []float64
+	for _, entry := range strings.Split(v, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(entry), 64)
+		if err != nil || (len(bounds) > 0 && bound <= bounds[len(bounds)-1]) {
+			log.Fatalf("Invalid %s: expected increasing numbers, got %q", name, v)
+		}
+		bounds = append(bounds, bound)
+	}
+	return bounds
+}
+
+// closeReasons are the reasons an SSE stream ends for, counted by countClose.
+var closeReasons = []string{"client_disconnect", "token_expired", "quota_exceeded", "write_error", "draining", "disconnected", "control_disconnect", "max_events", "stalled", "superseded", "maintenance", "migrate"}
+
+// disconnectKinds groups the close reasons into the few kinds of
+// sse_disconnects_total, for dashboards and alerts.
+var disconnectKinds = map[string]string{
+	"client_disconnect":  "client",
+	"token_expired":      "expiry",
+	"draining":           "shutdown",
+	"maintenance":        "shutdown",
+	"write_error":        "error",
+	"stalled":            "error",
+	"quota_exceeded":     "limit",
+	"max_events":         "limit",
+	"superseded":         "limit",
+	"disconnected":       "admin",
+	"control_disconnect": "admin",
+	"migrate":            "admin",
+}
+
+var disconnectKindNames = []string{"client", "expiry", "shutdown", "error", "limit", "admin"}
+
+func newCounters(names []string) map[string]*atomic.Int64 {
+	counts := make(map[string]*atomic.Int64, len(names))
+	for _, name := range names {
+		counts[name] = new(atomic.Int64)
+	}
+	return counts
+}
+
+var (
+	closeCounts      = newLabeledCounter("sse_streams_closed_total", "reason", "SSE streams closed, by reason.", closeReasons)
+	disconnectCounts = newCounters(disconnectKindNames)
+)
+
+func init() {
+	for _, kind := range disconnectKindNames {
+		metricDefs = append(metricDefs, metricDef{fmt.Sprintf("sse_disconnects_total{reason=%q}", kind), "SSE streams closed, by kind of reason.", counterMetric, counterValue(disconnectCounts[kind])})
+	}
+}
+
+func countClose(reason string) {
+	closeCounts.add(reason)
+	if c, ok := disconnectCounts[disconnectKinds[reason]]; ok {
+		c.Add(1)
+	}
+}
+
+// splitMetricName splits a `name{label="value",...}` metric name into its
+// base name and labels.
+func splitMetricName(name string) (string, string) {
+	base, labels, _ := strings.Cut(name, "{")
+	return base, strings.TrimSuffix(labels, "}")
+}
+
+// metricFamily is the name a metric is described under, the histogram's
+// name for its series.
+func metricFamily(m metricDef) string {
+	base, _ := splitMetricName(m.name)
+	if m.kind == histogramMetric {
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if strings.HasSuffix(base, suffix) {
+				return strings.TrimSuffix(base, suffix)
+			}
+		}
+	}
+	return base
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	described := make(map[string]bool)
+	for _, m := range allMetrics() {
+		if family := metricFamily(m); !described[family] {
+			described[family] = true
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family, m.help, family, m.kind)
+		}
+		fmt.Fprintf(&b, "%s %g\n", m.name, m.value())
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// runStatsD pushes the metrics to a StatsD/DogStatsD agent over UDP every
+// interval: gauges as their value, counters (and histogram series) as the
+// increase since the last push. Labels are sent as DogStatsD tags. It stops
+// when ctx is done.
+func runStatsD(ctx context.Context, addr, prefix string, interval time.Duration) {
+	log.Printf("[METRICS] Pushing StatsD metrics to %s every %v", addr, interval)
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	last := make(map[string]float64)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		// The agent address may not resolve yet (ex: a sidecar container
+		// starting), so dialing is retried every interval.
+		if conn == nil {
+			c, err := net.Dial("udp", addr)
+			if err != nil {
+				recordExport("StatsD", err)
+				continue
+			}
+			conn = c
+		}
+		var b strings.Builder
+		for _, m := range allMetrics() {
+			base, labels := splitMetricName(m.name)
+			var tags string
+			if labels != "" {
+				tags = "|#" + strings.NewReplacer(`="`, ":", `"`, "").Replace(labels)
+			}
+			v := m.value()
+			if m.kind == gaugeMetric {
+				fmt.Fprintf(&b, "%s%s:%g|g%s\n", prefix, base, v, tags)
+				continue
+			}
+			delta := v - last[m.name]
+			last[m.name] = v
+			if delta > 0 {
+				fmt.Fprintf(&b, "%s%s:%g|c%s\n", prefix, base, delta, tags)
+			}
+		}
+		_, err := conn.Write([]byte(b.String()))
+		recordExport("StatsD", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdAgent listens like a StatsD agent and returns the lines of each
+// packet it gets.
+func statsdAgent(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	packets := make(chan []string, 100)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packets <- strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")
+		}
+	}()
+	return conn.LocalAddr().String(), packets
+}
+
+func nextPacket(t *testing.T, packets <-chan []string) []string {
+	t.Helper()
+	select {
+	case p := <-packets:
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatal("no StatsD packet")
+	}
+	return nil
+}
+
+// metricLine returns the line of the packet for the metric, "" without one.
+func metricLine(packet []string, name string) string {
+	for _, line := range packet {
+		if strings.HasPrefix(line, name+":") {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestStatsDPushesMetrics(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MetricsByTransport = true })
+	addr, packets := statsdAgent(t)
+	stop, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runStatsD(stop, addr, "test.", 20*time.Millisecond)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	first := nextPacket(t, packets)
+	if line := metricLine(first, "test.sse_connections"); !strings.HasSuffix(line, "|g") {
+		t.Errorf("connections gauge line %q", line)
+	}
+	// Labels become DogStatsD tags.
+	if line := metricLine(first, "test.sse_transport_connections"); !strings.HasSuffix(line, "|g|#transport:sse") {
+		t.Errorf("transport gauge line %q, want the label as a tag", line)
+	}
+
+	// Counters are sent as what they grew by since the last push, and not
+	// at all when they didn't.
+	metrics.delivered.Add(3)
+	var line string
+	for line == "" {
+		line = metricLine(nextPacket(t, packets), "test.sse_messages_delivered_total")
+	}
+	if line != "test.sse_messages_delivered_total:3|c" {
+		t.Errorf("delivered line %q, want an increase of 3", line)
+	}
+	if line := metricLine(nextPacket(t, packets), "test.sse_messages_delivered_total"); line != "" {
+		t.Errorf("unchanged counter sent: %q", line)
+	}
+}
+
+func TestStatsDStops(t *testing.T) {
+	addr, packets := statsdAgent(t)
+	stop, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		runStatsD(stop, addr, "test.", 10*time.Millisecond)
+		close(done)
+	}()
+	nextPacket(t, packets)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runStatsD kept running after its context was done")
+	}
+}
+
+// scrape returns the values of GET /metrics by series name.
+func scrape(t *testing.T, srv *httptest.Server) map[string]float64 {
+	t.Helper()
+	resp := get(t, srv.URL+"/metrics", nil)
+	defer resp.Body.Close()
+	values := make(map[string]float64)
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("metric line %q: %v", line, err)
+		}
+		values[line[:i]] = v
+	}
+	return values
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram([]float64{10, 100})
+	for _, v := range []int{0, 10, 11, 100, 5000} {
+		h.observe(v)
+	}
+	got := map[string]float64{}
+	for _, d := range h.defs("sizes", "") {
+		got[d.name] = d.value()
+	}
+	want := map[string]float64{
+		`sizes_bucket{le="10"}`:   2,
+		`sizes_bucket{le="100"}`:  4,
+		`sizes_bucket{le="+Inf"}`: 5,
+		"sizes_sum":               5121,
+		"sizes_count":             5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestEventSizesObserved(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 1661, nil)
+	before := scrape(t, srv)
+	for _, n := range []int{10, 300, 5000} {
+		rdb.Publish(ctx, "events:user:1661", strings.Repeat("x", n))
+		s.nextData(t)
+	}
+	after := scrape(t, srv)
+
+	want := map[string]float64{
+		`sse_event_bytes_bucket{le="64"}`:    1,
+		`sse_event_bytes_bucket{le="256"}`:   1,
+		`sse_event_bytes_bucket{le="1024"}`:  2,
+		`sse_event_bytes_bucket{le="4096"}`:  2,
+		`sse_event_bytes_bucket{le="16384"}`: 3,
+		`sse_event_bytes_bucket{le="+Inf"}`:  3,
+		"sse_event_bytes_sum":                5310,
+		"sse_event_bytes_count":              3,
+	}
+	for name, n := range want {
+		if _, ok := after[name]; !ok {
+			t.Errorf("no %s", name)
+		} else if d := after[name] - before[name]; d != n {
+			t.Errorf("%s grew by %g, want %g", name, d, n)
+		}
+	}
+}
+
+func TestEveryCloseReasonHasADisconnectKind(t *testing.T) {
+	kinds := make(map[string]bool)
+	for _, kind := range disconnectKindNames {
+		kinds[kind] = true
+	}
+	for _, reason := range closeReasons {
+		if !kinds[disconnectKinds[reason]] {
+			t.Errorf("close reason %s has no kind of sse_disconnects_total", reason)
+		}
+	}
+}
+
+func TestDisconnectKindsCounted(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	for reason, kind := range map[string]string{
+		"client_disconnect": "client",
+		"token_expired":     "expiry",
+		"maintenance":       "shutdown",
+		"stalled":           "error",
+		"superseded":        "limit",
+		"migrate":           "admin",
+	} {
+		before := scrape(t, srv)
+		countClose(reason)
+		after := scrape(t, srv)
+		for _, k := range disconnectKindNames {
+			name := fmt.Sprintf("sse_disconnects_total{reason=%q}", k)
+			want := 0.0
+			if k == kind {
+				want = 1
+			}
+			if d := after[name] - before[name]; d != want {
+				t.Errorf("%s: %s grew by %g, want %g", reason, name, d, want)
+			}
+		}
+	}
+}
+
+func TestDisconnectOfStreamCounted(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 1771, nil)
+	name := `sse_disconnects_total{reason="client"}`
+	before := scrape(t, srv)[name]
+	s.resp.Body.Close()
+	waitFor(t, "the disconnect to be counted", func() bool { return scrape(t, srv)[name]-before == 1 })
+}
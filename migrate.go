@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+var errMigrateTarget = errors.New("migration target not allowed")
+
+// normalizeMigrateTarget checks that v is the base URL of a sidecar, an
+// absolute http(s) URL without credentials, query or fragment, and returns
+// it without the trailing slash. The client appends the endpoint paths.
+func normalizeMigrateTarget(v string) (string, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("%q is not an http or https URL", v)
+	}
+	if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q must be a base URL, without credentials, query or fragment", v)
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+// parseMigrateTargets reads the base URLs clients may be migrated to.
+func parseMigrateTargets(name string, list []string) []string {
+	var targets []string
+	for _, entry := range list {
+		target, err := normalizeMigrateTarget(entry)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", name, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// migrateTarget returns the target of a migration request, when it's one of
+// cfg.MigrateTargets.
+func migrateTarget(v string) (string, error) {
+	target, err := normalizeMigrateTarget(v)
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(cfg.MigrateTargets, target) {
+		return "", fmt.Errorf("%w: %s", errMigrateTarget, target)
+	}
+	return target, nil
+}
+
+// migrate closes the streams after an `event: migrate` telling their
+// clients to reconnect to target, spread like a drain. Poll sessions are
+// left as they are, a poll client has no stream to get the event on. It
+// returns how many were migrated.
+func migrate(conns []*SSEClient, target string) int {
+	var streams []*SSEClient
+	for _, c := range conns {
+		if c.transport != transportPoll {
+			c.migrateTarget.Store(target)
+			streams = append(streams, c)
+		}
+	}
+	closeSpread(streams, "migrate")
+	return len(streams)
+}
+
+// writeMigrateEvent tells the client to reconnect to another sidecar, ex:
+// `{"url": "https://sse2.example.com"}`.
+func writeMigrateEvent(w io.Writer, target string) error {
+	b, _ := json.Marshal(map[string]string{"url": target})
+	return writeEvent(w, "migrate", string(b))
+}
+
+type migrateRequest struct {
+	URL string `json:"url"`
+	// Claims, when set, limit the migration to the connections matching
+	// them, like disconnectRequest.
+	Claims map[string]string `json:"claims"`
+}
+
+// migrateHandler moves the connections of this instance, or those matching
+// a claim filter, to another sidecar, ex: `{"url": "https://sse2.example.com"}`.
+// It returns how many were migrated.
+func migrateHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req migrateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Expected JSON body with a url", http.StatusBadRequest)
+		return
+	}
+	target, err := migrateTarget(req.URL)
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var matched []*SSEClient
+	for _, c := range registry.all() {
+		if c.matchesClaims(req.Claims) {
+			matched = append(matched, c)
+		}
+	}
+	n := migrate(matched, target)
+
+	log.Printf("[SSE-SIDECAR] Migrating %d connections to %s", n, target)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"migrated": n})
+}
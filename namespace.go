@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var errNamespaceNotAllowed = errors.New("namespace not allowed")
+
+// namespacePattern keeps namespaces from holding the separator or glob
+// characters.
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// namespaceFor returns the namespace in the token's `namespace` claim, which
+// must be listed in cfg.Namespaces (or its Redis set). Tokens without one use the channels and
+// keys as they are.
+func namespaceFor(claims *SSETokenClaims) (string, error) {
+	if claims.Namespace == "" {
+		return "", nil
+	}
+	if !allowlists.namespaces()[claims.Namespace] {
+		return "", fmt.Errorf("%w: %q", errNamespaceNotAllowed, claims.Namespace)
+	}
+	return claims.Namespace, nil
+}
+
+// qualify prefixes a Redis channel or key with the namespace, ex:
+// `prod:events:user:1`.
+func qualify(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + ":" + name
+}
+
+// qualify returns the Redis name of a channel or key of the connection.
+func (c *SSEClient) qualify(name string) string {
+	return qualify(c.namespace, name)
+}
+
+// unqualify returns a channel of the connection as named without namespace,
+// which is how the rest of the sidecar and the client see it.
+func (c *SSEClient) unqualify(name string) string {
+	if c.namespace == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, c.namespace+":")
+}
+
+// parseNamespaces reads a comma-separated list of namespaces.
+func parseNamespaces(name string, list []string) map[string]bool {
+	namespaces, err := compileNamespaces(list)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return namespaces
+}
+
+func compileNamespaces(list []string) (map[string]bool, error) {
+	namespaces := make(map[string]bool, len(list))
+	for _, ns := range list {
+		if !namespacePattern.MatchString(ns) {
+			return nil, fmt.Errorf("%q must be 1 to 64 letters, digits or -_.", ns)
+		}
+		namespaces[ns] = true
+	}
+	return namespaces, nil
+}
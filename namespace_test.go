@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func useNamespaces(c *Config) {
+	c.Namespaces = map[string]bool{"prod": true, "staging": true}
+}
+
+func TestNamespaceClaimValidated(t *testing.T) {
+	useConfig(t, useNamespaces)
+	for ns, want := range map[string]string{"": "", "prod": "prod", "staging": "staging"} {
+		if got, err := namespaceFor(&SSETokenClaims{Namespace: ns}); err != nil || got != want {
+			t.Errorf("%q: %q, %v", ns, got, err)
+		}
+	}
+	if _, err := namespaceFor(&SSETokenClaims{Namespace: "dev"}); err == nil {
+		t.Error("unlisted namespace accepted")
+	}
+	for _, ns := range []string{"prod:events", "prod*", "", "a b"} {
+		if _, err := compileNamespaces([]string{ns}); err == nil {
+			t.Errorf("namespace %q accepted in the list", ns)
+		}
+	}
+}
+
+func TestNamespacesDontCrossStreams(t *testing.T) {
+	_, srv := newSidecar(t, useNamespaces)
+	// The same user ID in two namespaces, and without one.
+	streams := map[string]*sseStream{}
+	for _, ns := range []string{"prod", "staging", ""} {
+		claims := jwt.MapClaims{}
+		if ns != "" {
+			claims["namespace"] = ns
+		}
+		streams[ns], _ = connect(t, srv, 1891, url.Values{"ssetoken": {token(t, 1891, claims)}})
+	}
+	for _, ns := range []string{"prod", "staging"} {
+		if n := len(registry.forUser(ns, 1891)); n != 1 {
+			t.Errorf("%d connections of user 1891 in %s", n, ns)
+		}
+	}
+
+	rdb.Publish(ctx, "prod:events:user:1891", "for prod")
+	rdb.Publish(ctx, "staging:events:user:1891", "for staging")
+	rdb.Publish(ctx, "events:user:1891", "for no namespace")
+	for ns, want := range map[string]string{"prod": "for prod", "staging": "for staging", "": "for no namespace"} {
+		if ev := streams[ns].nextData(t); ev.data != want {
+			t.Errorf("namespace %q got %q, want %q", ns, ev.data, want)
+		}
+	}
+	// Nothing else arrived on any of them.
+	rdb.Publish(ctx, "prod:events:user:1891", "end")
+	rdb.Publish(ctx, "staging:events:user:1891", "end")
+	rdb.Publish(ctx, "events:user:1891", "end")
+	for ns, s := range streams {
+		if ev := s.nextData(t); ev.data != "end" {
+			t.Errorf("namespace %q got %q from another namespace", ns, ev.data)
+		}
+	}
+}
+
+func TestUnlistedNamespaceRefused(t *testing.T) {
+	_, srv := newSidecar(t, useNamespaces)
+	if code := streamStatus(t, srv, 1892, jwt.MapClaims{"namespace": "dev"}); code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", code)
+	}
+	if len(registry.forUser("dev", 1892)) != 0 {
+		t.Error("connection registered in the unlisted namespace")
+	}
+}
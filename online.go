@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func onlineKey(userID int64) string {
+	return fmt.Sprintf("online:user:%d", userID)
+}
+
+// keepOnline sets the user's online key, with a TTL of cfg.PresenceTTL, and
+// refreshes it every cfg.PresenceRefresh while the connection is open. When
+// it closes the key is deleted, unless the user has other connections here;
+// connections on other instances set it again on their next refresh. A
+// crashed sidecar leaves the key to expire.
+func keepOnline(cctx context.Context, rdb *redis.Client, c *SSEClient) {
+	key := c.qualify(onlineKey(c.userID))
+	refresh := func() {
+		// A skipped refresh is made up for by the next one, within the TTL.
+		sctx, cancel, ok := backgroundRedis(cctx)
+		if !ok {
+			return
+		}
+		defer cancel()
+		if err := rdb.Set(sctx, key, time.Now().Unix(), cfg.PresenceTTL).Err(); err != nil && cctx.Err() == nil {
+			log.Printf("[PRESENCE] Failed to refresh %s: %v", key, redisErr(err))
+		}
+	}
+
+	refresh()
+	ticker := time.NewTicker(cfg.PresenceRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			refresh()
+		case <-cctx.Done():
+			for _, other := range registry.forUser(c.namespace, c.userID) {
+				if other != c {
+					return
+				}
+			}
+			dctx, cancel, ok := backgroundRedis(ctx)
+			if !ok {
+				// The key expires.
+				return
+			}
+			defer cancel()
+			if err := rdb.Del(dctx, key).Err(); err != nil {
+				log.Printf("[PRESENCE] Failed to delete %s: %v", key, redisErr(err))
+			}
+			return
+		}
+	}
+}
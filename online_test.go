@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnlineKeyRefreshed(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.PresenceTTL = time.Second
+		c.PresenceRefresh = 20 * time.Millisecond
+	})
+	connect(t, srv, 1931, nil)
+	waitFor(t, "the online key", func() bool { return mr.Exists("online:user:1931") })
+
+	// Most of the TTL goes by, the next refresh sets it again.
+	mr.FastForward(900 * time.Millisecond)
+	waitFor(t, "the refresh", func() bool { return mr.TTL("online:user:1931") > 900*time.Millisecond })
+	if !mr.Exists("online:user:1931") {
+		t.Error("online key gone while connected")
+	}
+}
+
+func TestOnlineKeyExpiresWithoutRefresh(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.PresenceTTL = time.Second
+		// Longer than the test, as if the sidecar had crashed.
+		c.PresenceRefresh = time.Minute
+	})
+	connect(t, srv, 1932, nil)
+	waitFor(t, "the online key", func() bool { return mr.Exists("online:user:1932") })
+	if ttl := mr.TTL("online:user:1932"); ttl != time.Second {
+		t.Errorf("TTL %v, want GO_SSE_SIDECAR_PRESENCE_TTL", ttl)
+	}
+	mr.FastForward(time.Second)
+	if mr.Exists("online:user:1932") {
+		t.Error("online key outlived its TTL")
+	}
+}
+
+func TestOnlineKeyDeletedOnLastDisconnect(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.PresenceTTL = time.Minute
+		c.PresenceRefresh = time.Second
+	})
+	first, _ := connect(t, srv, 1933, nil)
+	second, _ := connect(t, srv, 1933, nil)
+	waitFor(t, "the online key", func() bool { return mr.Exists("online:user:1933") })
+
+	first.resp.Body.Close()
+	waitFor(t, "the first close", func() bool { return len(registry.forUser("", 1933)) == 1 })
+	// Give a wrongful delete the time to happen.
+	time.Sleep(50 * time.Millisecond)
+	if !mr.Exists("online:user:1933") {
+		t.Fatal("online key deleted while another connection is open")
+	}
+	second.resp.Body.Close()
+	waitFor(t, "the delete", func() bool { return !mr.Exists("online:user:1933") })
+}
+
+func TestOnlineKeyOffByDefault(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 1934, nil)
+	mr.Publish("events:user:1934", "live")
+	s.nextData(t)
+	if mr.Exists("online:user:1934") {
+		t.Error("online key set without GO_SSE_SIDECAR_PRESENCE_TTL")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// connOptions are the per-connection overrides of the server's framing
+// defaults, from the `framing`, `encoding` and `events` query parameters.
+type connOptions struct {
+	envelope bool
+	// encoding is the stream's content encoding, "" for identity.
+	encoding string
+	// events is "named", "anonymous" or "" for the server default.
+	events string
+	// diag follows every event with a `: diag` comment, see writeDiagComment.
+	diag bool
+	// websocket streams over a WebSocket in the compact framing, see ws.go.
+	websocket bool
+	// downgraded are the options asked for but disabled on the server, that
+	// fell back to what the server supports.
+	downgraded []string
+}
+
+// What to do when a client asks for an option disabled on the server, see
+// GO_SSE_SIDECAR_UNSUPPORTED_OPTIONS.
+const (
+	// policyReject refuses the connection with 400.
+	policyReject = "reject"
+	// policyIgnore connects as if the option wasn't asked for.
+	policyIgnore = "ignore"
+	// policyDowngrade connects with what the server supports instead, and
+	// tells the client in the `connected` event.
+	policyDowngrade = "downgrade"
+)
+
+// unsupportedOptions are the options that can be asked for while disabled:
+// an `encoding` not in GO_SSE_SIDECAR_COMPRESSION, `presence`
+// without GO_SSE_SIDECAR_PRESENCE_CHANNEL and `diag` without
+// GO_SSE_SIDECAR_DIAGNOSTICS.
+var unsupportedOptions = []string{"encoding", "presence", "diag"}
+
+// parseUnsupportedPolicies reads either one policy for every option or
+// `option=policy` pairs, ex: `encoding=downgrade,presence=ignore`. Options
+// not listed are rejected.
+func parseUnsupportedPolicies(name, v string) map[string]string {
+	policies := make(map[string]string, len(unsupportedOptions))
+	for _, option := range unsupportedOptions {
+		policies[option] = policyReject
+	}
+	if v == "" {
+		return policies
+	}
+	for _, pair := range strings.Split(v, ",") {
+		option, policy, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			option, policy = "", option
+		}
+		switch policy {
+		case policyReject, policyIgnore, policyDowngrade:
+		default:
+			log.Fatalf("Invalid %s: unknown policy %q, expected reject, ignore or downgrade", name, policy)
+		}
+		switch {
+		case option == "":
+			for o := range policies {
+				policies[o] = policy
+			}
+		case slices.Contains(unsupportedOptions, option):
+			policies[option] = policy
+		default:
+			log.Fatalf("Invalid %s: unknown option %q, expected one of %s", name, option, strings.Join(unsupportedOptions, ", "))
+		}
+	}
+	return policies
+}
+
+// unsupported applies the policy of option to a request for it while it's
+// disabled on the server: err when it's rejected, nil otherwise.
+func (o *connOptions) unsupported(option string, err error) error {
+	switch cfg.UnsupportedOptions[option] {
+	case policyIgnore:
+		return nil
+	case policyDowngrade:
+		o.downgraded = append(o.downgraded, option)
+		return nil
+	}
+	return err
+}
+
+// parseConnOptions reads the connection options from the query, starting
+// from the server defaults. Unknown values are errors, like an encoding not
+// enabled on the server unless its policy says otherwise.
+func parseConnOptions(r *http.Request) (connOptions, error) {
+	q := r.URL.Query()
+	opts := connOptions{
+		envelope: cfg.Envelope,
+		encoding: negotiateEncoding(r, cfg.Compression),
+	}
+
+	switch v := q.Get("framing"); v {
+	case "":
+	case "raw":
+		opts.envelope = false
+	case "envelope":
+		opts.envelope = true
+	default:
+		return opts, fmt.Errorf("unknown framing %q", v)
+	}
+
+	switch v := q.Get("encoding"); v {
+	case "":
+	case "identity":
+		opts.encoding = ""
+	case "gzip", "deflate":
+		if !slices.Contains(cfg.Compression, v) {
+			if err := opts.unsupported("encoding", fmt.Errorf("encoding %q is not enabled", v)); err != nil {
+				return opts, err
+			}
+			break
+		}
+		opts.encoding = v
+	default:
+		return opts, fmt.Errorf("unknown encoding %q", v)
+	}
+
+	switch v := q.Get("events"); v {
+	case "", "named", "anonymous":
+		opts.events = v
+	default:
+		return opts, fmt.Errorf("unknown events %q", v)
+	}
+
+	switch v := q.Get("transport"); v {
+	case "", transportSSE:
+	case transportWS:
+		if !cfg.WebSocket {
+			return opts, errWebSocketDisabled
+		}
+		if !isWebSocketUpgrade(r) {
+			return opts, errNotWebSocket
+		}
+		// The sidecar doesn't compress WebSocket frames, so an encoding asked
+		// for in the query is unsupported here.
+		if v := q.Get("encoding"); v != "" && v == opts.encoding {
+			if err := opts.unsupported("encoding", fmt.Errorf("encoding %q is not available over WebSocket", v)); err != nil {
+				return opts, err
+			}
+		}
+		opts.websocket, opts.encoding = true, ""
+	default:
+		return opts, fmt.Errorf("unknown transport %q", v)
+	}
+
+	switch v := q.Get("diag"); v {
+	case "", "0":
+	case "1":
+		if !cfg.Diagnostics {
+			if err := opts.unsupported("diag", fmt.Errorf("diagnostics are not enabled")); err != nil {
+				return opts, err
+			}
+			break
+		}
+		opts.diag = true
+	default:
+		return opts, fmt.Errorf("unknown diag %q, expected 0 or 1", v)
+	}
+	return opts, nil
+}
+
+// connectedData is the data of the `connected` event: the connection ID and
+// the options the connection actually got.
+func connectedData(connID string, opts connOptions, presence bool) string {
+	framing, encoding, events := "raw", "identity", opts.events
+	if opts.envelope {
+		framing = "envelope"
+	}
+	if opts.encoding != "" {
+		encoding = opts.encoding
+	}
+	if events == "" {
+		events = "default"
+	}
+	data, _ := json.Marshal(struct {
+		ConnectionID string         `json:"connection_id"`
+		Options      map[string]any `json:"options"`
+		Downgraded   []string       `json:"downgraded,omitempty"`
+	}{
+		ConnectionID: connID,
+		Options:      map[string]any{"framing": framing, "encoding": encoding, "events": events, "presence": presence, "diag": opts.diag},
+		Downgraded:   opts.downgraded,
+	})
+	return string(data)
+}
+
+// frameEvent returns the SSE event name for msg on this connection. Named
+// events fall back to the channel name when the server default would send an
+// anonymous event. Presence records are always `presence` events.
+func (c *SSEClient) frameEvent(msg sseMessage) string {
+	if msg.event != "" {
+		return msg.event
+	}
+	if cfg.PresenceChannel != "" && msg.channel == cfg.PresenceChannel {
+		return "presence"
+	}
+	switch c.opts.events {
+	case "anonymous":
+		return ""
+	case "named":
+		if name := eventName(msg); name != "" {
+			return name
+		}
+		return mappedChannelName(msg.channel)
+	}
+	return eventName(msg)
+}
+
+// sseQueryParams and pollQueryParams are the query parameters each endpoint
+// understands.
+var (
+	sseQueryParams  = []string{"ssetoken", "framing", "encoding", "events", "presence", "feed", "diag", "transport"}
+	pollQueryParams = []string{"ssetoken", "cursor", "feed"}
+)
+
+// checkQueryParams refuses, in strict mode, the query parameters that are
+// neither known nor in cfg.ExtraQueryParams, so client typos surface instead
+// of being ignored.
+func checkQueryParams(r *http.Request, known []string) error {
+	if !cfg.StrictQuery {
+		return nil
+	}
+	for name := range r.URL.Query() {
+		if !slices.Contains(known, name) && !cfg.ExtraQueryParams[name] {
+			return fmt.Errorf("unknown query parameter %q", name)
+		}
+	}
+	return nil
+}
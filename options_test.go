@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestParseConnOptions(t *testing.T) {
+	useConfig(t, func(c *Config) { c.Compression = []string{"gzip"} })
+	tests := []struct {
+		query    string
+		envelope bool
+		encoding string
+		events   string
+	}{
+		{"", false, "", ""},
+		{"framing=envelope", true, "", ""},
+		{"framing=raw&events=named", false, "", "named"},
+		{"encoding=gzip&events=anonymous", false, "gzip", "anonymous"},
+		{"framing=envelope&encoding=gzip&events=named", true, "gzip", "named"},
+		{"encoding=identity", false, "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/sse-events?"+tt.query, nil)
+		opts, err := parseConnOptions(r)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if opts.envelope != tt.envelope || opts.encoding != tt.encoding || opts.events != tt.events {
+			t.Errorf("%q: got %+v", tt.query, opts)
+		}
+	}
+}
+
+func TestConnOptionsOverrideServerDefaults(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.Envelope = true
+		c.Compression = []string{"gzip"}
+	})
+	r := httptest.NewRequest(http.MethodGet, "/sse-events?framing=raw&encoding=identity", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	opts, err := parseConnOptions(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.envelope || opts.encoding != "" {
+		t.Errorf("got %+v, want raw framing without compression", opts)
+	}
+}
+
+func TestConnOptionsRejected(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	tok := token(t, 1351, nil)
+	for _, query := range []string{
+		"framing=protobuf",
+		"encoding=br",
+		// Known, but not enabled on the server.
+		"encoding=gzip",
+		"events=NAMED",
+	} {
+		resp := get(t, srv.URL+"/sse-events?ssetoken="+tok+"&"+query, nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %s, want 400", query, resp.Status)
+		} else if !strings.HasPrefix(string(body), "Bad Request: ") {
+			t.Errorf("%s: body %q doesn't say what was wrong", query, body)
+		}
+	}
+}
+
+func TestNamedEnvelopeConnection(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 1352, url.Values{"framing": {"envelope"}, "events": {"named"}})
+	rdb.Publish(ctx, "events:user:1352", `{"n": 1}`)
+
+	// Without a server default, named events are named after the channel.
+	ev := s.nextData(t)
+	if ev.event != "events:user:1352" {
+		t.Errorf("named event %q, want the channel name", ev.event)
+	}
+	var envelope struct {
+		Channel string `json:"channel"`
+		Data    struct {
+			N int `json:"n"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(ev.data), &envelope); err != nil || envelope.Channel != "events:user:1352" || envelope.Data.N != 1 {
+		t.Errorf("envelope %q (%v)", ev.data, err)
+	}
+}
+
+func TestAnonymousConnectionIgnoresDefaultEvent(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.DefaultEvent = "message" })
+	anonymous, _ := connect(t, srv, 1354, url.Values{"events": {"anonymous"}})
+	byDefault, _ := connect(t, srv, 1354, nil)
+	rdb.Publish(ctx, "events:user:1354", "hi")
+
+	if ev := anonymous.nextData(t); ev.event != "" || ev.data != "hi" {
+		t.Errorf("anonymous connection got event %q data %q", ev.event, ev.data)
+	}
+	if ev := byDefault.nextData(t); ev.event != "message" {
+		t.Errorf("default connection got event %q, want the server default", ev.event)
+	}
+}
+
+func TestConnectedEventReportsOptions(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	q := url.Values{"ssetoken": {token(t, 1353, nil)}, "framing": {"envelope"}, "events": {"named"}}
+	ev := openStream(t, srv, q).nextEvent(t, "connected")
+	var data struct {
+		Options map[string]any `json:"options"`
+	}
+	if err := json.Unmarshal([]byte(ev.data), &data); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"framing": "envelope", "encoding": "identity", "events": "named"}
+	for k, v := range want {
+		if data.Options[k] != v {
+			t.Errorf("options.%s = %v, want %v", k, data.Options[k], v)
+		}
+	}
+}
+
+// queryStatus is the status of GET path with the token of userID and query.
+func queryStatus(t *testing.T, srv *httptest.Server, path string, userID int64, query string) (int, string) {
+	t.Helper()
+	resp := get(t, srv.URL+path+"?ssetoken="+token(t, userID, nil)+query, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	return resp.StatusCode, ""
+}
+
+func TestStrictQuery(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.StrictQuery = true
+		c.ExtraQueryParams = parseFieldSet("v, _cb")
+	})
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusOK},
+		{"&framing=raw&events=named", http.StatusOK},
+		// Added by the app or a cache buster.
+		{"&v=3&_cb=123", http.StatusOK},
+		{"&framming=raw", http.StatusBadRequest},
+		{"&event=named", http.StatusBadRequest},
+		{"&cursor=abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		status, body := queryStatus(t, srv, "/sse-events", 1551, tt.query)
+		if status != tt.want {
+			t.Errorf("%q: %d %s, want %d", tt.query, status, body, tt.want)
+		}
+		if status == http.StatusBadRequest && !strings.Contains(body, "unknown query parameter") {
+			t.Errorf("%q: body %q doesn't name the parameter", tt.query, body)
+		}
+	}
+}
+
+func TestStrictQueryOnPoll(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) {
+		c.StrictQuery = true
+		c.PollTimeout = 10 * time.Millisecond
+	})
+	if status, body := queryStatus(t, srv, "/poll", 1552, "&framing=raw"); status != http.StatusBadRequest {
+		t.Errorf("framing on /poll: %d %s, want 400", status, body)
+	}
+	if status, body := queryStatus(t, srv, "/poll", 1552, "&feed="); status != http.StatusOK {
+		t.Errorf("feed on /poll: %d %s", status, body)
+	}
+}
+
+func TestLenientQueryByDefault(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	if status, body := queryStatus(t, srv, "/sse-events", 1553, "&frmaing=raw&whatever=1"); status != http.StatusOK {
+		t.Errorf("unknown parameters: %d %s, want them ignored", status, body)
+	}
+}
+
+func TestParseUnsupportedPolicies(t *testing.T) {
+	tests := []struct {
+		v    string
+		want map[string]string
+	}{
+		{"", map[string]string{"encoding": "reject", "presence": "reject", "diag": "reject"}},
+		{"downgrade", map[string]string{"encoding": "downgrade", "presence": "downgrade", "diag": "downgrade"}},
+		{"encoding=downgrade, presence=ignore", map[string]string{"encoding": "downgrade", "presence": "ignore", "diag": "reject"}},
+	}
+	for _, tt := range tests {
+		if got := parseUnsupportedPolicies("GO_SSE_SIDECAR_UNSUPPORTED_OPTIONS", tt.v); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+// connectedEvent is the data of a `connected` event.
+type connectedEvent struct {
+	Options    map[string]any `json:"options"`
+	Downgraded []string       `json:"downgraded"`
+}
+
+func TestUnsupportedOptionPolicies(t *testing.T) {
+	// Neither compression, presence nor diagnostics are enabled.
+	const query = "encoding=gzip&presence=2082&diag=1"
+	tests := []struct {
+		policy     string
+		want       int
+		downgraded []string
+	}{
+		{"reject", http.StatusBadRequest, nil},
+		{"ignore", http.StatusOK, nil},
+		{"downgrade", http.StatusOK, []string{"encoding", "diag", "presence"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			_, srv := newSidecar(t, func(c *Config) {
+				c.UnsupportedOptions = parseUnsupportedPolicies("GO_SSE_SIDECAR_UNSUPPORTED_OPTIONS", tt.policy)
+			})
+			q, _ := url.ParseQuery(query)
+			q.Set("ssetoken", token(t, 2081, jwt.MapClaims{"presence_users": []int64{2082}}))
+			if tt.want != http.StatusOK {
+				if status, body := queryStatus(t, srv, "/sse-events", 2081, "&"+query); status != tt.want {
+					t.Errorf("%d %s, want %d", status, body, tt.want)
+				}
+				return
+			}
+			s := openStream(t, srv, q)
+			var got connectedEvent
+			if err := json.Unmarshal([]byte(s.nextEvent(t, "connected").data), &got); err != nil {
+				t.Fatal(err)
+			}
+			// What the connection got, not what was asked for.
+			if got.Options["encoding"] != "identity" || got.Options["presence"] != false || got.Options["diag"] != false {
+				t.Errorf("options %v", got.Options)
+			}
+			if !reflect.DeepEqual(got.Downgraded, tt.downgraded) {
+				t.Errorf("downgraded %v, want %v", got.Downgraded, tt.downgraded)
+			}
+		})
+	}
+}
+
+func TestConnectedReflectsOptions(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	q := url.Values{"ssetoken": {token(t, 2083, nil)}, "framing": {"envelope"}, "events": {"named"}}
+	s := openStream(t, srv, q)
+	var got connectedEvent
+	if err := json.Unmarshal([]byte(s.nextEvent(t, "connected").data), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"framing": "envelope", "encoding": "identity", "events": "named", "presence": false, "diag": false}
+	if !reflect.DeepEqual(got.Options, want) || got.Downgraded != nil {
+		t.Errorf("connected %+v, want options %v", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pauseGate holds event delivery on every connection of the instance, ex:
+// during a Redis failover, without closing them. Messages keep being queued
+// in each connection's buffer, and dropped once it's full.
+type pauseGate struct {
+	mu     sync.Mutex
+	paused bool
+	// changed is closed and replaced on every pause and resume.
+	changed chan struct{}
+	// timer resumes delivery after cfg.MaxPause.
+	timer *time.Timer
+}
+
+var delivery = &pauseGate{changed: make(chan struct{})}
+
+// state reports whether delivery is paused, and returns a channel closed at
+// the next change.
+func (g *pauseGate) state() (bool, <-chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused, g.changed
+}
+
+func (g *pauseGate) isPaused() bool {
+	paused, _ := g.state()
+	return paused
+}
+
+// set pauses or resumes delivery and reports whether that changed anything.
+func (g *pauseGate) set(paused bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.setLocked(paused)
+}
+
+func (g *pauseGate) setLocked(paused bool) bool {
+	if g.paused == paused {
+		return false
+	}
+	g.paused = paused
+	close(g.changed)
+	g.changed = make(chan struct{})
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	if paused && cfg.MaxPause > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(cfg.MaxPause, func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			// A resume and a new pause may have happened meanwhile.
+			if g.timer == t && g.setLocked(false) {
+				log.Printf("[SSE-SIDECAR] Delivery paused for %v, resuming", cfg.MaxPause)
+			}
+		})
+		g.timer = t
+	}
+	return true
+}
+
+// pauseHandler pauses (POST /pause) or resumes (POST /resume) delivery on
+// this instance.
+func pauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		if delivery.set(paused) {
+			if paused {
+				log.Printf("[SSE-SIDECAR] Delivery paused on %d connections", len(registry.all()))
+			} else {
+				log.Printf("[SSE-SIDECAR] Delivery resumed")
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"paused": paused})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setDelivery calls POST /pause or POST /resume with the admin token.
+func setDelivery(t *testing.T, paused bool) {
+	t.Helper()
+	path := "/resume"
+	if paused {
+		path = "/pause"
+	}
+	r := httptest.NewRequest(http.MethodPost, path, nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	pauseHandler(paused)(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST %s: %d %s", path, rec.Code, rec.Body)
+	}
+	t.Cleanup(func() { delivery.set(false) })
+}
+
+func TestPauseBuffersUntilResume(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin")
+	_, srv := newSidecar(t, func(c *Config) { c.TimeSyncInterval = 50 * time.Millisecond })
+	s, conn := connect(t, srv, 1671, nil)
+
+	setDelivery(t, true)
+	for _, p := range []string{"a", "b", "c"} {
+		rdb.Publish(ctx, "events:user:1671", p)
+	}
+	waitFor(t, "the messages to be queued", func() bool { return registry.get(conn).queued() == 3 })
+	// The connection stays up, only the messages wait.
+	for i := 0; i < 2; i++ {
+		if ev := s.next(t); ev.event != "time" {
+			t.Fatalf("got %+v while paused, want only time events", ev)
+		}
+	}
+
+	setDelivery(t, false)
+	for _, want := range []string{"a", "b", "c"} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Fatalf("got %q after the resume, want %q", ev.data, want)
+		}
+	}
+}
+
+func TestPauseOverflowDeadLettered(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin")
+	_, srv := newSidecar(t, func(c *Config) {
+		c.QueueSize = 2
+		c.DeadLetterChannel = "deadletters"
+	})
+	records := subscribeTo(t, "deadletters")
+	startDeadLetters(t)
+	s, conn := connect(t, srv, 1672, nil)
+
+	setDelivery(t, true)
+	for _, p := range []string{"a", "b", "c"} {
+		rdb.Publish(ctx, "events:user:1672", p)
+	}
+	if r := decodeDeadLetter(t, receive(t, records)); r.Reason != "paused" || r.Payload != "c" {
+		t.Errorf("record %+v, want the message over the queue", r)
+	}
+	if n := registry.get(conn).queued(); n != 2 {
+		t.Errorf("%d queued, want the queue size", n)
+	}
+
+	setDelivery(t, false)
+	for _, want := range []string{"a", "b"} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Fatalf("got %q after the resume, want %q", ev.data, want)
+		}
+	}
+}
+
+func TestPauseEndsAfterMaxPause(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin")
+	_, srv := newSidecar(t, func(c *Config) { c.MaxPause = 300 * time.Millisecond })
+	s, conn := connect(t, srv, 1673, nil)
+
+	setDelivery(t, true)
+	rdb.Publish(ctx, "events:user:1673", "held")
+	waitFor(t, "the message to be queued", func() bool { return registry.get(conn).queued() == 1 })
+	if ev := s.nextData(t); ev.data != "held" {
+		t.Errorf("got %q", ev.data)
+	}
+	if delivery.isPaused() {
+		t.Error("still paused after GO_SSE_SIDECAR_MAX_PAUSE")
+	}
+}
+
+func TestPauseRequiresAdminToken(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_ADMIN_TOKEN", "admin")
+	useConfig(t, nil)
+	rec := httptest.NewRecorder()
+	pauseHandler(true)(rec, httptest.NewRequest(http.MethodPost, "/pause", nil))
+	if rec.Code != http.StatusUnauthorized || delivery.isPaused() {
+		t.Errorf("status %d, paused %v without the admin token", rec.Code, delivery.isPaused())
+	}
+}
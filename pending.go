@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pendingTTL is how long the messages persisted on shutdown wait for the
+// user to reconnect.
+const pendingTTL = 24 * time.Hour
+
+func pendingKey(userID int64) string {
+	return fmt.Sprintf("pending:user:%d", userID)
+}
+
+// pendingEntry is a message persisted on shutdown.
+type pendingEntry struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern,omitempty"`
+	Payload string `json:"payload"`
+}
+
+// persistPending writes the messages the connection still holds when the
+// sidecar shuts down to the user's pending list, at most
+// cfg.PersistOnShutdown, so the next connection replays them. Messages of
+// the sidecar's own events are left out, the next connection sends its own.
+// The ones not persisted are left to the dead-letter channel.
+func (c *SSEClient) persistPending(rdb *redis.Client, fair *fairQueue) {
+	if cfg.PersistOnShutdown <= 0 || !draining.Load() {
+		return
+	}
+	var entries []interface{}
+	var held []sseMessage
+	for len(entries) < cfg.PersistOnShutdown {
+		msg, ok := fair.pop()
+		if !ok {
+			msg, ok = c.next()
+		}
+		if !ok {
+			break
+		}
+		if msg.event != "" {
+			continue
+		}
+		b, _ := json.Marshal(pendingEntry{Channel: msg.channel, Pattern: msg.pattern, Payload: msg.payload})
+		entries = append(entries, string(b))
+		held = append(held, msg)
+	}
+	if len(entries) == 0 {
+		return
+	}
+	key := c.qualify(c.pendingKey())
+	pctx, cancel := context.WithTimeout(ctx, cfg.BackgroundTimeout)
+	defer cancel()
+	pipe := rdb.TxPipeline()
+	pipe.RPush(pctx, key, entries...)
+	pipe.LTrim(pctx, key, int64(-cfg.PersistOnShutdown), -1)
+	pipe.Expire(pctx, key, pendingTTL)
+	if _, err := pipe.Exec(pctx); err != nil {
+		c.logf("Failed to persist %d undelivered messages to %s: %v", len(held), key, redisErr(err))
+		for _, msg := range held {
+			deadLetters.add(c, msg, "disconnected")
+		}
+		return
+	}
+	metrics.persisted.Add(int64(len(held)))
+	c.logf("Persisted %d undelivered messages to %s", len(held), key)
+}
+
+// replayPending queues the messages persisted by the user's previous
+// connection and removes them, so only one connection replays them.
+func replayPending(ctx context.Context, rdb *redis.Client, client *SSEClient) {
+	key := client.qualify(client.pendingKey())
+	pipe := rdb.TxPipeline()
+	lrange := pipe.LRange(ctx, key, 0, -1)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		client.logf("Failed to read pending messages %s: %v", key, err)
+		return
+	}
+	entries := lrange.Val()
+	if len(entries) == 0 {
+		return
+	}
+	client.logf("Replaying %d pending messages from %s", len(entries), key)
+	for _, raw := range entries {
+		var e pendingEntry
+		if json.Unmarshal([]byte(raw), &e) != nil {
+			continue
+		}
+		msg := sseMessage{channel: e.Channel, pattern: e.Pattern, payload: e.Payload}
+		msg.enqueued, msg.seq = time.Now(), client.enqueueSeq.Add(1)
+		select {
+		case client.channel <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestUndeliveredPersistedOnShutdownAndReplayed(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.HistoryBackfill = 10
+		c.PersistOnShutdown = 3
+		c.QueueSize = 10
+	})
+	persisted := metrics.persisted.Load()
+	s, conn := connect(t, srv, 2241, nil)
+
+	// Held back, so the messages are still buffered when draining.
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	for i := 0; i < 5; i++ {
+		rdb.Publish(ctx, "events:user:2241", fmt.Sprintf("m%d", i))
+	}
+	waitFor(t, "the messages buffered", func() bool { return registry.get(conn).queued() == 5 })
+	drainForTest(t)
+	s.ended(t)
+	waitFor(t, "the connection closed", func() bool { return registry.get(conn) == nil })
+
+	// Bounded to the first 3, what the next connection would have got first.
+	got, _ := mr.List("pending:user:2241")
+	if len(got) != 3 {
+		t.Fatalf("persisted %q, want 3 messages", got)
+	}
+	for i, raw := range got {
+		var e pendingEntry
+		if err := json.Unmarshal([]byte(raw), &e); err != nil || e.Channel != "events:user:2241" || e.Payload != fmt.Sprintf("m%d", i) {
+			t.Errorf("entry %d: %s", i, raw)
+		}
+	}
+	if ttl := mr.TTL("pending:user:2241"); ttl != pendingTTL {
+		t.Errorf("TTL %v, want %v", ttl, pendingTTL)
+	}
+	if n := metrics.persisted.Load() - persisted; n != 3 {
+		t.Errorf("%d counted persisted, want 3", n)
+	}
+
+	// The next connection replays them, then gets the live events.
+	draining.Store(false)
+	delivery.set(false)
+	s, _ = connect(t, srv, 2241, nil)
+	for _, want := range []string{"m0", "m1", "m2"} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Fatalf("replayed %q, want %q", ev.data, want)
+		}
+	}
+	rdb.Publish(ctx, "events:user:2241", "live")
+	if ev := s.nextData(t); ev.data != "live" {
+		t.Fatalf("got %q after the replay", ev.data)
+	}
+	// Only once.
+	if mr.Exists("pending:user:2241") {
+		t.Error("pending list kept after the replay")
+	}
+}
+
+func TestNothingPersistedWhenClientLeaves(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.HistoryBackfill = 10
+		c.PersistOnShutdown = 3
+	})
+	s, conn := connect(t, srv, 2242, nil)
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	rdb.Publish(ctx, "events:user:2242", "held")
+	waitFor(t, "the message buffered", func() bool { return registry.get(conn).queued() == 1 })
+	s.resp.Body.Close()
+	waitFor(t, "the connection closed", func() bool { return registry.get(conn) == nil })
+	if mr.Exists("pending:user:2242") {
+		t.Error("persisted without a shutdown")
+	}
+}
+
+func TestPersistPendingSkipsSidecarEvents(t *testing.T) {
+	mr := useRedis(t)
+	useConfig(t, func(c *Config) {
+		c.HistoryBackfill = 10
+		c.PersistOnShutdown = 2
+	})
+	draining.Store(true)
+	t.Cleanup(func() { draining.Store(false) })
+	mr.RPush("pending:user:2243", `{"channel":"events:user:2243","payload":"older"}`)
+
+	c := &SSEClient{id: "pending", userID: 2243, channel: make(chan sseMessage, 4)}
+	c.channel <- sseMessage{event: "snapshot", payload: "{}"}
+	c.channel <- sseMessage{channel: "events:user:2243", pattern: "events:*", payload: "a"}
+	c.channel <- sseMessage{channel: "events:user:2243", payload: "b"}
+	c.persistPending(rdb, nil)
+
+	// Appended to what's there, the list trimmed to the newest 2.
+	got, _ := mr.List("pending:user:2243")
+	want := []string{
+		`{"channel":"events:user:2243","pattern":"events:*","payload":"a"}`,
+		`{"channel":"events:user:2243","payload":"b"}`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("pending %q, want %q", got, want)
+	}
+}
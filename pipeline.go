@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// pipelineStage is a step a message received from Redis (or read from the
+// history) goes through before it's queued, or a queued one before it's
+// written. It returns false to drop it.
+type pipelineStage func(c *SSEClient, msg sseMessage) (sseMessage, bool)
+
+// pipelineStages are the stages by name. A stage with nothing configured
+// passes messages through.
+var pipelineStages = map[string]pipelineStage{
+	"bom": func(c *SSEClient, msg sseMessage) (sseMessage, bool) {
+		msg.payload = stripBOM(msg.payload)
+		return msg, true
+	},
+	"empty": func(c *SSEClient, msg sseMessage) (sseMessage, bool) {
+		payload, ok := emptyPayload(msg.payload)
+		if !ok {
+			c.logf("Skipping empty message for user %d on %s", c.userID, msg.channel)
+		}
+		msg.payload = payload
+		return msg, ok
+	},
+	"schema": func(c *SSEClient, msg sseMessage) (sseMessage, bool) {
+		return msg, c.conforms(msg)
+	},
+	"plugin": func(c *SSEClient, msg sseMessage) (sseMessage, bool) {
+		msg, ok := c.plugged(msg)
+		if !ok {
+			c.logf("Plugin dropped message for user %d on %s", c.userID, msg.channel)
+		}
+		return msg, ok
+	},
+}
+
+// writeStages are the stages a queued message goes through, by name, when
+// it's about to be written: after its staleness is checked and before the
+// fair share and quota are.
+var writeStages = map[string]pipelineStage{
+	"dedupe": func(c *SSEClient, msg sseMessage) (sseMessage, bool) {
+		if c.dedupe.duplicate(msg.payload, time.Now()) {
+			c.logf("Suppressing duplicate message for user %d", c.userID)
+			return msg, false
+		}
+		if c.seenIDs.duplicate(msg.asPublished().payload) {
+			c.logf("Suppressing already sent event id for user %d", c.userID)
+			return msg, false
+		}
+		return msg, true
+	},
+	"transform": func(c *SSEClient, msg sseMessage) (sseMessage, bool) {
+		return transformMessage(c, msg), true
+	},
+	"envelope": func(c *SSEClient, msg sseMessage) (sseMessage, bool) {
+		if c.envelopes(msg) {
+			msg.rewrite(envelopeData(msg, c.eventMetadata))
+			msg.enveloped = true
+		}
+		return msg, true
+	},
+}
+
+// transformMessage applies GO_SSE_SIDECAR_TRANSFORM to msg, once.
+func transformMessage(c *SSEClient, msg sseMessage) sseMessage {
+	if !msg.transformed {
+		msg.rewrite(cfg.Transform.apply(msg.payload))
+		msg.transformed = true
+	}
+	return msg
+}
+
+// defaultPipeline and defaultWritePipeline are the order of the stages
+// unless GO_SSE_SIDECAR_PIPELINE and GO_SSE_SIDECAR_WRITE_PIPELINE say
+// otherwise.
+const (
+	defaultPipeline      = "bom,empty,schema,plugin"
+	defaultWritePipeline = "dedupe,transform,envelope"
+)
+
+// parsePipeline reads the order of stages, which must list every one of
+// them once.
+func parsePipeline(name, v string, stages map[string]pipelineStage, def string) []pipelineStage {
+	var order []pipelineStage
+	seen := make(map[string]bool)
+	for _, stage := range strings.Split(v, ",") {
+		stage = strings.TrimSpace(stage)
+		f, ok := stages[stage]
+		if !ok || seen[stage] {
+			log.Fatalf("Invalid %s %q: %q is unknown or repeated, expected an order of %s", name, v, stage, def)
+		}
+		seen[stage] = true
+		order = append(order, f)
+	}
+	if len(order) != len(stages) {
+		log.Fatalf("Invalid %s %q: every stage of %s must be listed", name, v, def)
+	}
+	return order
+}
+
+// receive runs msg through the pipeline.
+func (c *SSEClient) receive(msg sseMessage) (sseMessage, bool) {
+	return c.runStages(cfg.Pipeline, msg)
+}
+
+// prepare runs msg through the write pipeline.
+func (c *SSEClient) prepare(msg sseMessage) (sseMessage, bool) {
+	return c.runStages(cfg.WritePipeline, msg)
+}
+
+func (c *SSEClient) runStages(stages []pipelineStage, msg sseMessage) (sseMessage, bool) {
+	for _, stage := range stages {
+		var ok bool
+		if msg, ok = stage(c, msg); !ok {
+			return msg, false
+		}
+	}
+	return msg, true
+}
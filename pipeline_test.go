@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWritePipelineOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		// The nonce differs, so both are written; then enveloped transformed.
+		{defaultWritePipeline, []string{
+			`{"channel":"events:user:2071","content_type":"application/json","data":{"text":"hi"}}`,
+			`{"channel":"events:user:2071","content_type":"application/json","data":{"text":"hi"}}`,
+			`{"channel":"events:user:2071","content_type":"text/plain","data":"end"}`,
+		}},
+		// Transformed first, the second one is a duplicate.
+		{"transform,dedupe,envelope", []string{
+			`{"channel":"events:user:2072","content_type":"application/json","data":{"text":"hi"}}`,
+			`{"channel":"events:user:2072","content_type":"text/plain","data":"end"}`,
+		}},
+		// The transform reshapes the envelope, not the payload.
+		{"dedupe,envelope,transform", []string{
+			`{"body":{"msg":"hi","nonce":1},"channel":"events:user:2073","content_type":"application/json"}`,
+			`{"body":{"msg":"hi","nonce":2},"channel":"events:user:2073","content_type":"application/json"}`,
+			`{"body":"end","channel":"events:user:2073","content_type":"text/plain"}`,
+		}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			_, srv := newSidecar(t, func(c *Config) {
+				c.WritePipeline = parsePipeline("GO_SSE_SIDECAR_WRITE_PIPELINE", tt.order, writeStages, defaultWritePipeline)
+				c.Transform = parseTransform("", "nonce", "msg=text,data=body")
+				c.DedupeWindow = time.Minute
+			})
+			id := int64(2071 + i)
+			s, _ := connect(t, srv, id, url.Values{"framing": {"envelope"}})
+			channel := userChannel(id)
+			for _, payload := range []string{`{"msg": "hi", "nonce": 1}`, `{"msg": "hi", "nonce": 2}`, "end"} {
+				rdb.Publish(ctx, channel, payload)
+			}
+			var got []string
+			for len(got) < len(tt.want) {
+				got = append(got, s.nextData(t).data)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("written\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIDAndNameReadAsPublished(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.EventIDField = "id"
+		c.Transform = parseTransform("", "id", "")
+	})
+	c := &SSEClient{id: "c", opts: connOptions{envelope: true}}
+	msg, _ := c.runStages(parsePipeline("GO_SSE_SIDECAR_WRITE_PIPELINE", "transform,envelope,dedupe", writeStages, defaultWritePipeline), sseMessage{channel: "c", payload: `{"id": "e1", "n": 1}`})
+	if got := c.eventID(msg.asPublished()); got != "e1" {
+		t.Errorf("id %q after the transform, want the published one", got)
+	}
+	if msg.payload != `{"channel":"c","content_type":"application/json","data":{"n":1}}` {
+		t.Errorf("payload %s", msg.payload)
+	}
+}
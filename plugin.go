@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// EventPlugin is custom logic run on every event before it's queued for a
+// connection, compiled into the sidecar: implement it in a new file of this
+// package, register it from an init function and select it with
+// GO_SSE_SIDECAR_PLUGIN (see plugin_example.go).
+type EventPlugin interface {
+	// Transform returns the payload to deliver, or keep false to drop the
+	// event. On error the event is delivered unchanged.
+	Transform(ev PluginEvent) (payload string, keep bool, err error)
+}
+
+// PluginEvent is an event as received from Redis, for one connection.
+type PluginEvent struct {
+	UserID  int64
+	Channel string
+	Payload string
+}
+
+var plugins = make(map[string]EventPlugin)
+
+// registerPlugin makes a plugin selectable by name.
+func registerPlugin(name string, p EventPlugin) {
+	plugins[name] = p
+}
+
+// eventPlugin is the plugin selected by GO_SSE_SIDECAR_PLUGIN, or nil.
+var eventPlugin EventPlugin
+
+// loadPlugin selects the configured plugin at startup.
+func loadPlugin(name string) {
+	p, ok := plugins[name]
+	if !ok {
+		names := make([]string, 0, len(plugins))
+		for n := range plugins {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		log.Fatalf("Unknown GO_SSE_SIDECAR_PLUGIN %q, expected one of: %s", name, strings.Join(names, ", "))
+	}
+	eventPlugin = p
+	log.Printf("[SSE-SIDECAR] Transforming events with plugin %s", name)
+}
+
+// plugged runs the plugin on msg. It reports false when the plugin drops
+// it; a failing (or panicking) plugin leaves msg as it is.
+func (c *SSEClient) plugged(msg sseMessage) (sseMessage, bool) {
+	if eventPlugin == nil {
+		return msg, true
+	}
+	payload, keep, err := runPlugin(PluginEvent{UserID: c.userID, Channel: msg.channel, Payload: msg.payload})
+	if err != nil {
+		metrics.pluginErrors.Add(1)
+		c.logf("Plugin failed on a message for user %d, delivering it unchanged: %v", c.userID, err)
+		return msg, true
+	}
+	if !keep {
+		metrics.pluginDropped.Add(1)
+		return msg, false
+	}
+	msg.payload = payload
+	return msg, true
+}
+
+func runPlugin(ev PluginEvent) (payload string, keep bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return eventPlugin.Transform(ev)
+}
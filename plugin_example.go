@@ -0,0 +1,29 @@
+package main
+
+import "encoding/json"
+
+// dropInternalPlugin is an example EventPlugin, selected with
+// GO_SSE_SIDECAR_PLUGIN=drop_internal: it drops JSON object events with
+// `"internal": true` and removes the field from the others.
+type dropInternalPlugin struct{}
+
+func init() {
+	registerPlugin("drop_internal", dropInternalPlugin{})
+}
+
+func (dropInternalPlugin) Transform(ev PluginEvent) (string, bool, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(ev.Payload), &fields) != nil {
+		return ev.Payload, true, nil
+	}
+	internal, ok := fields["internal"]
+	if !ok {
+		return ev.Payload, true, nil
+	}
+	if string(internal) == "true" {
+		return "", false, nil
+	}
+	delete(fields, "internal")
+	b, err := json.Marshal(fields)
+	return string(b), true, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// shoutPlugin upper-cases payloads, drops "drop", fails on "fail" and
+// panics on "panic".
+type shoutPlugin struct{}
+
+func (shoutPlugin) Transform(ev PluginEvent) (string, bool, error) {
+	switch ev.Payload {
+	case "drop":
+		return "", false, nil
+	case "fail":
+		return "", false, errors.New("can't shout")
+	case "panic":
+		panic("shouting too loud")
+	}
+	return fmt.Sprintf("%s (user %d on %s)", strings.ToUpper(ev.Payload), ev.UserID, ev.Channel), true, nil
+}
+
+// usePlugin registers p as name and selects it for the test.
+func usePlugin(t *testing.T, name string, p EventPlugin) {
+	t.Helper()
+	old := eventPlugin
+	registerPlugin(name, p)
+	loadPlugin(name)
+	t.Cleanup(func() {
+		eventPlugin = old
+		delete(plugins, name)
+	})
+}
+
+func TestDropInternalPlugin(t *testing.T) {
+	p := plugins["drop_internal"]
+	for payload, want := range map[string]string{
+		`{"internal": true, "n": 1}`:  "",
+		`{"internal": false, "n": 1}`: `{"n":1}`,
+		`{"n": 1}`:                    `{"n": 1}`,
+		"plain text":                  "plain text",
+	} {
+		got, keep, err := p.Transform(PluginEvent{UserID: 2031, Channel: "events:user:2031", Payload: payload})
+		if err != nil || keep != (want != "") || (keep && got != want) {
+			t.Errorf("%s: %q, keep %v, %v; want %q", payload, got, keep, err, want)
+		}
+	}
+}
+
+func TestStreamTransformedByPlugin(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	usePlugin(t, "shout", shoutPlugin{})
+	s, _ := connect(t, srv, 2032, nil)
+
+	dropped, failed := metrics.pluginDropped.Load(), metrics.pluginErrors.Load()
+	for _, payload := range []string{"drop", "hello", "fail", "panic", "bye"} {
+		rdb.Publish(ctx, "events:user:2032", payload)
+	}
+	// Failing plugins let the event through unchanged.
+	for _, want := range []string{"HELLO (user 2032 on events:user:2032)", "fail", "panic", "BYE (user 2032 on events:user:2032)"} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Errorf("got %q, want %q", ev.data, want)
+		}
+	}
+	if n := metrics.pluginDropped.Load() - dropped; n != 1 {
+		t.Errorf("%d events dropped by the plugin, want 1", n)
+	}
+	if n := metrics.pluginErrors.Load() - failed; n != 2 {
+		t.Errorf("%d plugin errors, want 2", n)
+	}
+}
+
+func TestHistoryTransformedByPlugin(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.HistoryBackfill = 5 })
+	usePlugin(t, "shout", shoutPlugin{})
+	mr.RPush("history:user:2033", "drop", "old")
+	s, _ := connect(t, srv, 2033, nil)
+	if ev := s.nextData(t); ev.data != "OLD (user 2033 on events:user:2033)" {
+		t.Errorf("replayed %q", ev.data)
+	}
+}
+
+func TestNoPluginByDefault(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	if eventPlugin != nil {
+		t.Fatal("plugin selected without GO_SSE_SIDECAR_PLUGIN")
+	}
+	s, _ := connect(t, srv, 2034, nil)
+	rdb.Publish(ctx, "events:user:2034", `{"internal": true}`)
+	if ev := s.nextData(t); ev.data != `{"internal": true}` {
+		t.Errorf("got %q", ev.data)
+	}
+}
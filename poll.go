@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pollBuffer is how many messages a poll session holds between polls.
+const pollBuffer = 100
+
+// pollSession keeps a user's subscription alive between long-polls, so
+// messages published while no poll is waiting are delivered by the next one.
+// Its ID is the cursor returned to the client.
+type pollSession struct {
+	client *SSEClient
+	ctx    context.Context
+	quota  *quotaCounter
+	// busy is set while a poll is waiting on the session.
+	busy atomic.Bool
+	// idle closes the session when it isn't polled for cfg.PollSessionTTL.
+	idle *time.Timer
+	// held is a message taken from the queue but over quota, the first one
+	// delivered by the next poll.
+	held atomic.Pointer[sseMessage]
+}
+
+type pollSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+}
+
+var polls = &pollSessions{sessions: make(map[string]*pollSession)}
+
+func (p *pollSessions) get(cursor string) *pollSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sessions[cursor]
+}
+
+func (p *pollSessions) add(s *pollSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[s.client.id] = s
+}
+
+func (p *pollSessions) remove(s *pollSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, s.client.id)
+}
+
+// pollEvent is an event in a /poll response.
+type pollEvent struct {
+	ID      string `json:"id,omitempty"`
+	Event   string `json:"event,omitempty"`
+	Channel string `json:"channel"`
+	Data    string `json:"data"`
+	// Metadata are the connection's GO_SSE_SIDECAR_EVENT_CLAIMS.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// startPollSession subscribes a new poll session for the user. It writes the
+// error response and returns nil when the subscription fails.
+func startPollSession(w http.ResponseWriter, r *http.Request, connID string, claims *SSETokenClaims, feed *feedConfig) *pollSession {
+	if !authorize(w, r, connID, claims) {
+		return nil
+	}
+	channels := subscriptionChannels(claims, feed)
+	if err := validateChannels(channels); err != nil {
+		log.Printf("[SSE] [conn %s] Refusing subscription for user %d: %v", connID, claims.UserID, err)
+		http.Error(w, "Forbidden: channel not allowed", http.StatusForbidden)
+		return nil
+	}
+
+	tenantDB, releaseDB, err := redisFor(claims)
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Refusing user %d: %v", connID, claims.UserID, err)
+		refuseRedis(w, err)
+		return nil
+	}
+	// Released here when the session doesn't start, by the session when
+	// it ends otherwise.
+	started := false
+	defer func() {
+		if !started {
+			releaseDB()
+		}
+	}()
+	namespace, err := namespaceFor(claims)
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Refusing user %d: %v", connID, claims.UserID, err)
+		http.Error(w, "Forbidden: namespace not allowed", http.StatusForbidden)
+		return nil
+	}
+	addr := parseClientAddr(clientIP(r))
+	releaseAddr, err := addressConns.reserve(addr)
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Refusing user %d: %v", connID, claims.UserID, err)
+		refuseAddressLimit(w, err)
+		return nil
+	}
+	defer func() {
+		if !started {
+			releaseAddr()
+		}
+	}()
+
+	quota, err := newQuotaCounter(r.Context(), tenantDB, namespace, claims.UserID)
+	if errors.Is(err, errQuotaExceeded) {
+		refuseQuota(w, time.Now())
+		return nil
+	}
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Failed to read the event quota of user %d: %v", connID, claims.UserID, err)
+		http.Error(w, "Quota check failed", http.StatusServiceUnavailable)
+		return nil
+	}
+
+	client := &SSEClient{
+		id:            connID,
+		userID:        claims.UserID,
+		namespace:     namespace,
+		db:            tenantDB,
+		feed:          feed,
+		claims:        claims,
+		channels:      channels,
+		transport:     transportPoll,
+		channel:       make(chan sseMessage, pollBuffer),
+		priority:      newPriorityQueue(pollBuffer),
+		extraChannels: make(map[string]bool),
+		refreshed:     make(chan struct{}, 1),
+		logSampled:    sampleConnection(connID, cfg.ConnLogSample),
+		metadata:      connectionMetadata(claims),
+		eventMetadata: eventMetadata(claims),
+		acks:          newAckTracker(),
+	}
+	sessionCtx, cancel := context.WithCancel(ctx)
+	client.close = cancel
+	s := &pollSession{client: client, ctx: sessionCtx, quota: quota}
+
+	subscribed := make(chan error, 1)
+	subscription := runSubscription(tenantDB, client, sessionCtx, subscribed)
+
+	setupTimeout := time.NewTimer(cfg.ConnectTimeout)
+	defer setupTimeout.Stop()
+	select {
+	case err := <-subscribed:
+		if err != nil {
+			cancel()
+			client.logf("Subscription failed for user %d: %v", claims.UserID, err)
+			refuseSubscription(w, err)
+			return nil
+		}
+	case <-setupTimeout.C:
+		cancel()
+		client.logf("Poll session setup for user %d exceeded %v", claims.UserID, cfg.ConnectTimeout)
+		http.Error(w, "Connection setup timed out", http.StatusGatewayTimeout)
+		return nil
+	case <-r.Context().Done():
+		cancel()
+		return nil
+	}
+
+	s.idle = time.AfterFunc(cfg.PollSessionTTL, cancel)
+	registry.add(client)
+	client.counters().opened.Add(1)
+	polls.add(s)
+	if cfg.ConfirmTimeout > 0 {
+		goConn(func() { client.confirmDeliveries(sessionCtx) })
+	}
+	client.lifecyclef("Started poll session for user %d", claims.UserID)
+	goConn(func() {
+		<-sessionCtx.Done()
+		stopSubscription(client, cancel, subscription)
+		s.idle.Stop()
+		polls.remove(s)
+		registry.remove(client)
+		quota.flush(ctx)
+		if msg := s.held.Swap(nil); msg != nil {
+			deadLetters.add(client, *msg, "disconnected")
+		}
+		client.persistPending(tenantDB, nil)
+		releaseDB()
+		client.deadLetterPending()
+		client.lifecyclef("Closed poll session for user %d", claims.UserID)
+		// The address's slot is free once nothing is left of the session.
+		releaseAddr()
+	})
+	started = true
+	return s
+}
+
+// pollHandler is the long-polling fallback for clients without SSE. It
+// waits up to cfg.PollTimeout for events on the user's channels and returns
+// them as a JSON array. The `X-Poll-Cursor` response header must be sent back
+// as `cursor` on the next poll to receive the events published in between.
+// An unknown or expired cursor starts a new session.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	connWork.Add(1)
+	defer connWork.Add(-1)
+	applyResponseHeaders(w)
+	if draining.Load() {
+		refuseDraining(w)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Poll-Cursor")
+
+	connID := requestConnectionID(r)
+	if err := checkQueryParams(r, pollQueryParams); err != nil {
+		log.Printf("[SSE] [conn %s] Rejecting query: %v", connID, err)
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	feed, err := feedFor(r)
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Rejecting poll: %v", connID, err)
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	claims := authenticate(w, r, connID)
+	if claims == nil {
+		return
+	}
+
+	s := polls.get(r.URL.Query().Get("cursor"))
+	if s == nil || s.client.userID != claims.UserID || s.client.namespace != claims.Namespace || s.client.feed != feed {
+		// Sessions already started keep polling during a maintenance window.
+		if until, ok := maintenanceUntil(maintenanceNow()); ok {
+			refuseMaintenance(w, until)
+			return
+		}
+		if s = startPollSession(w, r, connID, claims, feed); s == nil {
+			return
+		}
+	}
+	if !s.busy.CompareAndSwap(false, true) {
+		http.Error(w, "Conflict: a poll is already waiting on this cursor", http.StatusConflict)
+		return
+	}
+	defer s.busy.Store(false)
+	s.idle.Stop()
+	defer s.idle.Reset(cfg.PollSessionTTL)
+
+	client := s.client
+	events := []pollEvent{}
+	overQuota := false
+	// add reports false when the quota is used up, msg is then held for the
+	// next poll.
+	add := func(msg sseMessage) bool {
+		if !s.quota.allow(r.Context(), time.Now()) {
+			overQuota = true
+			s.held.Store(&msg)
+			return false
+		}
+		if cfg.MaxQueueAge > 0 && time.Since(msg.enqueued) > cfg.MaxQueueAge {
+			client.countDropped()
+			deadLetters.add(client, msg, "stale")
+			return true
+		}
+		events = append(events, pollEvent{ID: client.eventID(msg), Event: client.frameEvent(msg), Channel: msg.channel, Data: cfg.Transform.apply(msg.payload), Metadata: client.eventMetadata})
+		client.countDelivered()
+		eventSizes.observe(len(msg.payload))
+		client.markReceipt(msg)
+		return true
+	}
+
+	// While delivery is paused the poll waits for nothing and times out.
+	messages, priority := client.channel, client.priority
+	if delivery.isPaused() {
+		messages, priority = nil, nil
+	}
+
+	timeout := time.NewTimer(cfg.PollTimeout)
+	defer timeout.Stop()
+	if msg := s.held.Swap(nil); msg != nil {
+		add(*msg)
+	} else {
+		select {
+		case msg := <-priority:
+			add(msg)
+		case msg := <-messages:
+			add(msg)
+		case <-timeout.C:
+		case <-s.ctx.Done():
+		case <-r.Context().Done():
+			return
+		}
+	}
+	// Return everything already queued with the first event.
+	for len(events) > 0 && !overQuota {
+		msg, ok := client.next()
+		if !ok || !add(msg) {
+			break
+		}
+	}
+	if overQuota && len(events) == 0 {
+		client.close()
+		refuseQuota(w, time.Now())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Poll-Cursor", client.id)
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		client.dropReceipts()
+		return
+	}
+	client.sendReceipts()
+}
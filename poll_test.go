@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// poll sends one GET /poll for userID, with the cursor when set, and returns
+// the status, events and next cursor.
+func poll(t *testing.T, srv *httptest.Server, userID int64, cursor string) (int, []pollEvent, string) {
+	t.Helper()
+	q := url.Values{"ssetoken": {token(t, userID, nil)}}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	resp := get(t, srv.URL+"/poll?"+q.Encode(), nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil, ""
+	}
+	var events []pollEvent
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, events, resp.Header.Get("X-Poll-Cursor")
+}
+
+// pollSidecar is newSidecar with the poll sessions started by the test
+// closed at its end, before the config is restored.
+func pollSidecar(t *testing.T, set func(c *Config)) (*miniredis.Miniredis, *httptest.Server) {
+	t.Helper()
+	mr, srv := newSidecar(t, set)
+	t.Cleanup(func() {
+		polls.mu.Lock()
+		for _, s := range polls.sessions {
+			s.client.close()
+		}
+		polls.mu.Unlock()
+		waitFor(t, "the poll sessions to close", func() bool {
+			polls.mu.Lock()
+			defer polls.mu.Unlock()
+			return len(polls.sessions) == 0
+		})
+	})
+	return mr, srv
+}
+
+func pollData(events []pollEvent) []string {
+	data := make([]string, len(events))
+	for i, ev := range events {
+		data[i] = ev.Data
+	}
+	return data
+}
+
+func TestPollTimesOutEmpty(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) { c.PollTimeout = 100 * time.Millisecond })
+	start := time.Now()
+	status, events, cursor := poll(t, srv, 1391, "")
+	if status != http.StatusOK || len(events) != 0 {
+		t.Fatalf("status %d, events %v, want an empty array", status, events)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("returned after %v, before the poll timeout", d)
+	}
+	if cursor == "" {
+		t.Error("no X-Poll-Cursor")
+	}
+}
+
+func TestPollReturnsEventAtOnce(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) { c.PollTimeout = 5 * time.Second })
+	go func() {
+		waitFor(t, "the poll session", func() bool { return len(registry.forUser("", 1392)) == 1 })
+		rdb.Publish(ctx, "events:user:1392", "hello")
+	}()
+	start := time.Now()
+	_, events, _ := poll(t, srv, 1392, "")
+	if got := pollData(events); len(got) != 1 || got[0] != "hello" {
+		t.Fatalf("events %v", got)
+	}
+	if events[0].Channel != "events:user:1392" {
+		t.Errorf("channel %q", events[0].Channel)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("returned after %v, want as soon as the event came", d)
+	}
+}
+
+func TestPollCursorKeepsMessagesBetweenPolls(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) { c.PollTimeout = 50 * time.Millisecond })
+	_, _, cursor := poll(t, srv, 1393, "")
+
+	for _, p := range []string{"a", "b", "c"} {
+		rdb.Publish(ctx, "events:user:1393", p)
+	}
+	waitFor(t, "the messages to be queued", func() bool { return registry.get(cursor).queued() == 3 })
+	_, events, next := poll(t, srv, 1393, cursor)
+	if got := pollData(events); len(got) != 3 || got[0] != "a" || got[2] != "c" {
+		t.Errorf("events %v, want the three published between polls", got)
+	}
+	if next != cursor {
+		t.Errorf("cursor changed from %s to %s", cursor, next)
+	}
+
+	// Another user's poll doesn't get the session.
+	if _, _, other := poll(t, srv, 1394, cursor); other == cursor {
+		t.Error("another user took over the cursor")
+	}
+}
+
+func TestPollOverQuotaKeepsTheMessage(t *testing.T) {
+	mr, srv := pollSidecar(t, func(c *Config) {
+		c.PollTimeout = 50 * time.Millisecond
+		c.DailyEventQuota = 2
+		c.QuotaBatch = 1
+	})
+	_, _, cursor := poll(t, srv, 1395, "")
+	for _, p := range []string{"a", "b", "c"} {
+		rdb.Publish(ctx, "events:user:1395", p)
+	}
+	waitFor(t, "the messages to be queued", func() bool { return registry.get(cursor).queued() == 3 })
+
+	_, events, _ := poll(t, srv, 1395, cursor)
+	if got := pollData(events); len(got) != 2 || got[1] != "b" {
+		t.Fatalf("events %v, want the two within the quota", got)
+	}
+
+	// The third one was taken from the queue, it's still the next delivered
+	// once there's quota again.
+	mr.Set(quotaKey(1395, time.Now()), "1")
+	_, events, _ = poll(t, srv, 1395, cursor)
+	if got := pollData(events); len(got) != 1 || got[0] != "c" {
+		t.Fatalf("events %v with quota left, want the held message", got)
+	}
+}
+
+func TestPollOverQuotaRefused(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) {
+		c.PollTimeout = 50 * time.Millisecond
+		c.DailyEventQuota = 1
+		c.QuotaBatch = 1
+	})
+	_, _, cursor := poll(t, srv, 1396, "")
+	rdb.Publish(ctx, "events:user:1396", "a")
+	rdb.Publish(ctx, "events:user:1396", "b")
+	waitFor(t, "the messages to be queued", func() bool { return registry.get(cursor).queued() == 2 })
+
+	if _, events, _ := poll(t, srv, 1396, cursor); len(events) != 1 {
+		t.Fatalf("events %v, want the one within the quota", pollData(events))
+	}
+	if status, _, _ := poll(t, srv, 1396, cursor); status != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429 once the quota is used", status)
+	}
+	waitFor(t, "the session to close", func() bool { return registry.get(cursor) == nil })
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type presenceRecord struct {
+	UserID       int64  `json:"user_id"`
+	Event        string `json:"event"`
+	ConnectionID string `json:"connection_id"`
+	TS           int64  `json:"ts"`
+
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// presenceTracker publishes connect/disconnect records to the presence
+// channel. With a debounce, a disconnect is held back for that long and
+// dropped, together with the matching connect, when the same user reconnects
+// in the meantime (ex: a page reload or tab churn). Users are told apart by
+// tenant and namespace, see presenceKey.
+type presenceTracker struct {
+	mu      sync.Mutex
+	pending map[string][]*time.Timer
+}
+
+var presence = &presenceTracker{pending: make(map[string][]*time.Timer)}
+
+// presenceKey names the connection's user among those of every tenant and
+// namespace, as their presence records go to different channels.
+func presenceKey(c *SSEClient) string {
+	c.mu.Lock()
+	tenant := tenantOf(c.claims)
+	c.mu.Unlock()
+	return tenant + "/" + qualify(c.namespace, strconv.FormatInt(c.userID, 10))
+}
+
+func (p *presenceTracker) connect(c *SSEClient) {
+	if cfg.PresenceChannel == "" {
+		return
+	}
+
+	key := presenceKey(c)
+	p.mu.Lock()
+	if timers := p.pending[key]; len(timers) > 0 {
+		last := timers[len(timers)-1]
+		if last.Stop() {
+			connWork.Add(-1)
+			p.pending[key] = timers[:len(timers)-1]
+			p.mu.Unlock()
+			c.logf("Presence reconnect of user %d within debounce, not published", c.userID)
+			return
+		}
+	}
+	p.mu.Unlock()
+
+	publishPresence(c, "connect")
+}
+
+func (p *presenceTracker) disconnect(c *SSEClient) {
+	if cfg.PresenceChannel == "" {
+		return
+	}
+	if cfg.PresenceDebounce <= 0 {
+		publishPresence(c, "disconnect")
+		return
+	}
+
+	key := presenceKey(c)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var t *time.Timer
+	// Counted in connWork until it fires or a reconnect stops it.
+	connWork.Add(1)
+	t = time.AfterFunc(cfg.PresenceDebounce, func() {
+		defer connWork.Add(-1)
+		p.mu.Lock()
+		timers := p.pending[key]
+		for i, pt := range timers {
+			if pt == t {
+				p.pending[key] = append(timers[:i], timers[i+1:]...)
+				break
+			}
+		}
+		if len(p.pending[key]) == 0 {
+			delete(p.pending, key)
+		}
+		p.mu.Unlock()
+
+		publishPresence(c, "disconnect")
+	})
+	p.pending[key] = append(p.pending[key], t)
+}
+
+func publishPresence(c *SSEClient, event string) {
+	b, _ := json.Marshal(presenceRecord{
+		UserID:       c.userID,
+		Event:        event,
+		ConnectionID: c.id,
+		TS:           time.Now().Unix(),
+		Metadata:     c.metadata,
+	})
+
+	pctx, cancel, ok := backgroundRedis(ctx)
+	if !ok {
+		log.Printf("[PRESENCE] Not publishing %s for user %d: %v", event, c.userID, errRedisShed)
+		return
+	}
+	defer cancel()
+	if err := c.redisDB().Publish(pctx, c.qualify(cfg.PresenceChannel), b).Err(); err != nil {
+		log.Printf("[PRESENCE] Failed to publish %s for user %d: %v", event, c.userID, redisErr(err))
+	}
+}
+
+// parsePresenceWatch reads the comma-separated user IDs of the `presence`
+// query parameter. Each must be in the token's `presence_users` claim.
+func parsePresenceWatch(r *http.Request, claims *SSETokenClaims) (map[int64]bool, error) {
+	v := r.URL.Query().Get("presence")
+	if v == "" {
+		return nil, nil
+	}
+	if cfg.PresenceChannel == "" {
+		return nil, errPresenceDisabled
+	}
+
+	allowed := make(map[int64]bool, len(claims.PresenceUsers))
+	for _, id := range claims.PresenceUsers {
+		allowed[id] = true
+	}
+	watch := make(map[int64]bool)
+	for _, part := range strings.Split(v, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid presence user ID %q", part)
+		}
+		if !allowed[id] {
+			return nil, fmt.Errorf("%w: user %d", errPresenceNotAllowed, id)
+		}
+		watch[id] = true
+	}
+	return watch, nil
+}
+
+var (
+	errPresenceNotAllowed = errors.New("presence not allowed")
+	errPresenceDisabled   = errors.New("presence is not enabled")
+)
+
+// watchesPresence reports whether a presence record is for a user the
+// connection watches. Every watching connection receives the whole presence
+// channel and drops the other records.
+func (c *SSEClient) watchesPresence(payload string) bool {
+	var record presenceRecord
+	if err := json.Unmarshal([]byte(payload), &record); err != nil {
+		return false
+	}
+	return c.presenceWatch[record.UserID]
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func decodePresence(t *testing.T, payload string) presenceRecord {
+	t.Helper()
+	var r presenceRecord
+	if err := json.Unmarshal([]byte(payload), &r); err != nil {
+		t.Fatalf("presence record %q: %v", payload, err)
+	}
+	return r
+}
+
+func TestPresencePublishesConnectAndDisconnect(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.PresenceChannel = "presence" })
+	records := subscribeTo(t, "presence")
+
+	s, id := connect(t, srv, 21, nil)
+	r := decodePresence(t, receive(t, records))
+	if r.Event != "connect" || r.UserID != 21 || r.ConnectionID != id || r.TS == 0 {
+		t.Fatalf("connect record = %+v", r)
+	}
+
+	s.resp.Body.Close()
+	r = decodePresence(t, receive(t, records))
+	if r.Event != "disconnect" || r.ConnectionID != id {
+		t.Fatalf("disconnect record = %+v", r)
+	}
+}
+
+func TestPresenceDebounceHidesQuickReconnect(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.PresenceChannel = "presence"
+		c.PresenceDebounce = 200 * time.Millisecond
+	})
+	records := subscribeTo(t, "presence")
+
+	first, _ := connect(t, srv, 22, nil)
+	receive(t, records) // connect
+	first.resp.Body.Close()
+	waitFor(t, "the first connection to close", func() bool { return len(registry.forUser("", 22)) == 0 })
+	second, _ := connect(t, srv, 22, nil)
+
+	select {
+	case p := <-records:
+		t.Fatalf("published %s for a reconnect within the debounce", p)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	second.resp.Body.Close()
+	if r := decodePresence(t, receive(t, records)); r.Event != "disconnect" {
+		t.Fatalf("record after the last close = %+v", r)
+	}
+}
+
+func TestPresenceDebounceKeepsNamespacesApart(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		useNamespaces(c)
+		c.PresenceChannel = "presence"
+		c.PresenceDebounce = 200 * time.Millisecond
+	})
+	prod := subscribeTo(t, "prod:presence")
+	staging := subscribeTo(t, "staging:presence")
+	in := func(ns string) url.Values {
+		return url.Values{"ssetoken": {token(t, 1895, jwt.MapClaims{"namespace": ns})}}
+	}
+
+	first, _ := connect(t, srv, 1895, in("prod"))
+	receive(t, prod) // connect
+	first.resp.Body.Close()
+	waitFor(t, "the prod connection to close", func() bool { return len(registry.forUser("prod", 1895)) == 0 })
+
+	// The same user ID in another namespace is another user.
+	second, id := connect(t, srv, 1895, in("staging"))
+	if r := decodePresence(t, receive(t, staging)); r.Event != "connect" || r.ConnectionID != id {
+		t.Fatalf("staging record = %+v, want its connect", r)
+	}
+	if r := decodePresence(t, receive(t, prod)); r.Event != "disconnect" {
+		t.Fatalf("prod record = %+v, want its disconnect after the debounce", r)
+	}
+	second.resp.Body.Close()
+	if r := decodePresence(t, receive(t, staging)); r.Event != "disconnect" {
+		t.Fatalf("staging record = %+v", r)
+	}
+}
+
+func TestPresenceKeyOfTenant(t *testing.T) {
+	useConfig(t, nil)
+	of := func(claims jwt.MapClaims) string {
+		return presenceKey(&SSEClient{userID: 1896, namespace: "prod", claims: &SSETokenClaims{raw: claims}})
+	}
+	acme, globex := of(jwt.MapClaims{"tenant": "acme"}), of(jwt.MapClaims{"tenant": "globex"})
+	if acme == globex || acme == of(nil) {
+		t.Errorf("tenants share presence keys: %q %q %q", acme, globex, of(nil))
+	}
+	if acme != of(jwt.MapClaims{"tenant": "acme", "other": 1}) {
+		t.Error("the key of a tenant's user changed with its other claims")
+	}
+}
+
+func TestPresenceWatchDeliversWatchedUsers(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.PresenceChannel = "presence" })
+	watcher, _ := connect(t, srv, 1501, url.Values{
+		"ssetoken": {token(t, 1501, jwt.MapClaims{"presence_users": []int64{1502, 1503}})},
+		"presence": {"1502"},
+	})
+
+	// 1503 may be watched, but isn't.
+	connect(t, srv, 1503, nil)
+	_, id := connect(t, srv, 1502, nil)
+	ev := watcher.nextEvent(t, "presence")
+	if r := decodePresence(t, ev.data); r.UserID != 1502 || r.Event != "connect" || r.ConnectionID != id {
+		t.Errorf("presence %+v, want only the watched user's connect", r)
+	}
+}
+
+func TestPresenceWatchRefused(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.PresenceChannel = "presence" })
+	tok := token(t, 1504, jwt.MapClaims{"presence_users": []int64{1505}})
+	tests := []struct {
+		watch  string
+		status int
+	}{
+		{"1506", http.StatusForbidden},
+		// One user outside the allowlist refuses the whole list.
+		{"1505,1506", http.StatusForbidden},
+		{"1505,alice", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {tok}, "presence": {tt.watch}}.Encode(), nil)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("presence=%s: %d, want %d", tt.watch, resp.StatusCode, tt.status)
+		}
+	}
+
+	// Without the claim nobody can be watched.
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, 1504, nil)}, "presence": {"1505"}}.Encode(), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("no presence_users claim: %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestPresenceWatchNeedsPresenceChannel(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	tok := token(t, 1507, jwt.MapClaims{"presence_users": []int64{1508}})
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {tok}, "presence": {"1508"}}.Encode(), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d without GO_SSE_SIDECAR_PRESENCE_CHANNEL, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	rtmetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// heapMetric is the runtime metric the memory pressure is read from: the
+// bytes of live and not yet swept heap objects.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// memoryPressure is set while the heap is over cfg.MemoryPressureMB, until it
+// falls back under 90% of it. pressureEpisode counts the times it was set,
+// so each connection tells its client once per episode.
+var (
+	memoryPressure  atomic.Bool
+	pressureEpisode atomic.Int64
+)
+
+// watchMemory checks the heap every cfg.MemoryCheckInterval.
+func watchMemory() {
+	sample := []rtmetrics.Sample{{Name: heapMetric}}
+	ticker := time.NewTicker(cfg.MemoryCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rtmetrics.Read(sample)
+		if sample[0].Value.Kind() != rtmetrics.KindUint64 {
+			log.Printf("[SSE-SIDECAR] Runtime metric %s unavailable, memory pressure is not watched", heapMetric)
+			return
+		}
+		checkMemory(sample[0].Value.Uint64())
+	}
+}
+
+// checkMemory sets or clears memoryPressure for a heap of heap bytes.
+func checkMemory(heap uint64) {
+	limit := uint64(cfg.MemoryPressureMB) << 20
+	switch {
+	case heap > limit && !memoryPressure.Load():
+		memoryPressure.Store(true)
+		pressureEpisode.Add(1)
+		log.Printf("[SSE-SIDECAR] WARNING: heap at %d MB over GO_SSE_SIDECAR_MEMORY_PRESSURE_MB, shedding low priority events", heap>>20)
+	case heap < limit/10*9 && memoryPressure.Load():
+		memoryPressure.Store(false)
+		log.Printf("[SSE-SIDECAR] Heap back at %d MB, memory pressure over", heap>>20)
+	}
+}
+
+// shedUnderPressure reports whether msg is dropped instead of queued under
+// memory pressure: a low priority one, or a normal one once the queue is
+// half full. Priority messages are kept.
+func (c *SSEClient) shedUnderPressure(msg sseMessage, queue chan sseMessage) bool {
+	if !memoryPressure.Load() || queue == c.priority {
+		return false
+	}
+	if level, ok := payloadPriority(msg.payload); ok && level == priorityLow {
+		return true
+	}
+	return len(queue) >= cap(queue)/2
+}
+
+// notifyDegraded sends `event: degraded` the first time the connection sheds
+// a message in a pressure episode. It's dropped when there's no room.
+func (c *SSEClient) notifyDegraded() {
+	episode := pressureEpisode.Load()
+	if c.degradedEpisode.Swap(episode) == episode {
+		return
+	}
+	select {
+	case c.channel <- sseMessage{event: "degraded", payload: `{"reason":"memory_pressure"}`, enqueued: time.Now(), seq: c.enqueueSeq.Add(1)}:
+	default:
+	}
+}
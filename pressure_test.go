@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	rtmetrics "runtime/metrics"
+	"testing"
+)
+
+// usePressure clears the memory pressure at the end of the test.
+func usePressure(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() { memoryPressure.Store(false) })
+}
+
+func TestCheckMemoryHysteresis(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MemoryPressureMB = 100 })
+	usePressure(t)
+	episode := pressureEpisode.Load()
+	for _, tt := range []struct {
+		heapMB   uint64
+		pressure bool
+		episodes int64
+	}{
+		{50, false, 0},
+		{101, true, 1},
+		{150, true, 1},
+		// Over until under 90% of the threshold.
+		{95, true, 1},
+		{89, false, 1},
+		{95, false, 1},
+		{101, true, 2},
+	} {
+		checkMemory(tt.heapMB << 20)
+		if memoryPressure.Load() != tt.pressure || pressureEpisode.Load()-episode != tt.episodes {
+			t.Errorf("at %d MB: pressure %v, %d episodes, want %v, %d", tt.heapMB, memoryPressure.Load(), pressureEpisode.Load()-episode, tt.pressure, tt.episodes)
+		}
+	}
+}
+
+func TestHeapMetricAvailable(t *testing.T) {
+	sample := []rtmetrics.Sample{{Name: heapMetric}}
+	rtmetrics.Read(sample)
+	if sample[0].Value.Kind() != rtmetrics.KindUint64 || sample[0].Value.Uint64() == 0 {
+		t.Errorf("%s: kind %v", heapMetric, sample[0].Value.Kind())
+	}
+}
+
+func TestSustainedOverloadSheds(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.MemoryPressureMB = 100
+		c.PriorityField = "priority"
+		c.QueueSize = 8
+	})
+	usePressure(t)
+	s, conn := connect(t, srv, 2271, nil)
+	client := registry.get(conn)
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	shed := metrics.pressureShed.Load()
+
+	checkMemory(200 << 20)
+	rdb.Publish(ctx, "events:user:2271", `{"priority": "low"}`)
+	for i := 0; i < 10; i++ {
+		rdb.Publish(ctx, "events:user:2271", fmt.Sprintf(`{"n": %d}`, i))
+	}
+	rdb.Publish(ctx, "events:user:2271", `{"priority": "high"}`)
+	waitFor(t, "the flood handled", func() bool { return len(client.priority) == 1 })
+
+	// The low one and the normal ones over half the queue are shed, the
+	// degraded event taking a place.
+	if n := len(client.channel); n != 4 {
+		t.Errorf("%d queued, want half the queue", n)
+	}
+	if n := metrics.pressureShed.Load() - shed; n != 8 {
+		t.Errorf("%d shed, want the low one and 7 normal ones", n)
+	}
+	if _, _, ok := backgroundRedis(ctx); ok {
+		t.Error("background Redis calls made under pressure")
+	}
+
+	checkMemory(50 << 20)
+	rdb.Publish(ctx, "events:user:2271", `{"n": "after"}`)
+	waitFor(t, "the next one queued", func() bool { return len(client.channel) == 5 })
+	delivery.set(false)
+	var got []string
+	for len(got) == 0 || got[len(got)-1] != `{"n": "after"}` {
+		ev := s.next(t)
+		if ev.event == "degraded" {
+			ev.data = "degraded " + ev.data
+		}
+		got = append(got, ev.data)
+	}
+	want := []string{`{"priority": "high"}`, `degraded {"reason":"memory_pressure"}`, `{"n": 0}`, `{"n": 1}`, `{"n": 2}`, `{"n": "after"}`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+}
+
+func TestDegradedOncePerEpisode(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.MemoryPressureMB = 100
+		c.PriorityField = "priority"
+	})
+	usePressure(t)
+	c := &SSEClient{id: "degraded", userID: 2272, channel: make(chan sseMessage, 10)}
+	countDegraded := func() int {
+		n := 0
+		for len(c.channel) > 0 {
+			if msg := <-c.channel; msg.event == "degraded" {
+				n++
+			}
+		}
+		return n
+	}
+
+	for episode := 1; episode <= 2; episode++ {
+		checkMemory(200 << 20)
+		for i := 0; i < 3; i++ {
+			c.enqueue(sseMessage{channel: "events:user:2272", payload: `{"priority": "low"}`})
+		}
+		if n := countDegraded(); n != 1 {
+			t.Errorf("episode %d: %d degraded events, want 1", episode, n)
+		}
+		checkMemory(0)
+	}
+	// No pressure, nothing shed.
+	if !c.enqueue(sseMessage{channel: "events:user:2272", payload: `{"priority": "low"}`}) {
+		t.Error("shed without memory pressure")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Messages of cfg.PriorityChannels, and those marked high in
+// cfg.PriorityField, have their own queue, read before the normal one. A
+// flood on low priority channels fills and drops only from the normal queue,
+// and a priority message never waits behind it.
+
+// The priority levels of cfg.PriorityField. Only high messages get the
+// priority queue, there is no queue for low ones.
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityNames = map[string]int{"low": priorityLow, "normal": priorityNormal, "high": priorityHigh}
+
+// newPriorityQueue returns a connection's priority queue, or nil (never
+// ready in a select) when neither priority channels nor a priority field are
+// configured.
+func newPriorityQueue(size int) chan sseMessage {
+	if cfg.PriorityChannels == nil && cfg.PriorityField == "" {
+		return nil
+	}
+	return make(chan sseMessage, size)
+}
+
+// queueFor returns the queue msg goes in.
+func (c *SSEClient) queueFor(msg sseMessage) chan sseMessage {
+	if c.priority == nil {
+		return c.channel
+	}
+	if level, ok := payloadPriority(msg.payload); ok {
+		if level == priorityHigh {
+			return c.priority
+		}
+		return c.channel
+	}
+	if msg.channel != "" && cfg.PriorityChannels != nil && cfg.PriorityChannels.match(msg.channel) {
+		return c.priority
+	}
+	return c.channel
+}
+
+// payloadPriority reads the level in the payload's cfg.PriorityField: `low`,
+// `normal` or `high` (in any case), or the level as a number, clamped. Other
+// values are normal. It reports false when the payload has no such field,
+// the channel then deciding.
+func payloadPriority(payload string) (int, bool) {
+	if cfg.PriorityField == "" {
+		return 0, false
+	}
+	v := payloadScalar(payload, cfg.PriorityField)
+	if v == "" {
+		return 0, false
+	}
+	if level, ok := priorityNames[strings.ToLower(v)]; ok {
+		return level, true
+	}
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		return int(min(max(n, priorityLow), priorityHigh)), true
+	}
+	return priorityNormal, true
+}
+
+// next returns a queued message without blocking, priority messages first.
+func (c *SSEClient) next() (sseMessage, bool) {
+	select {
+	case msg := <-c.priority:
+		return msg, true
+	default:
+	}
+	select {
+	case msg := <-c.channel:
+		return msg, true
+	default:
+		return sseMessage{}, false
+	}
+}
+
+// queued is how many messages wait in both queues.
+func (c *SSEClient) queued() int {
+	return len(c.channel) + len(c.priority)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHighPrioritySurvivesFlood(t *testing.T) {
+	useConfig(t, func(c *Config) { c.PriorityChannels = parseChannelMatcher("test", "alerts:") })
+	c := &SSEClient{id: "priority-flood", userID: 1681, channel: make(chan sseMessage, 4), priority: newPriorityQueue(4)}
+
+	for i := 0; i < 50; i++ {
+		c.enqueue(sseMessage{channel: "feed:news", payload: fmt.Sprint(i)})
+		if i%20 == 0 {
+			if !c.enqueue(sseMessage{channel: "alerts:fire", payload: fmt.Sprintf("alert %d", i)}) {
+				t.Fatalf("alert %d dropped in the flood", i)
+			}
+		}
+	}
+	// The alerts come first, then what fitted of the flood.
+	var got []string
+	for msg, ok := c.next(); ok; msg, ok = c.next() {
+		got = append(got, msg.payload)
+	}
+	want := []string{"alert 0", "alert 20", "alert 40", "0", "1", "2", "3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+}
+
+func TestPayloadPriority(t *testing.T) {
+	useConfig(t, func(c *Config) { c.PriorityField = "priority" })
+	for payload, want := range map[string]int{
+		`{"priority": "high"}`:   priorityHigh,
+		`{"priority": "LOW"}`:    priorityLow,
+		`{"priority": 7}`:        priorityHigh,
+		`{"priority": -1}`:       priorityLow,
+		`{"priority": "urgent"}`: priorityNormal,
+	} {
+		if level, ok := payloadPriority(payload); !ok || level != want {
+			t.Errorf("%s: level %d, %v, want %d", payload, level, ok, want)
+		}
+	}
+	if _, ok := payloadPriority(`{"text": "hi"}`); ok {
+		t.Error("priority read from a payload without the field")
+	}
+}
+
+func TestPriorityFieldOverridesChannel(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.PriorityChannels = parseChannelMatcher("test", "alerts:")
+		c.PriorityField = "priority"
+	})
+	c := &SSEClient{channel: make(chan sseMessage, 1), priority: newPriorityQueue(1)}
+	if c.queueFor(sseMessage{channel: "alerts:x", payload: `{"priority": "low"}`}) != c.channel {
+		t.Error("a low message of a priority channel got the priority queue")
+	}
+	if c.queueFor(sseMessage{channel: "feed", payload: `{"priority": "high"}`}) != c.priority {
+		t.Error("a high message got the normal queue")
+	}
+}
+
+func TestNoPriorityQueueByDefault(t *testing.T) {
+	useConfig(t, nil)
+	if q := newPriorityQueue(4); q != nil {
+		t.Error("priority queue without GO_SSE_SIDECAR_PRIORITY_CHANNELS or GO_SSE_SIDECAR_PRIORITY_FIELD")
+	}
+}
+
+func TestStreamSendsHighPriorityFirst(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.PriorityField = "priority"
+		c.QueueSize = 3
+	})
+	s, conn := connect(t, srv, 1682, nil)
+
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	for i := 0; i < 10; i++ {
+		rdb.Publish(ctx, "events:user:1682", fmt.Sprintf(`{"n": %d}`, i))
+	}
+	rdb.Publish(ctx, "events:user:1682", `{"priority": "high"}`)
+	waitFor(t, "the queues to fill", func() bool { return registry.get(conn).queued() == 4 })
+
+	delivery.set(false)
+	if ev := s.nextData(t); ev.data != `{"priority": "high"}` {
+		t.Fatalf("first delivered %s, want the high priority message", ev.data)
+	}
+	for i := 0; i < 3; i++ {
+		if ev := s.nextData(t); ev.data != fmt.Sprintf(`{"n": %d}`, i) {
+			t.Errorf("got %s, want the flood in order", ev.data)
+		}
+	}
+}
+
+func TestMarkedHighSurvivesPressure(t *testing.T) {
+	useConfig(t, func(c *Config) { c.PriorityField = "priority" })
+	c := &SSEClient{id: "marked-pressure", userID: 2191, channel: make(chan sseMessage, 3), priority: newPriorityQueue(3)}
+
+	// Unmarked and low messages share the normal queue, and drop once it's full.
+	var dropped []string
+	for i := 0; i < 12; i++ {
+		payload := fmt.Sprintf(`{"n": %d}`, i)
+		switch i % 4 {
+		case 1:
+			payload = fmt.Sprintf(`{"n": %d, "priority": "low"}`, i)
+		case 3:
+			payload = fmt.Sprintf(`{"n": %d, "priority": "HIGH"}`, i)
+		}
+		if !c.enqueue(sseMessage{channel: "events:user:2191", payload: payload}) {
+			dropped = append(dropped, payload)
+		}
+	}
+	for _, payload := range dropped {
+		if level, _ := payloadPriority(payload); level == priorityHigh {
+			t.Errorf("%s dropped under pressure", payload)
+		}
+	}
+	if len(dropped) != 6 || c.dropped.Load() != 6 {
+		t.Errorf("%d dropped, counted %d, want the 6 that didn't fit", len(dropped), c.dropped.Load())
+	}
+
+	var got []string
+	for msg, ok := c.next(); ok; msg, ok = c.next() {
+		got = append(got, msg.payload)
+	}
+	want := []string{
+		`{"n": 3, "priority": "HIGH"}`, `{"n": 7, "priority": "HIGH"}`, `{"n": 11, "priority": "HIGH"}`,
+		`{"n": 0}`, `{"n": 1, "priority": "low"}`, `{"n": 2}`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+}
+
+func TestPayloadPriorityLevels(t *testing.T) {
+	useConfig(t, func(c *Config) { c.PriorityField = "level" })
+	for _, tt := range []struct {
+		payload string
+		want    int
+		marked  bool
+	}{
+		{`{"level": "normal"}`, priorityNormal, true},
+		{`{"level": "High"}`, priorityHigh, true},
+		// Numbers, in strings too, are clamped to the levels.
+		{`{"level": 2}`, priorityHigh, true},
+		{`{"level": "2"}`, priorityHigh, true},
+		{`{"level": 1.9}`, priorityNormal, true},
+		{`{"level": 1e9}`, priorityHigh, true},
+		{`{"level": -3.5}`, priorityLow, true},
+		{`{"level": "soon"}`, priorityNormal, true},
+		// Unmarked: the channel decides, normal unless a priority channel.
+		{`{"level": ""}`, 0, false},
+		{`{"level": null}`, 0, false},
+		{`{"level": {"of": "high"}}`, 0, false},
+		{`{"priority": "high"}`, 0, false},
+		{`high`, 0, false},
+	} {
+		level, marked := payloadPriority(tt.payload)
+		if marked != tt.marked || (marked && level != tt.want) {
+			t.Errorf("%s: level %d, %v, want %d, %v", tt.payload, level, marked, tt.want, tt.marked)
+		}
+	}
+
+	c := &SSEClient{channel: make(chan sseMessage, 1), priority: newPriorityQueue(1)}
+	if c.queueFor(sseMessage{channel: "feed", payload: `{"text": "hi"}`}) != c.channel {
+		t.Error("an unmarked message got the priority queue")
+	}
+}
+
+func TestPriorityFieldFromEnvironment(t *testing.T) {
+	t.Setenv("GO_SSE_SIDECAR_PRIORITY_FIELD", "urgency")
+	useConfig(t, nil)
+	if cfg.PriorityField != "urgency" {
+		t.Errorf("PriorityField %q", cfg.PriorityField)
+	}
+	if newPriorityQueue(1) == nil {
+		t.Error("no priority queue with only a priority field")
+	}
+}
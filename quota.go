@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// quotaKeyTTL keeps a day's counter around a bit longer than the day.
+const quotaKeyTTL = 48 * time.Hour
+
+var errQuotaExceeded = errors.New("daily event quota exceeded")
+
+func quotaKey(userID int64, now time.Time) string {
+	return fmt.Sprintf("quota:user:%d:%s", userID, now.UTC().Format("2006-01-02"))
+}
+
+// quotaCounter counts a connection's delivered events against the user's
+// daily quota, shared by all instances through a Redis counter. Increments
+// are sent in batches of cfg.QuotaBatch, so the quota can be overshot by up
+// to a batch per open connection.
+type quotaCounter struct {
+	rdb       *redis.Client
+	namespace string
+	userID    int64
+	// day is the key of the day the used and pending events count for,
+	// until dayEnds.
+	day     string
+	dayEnds time.Time
+	// used is the user's total as last read from Redis, pending the events
+	// delivered since.
+	used    int64
+	pending int64
+}
+
+// newQuotaCounter loads the user's usage for today. It returns nil when no
+// quota is configured, and errQuotaExceeded when the quota is already used.
+func newQuotaCounter(ctx context.Context, rdb *redis.Client, namespace string, userID int64) (*quotaCounter, error) {
+	if cfg.DailyEventQuota <= 0 {
+		return nil, nil
+	}
+	q := &quotaCounter{rdb: rdb, namespace: namespace, userID: userID}
+	if err := q.flush(ctx); err != nil {
+		return nil, err
+	}
+	if q.used >= cfg.DailyEventQuota {
+		return nil, errQuotaExceeded
+	}
+	return q, nil
+}
+
+// allow counts another event delivered at now, or reports false when the
+// quota is used up.
+func (q *quotaCounter) allow(ctx context.Context, now time.Time) bool {
+	if q == nil {
+		return true
+	}
+	if !now.Before(q.dayEnds) {
+		// The pending events count for the day they were delivered.
+		q.flushAt(ctx, now)
+	}
+	if q.used+q.pending >= cfg.DailyEventQuota {
+		// Other instances may have sent less than estimated.
+		if err := q.flushAt(ctx, now); err == nil && q.used >= cfg.DailyEventQuota {
+			return false
+		}
+	}
+	q.pending++
+	if q.pending >= int64(cfg.QuotaBatch) {
+		q.flushAt(ctx, now)
+	}
+	return true
+}
+
+// flush adds the pending events to the Redis counter and reads back the
+// user's total. On error the events stay pending.
+func (q *quotaCounter) flush(ctx context.Context) error {
+	return q.flushAt(ctx, time.Now())
+}
+
+// flushAt is flush at now. Events still pending from a previous day are
+// added to that day's counter, and the total read is the one of now's day.
+func (q *quotaCounter) flushAt(ctx context.Context, now time.Time) error {
+	if q == nil {
+		return nil
+	}
+	key := qualify(q.namespace, quotaKey(q.userID, now))
+	pending := q.pending
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var total *redis.IntCmd
+	_, err := q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if key != q.day {
+			if q.day != "" && pending > 0 {
+				pipe.IncrBy(ctx, q.day, pending)
+				pipe.Expire(ctx, q.day, quotaKeyTTL)
+			}
+			pending = 0
+		}
+		total = pipe.IncrBy(ctx, key, pending)
+		pipe.Expire(ctx, key, quotaKeyTTL)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.day, q.dayEnds = key, now.UTC().Truncate(24*time.Hour).Add(24*time.Hour)
+	q.used, q.pending = total.Val(), 0
+	return nil
+}
+
+// refuseQuota answers a connection from a user over quota, retrying at the
+// next UTC day.
+func refuseQuota(w http.ResponseWriter, now time.Time) {
+	tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(tomorrow.Sub(now).Seconds())+1))
+	http.Error(w, "Daily event quota exceeded", http.StatusTooManyRequests)
+}
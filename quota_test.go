@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func quotaUsed(t *testing.T, mr *miniredis.Miniredis, userID int64, day time.Time) int {
+	t.Helper()
+	v, err := mr.Get(quotaKey(userID, day))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+func TestQuotaExceededEndsStream(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.DailyEventQuota = 2
+		c.QuotaBatch = 1
+	})
+	s, _ := connect(t, srv, 1471, nil)
+	for _, p := range []string{"a", "b", "c"} {
+		rdb.Publish(ctx, "events:user:1471", p)
+	}
+	s.nextData(t)
+	s.nextData(t)
+	if ev := s.nextEvent(t, "quota_exceeded"); ev.data != `{"quota":2}` {
+		t.Errorf("quota_exceeded data %s", ev.data)
+	}
+	if !s.ended(t) {
+		t.Error("stream still open over quota")
+	}
+	if n := quotaUsed(t, mr, 1471, time.Now()); n != 2 {
+		t.Errorf("counter at %d, want 2", n)
+	}
+}
+
+func TestQuotaSharedAcrossInstances(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.DailyEventQuota = 5 })
+	// Another instance delivered the user's events for today.
+	mr.Set(quotaKey(1472, time.Now()), "5")
+
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, 1472, nil)}}.Encode(), nil)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status %s, want 429", resp.Status)
+	}
+	retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if retry <= 0 || retry > 24*60*60+1 {
+		t.Errorf("Retry-After %q, want the seconds to the next UTC day", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestQuotaIncrementsBatched(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.DailyEventQuota = 100
+		c.QuotaBatch = 3
+	})
+	mr := useRedis(t)
+	q, err := newQuotaCounter(ctx, rdb, "", 1473)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.allow(ctx, now)
+	q.allow(ctx, now)
+	if n := quotaUsed(t, mr, 1473, now); n != 0 {
+		t.Fatalf("counter at %d before a full batch", n)
+	}
+	q.allow(ctx, now)
+	if n := quotaUsed(t, mr, 1473, now); n != 3 {
+		t.Errorf("counter at %d after a batch of 3", n)
+	}
+	if ttl := mr.TTL(quotaKey(1473, now)); ttl <= 24*time.Hour {
+		t.Errorf("TTL %v, want the counter kept past the day", ttl)
+	}
+}
+
+func TestQuotaPendingCountedForTheirDay(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.DailyEventQuota = 3
+		c.QuotaBatch = 10
+	})
+	mr := useRedis(t)
+	q, err := newQuotaCounter(ctx, rdb, "", 1474)
+	if err != nil {
+		t.Fatal(err)
+	}
+	midnight := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	before, after := midnight.Add(-time.Second), midnight.Add(time.Second)
+	q.allow(ctx, before)
+	q.allow(ctx, before)
+
+	// The first event of the new day flushes the previous day's batch.
+	if !q.allow(ctx, after) {
+		t.Fatal("refused at the start of a new day")
+	}
+	if n := quotaUsed(t, mr, 1474, before); n != 2 {
+		t.Errorf("%d events for the day before midnight, want 2", n)
+	}
+	q.flushAt(ctx, after)
+	if n := quotaUsed(t, mr, 1474, after); n != 1 {
+		t.Errorf("%d events for the new day, want 1", n)
+	}
+	// The new day's quota is its own.
+	if !q.allow(ctx, after) || !q.allow(ctx, after) || q.allow(ctx, after) {
+		t.Error("want two more events allowed then refused on the new day")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// receiptBuffer is how many receipts can wait to be published.
+const receiptBuffer = 1000
+
+// The statuses of receipts with cfg.ConfirmTimeout.
+const (
+	receiptConfirmed   = "confirmed"
+	receiptUnconfirmed = "delivery_unconfirmed"
+)
+
+type receiptRecord struct {
+	ReceiptID   string `json:"receipt_id"`
+	UserID      int64  `json:"user_id"`
+	DeliveredAt int64  `json:"delivered_at"`
+	// Status is only set with cfg.ConfirmTimeout, DeliveredAt then being
+	// when the ack came or the timeout expired.
+	Status string `json:"status,omitempty"`
+
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
+	// namespace selects the receipt channel of the connection's namespace,
+	// db the Redis it's published to.
+	namespace string
+	db        *redis.Client
+}
+
+var receipts = make(chan receiptRecord, receiptBuffer)
+
+// markReceipt remembers that msg asked for a receipt, sent once the write is
+// flushed to the client.
+func (c *SSEClient) markReceipt(msg sseMessage) {
+	if cfg.ReceiptChannel == "" && cfg.AckChannel == "" {
+		return
+	}
+	if id := payloadScalar(msg.payload, "receipt_id"); id != "" {
+		c.mu.Lock()
+		c.pendingReceipts = append(c.pendingReceipts, id)
+		c.mu.Unlock()
+	}
+}
+
+// takeReceipts returns the pending receipts and clears them.
+func (c *SSEClient) takeReceipts() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.pendingReceipts
+	c.pendingReceipts = nil
+	return pending
+}
+
+// dropReceipts discards the pending receipts after a failed write, like
+// sendReceipts does once the connection closed on a write error.
+func (c *SSEClient) dropReceipts() {
+	metrics.receiptsDropped.Add(int64(len(c.takeReceipts())))
+}
+
+// sendReceipts queues the receipts of the messages flushed so far, without
+// blocking, and lets the client ack them. Nothing is sent when a write
+// failed, the messages may not have reached the client. With
+// cfg.ConfirmTimeout the receipts wait for the acks instead.
+func (c *SSEClient) sendReceipts() {
+	pending := c.takeReceipts()
+	if len(pending) == 0 {
+		return
+	}
+	if reason, _ := c.closeReason.Load().(string); reason == "write_error" {
+		metrics.receiptsDropped.Add(int64(len(pending)))
+		return
+	}
+	now := time.Now()
+	dropped := c.acks.await(pending, now)
+	if cfg.ConfirmTimeout > 0 {
+		c.queueReceipts(dropped, now, receiptUnconfirmed)
+		return
+	}
+	c.queueReceipts(pending, now, "")
+}
+
+// queueReceipts queues receipts for ids, without blocking.
+func (c *SSEClient) queueReceipts(ids []string, at time.Time, status string) {
+	if cfg.ReceiptChannel == "" {
+		return
+	}
+	if status == receiptUnconfirmed {
+		metrics.receiptsUnconfirmed.Add(int64(len(ids)))
+	}
+	for _, id := range ids {
+		select {
+		case receipts <- receiptRecord{ReceiptID: id, UserID: c.userID, DeliveredAt: at.UnixMilli(), Status: status, Metadata: c.metadata, namespace: c.namespace, db: c.redisDB()}:
+		default:
+			metrics.receiptsDropped.Add(1)
+		}
+	}
+}
+
+// runReceipts publishes the receipts queued in records to the receipt
+// channel, until records is closed.
+func runReceipts(records <-chan receiptRecord) {
+	log.Printf("[RECEIPTS] Publishing delivery receipts to %s", cfg.ReceiptChannel)
+	for record := range records {
+		b, _ := json.Marshal(record)
+		pctx, cancel, ok := backgroundRedis(ctx)
+		if !ok {
+			metrics.receiptsDropped.Add(1)
+			continue
+		}
+		if err := record.db.Publish(pctx, qualify(record.namespace, cfg.ReceiptChannel), b).Err(); err != nil {
+			log.Printf("[RECEIPTS] Failed to publish receipt %s for user %d: %v", record.ReceiptID, record.UserID, redisErr(err))
+			metrics.receiptsDropped.Add(1)
+		} else {
+			metrics.receipts.Add(1)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// receiptSidecar is newSidecar publishing receipts to the `receipts`
+// channel, whose records it returns.
+func receiptSidecar(t *testing.T, set func(c *Config)) (*miniredis.Miniredis, *httptest.Server, <-chan string) {
+	t.Helper()
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.ReceiptChannel = "receipts"
+		if set != nil {
+			set(c)
+		}
+	})
+	published := subscribeTo(t, "receipts")
+	startReceipts(t)
+	return mr, srv, published
+}
+
+// startReceipts publishes the receipts of the test with a queue of its own.
+func startReceipts(t *testing.T) {
+	t.Helper()
+	old := receipts
+	q := make(chan receiptRecord, receiptBuffer)
+	receipts = q
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReceipts(q)
+	}()
+	t.Cleanup(func() {
+		endConnections(t)
+		receipts = old
+		close(q)
+		<-done
+	})
+}
+
+func decodeReceipt(t *testing.T, payload string) receiptRecord {
+	t.Helper()
+	var r receiptRecord
+	if err := json.Unmarshal([]byte(payload), &r); err != nil {
+		t.Fatalf("receipt %q: %v", payload, err)
+	}
+	return r
+}
+
+func TestReceiptPublishedOnFlush(t *testing.T) {
+	_, srv, published := receiptSidecar(t, nil)
+	s, _ := connect(t, srv, 1591, nil)
+
+	before := time.Now()
+	rdb.Publish(ctx, "events:user:1591", `{"text": "no receipt"}`)
+	rdb.Publish(ctx, "events:user:1591", `{"receipt_id": "r-1", "text": "hi"}`)
+	s.nextData(t)
+	s.nextData(t)
+
+	r := decodeReceipt(t, receive(t, published))
+	if r.ReceiptID != "r-1" || r.UserID != 1591 || r.Status != "" {
+		t.Errorf("receipt %+v", r)
+	}
+	if at := time.UnixMilli(r.DeliveredAt); at.Before(before.Truncate(time.Millisecond)) || time.Since(at) > time.Second {
+		t.Errorf("delivered_at %v, want the flush time", at)
+	}
+	// Only the message asking for one gets a receipt.
+	select {
+	case p := <-published:
+		t.Errorf("second receipt %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReceiptsNotSentAfterWriteError(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ReceiptChannel = "receipts" })
+	old := receipts
+	receipts = make(chan receiptRecord, 1)
+	t.Cleanup(func() { receipts = old })
+
+	c := &SSEClient{id: "receipt-write-error", userID: 1592}
+	c.markReceipt(sseMessage{payload: `{"receipt_id": "r-2"}`})
+	c.closeReason.Store("write_error")
+	dropped := metrics.receiptsDropped.Load()
+	c.sendReceipts()
+	if len(receipts) != 0 {
+		t.Error("receipt queued for a failed write")
+	}
+	if n := metrics.receiptsDropped.Load() - dropped; n != 1 {
+		t.Errorf("%d receipts dropped, want 1", n)
+	}
+}
+
+func TestReceiptsOffWithoutChannel(t *testing.T) {
+	useConfig(t, nil)
+	c := &SSEClient{id: "receipt-off", userID: 1593}
+	c.markReceipt(sseMessage{payload: `{"receipt_id": "r-3"}`})
+	if len(c.takeReceipts()) != 0 {
+		t.Error("receipt kept without GO_SSE_SIDECAR_RECEIPT_CHANNEL")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultRedactFields are masked in logs unless GO_SSE_SIDECAR_LOG_REDACT
+// is set.
+var defaultRedactFields = []string{"password", "token", "ssetoken", "secret", "authorization", "api_key"}
+
+// parseRedactFields builds the pattern matching the JSON members of the
+// redacted fields, of any case, with a scalar value. Set to an empty list it
+// disables redaction.
+func parseRedactFields(name string) *regexp.Regexp {
+	fields := defaultRedactFields
+	if _, ok := os.LookupEnv(name); ok {
+		fields = envList(name)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		quoted[i] = regexp.QuoteMeta(f)
+	}
+	return regexp.MustCompile(`"((?i:` + strings.Join(quoted, "|") + `))"\s*:\s*(?:"(?:[^"\\]|\\.)*"|[-0-9.eE+]+|true|false|null)`)
+}
+
+// redactJSON masks the values of the redacted fields in the JSON found in a
+// log line, ex: a payload or claims. Objects and arrays are left as they
+// are, their own fields being matched.
+func redactJSON(s string) string {
+	if cfg.LogRedact == nil || !strings.Contains(s, `"`) {
+		return s
+	}
+	return cfg.LogRedact.ReplaceAllString(s, `"$1":"[REDACTED]"`)
+}
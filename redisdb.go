@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var errDBNotAllowed = errors.New("redis database not allowed")
+
+// tenantClients are the Redis clients of the logical databases selected by
+// `db` claims, created on first use with the shared client's settings.
+var tenantClients = struct {
+	mu      sync.Mutex
+	clients map[int]*redis.Client
+}{clients: make(map[int]*redis.Client)}
+
+// redisFor returns the Redis client of a connection and the func to call
+// once the connection is done with it: the shared one, the one of the
+// logical database in the token's `db` claim, which must be listed in
+// cfg.RedisDBs, or the dedicated Redis of the tenant in its
+// cfg.TenantClaim, see tenantRedisPool. The database holds the connection's
+// history, quota, hybrid and online keys, and gets its records. Pub/sub ignores databases, so channels
+// still need a tenant prefix to be isolated. A dedicated Redis isolates
+// them too.
+func redisFor(claims *SSETokenClaims) (*redis.Client, func(), error) {
+	if len(cfg.TenantRedis) > 0 {
+		if tenant := tenantOf(claims); tenant != "" {
+			if claims.DB != nil {
+				return nil, nil, fmt.Errorf("%w: tenant %q has its own Redis", errDBNotAllowed, tenant)
+			}
+			c, release, err := tenantRedis.acquire(tenant)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %q", err, tenant)
+			}
+			return c, release, nil
+		}
+	}
+	if claims.DB == nil {
+		return rdb, func() {}, nil
+	}
+	db := *claims.DB
+	if !cfg.RedisDBs[db] {
+		return nil, nil, fmt.Errorf("%w: %d", errDBNotAllowed, db)
+	}
+	if db == rdb.Options().DB {
+		return rdb, func() {}, nil
+	}
+
+	tenantClients.mu.Lock()
+	defer tenantClients.mu.Unlock()
+	c, ok := tenantClients.clients[db]
+	if !ok {
+		opts := *rdb.Options()
+		opts.DB = db
+		c = redis.NewClient(&opts)
+		tenantClients.clients[db] = c
+	}
+	return c, func() {}, nil
+}
+
+// refuseRedis answers a connection redisFor has no client for.
+func refuseRedis(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTenantClientsFull):
+		http.Error(w, "Too many tenant Redis clients", http.StatusServiceUnavailable)
+	case errors.Is(err, errTenantNotAllowed):
+		http.Error(w, "Forbidden: tenant not allowed", http.StatusForbidden)
+	default:
+		http.Error(w, "Forbidden: database not allowed", http.StatusForbidden)
+	}
+}
+
+// parseRedisDBs reads a comma-separated list of logical database numbers.
+func parseRedisDBs(name string, list []string) map[int]bool {
+	dbs := make(map[int]bool, len(list))
+	for _, entry := range list {
+		db, err := strconv.Atoi(entry)
+		if err != nil || db < 0 {
+			log.Fatalf("Invalid %s: %q is not a database number", name, entry)
+		}
+		dbs[db] = true
+	}
+	return dbs
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// useRedisDBs lets tokens select dbs, with clients of the test's Redis.
+func useRedisDBs(t *testing.T, dbs ...int) {
+	t.Helper()
+	t.Cleanup(func() {
+		tenantClients.mu.Lock()
+		defer tenantClients.mu.Unlock()
+		for db, c := range tenantClients.clients {
+			c.Close()
+			delete(tenantClients.clients, db)
+		}
+	})
+	cfg.RedisDBs = make(map[int]bool)
+	for _, db := range dbs {
+		cfg.RedisDBs[db] = true
+	}
+}
+
+func TestDBClaimSelectsDatabase(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.HistoryBackfill = 1 })
+	useRedisDBs(t, 2)
+	mr.RPush("history:user:1691", "from db 0")
+	mr.DB(2).Push("history:user:1691", "from db 2")
+
+	s, _ := connect(t, srv, 1691, url.Values{"ssetoken": {token(t, 1691, jwt.MapClaims{"db": 2})}})
+	if ev := s.nextData(t); ev.data != "from db 2" {
+		t.Fatalf("replayed %q, want the history of db 2", ev.data)
+	}
+	// Pub/sub ignores the database.
+	mr.Publish("events:user:1691", "live")
+	if ev := s.nextData(t); ev.data != "live" {
+		t.Errorf("live event %q", ev.data)
+	}
+
+	other, _ := connect(t, srv, 1691, nil)
+	if ev := other.nextData(t); ev.data != "from db 0" {
+		t.Errorf("replayed %q without a db claim, want the history of db 0", ev.data)
+	}
+}
+
+func TestDBClientSharedPerDatabase(t *testing.T) {
+	useConfig(t, nil)
+	useRedis(t)
+	useRedisDBs(t, 0, 3)
+	db := func(n int) *redis.Client {
+		c, release, err := redisFor(&SSETokenClaims{DB: &n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		return c
+	}
+	if db(0) != rdb {
+		t.Error("a new client for the database of GO_SSE_SIDECAR_REDIS_URL")
+	}
+	if c := db(3); c != db(3) || c.Options().DB != 3 {
+		t.Errorf("clients of db 3 not shared, or on db %d", c.Options().DB)
+	}
+}
+
+func TestDBNotAllowed(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	useRedisDBs(t, 2)
+	for _, db := range []int{3, 0} {
+		resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, 1692, jwt.MapClaims{"db": db})}}.Encode(), nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("db %d: %s, want 403", db, resp.Status)
+		}
+	}
+	n := 5
+	if _, _, err := redisFor(&SSETokenClaims{DB: &n}); !errors.Is(err, errDBNotAllowed) {
+		t.Errorf("err = %v, want errDBNotAllowed", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// backgroundRedis returns the context of a Redis call streaming doesn't
+// depend on (presence, online keys, receipts, acks, dead letters), bounded
+// by cfg.BackgroundTimeout. With cfg.RedisShed it reports false, and the
+// call should be skipped, while every pooled connection is in use, leaving
+// them to subscriptions and the history reads of new connections. It does
+// too under memory pressure, see watchMemory.
+func backgroundRedis(parent context.Context) (context.Context, context.CancelFunc, bool) {
+	if (cfg.RedisShed && poolSaturated(rdb)) || memoryPressure.Load() {
+		metrics.redisShed.Add(1)
+		return nil, nil, false
+	}
+	bctx, cancel := context.WithTimeout(parent, cfg.BackgroundTimeout)
+	return bctx, cancel, true
+}
+
+// errRedisShed is logged for the background calls skipped by
+// backgroundRedis.
+var errRedisShed = errors.New("skipped, the Redis connection pool is saturated")
+
+func poolSaturated(c *redis.Client) bool {
+	stats := c.PoolStats()
+	return stats.IdleConns == 0 && int(stats.TotalConns) >= c.Options().PoolSize
+}
+
+// redisErr calls out (and counts) the errors of an exhausted connection
+// pool, which mean the sidecar is overloaded rather than Redis down.
+func redisErr(err error) error {
+	if errors.Is(err, redis.ErrPoolTimeout) || errors.Is(err, redis.ErrPoolExhausted) {
+		metrics.redisPoolExhausted.Add(1)
+		return fmt.Errorf("connection pool exhausted (see pool_size in the Redis URL): %w", err)
+	}
+	return err
+}
+
+func init() {
+	stat := func(f func(*redis.PoolStats) uint32) func() float64 {
+		return func() float64 {
+			if rdb == nil {
+				return 0
+			}
+			return float64(f(rdb.PoolStats()))
+		}
+	}
+	metricDefs = append(metricDefs,
+		metricDef{"sse_redis_pool_hits_total", "Redis commands that found an idle pooled connection.", counterMetric, stat(func(s *redis.PoolStats) uint32 { return s.Hits })},
+		metricDef{"sse_redis_pool_misses_total", "Redis commands that found no idle pooled connection.", counterMetric, stat(func(s *redis.PoolStats) uint32 { return s.Misses })},
+		metricDef{"sse_redis_pool_timeouts_total", "Redis commands that timed out waiting for a pooled connection.", counterMetric, stat(func(s *redis.PoolStats) uint32 { return s.Timeouts })},
+		metricDef{"sse_redis_pool_connections", "Connections in the Redis pool, subscriptions excluded.", gaugeMetric, stat(func(s *redis.PoolStats) uint32 { return s.TotalConns })},
+		metricDef{"sse_redis_pool_idle_connections", "Idle connections in the Redis pool.", gaugeMetric, stat(func(s *redis.PoolStats) uint32 { return s.IdleConns })},
+		metricDef{"sse_redis_pool_stale_connections_total", "Connections removed from the Redis pool as stale.", counterMetric, stat(func(s *redis.PoolStats) uint32 { return s.StaleConns })},
+	)
+}
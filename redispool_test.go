@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// holdPool points rdb at a one-connection pool of a new miniredis, and
+// keeps that connection busy with a blocking pop until the returned
+// function is called.
+func holdPool(t *testing.T) (release func()) {
+	t.Helper()
+	mr := useRedis(t)
+	shared := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr(), PoolSize: 1, PoolTimeout: 50 * time.Millisecond})
+	t.Cleanup(func() {
+		rdb.Close()
+		rdb = shared
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rdb.BLPop(ctx, 5*time.Second, "held")
+	}()
+	waitFor(t, "the pool in use", func() bool { return poolSaturated(rdb) })
+	return func() {
+		mr.Lpush("held", "done")
+		wg.Wait()
+	}
+}
+
+func TestPoolExhaustionSurfaced(t *testing.T) {
+	useConfig(t, nil)
+	release := holdPool(t)
+	exhausted := metrics.redisPoolExhausted.Load()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- redisErr(rdb.Get(ctx, "k").Err())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, redis.ErrPoolTimeout) || !strings.Contains(err.Error(), "connection pool exhausted") {
+			t.Errorf("err = %v, want the pool called out", err)
+		}
+	}
+	if n := metrics.redisPoolExhausted.Load() - exhausted; n != 5 {
+		t.Errorf("%d exhausted calls counted, want 5", n)
+	}
+	release()
+	if err := redisErr(rdb.Get(ctx, "k").Err()); err != redis.Nil {
+		t.Errorf("after the pool freed up: %v", err)
+	}
+	if other := errors.New("other"); redisErr(other) != other || metrics.redisPoolExhausted.Load()-exhausted != 5 {
+		t.Error("other errors taken for exhaustion")
+	}
+}
+
+func TestBackgroundCallsShedWhenPoolSaturated(t *testing.T) {
+	useConfig(t, func(c *Config) { c.RedisShed = true })
+	release := holdPool(t)
+	shed := metrics.redisShed.Load()
+	if _, _, ok := backgroundRedis(ctx); ok {
+		t.Error("background call allowed with the pool saturated")
+	}
+	if n := metrics.redisShed.Load() - shed; n != 1 {
+		t.Errorf("%d shed calls counted", n)
+	}
+	release()
+	bctx, cancel, ok := backgroundRedis(ctx)
+	if !ok {
+		t.Fatal("background call shed with the pool free")
+	}
+	defer cancel()
+	if deadline, _ := bctx.Deadline(); time.Until(deadline) > cfg.BackgroundTimeout {
+		t.Errorf("deadline in %v, want GO_SSE_SIDECAR_REDIS_BACKGROUND_TIMEOUT", time.Until(deadline))
+	}
+}
+
+func TestBackgroundCallsNotShedByDefault(t *testing.T) {
+	useConfig(t, nil)
+	release := holdPool(t)
+	defer release()
+	_, cancel, ok := backgroundRedis(ctx)
+	if !ok {
+		t.Fatal("background call shed without GO_SSE_SIDECAR_REDIS_SHED")
+	}
+	cancel()
+}
+
+func TestPoolStatsExported(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	rdb.Ping(ctx)
+	m := scrape(t, srv)
+	for _, name := range []string{"sse_redis_pool_hits_total", "sse_redis_pool_misses_total", "sse_redis_pool_timeouts_total", "sse_redis_pool_connections", "sse_redis_pool_idle_connections"} {
+		if _, ok := m[name]; !ok {
+			t.Errorf("%s not exported", name)
+		}
+	}
+	if m["sse_redis_pool_connections"] < 1 {
+		t.Errorf("%v pooled connections after a ping", m["sse_redis_pool_connections"])
+	}
+}
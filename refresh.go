@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// tokenExpiry returns when the connection's current token expires.
+func (c *SSEClient) tokenExpiry() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expiresAt
+}
+
+// refreshToken extends the connection's expiry and wakes up the handler so it
+// resets its expiry timer.
+func (c *SSEClient) refreshToken(claims *SSETokenClaims) {
+	c.mu.Lock()
+	c.claims = claims
+	if claims.ExpiresAt != nil {
+		c.expiresAt = claims.ExpiresAt.Time
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.refreshed <- struct{}{}:
+	default:
+	}
+}
+
+// expiryWarningDelay returns when to send `event: token_expiring` for a
+// token expiring at expiresAt: cfg.ExpiryWarning before, at once when that's
+// already past.
+func expiryWarningDelay(expiresAt, now time.Time) time.Duration {
+	return max(expiresAt.Sub(now)-cfg.ExpiryWarning, 0)
+}
+
+// writeExpiringEvent tells the client its token expires soon, so it sends a
+// fresh one to POST /refresh/{conn_id} before the stream is closed.
+func writeExpiringEvent(w io.Writer, expiresAt, now time.Time) error {
+	b, _ := json.Marshal(map[string]interface{}{
+		"expires_at":    expiresAt.UTC().Format(time.RFC3339),
+		"expires_in_ms": max(expiresAt.Sub(now), 0).Milliseconds(),
+	})
+	return writeEvent(w, "token_expiring", string(b))
+}
+
+// resetTimer resets a timer that may have fired without being read.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// refreshHandler accepts a fresh token for a live connection, so it isn't
+// closed when the original token expires. The new token must belong to the
+// connection's user and tenant, and pass the checks of a new connection.
+// Like acks, it can be sent cross-origin without a preflight, with the token
+// in the query.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	connID := r.PathValue("conn_id")
+	claims := checkCredentials(w, r, connID, func() (*SSETokenClaims, error) {
+		return verifyToken(requestToken(r))
+	})
+	if claims == nil {
+		return
+	}
+
+	client := registry.get(connID)
+	if client == nil {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	client.mu.Lock()
+	tenant := tenantOf(client.claims)
+	client.mu.Unlock()
+	if client.userID != claims.UserID || client.namespace != claims.Namespace || tenantOf(claims) != tenant {
+		client.logf("Refused refresh with a token for user %d in namespace %q of tenant %q", claims.UserID, claims.Namespace, tenantOf(claims))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !authorize(w, r, connID, claims) {
+		return
+	}
+
+	client.refreshToken(claims)
+	expiresAt := client.tokenExpiry()
+	client.logf("Token refreshed for user %d (expires: %v)", client.userID, expiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"expires_at": expiresAt.UTC().Format(time.RFC3339)})
+}
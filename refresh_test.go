@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// expiringToken signs a token for userID expiring soon, between 300ms and
+// 1.3s from now: exp has a one second precision.
+func expiringToken(t *testing.T, userID int64) string {
+	t.Helper()
+	exp := time.Now().Truncate(time.Second).Add(time.Second)
+	if time.Until(exp) < 300*time.Millisecond {
+		exp = exp.Add(time.Second)
+	}
+	return token(t, userID, jwt.MapClaims{"exp": exp.Unix()})
+}
+
+func closeOnExpiry(c *Config) { c.CloseOnExpiry = true }
+
+func TestStreamClosedWhenTokenExpires(t *testing.T) {
+	_, srv := newSidecar(t, closeOnExpiry)
+	s, _ := connect(t, srv, 1271, url.Values{"ssetoken": {expiringToken(t, 1271)}})
+
+	s.nextEvent(t, "token_expired")
+	if !s.ended(t) {
+		t.Fatal("stream still open after token_expired")
+	}
+}
+
+func TestRefreshExtendsTheConnection(t *testing.T) {
+	_, srv := newSidecar(t, closeOnExpiry)
+	s, connID := connect(t, srv, 1272, url.Values{"ssetoken": {expiringToken(t, 1272)}})
+
+	resp := post(t, srv.URL+"/refresh/"+connID, "", token(t, 1272, nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: %s", resp.Status)
+	}
+	var body struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(body.ExpiresAt) < 50*time.Minute {
+		t.Errorf("expires_at = %v, want the refreshed token's expiry", body.ExpiresAt)
+	}
+
+	// The original token is past its expiry by now; the stream stays and
+	// still delivers.
+	time.Sleep(1500 * time.Millisecond)
+	rdb.Publish(ctx, "events:user:1272", "after-expiry")
+	if ev := s.nextData(t); ev.event == "token_expired" || ev.data != "after-expiry" {
+		t.Fatalf("got %+v, want the message published after the old expiry", ev)
+	}
+}
+
+func TestRefreshRefused(t *testing.T) {
+	_, srv := newSidecar(t, closeOnExpiry)
+	s, connID := connect(t, srv, 1273, url.Values{"ssetoken": {expiringToken(t, 1273)}})
+
+	tests := []struct {
+		name   string
+		path   string
+		bearer string
+		want   int
+	}{
+		{"other user", "/refresh/" + connID, token(t, 1274, nil), http.StatusForbidden},
+		{"expired token", "/refresh/" + connID, token(t, 1273, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}), http.StatusUnauthorized},
+		{"no token", "/refresh/" + connID, "", http.StatusUnauthorized},
+		{"unknown connection", "/refresh/nope", token(t, 1273, nil), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := post(t, srv.URL+tt.path, "", tt.bearer); resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+
+	// None of them extended the connection.
+	s.nextEvent(t, "token_expired")
+}
+
+// refreshStatus posts a refresh of connID with bearer, failing the test when
+// it extended the connection anyway.
+func refreshStatus(t *testing.T, srv *httptest.Server, connID, bearer string) int {
+	t.Helper()
+	before := registry.get(connID).tokenExpiry()
+	resp := post(t, srv.URL+"/refresh/"+connID, "", bearer)
+	if resp.StatusCode != http.StatusOK && !registry.get(connID).tokenExpiry().Equal(before) {
+		t.Errorf("refused with %d, but the connection was extended", resp.StatusCode)
+	}
+	return resp.StatusCode
+}
+
+func TestRefreshNeedsTheRequiredClaim(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		closeOnExpiry(c)
+		c.RequiredClaim = parseRequiredClaim("claim", "features:sse")
+	})
+	sse := jwt.MapClaims{"features": []string{"sse"}, "exp": time.Now().Add(time.Minute).Unix()}
+	_, connID := connect(t, srv, 1275, url.Values{"ssetoken": {token(t, 1275, sse)}})
+
+	if code := refreshStatus(t, srv, connID, token(t, 1275, jwt.MapClaims{"features": []string{"beta"}})); code != http.StatusForbidden {
+		t.Errorf("refresh without the required claim: %d, want 403", code)
+	}
+	if code := refreshStatus(t, srv, connID, token(t, 1275, jwt.MapClaims{"features": []string{"sse"}})); code != http.StatusOK {
+		t.Errorf("refresh with it: %d, want 200", code)
+	}
+}
+
+func TestRefreshAskedToTheAuthzWebhook(t *testing.T) {
+	_, srv := newSidecar(t, closeOnExpiry)
+	requests := authzWebhook(t, func(w http.ResponseWriter, req authzRequest) {
+		json.NewEncoder(w).Encode(authzResponse{Allow: req.Claims["banned"] == nil})
+	})
+	_, connID := connect(t, srv, 1276, url.Values{"ssetoken": {expiringToken(t, 1276)}})
+	<-requests // the connection's
+	banned := token(t, 1276, jwt.MapClaims{"banned": true})
+
+	if code := refreshStatus(t, srv, connID, banned); code != http.StatusForbidden {
+		t.Errorf("refresh denied by the webhook: %d, want 403", code)
+	}
+	if req := <-requests; req.UserID != 1276 || req.ConnectionID != connID {
+		t.Errorf("webhook asked %+v", req)
+	}
+	if code := refreshStatus(t, srv, connID, token(t, 1276, nil)); code != http.StatusOK {
+		t.Errorf("refresh allowed by the webhook: %d, want 200", code)
+	}
+}
+
+func TestRefreshBackedOffAfterInvalidTokens(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		closeOnExpiry(c)
+		c.AuthFailThreshold = 2
+		c.AuthFailBlock = time.Minute
+	})
+	useAuthLimiter(t)
+	_, connID := connect(t, srv, 1277, url.Values{"ssetoken": {expiringToken(t, 1277)}})
+
+	for i := 0; i < 2; i++ {
+		if code := refreshStatus(t, srv, connID, "guess"); code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: %d, want 401", i, code)
+		}
+	}
+	if code := refreshStatus(t, srv, connID, token(t, 1277, nil)); code != http.StatusTooManyRequests {
+		t.Errorf("valid token from the blocked address: %d, want 429", code)
+	}
+}
+
+func TestRefreshKeepsTheTenant(t *testing.T) {
+	_, _, _, srv := tenantSidecar(t, closeOnExpiry)
+	expiring := jwt.MapClaims{"tenant": "acme", "exp": time.Now().Add(time.Minute).Unix()}
+	_, connID := connect(t, srv, 1278, url.Values{"ssetoken": {token(t, 1278, expiring)}})
+
+	for _, claims := range []jwt.MapClaims{{"tenant": "globex"}, nil} {
+		if code := refreshStatus(t, srv, connID, token(t, 1278, claims)); code != http.StatusForbidden {
+			t.Errorf("refresh with tenant %v: %d, want 403", claims["tenant"], code)
+		}
+	}
+	if code := refreshStatus(t, srv, connID, token(t, 1278, jwt.MapClaims{"tenant": "acme"})); code != http.StatusOK {
+		t.Errorf("refresh of the same tenant: %d, want 200", code)
+	}
+}
+
+func TestExpiryWarningDelay(t *testing.T) {
+	useConfig(t, func(c *Config) { c.ExpiryWarning = 2 * time.Minute })
+	now := time.Now()
+	for _, tt := range []struct {
+		expiresIn, want time.Duration
+	}{
+		{time.Hour, 58 * time.Minute},
+		{2 * time.Minute, 0},
+		{time.Minute, 0},
+		{-time.Minute, 0},
+	} {
+		if got := expiryWarningDelay(now.Add(tt.expiresIn), now); got != tt.want {
+			t.Errorf("expiring in %v: warned after %v, want %v", tt.expiresIn, got, tt.want)
+		}
+	}
+}
+
+func TestWriteExpiringEvent(t *testing.T) {
+	var b strings.Builder
+	now := time.Date(2026, 1, 1, 11, 58, 0, 0, time.UTC)
+	writeExpiringEvent(&b, now.Add(2*time.Minute), now)
+	if want := "event: token_expiring\ndata: {\"expires_at\":\"2026-01-01T12:00:00Z\",\"expires_in_ms\":120000}\n\n"; b.String() != want {
+		t.Errorf("wrote %q, want %q", b.String(), want)
+	}
+	b.Reset()
+	writeExpiringEvent(&b, now.Add(-time.Second), now)
+	if !strings.Contains(b.String(), `"expires_in_ms":0`) {
+		t.Errorf("past expiry: %q", b.String())
+	}
+}
+
+// warnedSidecar warns streams warning before their token expires.
+func warnedSidecar(t *testing.T, warning time.Duration) *httptest.Server {
+	t.Helper()
+	_, srv := newSidecar(t, func(c *Config) {
+		c.CloseOnExpiry = true
+		c.ExpiryWarning = warning
+	})
+	return srv
+}
+
+// expiryIn returns a token expiry between d-1s and d from now, exp having
+// a one second precision.
+func expiryIn(d time.Duration) time.Time {
+	return time.Now().Truncate(time.Second).Add(d)
+}
+
+// nextExpiring waits up to 4s for the stream's token_expiring event, failing
+// on any other event, and returns its data and when it came.
+func nextExpiring(t *testing.T, s *sseStream) (expiresAt time.Time, expiresInMS int64, at time.Time) {
+	t.Helper()
+	timeout := time.After(4 * time.Second)
+	for {
+		select {
+		case ev, ok := <-s.events:
+			if !ok {
+				t.Fatal("stream ended before token_expiring")
+			}
+			if ev.event == "" && ev.data == "" {
+				continue
+			}
+			if ev.event != "token_expiring" {
+				t.Fatalf("got %+v before token_expiring", ev)
+			}
+			var data struct {
+				ExpiresAt   time.Time `json:"expires_at"`
+				ExpiresInMS int64     `json:"expires_in_ms"`
+			}
+			if err := json.Unmarshal([]byte(ev.data), &data); err != nil {
+				t.Fatalf("token_expiring data %q: %v", ev.data, err)
+			}
+			return data.ExpiresAt, data.ExpiresInMS, time.Now()
+		case <-timeout:
+			t.Fatal("no token_expiring")
+		}
+	}
+}
+
+// assertWarnedAhead checks the warning came about warning before exp.
+func assertWarnedAhead(t *testing.T, exp, expiresAt time.Time, expiresInMS int64, at time.Time, warning time.Duration) {
+	t.Helper()
+	if !expiresAt.Equal(exp) {
+		t.Errorf("expires_at %v, want %v", expiresAt, exp)
+	}
+	if ahead := exp.Sub(at); ahead < warning-200*time.Millisecond || ahead > warning+50*time.Millisecond {
+		t.Errorf("warned %v before the expiry, want %v", ahead, warning)
+	}
+	if in := time.Duration(expiresInMS) * time.Millisecond; in < warning-200*time.Millisecond || in > warning+50*time.Millisecond {
+		t.Errorf("expires_in_ms %d, want about %d", expiresInMS, warning.Milliseconds())
+	}
+}
+
+func TestTokenExpiringSentBeforeExpiry(t *testing.T) {
+	srv := warnedSidecar(t, 1500*time.Millisecond)
+	exp := expiryIn(3 * time.Second)
+	s, _ := connect(t, srv, 2411, url.Values{"ssetoken": {token(t, 2411, jwt.MapClaims{"exp": exp.Unix()})}})
+
+	expiresAt, in, at := nextExpiring(t, s)
+	assertWarnedAhead(t, exp, expiresAt, in, at, 1500*time.Millisecond)
+
+	// Not refreshed, it's still closed at the expiry.
+	s.nextEvent(t, "token_expired")
+	if early := time.Until(exp); early > 100*time.Millisecond {
+		t.Errorf("closed %v before the expiry", early)
+	}
+	if !s.ended(t) {
+		t.Error("stream still open after token_expired")
+	}
+}
+
+func TestTokenExpiringAtOnceInsideWindow(t *testing.T) {
+	srv := warnedSidecar(t, time.Minute)
+	exp := expiryIn(3 * time.Second)
+	start := time.Now()
+	s, _ := connect(t, srv, 2412, url.Values{"ssetoken": {token(t, 2412, jwt.MapClaims{"exp": exp.Unix()})}})
+	expiresAt, in, at := nextExpiring(t, s)
+	if at.Sub(start) > 500*time.Millisecond || !expiresAt.Equal(exp) || in < 1500 || in > 3000 {
+		t.Errorf("warned after %v of %v expiring in %dms, want at once", at.Sub(start), expiresAt, in)
+	}
+}
+
+func TestRefreshRearmsExpiryWarning(t *testing.T) {
+	srv := warnedSidecar(t, 2500*time.Millisecond)
+	exp := expiryIn(3 * time.Second)
+	s, connID := connect(t, srv, 2413, url.Values{"ssetoken": {token(t, 2413, jwt.MapClaims{"exp": exp.Unix()})}})
+	nextExpiring(t, s)
+
+	// As client.js answers: the token in the query, no preflight.
+	refreshed := expiryIn(5 * time.Second)
+	q := url.Values{"ssetoken": {token(t, 2413, jwt.MapClaims{"exp": refreshed.Unix()})}}
+	resp := post(t, srv.URL+"/refresh/"+connID+"?"+q.Encode(), "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("refresh: %s, allowed origin %q", resp.Status, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	expiresAt, in, at := nextExpiring(t, s)
+	assertWarnedAhead(t, refreshed, expiresAt, in, at, 2500*time.Millisecond)
+
+	// Past the first token's expiry, the stream still delivers.
+	time.Sleep(time.Until(exp) + 100*time.Millisecond)
+	rdb.Publish(ctx, "events:user:2413", "after the first expiry")
+	if ev := s.nextData(t); ev.data != "after the first expiry" {
+		t.Errorf("got %+v, want the message", ev)
+	}
+}
+
+func TestClientJSRefreshesOnExpiring(t *testing.T) {
+	useConfig(t, nil)
+	js := clientJS(t)
+	for _, want := range []string{
+		`source.addEventListener("token_expiring"`,
+		`client.refresh().catch(function () {});`,
+		`fetch(baseUrl + "/refresh/" + encodeURIComponent(client.connectionId) + "?" + params.toString(), { method: "POST" })`,
+	} {
+		if !strings.Contains(js, want) {
+			t.Errorf("client.js lacks %s", want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connRegistry tracks the open connections of this instance so they can be
+// reached by operational commands.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*SSEClient
+}
+
+var registry = &connRegistry{conns: make(map[string]*SSEClient)}
+
+// draining is set once the instance stops accepting new connections.
+var draining atomic.Bool
+
+// connWork counts the handlers of streams and long-poll sessions, and the
+// goroutines and timers they leave running (sessions, lingering
+// subscriptions, debounced presence), so a handoff can wait until they're
+// done with Redis, see waitConnWork.
+var connWork atomic.Int64
+
+// goConn runs f in a goroutine counted in connWork.
+func goConn(f func()) {
+	connWork.Add(1)
+	go func() {
+		defer connWork.Add(-1)
+		f()
+	}()
+}
+
+// waitConnWork waits until nothing counted in connWork runs, or ctx is done.
+func waitConnWork(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for connWork.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (r *connRegistry) add(c *SSEClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[c.id] = c
+}
+
+func (r *connRegistry) remove(c *SSEClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c.id)
+}
+
+func (r *connRegistry) get(id string) *SSEClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[id]
+}
+
+// all returns a snapshot of the open connections.
+func (r *connRegistry) all() []*SSEClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]*SSEClient, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// forUser returns the connections of a user, the same ID in another
+// namespace being another user.
+func (r *connRegistry) forUser(namespace string, userID int64) []*SSEClient {
+	var conns []*SSEClient
+	for _, c := range r.all() {
+		if c.userID == userID && c.namespace == namespace {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// startDraining refuses new connections and closes the open ones so clients
+// reconnect to another instance.
+func startDraining() {
+	if draining.Swap(true) {
+		return
+	}
+	conns := registry.all()
+	log.Printf("[SSE-SIDECAR] Draining, closing %d connections", len(conns))
+	closeSpread(conns, "draining")
+}
+
+// maxCloseSpread bounds cfg.CloseSpread, so a drain still ends in time.
+const maxCloseSpread = 5 * time.Minute
+
+// closeSpread closes conns for reconnect, in random order and evenly spread
+// over cfg.CloseSpread, so their clients don't all reconnect at once.
+func closeSpread(conns []*SSEClient, reason string) {
+	if cfg.CloseSpread <= 0 || len(conns) < 2 {
+		for _, c := range conns {
+			c.closeForReconnect(reason)
+		}
+		return
+	}
+	conns = append([]*SSEClient(nil), conns...)
+	rand.Shuffle(len(conns), func(i, j int) { conns[i], conns[j] = conns[j], conns[i] })
+	step := cfg.CloseSpread / time.Duration(len(conns))
+	for i, c := range conns {
+		time.AfterFunc(time.Duration(i)*step, func() { c.closeForReconnect(reason) })
+	}
+}
+
+// refuseDraining answers a new connection while draining. The header lets a
+// load balancer retry on another instance instead of sending the client back
+// here.
+func refuseDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(cfg.DrainRetry.Seconds())))
+	w.Header().Set("X-Sidecar-Draining", "true")
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+}
+
+// closeForReconnect ends the connection after sending a reconnect event
+// with reason.
+func (c *SSEClient) closeForReconnect(reason string) {
+	c.reconnectReason.Store(reason)
+	c.closeWith(reason)
+}
+
+// closeWith ends the connection from the server side. The first reason is
+// the one logged and counted.
+func (c *SSEClient) closeWith(reason string) {
+	c.closeReason.CompareAndSwap(nil, reason)
+	c.close()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drainForTest starts draining the instance, undone with the test.
+func drainForTest(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() { draining.Store(false) })
+	startDraining()
+}
+
+func TestDrainCloseSendsReconnectEvent(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.DrainRetry = 1500 * time.Millisecond })
+	s, _ := connect(t, srv, 1361, nil)
+
+	drainForTest(t)
+	ev := s.nextEvent(t, "reconnect")
+	if ev.retry != "1500" {
+		t.Errorf("retry = %q, want the drain retry for EventSource", ev.retry)
+	}
+	var data struct {
+		RetryAfterMS int64  `json:"retry_after_ms"`
+		Reason       string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(ev.data), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.RetryAfterMS != 1500 || data.Reason != "draining" {
+		t.Errorf("reconnect data %s", ev.data)
+	}
+	if !s.ended(t) {
+		t.Error("stream still open after the reconnect event")
+	}
+}
+
+func TestDrainingRefusesNewConnections(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.DrainRetry = 1200 * time.Millisecond })
+	drainForTest(t)
+
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, 1362, nil)}}.Encode(), nil)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %s, want 503", resp.Status)
+	}
+	// Rounded up, so clients don't come back before the drain retry.
+	if h := resp.Header.Get("Retry-After"); h != "2" {
+		t.Errorf("Retry-After = %q, want 2", h)
+	}
+	if h := resp.Header.Get("X-Sidecar-Draining"); h != "true" {
+		t.Errorf("X-Sidecar-Draining = %q, want the header a load balancer keys on", h)
+	}
+}
+
+func TestDrainSpreadsCloses(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.CloseSpread = 300 * time.Millisecond })
+	var streams []*sseStream
+	for i := 0; i < 3; i++ {
+		s, _ := connect(t, srv, 1363, nil)
+		streams = append(streams, s)
+	}
+
+	start := time.Now()
+	drainForTest(t)
+	var last time.Duration
+	for _, s := range streams {
+		s.nextEvent(t, "reconnect")
+		last = max(last, time.Since(start))
+	}
+	// Three closes over 300ms are 100ms apart, the last at 200ms.
+	if last < 150*time.Millisecond {
+		t.Errorf("all connections closed within %v, want them spread", last)
+	}
+}
+
+// queueWhilePaused pauses delivery and publishes payloads to the user, who
+// has them queued on conn.
+func queueWhilePaused(t *testing.T, userID int64, conn string, payloads ...string) {
+	t.Helper()
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	for _, p := range payloads {
+		rdb.Publish(ctx, fmt.Sprintf("events:user:%d", userID), p)
+	}
+	waitFor(t, "the messages to be queued", func() bool { return registry.get(conn).queued() == len(payloads) })
+}
+
+func TestDrainSendsQueuedMessages(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.CloseFlushTimeout = time.Second })
+	s, conn := connect(t, srv, 1511, nil)
+	queueWhilePaused(t, 1511, conn, "a", "b", "c")
+
+	drainForTest(t)
+	for _, want := range []string{"a", "b", "c"} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Fatalf("got %+v, want the queued %q before the close", ev, want)
+		}
+	}
+	s.nextEvent(t, "reconnect")
+}
+
+func TestDrainDropsQueuedMessagesByDefault(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	s, conn := connect(t, srv, 1512, nil)
+	queueWhilePaused(t, 1512, conn, "a", "b")
+
+	drainForTest(t)
+	for ev := s.next(t); ev.event != "reconnect"; ev = s.next(t) {
+		if ev.data == "a" || ev.data == "b" {
+			t.Fatalf("queued %q sent without GO_SSE_SIDECAR_CLOSE_FLUSH_TIMEOUT", ev.data)
+		}
+	}
+}
+
+func TestMaxEventsForcesReconnect(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.MaxEventsPerConn = 3 })
+	s, _ := connect(t, srv, 1641, nil)
+	for i := 1; i <= 5; i++ {
+		rdb.Publish(ctx, "events:user:1641", fmt.Sprint(i))
+	}
+	for i := 1; i <= 3; i++ {
+		if ev := s.nextData(t); ev.data != fmt.Sprint(i) {
+			t.Fatalf("event %d is %+v", i, ev)
+		}
+	}
+	ev := s.next(t)
+	if ev.event != "reconnect" || !strings.Contains(ev.data, `"reason":"max_events"`) {
+		t.Fatalf("after the 3rd event got %+v, want the reconnect", ev)
+	}
+	if !s.ended(t) {
+		t.Error("stream still open")
+	}
+
+	// The count is the connection's, the next one starts over.
+	again, _ := connect(t, srv, 1641, nil)
+	rdb.Publish(ctx, "events:user:1641", "after")
+	if ev := again.nextData(t); ev.data != "after" {
+		t.Errorf("new connection got %+v", ev)
+	}
+}
+
+func TestMaxEventsUnlimitedByDefault(t *testing.T) {
+	useConfig(t, nil)
+	if cfg.MaxEventsPerConn != 0 {
+		t.Errorf("MaxEventsPerConn = %d by default", cfg.MaxEventsPerConn)
+	}
+}
+
+// closeTimes drains the instance and returns when each stream got its
+// reconnect event, sorted, from the drain.
+func closeTimes(t *testing.T, streams []*sseStream) []time.Duration {
+	t.Helper()
+	start := time.Now()
+	drainForTest(t)
+	times := make(chan time.Duration, len(streams))
+	for _, s := range streams {
+		go func() {
+			for ev := range s.events {
+				if ev.event == "reconnect" {
+					times <- time.Since(start)
+					return
+				}
+			}
+		}()
+	}
+	got := make([]time.Duration, len(streams))
+	for i := range got {
+		select {
+		case got[i] = <-times:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%d of %d streams closed", i, len(streams))
+		}
+	}
+	return got
+}
+
+func TestDrainClosesSpreadOverWindow(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.CloseSpread = 500 * time.Millisecond })
+	var streams []*sseStream
+	for i := 0; i < 5; i++ {
+		s, _ := connect(t, srv, int64(1831+i), nil)
+		streams = append(streams, s)
+	}
+
+	got := closeTimes(t, streams)
+	// One close every 100ms, the first right away.
+	if got[0] > 80*time.Millisecond {
+		t.Errorf("first close after %v", got[0])
+	}
+	if last := got[len(got)-1]; last < 350*time.Millisecond || last > 700*time.Millisecond {
+		t.Errorf("last close after %v, want about 400ms into the 500ms window", last)
+	}
+	for i := 1; i < len(got); i++ {
+		if d := got[i] - got[i-1]; d < 40*time.Millisecond {
+			t.Errorf("closes %d and %d %v apart", i-1, i, d)
+		}
+	}
+}
+
+func TestDrainClosesAtOnceByDefault(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	var streams []*sseStream
+	for i := 0; i < 3; i++ {
+		s, _ := connect(t, srv, int64(1836+i), nil)
+		streams = append(streams, s)
+	}
+	if got := closeTimes(t, streams); got[len(got)-1] > 200*time.Millisecond {
+		t.Errorf("closes took %v without GO_SSE_SIDECAR_CLOSE_SPREAD", got[len(got)-1])
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// reorderBuffer holds messages that arrive ahead of their source sequence
+// number (GO_SSE_SIDECAR_SOURCE_SEQ_FIELD) until the missing ones arrive, per
+// channel of one connection. A gap still open after the window, or more than
+// max held messages, releases the held messages in order.
+type reorderBuffer struct {
+	window   time.Duration
+	max      int
+	channels map[string]*reorderChannel
+}
+
+type reorderChannel struct {
+	// next is the sequence number expected next.
+	next    int64
+	pending map[int64]*redis.Message
+	// since is when the wait for the current gap started.
+	since time.Time
+}
+
+func newReorderBuffer(window time.Duration, size int) *reorderBuffer {
+	if window <= 0 || cfg.SourceSeqField == "" {
+		return nil
+	}
+	return &reorderBuffer{window: window, max: size, channels: make(map[string]*reorderChannel)}
+}
+
+// push adds msg and returns the messages ready to be delivered, in order.
+// Messages without a sequence number, and late ones, are returned at once.
+func (b *reorderBuffer) push(msg *redis.Message, now time.Time) []*redis.Message {
+	if b == nil {
+		return []*redis.Message{msg}
+	}
+	seq, ok := sourceSeq(msg.Payload)
+	if !ok {
+		return []*redis.Message{msg}
+	}
+
+	ch := b.channels[msg.Channel]
+	if ch == nil {
+		b.channels[msg.Channel] = &reorderChannel{next: seq + 1, pending: make(map[int64]*redis.Message)}
+		return []*redis.Message{msg}
+	}
+	if seq < ch.next {
+		return []*redis.Message{msg}
+	}
+	if seq > ch.next {
+		if len(ch.pending) == 0 {
+			ch.since = now
+		}
+		ch.pending[seq] = msg
+		if len(ch.pending) > b.max {
+			return ch.release()
+		}
+		return nil
+	}
+
+	ready := []*redis.Message{msg}
+	ch.next++
+	for {
+		held, ok := ch.pending[ch.next]
+		if !ok {
+			break
+		}
+		delete(ch.pending, ch.next)
+		ready = append(ready, held)
+		ch.next++
+	}
+	// Messages are still held, so there is a new gap to wait for.
+	ch.since = now
+	return ready
+}
+
+// expired releases the channels whose gap has been open for the window.
+func (b *reorderBuffer) expired(now time.Time) []*redis.Message {
+	if b == nil {
+		return nil
+	}
+	var ready []*redis.Message
+	for _, ch := range b.channels {
+		if len(ch.pending) > 0 && now.Sub(ch.since) >= b.window {
+			ready = append(ready, ch.release()...)
+		}
+	}
+	return ready
+}
+
+// release gives up on the gap and returns every held message in order.
+func (ch *reorderChannel) release() []*redis.Message {
+	seqs := make([]int64, 0, len(ch.pending))
+	for seq := range ch.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	ready := make([]*redis.Message, 0, len(seqs))
+	for _, seq := range seqs {
+		ready = append(ready, ch.pending[seq])
+		delete(ch.pending, seq)
+	}
+	ch.next = seqs[len(seqs)-1] + 1
+	return ready
+}
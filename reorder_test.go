@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func seqMessage(channel string, seq int) *redis.Message {
+	return &redis.Message{Channel: channel, Payload: fmt.Sprintf(`{"seq": %d}`, seq)}
+}
+
+// seqs returns the sequence numbers of msgs, in the order given.
+func seqs(msgs []*redis.Message) string {
+	var s []string
+	for _, msg := range msgs {
+		n, _ := sourceSeq(msg.Payload)
+		s = append(s, fmt.Sprint(n))
+	}
+	return strings.Join(s, ",")
+}
+
+func TestReorderBufferEmitsInOrder(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SourceSeqField = "seq" })
+	tests := []struct {
+		name string
+		in   []int
+		want string
+	}{
+		{"in order", []int{1, 2, 3}, "1,2,3"},
+		{"swapped", []int{1, 3, 2, 4}, "1,2,3,4"},
+		{"reversed after the first", []int{1, 5, 4, 3, 2}, "1,2,3,4,5"},
+		// Already behind, nothing to wait for.
+		{"late duplicate", []int{1, 2, 1, 3}, "1,2,1,3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReorderBuffer(time.Second, 10)
+			now := time.Now()
+			var out []*redis.Message
+			for _, seq := range tt.in {
+				out = append(out, b.push(seqMessage("events:user:1431", seq), now)...)
+			}
+			if got := seqs(out); got != tt.want {
+				t.Errorf("emitted %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReorderBufferPerChannel(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SourceSeqField = "seq" })
+	b := newReorderBuffer(time.Second, 10)
+	now := time.Now()
+	b.push(seqMessage("a", 1), now)
+	b.push(seqMessage("b", 7), now)
+	if got := seqs(b.push(seqMessage("a", 3), now)); got != "" {
+		t.Errorf("channel a emitted %s ahead of 2", got)
+	}
+	// Channel b is on its own sequence.
+	if got := seqs(b.push(seqMessage("b", 8), now)); got != "8" {
+		t.Errorf("channel b emitted %q, want 8", got)
+	}
+}
+
+func TestReorderBufferGivesUpOnGap(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SourceSeqField = "seq" })
+	b := newReorderBuffer(100*time.Millisecond, 10)
+	start := time.Now()
+	b.push(seqMessage("c", 1), start)
+	b.push(seqMessage("c", 4), start)
+	b.push(seqMessage("c", 3), start.Add(10*time.Millisecond))
+
+	if got := b.expired(start.Add(50 * time.Millisecond)); len(got) != 0 {
+		t.Fatalf("released %s within the window", seqs(got))
+	}
+	if got := seqs(b.expired(start.Add(100 * time.Millisecond))); got != "3,4" {
+		t.Fatalf("released %q after the window, want 3,4", got)
+	}
+	// 2 is given up for, what follows 4 is delivered at once.
+	if got := seqs(b.push(seqMessage("c", 5), start.Add(time.Second))); got != "5" {
+		t.Errorf("emitted %q after the gap, want 5", got)
+	}
+}
+
+func TestReorderBufferBounded(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SourceSeqField = "seq" })
+	b := newReorderBuffer(time.Minute, 2)
+	now := time.Now()
+	b.push(seqMessage("d", 1), now)
+	b.push(seqMessage("d", 4), now)
+	b.push(seqMessage("d", 3), now)
+	if got := seqs(b.push(seqMessage("d", 5), now)); got != "3,4,5" {
+		t.Errorf("emitted %q over the max held, want 3,4,5", got)
+	}
+}
+
+func TestReorderBufferOptIn(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SourceSeqField = "seq" })
+	if b := newReorderBuffer(0, 10); b != nil {
+		t.Fatal("buffer without GO_SSE_SIDECAR_REORDER_WINDOW")
+	}
+	var b *reorderBuffer
+	if got := seqs(b.push(seqMessage("e", 3), time.Now())); got != "3" {
+		t.Errorf("a nil buffer emitted %q", got)
+	}
+
+	// Payloads without a sequence number pass through.
+	b = newReorderBuffer(time.Second, 10)
+	b.push(seqMessage("e", 1), time.Now())
+	if got := b.push(&redis.Message{Channel: "e", Payload: "plain"}, time.Now()); len(got) != 1 {
+		t.Errorf("held a payload without a sequence number")
+	}
+}
+
+func TestStreamReordered(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.SourceSeqField = "seq"
+		c.ReorderWindow = time.Second
+	})
+	s, _ := connect(t, srv, 1432, nil)
+	for _, seq := range []int{1, 3, 4, 2} {
+		rdb.Publish(ctx, "events:user:1432", fmt.Sprintf(`{"seq": %d}`, seq))
+	}
+	for want := 1; want <= 4; want++ {
+		if ev := s.nextData(t); ev.data != fmt.Sprintf(`{"seq": %d}`, want) {
+			t.Fatalf("got %s, want seq %d", ev.data, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// connectWithRequestID opens a stream with X-Request-ID set to id, and
+// returns its connection ID as given in the `connected` event.
+func connectWithRequestID(t *testing.T, srv *httptest.Server, userID int64, id string) (*sseStream, string) {
+	t.Helper()
+	header := http.Header{}
+	if id != "" {
+		header.Set("X-Request-ID", id)
+	}
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, userID, nil)}}.Encode(), header)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /sse-events: %s", resp.Status)
+	}
+	s := readStream(t, resp)
+	var data struct {
+		ConnectionID string `json:"connection_id"`
+	}
+	if err := json.Unmarshal([]byte(s.nextEvent(t, "connected").data), &data); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("X-Connection-ID"); got != data.ConnectionID {
+		t.Errorf("X-Connection-ID %q, connected with %q", got, data.ConnectionID)
+	}
+	return s, data.ConnectionID
+}
+
+func TestConnectionIDFromRequestHeader(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.RequestIDHeader = "X-Request-ID" })
+	_, id := connectWithRequestID(t, srv, 1721, "gw-7f3a.1:b_2")
+	if id != "gw-7f3a.1:b_2" {
+		t.Fatalf("connection ID %q, want the request ID", id)
+	}
+	if c := registry.get(id); c == nil || c.userID != 1721 {
+		t.Error("connection not registered under the request ID")
+	}
+}
+
+func TestConnectionIDGeneratedWithoutHeader(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.RequestIDHeader = "X-Request-ID" })
+	if _, id := connectWithRequestID(t, srv, 1722, ""); !uuidPattern.MatchString(id) {
+		t.Errorf("connection ID %q, want a new UUID", id)
+	}
+}
+
+func TestInvalidRequestIDIgnored(t *testing.T) {
+	useConfig(t, func(c *Config) { c.RequestIDHeader = "X-Request-ID" })
+	for _, id := range []string{
+		"id\nINFO forged log line",
+		"id with spaces",
+		"idé",
+		strings.Repeat("a", maxRequestIDBytes+1),
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/sse-events", nil)
+		r.Header["X-Request-Id"] = []string{id}
+		if got := requestConnectionID(r); !uuidPattern.MatchString(got) {
+			t.Errorf("%q: connection ID %q, want a new UUID", id, got)
+		}
+	}
+}
+
+func TestRequestIDOfOpenConnectionIgnored(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.RequestIDHeader = "X-Request-ID" })
+	connectWithRequestID(t, srv, 1723, "retried-request")
+	if _, id := connectWithRequestID(t, srv, 1723, "retried-request"); id == "retried-request" {
+		t.Error("two open connections with the same ID")
+	}
+}
+
+func TestRequestIDHeaderOffByDefault(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	if _, id := connectWithRequestID(t, srv, 1724, "gw-1"); id == "gw-1" {
+		t.Error("request ID used without GO_SSE_SIDECAR_REQUEST_ID_HEADER")
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !(mips || mipsle || mips64 || mips64le)
+
+package main
+
+// soReusePort is SO_REUSEPORT, which the syscall package lacks on Linux.
+const soReusePort = 0xf
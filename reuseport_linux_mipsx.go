@@ -0,0 +1,6 @@
+//go:build mips || mipsle || mips64 || mips64le
+
+package main
+
+// soReusePort is SO_REUSEPORT on Linux on MIPS.
+const soReusePort = 0x200
@@ -0,0 +1,20 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// reusePortSupported reports whether GO_SSE_SIDECAR_REUSEPORT can be used.
+const reusePortSupported = true
+
+// reusePort sets SO_REUSEPORT on the listening socket, so another process
+// can bind the same port.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// eventSchema is the JSON Schema of GO_SSE_SIDECAR_EVENT_SCHEMA_FILE, or nil.
+var eventSchema *jsonSchema
+
+// jsonSchema is the subset of JSON Schema needed to hold events to a
+// contract: type, enum, const, properties, required, additionalProperties,
+// items, the numeric bounds, minLength, maxLength, pattern, minItems and
+// maxItems. Other keywords are ignored, with a warning at startup.
+type jsonSchema struct {
+	types      []string
+	enum       []interface{}
+	constValue interface{}
+	hasConst   bool
+
+	properties map[string]*jsonSchema
+	required   []string
+	// noAdditional forbids properties not listed, additional validates them.
+	noAdditional bool
+	additional   *jsonSchema
+	items        *jsonSchema
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	minLength, maxLength               *int
+	pattern                            *regexp.Regexp
+	minItems, maxItems                 *int
+}
+
+// schemaAnnotations are the keywords that don't constrain anything.
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true,
+}
+
+// loadEventSchema reads the event schema at startup.
+func loadEventSchema(path string) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read GO_SSE_SIDECAR_EVENT_SCHEMA_FILE: %v", err)
+	}
+	var ignored []string
+	s, err := compileSchema(b, "$", &ignored)
+	if err != nil {
+		log.Fatalf("Invalid schema in %s: %v", path, err)
+	}
+	if len(ignored) > 0 {
+		log.Printf("[SSE-SIDECAR] WARNING: unsupported schema keywords ignored: %s", strings.Join(ignored, ", "))
+	}
+	eventSchema = s
+}
+
+// compileSchema parses a schema, adding the unsupported keywords found to
+// ignored.
+func compileSchema(b []byte, path string, ignored *[]string) (*jsonSchema, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := &jsonSchema{}
+	for _, name := range names {
+		raw := fields[name]
+		var err error
+		switch name {
+		case "type":
+			var one string
+			if json.Unmarshal(raw, &one) == nil {
+				s.types = []string{one}
+			} else {
+				err = json.Unmarshal(raw, &s.types)
+			}
+		case "enum":
+			err = json.Unmarshal(raw, &s.enum)
+		case "const":
+			s.hasConst = true
+			err = json.Unmarshal(raw, &s.constValue)
+		case "properties":
+			var props map[string]json.RawMessage
+			if err = json.Unmarshal(raw, &props); err == nil {
+				s.properties = make(map[string]*jsonSchema, len(props))
+				for prop, sub := range props {
+					if s.properties[prop], err = compileSchema(sub, path+"."+prop, ignored); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case "required":
+			err = json.Unmarshal(raw, &s.required)
+		case "additionalProperties":
+			var allowed bool
+			if json.Unmarshal(raw, &allowed) == nil {
+				s.noAdditional = !allowed
+			} else {
+				s.additional, err = compileSchema(raw, path+".*", ignored)
+			}
+		case "items":
+			s.items, err = compileSchema(raw, path+"[]", ignored)
+		case "minimum":
+			err = json.Unmarshal(raw, &s.minimum)
+		case "maximum":
+			err = json.Unmarshal(raw, &s.maximum)
+		case "exclusiveMinimum":
+			err = json.Unmarshal(raw, &s.exclusiveMinimum)
+		case "exclusiveMaximum":
+			err = json.Unmarshal(raw, &s.exclusiveMaximum)
+		case "minLength":
+			err = json.Unmarshal(raw, &s.minLength)
+		case "maxLength":
+			err = json.Unmarshal(raw, &s.maxLength)
+		case "minItems":
+			err = json.Unmarshal(raw, &s.minItems)
+		case "maxItems":
+			err = json.Unmarshal(raw, &s.maxItems)
+		case "pattern":
+			var pattern string
+			if err = json.Unmarshal(raw, &pattern); err == nil {
+				s.pattern, err = regexp.Compile(pattern)
+			}
+		default:
+			if !schemaAnnotations[name] {
+				*ignored = append(*ignored, path+"."+name)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", path, name, err)
+		}
+	}
+	return s, nil
+}
+
+// validPayload checks payload against the event schema. Payloads that aren't
+// JSON, and every payload without a schema, are valid.
+func validPayload(payload string) error {
+	if eventSchema == nil {
+		return nil
+	}
+	var v interface{}
+	if json.Unmarshal([]byte(payload), &v) != nil {
+		return nil
+	}
+	return eventSchema.validate(v, "$")
+}
+
+func (s *jsonSchema) validate(v interface{}, path string) error {
+	if len(s.types) > 0 && !s.hasType(v) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(s.types, " or "), jsonType(v))
+	}
+	if s.enum != nil && !containsValue(s.enum, v) {
+		return fmt.Errorf("%s: not one of the allowed values", path)
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constValue, v) {
+		return fmt.Errorf("%s: not the expected constant", path)
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, value := range v {
+			sub, listed := s.properties[name]
+			switch {
+			case listed:
+			case s.noAdditional:
+				return fmt.Errorf("%s: unexpected property %q", path, name)
+			case s.additional != nil:
+				sub = s.additional
+			default:
+				continue
+			}
+			if err := sub.validate(value, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return fmt.Errorf("%s: fewer than %d items", path, *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return fmt.Errorf("%s: more than %d items", path, *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fmt.Errorf("%s: longer than %d characters", path, *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: doesn't match %s", path, s.pattern)
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			return fmt.Errorf("%s: below %v", path, *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			return fmt.Errorf("%s: above %v", path, *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			return fmt.Errorf("%s: not above %v", path, *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			return fmt.Errorf("%s: not below %v", path, *s.exclusiveMaximum)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) hasType(v interface{}) bool {
+	for _, t := range s.types {
+		if t == jsonType(v) {
+			return true
+		}
+		if f, ok := v.(float64); ok && t == "integer" && f == math.Trunc(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType names the JSON Schema type of a decoded value, numbers being
+// "number".
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, allowed := range values {
+		if reflect.DeepEqual(allowed, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// conforms reports whether msg matches the event schema, and otherwise drops
+// it to the dead-letter channel.
+func (c *SSEClient) conforms(msg sseMessage) bool {
+	err := validPayload(msg.payload)
+	if err == nil {
+		return true
+	}
+	metrics.schemaRejected.Add(1)
+	deadLetters.add(c, msg, "invalid_schema")
+	c.logf("Dropping message for user %d not matching the event schema: %v", c.userID, err)
+	return false
+}
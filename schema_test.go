@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const orderSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["type", "order_id"],
+	"additionalProperties": false,
+	"properties": {
+		"type": {"enum": ["order.created", "order.paid"]},
+		"order_id": {"type": "integer", "minimum": 1},
+		"ref": {"type": "string", "pattern": "^[A-Z]{3}-[0-9]+$", "maxLength": 12},
+		"items": {"type": "array", "maxItems": 2, "items": {"type": "string", "minLength": 1}}
+	}
+}`
+
+// useEventSchema loads schema from a file, like at startup, for the test.
+func useEventSchema(t *testing.T, schema string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(schema), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := eventSchema
+	t.Cleanup(func() { eventSchema = old })
+	loadEventSchema(path)
+}
+
+func TestPayloadsValidatedAgainstSchema(t *testing.T) {
+	useEventSchema(t, orderSchema)
+	for _, payload := range []string{
+		`{"type": "order.created", "order_id": 7}`,
+		`{"type": "order.paid", "order_id": 7.0, "ref": "ABC-12", "items": ["a", "b"]}`,
+		// Not JSON, so not checked.
+		"plain text",
+	} {
+		if err := validPayload(payload); err != nil {
+			t.Errorf("%s: %v", payload, err)
+		}
+	}
+	for payload, want := range map[string]string{
+		`{"order_id": 7}`:                                       `missing required property "type"`,
+		`{"type": "order.shipped", "order_id": 7}`:              "$.type: not one of the allowed values",
+		`{"type": "order.paid", "order_id": 7.5}`:               "$.order_id: expected integer",
+		`{"type": "order.paid", "order_id": 0}`:                 "$.order_id: below 1",
+		`{"type": "order.paid", "order_id": 1, "ref": "abc-1"}`: "$.ref: doesn't match",
+		`{"type": "order.paid", "order_id": 1, "items": [""]}`:  "$.items[0]: shorter than 1",
+		`{"type": "order.paid", "order_id": 1, "items": [1]}`:   "$.items[0]: expected string",
+		`{"type": "order.paid", "order_id": 1, "extra": true}`:  `unexpected property "extra"`,
+		`[1, 2]`: "$: expected object, got array",
+	} {
+		if err := validPayload(payload); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v, want %q", payload, err, want)
+		}
+	}
+}
+
+func TestNoSchemaByDefault(t *testing.T) {
+	old := eventSchema
+	eventSchema = nil
+	t.Cleanup(func() { eventSchema = old })
+	if err := validPayload(`{"anything": "goes"}`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamDropsNonConformingEvents(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.DeadLetterChannel = "deadletters" })
+	records := subscribeTo(t, "deadletters")
+	startDeadLetters(t)
+	useEventSchema(t, orderSchema)
+	s, _ := connect(t, srv, 1821, nil)
+
+	rejected := metrics.schemaRejected.Load()
+	rdb.Publish(ctx, "events:user:1821", `{"type": "order.paid"}`)
+	rdb.Publish(ctx, "events:user:1821", `{"type": "order.paid", "order_id": 3}`)
+	if ev := s.nextData(t); ev.data != `{"type": "order.paid", "order_id": 3}` {
+		t.Errorf("got %s, want only the conforming event", ev.data)
+	}
+	if n := metrics.schemaRejected.Load() - rejected; n != 1 {
+		t.Errorf("%d rejected, want 1", n)
+	}
+	if r := decodeDeadLetter(t, receive(t, records)); r.Reason != "invalid_schema" || r.Payload != `{"type": "order.paid"}` {
+		t.Errorf("record %+v", r)
+	}
+}
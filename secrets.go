@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keySet holds the token verification secret and EC public key, from the
+// environment or from GO_SSE_SIDECAR_TOKEN_FILE and
+// GO_SSE_SIDECAR_JWT_PUBLIC_KEY_FILE. The files are read again when a
+// signature doesn't verify, since that's what a rotation looks like, at most
+// once per cfg.SecretReloadInterval.
+type keySet struct {
+	mu     sync.Mutex
+	secret string
+	key    *ecdsa.PublicKey
+	read   time.Time
+}
+
+var signingKeys = &keySet{}
+
+// loadSigningKeys reads the verification keys at startup.
+func loadSigningKeys() {
+	secret := os.Getenv("GO_SSE_SIDECAR_TOKEN")
+	if secret != "" && cfg.TokenFile != "" {
+		log.Fatal("Only one of GO_SSE_SIDECAR_TOKEN and GO_SSE_SIDECAR_TOKEN_FILE can be set")
+	}
+	if cfg.JWTPublicKey != nil && cfg.JWTPublicKeyFile != "" {
+		log.Fatal("Only one of GO_SSE_SIDECAR_JWT_PUBLIC_KEY and GO_SSE_SIDECAR_JWT_PUBLIC_KEY_FILE can be set")
+	}
+	signingKeys.secret, signingKeys.key = secret, cfg.JWTPublicKey
+	if err := signingKeys.readFiles(); err != nil {
+		log.Fatalf("Failed to load token keys: %v", err)
+	}
+}
+
+func (k *keySet) hmacSecret() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.secret
+}
+
+func (k *keySet) publicKey() *ecdsa.PublicKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.key
+}
+
+// reload reads the key files again unless they were read recently, and
+// reports whether a key changed.
+func (k *keySet) reload() bool {
+	if cfg.TokenFile == "" && cfg.JWTPublicKeyFile == "" {
+		return false
+	}
+	k.mu.Lock()
+	if time.Since(k.read) < cfg.SecretReloadInterval {
+		k.mu.Unlock()
+		return false
+	}
+	k.read = time.Now()
+	secret, key := k.secret, k.key
+	k.mu.Unlock()
+
+	if err := k.readFiles(); err != nil {
+		// Keep the keys loaded before, the file may be half written.
+		log.Printf("[SECURITY] Failed to reload token keys: %v", err)
+		return false
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	changed := k.secret != secret || (k.key != key && (key == nil || !k.key.Equal(key)))
+	if changed {
+		log.Printf("[SECURITY] Token keys changed, reloaded from file")
+	}
+	return changed
+}
+
+// readFiles reads the configured key files, replacing the keys only when
+// both are valid.
+func (k *keySet) readFiles() error {
+	var secret string
+	var key *ecdsa.PublicKey
+	if cfg.TokenFile != "" {
+		s, err := readSecretFile(cfg.TokenFile)
+		if err != nil {
+			return err
+		}
+		if s == "" {
+			return errors.New(cfg.TokenFile + " is empty")
+		}
+		secret = s
+	}
+	if cfg.JWTPublicKeyFile != "" {
+		b, err := os.ReadFile(cfg.JWTPublicKeyFile)
+		if err != nil {
+			return err
+		}
+		if key, err = jwt.ParseECPublicKeyFromPEM(b); err != nil {
+			return err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.read = time.Now()
+	if cfg.TokenFile != "" {
+		k.secret = secret
+	}
+	if cfg.JWTPublicKeyFile != "" {
+		k.key = key
+	}
+	return nil
+}
+
+// verifyToken verifies a token with the current keys, and with the keys read
+// again from their files when its signature is wrong.
+func verifyToken(tokenString string) (*SSETokenClaims, error) {
+	claims, err := verifySseToken(tokenString, signingKeys.hmacSecret())
+	if errors.Is(err, jwt.ErrTokenSignatureInvalid) && signingKeys.reload() {
+		claims, err = verifySseToken(tokenString, signingKeys.hmacSecret())
+	}
+	return claims, err
+}
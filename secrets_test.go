@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useKeyFiles makes the test's key set read the secret from a file, whose
+// path it returns, starting with secret.
+func useKeyFiles(t *testing.T, secret string, reload time.Duration) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "token")
+	writeSecret(t, path, secret)
+	useConfig(t, func(c *Config) {
+		c.TokenFile = path
+		c.SecretReloadInterval = reload
+	})
+	old := signingKeys
+	signingKeys = &keySet{}
+	t.Cleanup(func() { signingKeys = old })
+	if err := signingKeys.readFiles(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writeSecret(t *testing.T, path, secret string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signedWith(t *testing.T, secret string, userID int64) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": userID, "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTokenSecretFromFile(t *testing.T) {
+	useKeyFiles(t, "from-file", 0)
+	if got := signingKeys.hmacSecret(); got != "from-file" {
+		t.Fatalf("secret %q, want the file's without the newline", got)
+	}
+	if claims, err := verifyToken(signedWith(t, "from-file", 1651)); err != nil || claims.UserID != 1651 {
+		t.Errorf("claims %+v, err %v", claims, err)
+	}
+}
+
+func TestTokenSecretRotatedMidRun(t *testing.T) {
+	path := useKeyFiles(t, "first", 0)
+	if _, err := verifyToken(signedWith(t, "first", 1652)); err != nil {
+		t.Fatal(err)
+	}
+
+	writeSecret(t, path, "second")
+	// The first token signed with the new secret makes the file be read again.
+	if _, err := verifyToken(signedWith(t, "second", 1652)); err != nil {
+		t.Fatalf("token of the rotated secret: %v", err)
+	}
+	if _, err := verifyToken(signedWith(t, "first", 1652)); err == nil {
+		t.Error("token of the old secret still accepted")
+	}
+}
+
+func TestTokenSecretReloadBounded(t *testing.T) {
+	path := useKeyFiles(t, "first", time.Hour)
+	// Just read at startup, a bad signature doesn't read the file again.
+	writeSecret(t, path, "second")
+	if _, err := verifyToken(signedWith(t, "second", 1653)); err == nil {
+		t.Fatal("file read again within GO_SSE_SIDECAR_SECRET_RELOAD_INTERVAL")
+	}
+
+	// A half written file keeps the keys loaded before.
+	signingKeys.read = time.Time{}
+	writeSecret(t, path, "")
+	if signingKeys.reload() || signingKeys.hmacSecret() != "first" {
+		t.Errorf("secret %q after reading an empty file", signingKeys.hmacSecret())
+	}
+}
+
+func TestPublicKeyFileRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	writeKey := func(t *testing.T) *ecdsa.PrivateKey {
+		key := newECKey(t)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	first := writeKey(t)
+	useConfig(t, func(c *Config) {
+		c.JWTAlgs = []string{"ES256"}
+		c.JWTPublicKeyFile = path
+		c.SecretReloadInterval = 0
+	})
+	old := signingKeys
+	signingKeys = &keySet{secret: testSecret}
+	t.Cleanup(func() { signingKeys = old })
+	if err := signingKeys.readFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(key *ecdsa.PrivateKey) string {
+		s, _ := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"user_id": 1654, "exp": time.Now().Add(time.Hour).Unix()}).SignedString(key)
+		return s
+	}
+	if _, err := verifyToken(sign(first)); err != nil {
+		t.Fatalf("key from the file: %v", err)
+	}
+	second := writeKey(t)
+	if _, err := verifyToken(sign(second)); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+}
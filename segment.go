@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// segment is the data of an `event: chunk` frame. The client buffers the
+// parts by id and dispatches the joined data as event once it has total parts.
+type segment struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Total int    `json:"total"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+}
+
+// writeSegments splits the frame data into ordered parts of at most size
+// bytes (without splitting UTF-8 characters) and writes each as a chunk event.
+// The frame's SSE id is only set on the last chunk, once the message is whole.
+func writeSegments(w io.Writer, id string, frame sseFrame, size int) error {
+	parts := splitUTF8(frame.data, size)
+	for i, part := range parts {
+		b, err := json.Marshal(segment{ID: id, Index: i, Total: len(parts), Event: frame.event, Data: part})
+		if err != nil {
+			return err
+		}
+		chunk := sseFrame{event: "chunk", data: string(b)}
+		if i == len(parts)-1 {
+			chunk.id = frame.id
+		}
+		if err := writeFrame(w, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitUTF8(s string, size int) []string {
+	var parts []string
+	for len(s) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = size
+		}
+		parts = append(parts, s[:cut])
+		s = s[cut:]
+	}
+	return append(parts, s)
+}
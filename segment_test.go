@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitUTF8KeepsCharactersWhole(t *testing.T) {
+	s := strings.Repeat("é€", 10) // 2 and 3 byte characters
+	parts := splitUTF8(s, 4)
+	if strings.Join(parts, "") != s {
+		t.Fatal("parts don't join back to the input")
+	}
+	for i, part := range parts {
+		if len(part) > 4 {
+			t.Errorf("part %d is %d bytes, max 4", i, len(part))
+		}
+		if !utf8.ValidString(part) {
+			t.Errorf("part %d %q splits a character", i, part)
+		}
+	}
+}
+
+func TestStreamSegmentsLargeEvents(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.SegmentBytes = 10 })
+	s, _ := connect(t, srv, 7, nil)
+
+	payload := `{"text":"` + strings.Repeat("a", 19) + `"}` // 30 bytes, 3 parts
+	mr.Publish("events:user:7", payload)
+	mr.Publish("events:user:7", "small")
+
+	var joined strings.Builder
+	var first segment
+	for i := 0; ; i++ {
+		ev := s.nextEvent(t, "chunk")
+		var seg segment
+		if err := json.Unmarshal([]byte(ev.data), &seg); err != nil {
+			t.Fatalf("chunk %q: %v", ev.data, err)
+		}
+		if i == 0 {
+			first = seg
+		}
+		if seg.ID != first.ID || seg.Index != i || seg.Total != 3 {
+			t.Fatalf("chunk %d = %+v, want part %d of 3 of %s", i, seg, i, first.ID)
+		}
+		joined.WriteString(seg.Data)
+		if seg.Index == seg.Total-1 {
+			break
+		}
+	}
+	if joined.String() != payload {
+		t.Errorf("joined chunks = %q, want %q", joined.String(), payload)
+	}
+	if ev := s.nextData(t); ev.event != "" || ev.data != "small" {
+		t.Errorf("event under the size = %q %q, want it unsegmented", ev.event, ev.data)
+	}
+}
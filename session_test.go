@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestNewestConnectionSupersedesOlder(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.SingleSession = true })
+	superseded := closeCounts.counter("superseded").Load()
+	other, _ := connect(t, srv, 1942, nil)
+	// Each connection closes the one before.
+	first, _ := connect(t, srv, 1941, nil)
+	second, _ := connect(t, srv, 1941, nil)
+	third, conn := connect(t, srv, 1941, nil)
+	for i, s := range []*sseStream{first, second} {
+		s.nextEvent(t, "superseded")
+		if !s.ended(t) {
+			t.Errorf("connection %d still open after superseded", i+1)
+		}
+	}
+	if conns := registry.forUser("", 1941); len(conns) != 1 || conns[0].id != conn {
+		t.Errorf("%d connections of the user, want only the newest", len(conns))
+	}
+	if n := closeCounts.counter("superseded").Load() - superseded; n != 2 {
+		t.Errorf("%d superseded closes counted, want 2", n)
+	}
+
+	rdb.Publish(ctx, "events:user:1941", "newest")
+	rdb.Publish(ctx, "events:user:1942", "unaffected")
+	if ev := third.nextData(t); ev.data != "newest" {
+		t.Errorf("newest connection got %q", ev.data)
+	}
+	if ev := other.nextData(t); ev.data != "unaffected" {
+		t.Errorf("other user got %q", ev.data)
+	}
+}
+
+func TestConnectionsCoexistByDefault(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	first, _ := connect(t, srv, 1943, nil)
+	second, _ := connect(t, srv, 1943, nil)
+	rdb.Publish(ctx, "events:user:1943", "both")
+	for _, s := range []*sseStream{first, second} {
+		if ev := s.nextData(t); ev.data != "both" {
+			t.Errorf("got %+v", ev)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "time"
+
+// slowFlushSamples is how many flushes are averaged before a connection can
+// be downgraded.
+const slowFlushSamples = 8
+
+// flushMonitor keeps a moving average of a connection's flush latency, the
+// time its writes take to reach the client's link.
+type flushMonitor struct {
+	avg        time.Duration
+	samples    int
+	downgraded bool
+}
+
+// newFlushMonitor returns nil unless cfg.SlowFlushThreshold is set.
+func newFlushMonitor() *flushMonitor {
+	if cfg.SlowFlushThreshold <= 0 {
+		return nil
+	}
+	return &flushMonitor{}
+}
+
+// observe adds a flush that took d, and reports whether the average just
+// went over cfg.SlowFlushThreshold. It does once per connection.
+func (m *flushMonitor) observe(d time.Duration) bool {
+	if m == nil || m.downgraded {
+		return false
+	}
+	m.samples++
+	if m.samples == 1 {
+		m.avg = d
+	} else {
+		// An exponential average weighting the last flush by 1/8.
+		m.avg += (d - m.avg) / 8
+	}
+	if m.samples < slowFlushSamples || m.avg <= cfg.SlowFlushThreshold {
+		return false
+	}
+	m.downgraded = true
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlushMonitorAverage(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SlowFlushThreshold = 10 * time.Millisecond })
+	m := newFlushMonitor()
+	// Too few flushes to judge the link.
+	for i := 1; i < slowFlushSamples; i++ {
+		if m.observe(50 * time.Millisecond) {
+			t.Fatalf("downgraded after %d flushes", i)
+		}
+	}
+	if !m.observe(50 * time.Millisecond) {
+		t.Fatal("not downgraded once the average is over the threshold")
+	}
+	if m.observe(50 * time.Millisecond) {
+		t.Error("downgraded twice")
+	}
+
+	// A spike among fast flushes stays under it.
+	m = newFlushMonitor()
+	for i := 0; i < 20; i++ {
+		d := time.Millisecond
+		if i == 10 {
+			d = 40 * time.Millisecond
+		}
+		if m.observe(d) {
+			t.Fatalf("downgraded by one slow flush, average %v", m.avg)
+		}
+	}
+
+	useConfig(t, nil)
+	if newFlushMonitor().observe(time.Hour) {
+		t.Error("downgraded by default")
+	}
+}
+
+// slowLinkWriter is the response writer of a client on a slow link: every
+// flush takes delay.
+type slowLinkWriter struct {
+	delay  time.Duration
+	header http.Header
+
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (w *slowLinkWriter) Header() http.Header { return w.header }
+
+func (w *slowLinkWriter) WriteHeader(int) {}
+
+func (w *slowLinkWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *slowLinkWriter) Flush() { time.Sleep(w.delay) }
+
+func (w *slowLinkWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// serveSlowLink streams to userID through a slowLinkWriter until the test
+// ends.
+func serveSlowLink(t *testing.T, userID int64, delay time.Duration) *slowLinkWriter {
+	t.Helper()
+	w := &slowLinkWriter{delay: delay, header: make(http.Header)}
+	rctx, cancel := context.WithCancel(ctx)
+	r := httptest.NewRequest(http.MethodGet, "/sse-events?"+url.Values{"ssetoken": {token(t, userID, nil)}}.Encode(), nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sseHandler(w, r.WithContext(rctx))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "the connection", func() bool { return len(registry.forUser("", userID)) == 1 })
+	return w
+}
+
+func TestSlowLinkDowngradedToCoalescing(t *testing.T) {
+	newSidecar(t, func(c *Config) { c.SlowFlushThreshold = 5 * time.Millisecond })
+	downgrades := metrics.slowFlushDowngrades.Load()
+	w := serveSlowLink(t, 2331, 20*time.Millisecond)
+
+	for i := 0; i < slowFlushSamples; i++ {
+		rdb.Publish(ctx, "events:user:2331", fmt.Sprintf("warmup %d", i))
+	}
+	degraded := "event: degraded\ndata: {\"reason\":\"slow_flush\"}\n\n"
+	waitFor(t, "the downgrade", func() bool { return strings.Contains(w.String(), degraded) })
+	if n := metrics.slowFlushDowngrades.Load() - downgrades; n != 1 {
+		t.Errorf("%d downgrades counted, want 1", n)
+	}
+
+	// Downgraded, a backlog without coalesce keys keeps the newest only.
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	conn := registry.forUser("", 2331)[0]
+	for _, payload := range []string{"old 1", "old 2", "old 3", "new"} {
+		rdb.Publish(ctx, "events:user:2331", payload)
+	}
+	waitFor(t, "the backlog queued", func() bool { return conn.queued() == 4 })
+	delivery.set(false)
+	waitFor(t, "the newest written", func() bool { return strings.Contains(w.String(), "data: new\n") })
+	if _, after, _ := strings.Cut(w.String(), degraded); strings.Contains(after, "data: old") {
+		t.Errorf("backlog written in full after the downgrade:\n%s", after)
+	}
+	if n := metrics.slowFlushDowngrades.Load() - downgrades; n != 1 {
+		t.Errorf("%d downgrades counted, want 1 per connection", n)
+	}
+}
+
+func TestFastLinkNotDowngraded(t *testing.T) {
+	newSidecar(t, func(c *Config) { c.SlowFlushThreshold = 20 * time.Millisecond })
+	downgrades := metrics.slowFlushDowngrades.Load()
+	w := serveSlowLink(t, 2332, 0)
+	for i := 0; i < 3*slowFlushSamples; i++ {
+		rdb.Publish(ctx, "events:user:2332", fmt.Sprintf("m %d", i))
+	}
+	waitFor(t, "the messages", func() bool { return strings.Contains(w.String(), fmt.Sprintf("data: m %d\n", 3*slowFlushSamples-1)) })
+	if strings.Contains(w.String(), "event: degraded") || metrics.slowFlushDowngrades.Load() != downgrades {
+		t.Error("fast link downgraded")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// snapshotKey returns the user's snapshot key from cfg.SnapshotKey, where
+// `{user_id}` is replaced by the user ID.
+func snapshotKey(userID int64) string {
+	return strings.ReplaceAll(cfg.SnapshotKey, "{user_id}", strconv.FormatInt(userID, 10))
+}
+
+// fetchSnapshot reads the user's snapshot: a string key as is, a hash as a
+// JSON object of its fields. It returns false when there is none.
+func fetchSnapshot(ctx context.Context, rdb *redis.Client, client *SSEClient) (string, bool) {
+	key := client.qualify(snapshotKey(client.userID))
+	kind, err := rdb.Type(ctx, key).Result()
+	if err != nil {
+		client.logf("Failed to read snapshot %s: %v", key, err)
+		return "", false
+	}
+	switch kind {
+	case "string":
+		v, err := rdb.Get(ctx, key).Result()
+		if err != nil {
+			// Deleted meanwhile (redis.Nil) or failed, either way no snapshot.
+			return "", false
+		}
+		return v, true
+	case "hash":
+		fields, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil || len(fields) == 0 {
+			return "", false
+		}
+		b, _ := json.Marshal(fields)
+		return string(b), true
+	case "none":
+		return "", false
+	}
+	client.logf("Ignoring snapshot %s of type %s, expected a string or a hash", key, kind)
+	return "", false
+}
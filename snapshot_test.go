@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func useSnapshots(c *Config) { c.SnapshotKey = "state:{user_id}" }
+
+func TestSnapshotStringSentFirst(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		useSnapshots(c)
+		c.HistoryBackfill = 1
+	})
+	mr.Set("state:1781", `{"unread": 3}`)
+	mr.RPush("history:user:1781", "from history")
+
+	s, _ := connect(t, srv, 1781, nil)
+	if ev := s.next(t); ev.event != "snapshot" || ev.data != `{"unread": 3}` {
+		t.Fatalf("got %+v, want the snapshot right after connected", ev)
+	}
+	if ev := s.nextData(t); ev.data != "from history" {
+		t.Errorf("got %q after the snapshot, want the history", ev.data)
+	}
+	mr.Publish("events:user:1781", "live")
+	if ev := s.nextData(t); ev.data != "live" {
+		t.Errorf("got %q", ev.data)
+	}
+}
+
+func TestSnapshotHashAsObject(t *testing.T) {
+	mr, srv := newSidecar(t, useSnapshots)
+	mr.HSet("state:1782", "unread", "3", "status", "away")
+
+	s, _ := connect(t, srv, 1782, nil)
+	ev := s.nextEvent(t, "snapshot")
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(ev.data), &fields); err != nil {
+		t.Fatalf("snapshot %q: %v", ev.data, err)
+	}
+	if len(fields) != 2 || fields["unread"] != "3" || fields["status"] != "away" {
+		t.Errorf("snapshot %v, want the hash fields", fields)
+	}
+}
+
+func TestMissingSnapshotSkipped(t *testing.T) {
+	mr, srv := newSidecar(t, useSnapshots)
+	// Someone else's snapshot, and one of a type that can't be sent.
+	mr.Set("state:1", "not yours")
+	mr.SAdd("state:1784", "a")
+
+	for _, userID := range []int64{1783, 1784} {
+		s, _ := connect(t, srv, userID, nil)
+		mr.Publish(fmt.Sprintf("events:user:%d", userID), "live")
+		if ev := s.next(t); ev.event == "snapshot" || ev.data != "live" {
+			t.Errorf("user %d: got %+v, want no snapshot", userID, ev)
+		}
+	}
+}
+
+func TestSnapshotOffByDefault(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	mr.Set("state:1785", "ignored")
+	s, _ := connect(t, srv, 1785, nil)
+	mr.Publish("events:user:1785", "live")
+	if ev := s.next(t); ev.event == "snapshot" {
+		t.Error("snapshot sent without GO_SSE_SIDECAR_SNAPSHOT_KEY")
+	}
+}
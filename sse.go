@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// sseMessage is a message received from Redis and queued for a connection.
+type sseMessage struct {
+	channel string
+	// pattern is the subscription pattern that matched channel, for
+	// messages received through PSUBSCRIBE.
+	pattern string
+	payload string
+	// event, when set, names the event whatever the channel.
+	event string
+	// enqueued is when the message was queued for the connection, and seq
+	// its position in the connection's queue. Dropped messages leave a gap.
+	enqueued time.Time
+	seq      int64
+	// transformed and enveloped say GO_SSE_SIDECAR_TRANSFORM or the envelope
+	// were applied to payload already, by the write pipeline. published is
+	// then the payload as published.
+	transformed, enveloped bool
+	published              string
+}
+
+// asPublished returns msg with its payload as published, which the event
+// id and name are read from.
+func (msg sseMessage) asPublished() sseMessage {
+	if msg.transformed || msg.enveloped {
+		msg.payload = msg.published
+	}
+	return msg
+}
+
+// rewrite replaces the payload, keeping the one published.
+func (msg *sseMessage) rewrite(payload string) {
+	if !msg.transformed && !msg.enveloped {
+		msg.published = msg.payload
+	}
+	msg.payload = payload
+}
+
+// emptyPayload applies cfg.EmptyPayload to a payload that is empty or only
+// whitespace, which would otherwise reach clients as an empty data line. It
+// returns false when the message is skipped.
+func emptyPayload(payload string) (string, bool) {
+	if strings.TrimSpace(payload) != "" {
+		return payload, true
+	}
+	switch cfg.EmptyPayload {
+	case "forward":
+		return payload, true
+	case "placeholder":
+		return cfg.EmptyPlaceholder, true
+	}
+	return "", false
+}
+
+// utf8BOM is the byte order mark some publishers put before UTF-8 text.
+const utf8BOM = "\ufeff"
+
+// stripBOM removes a leading byte order mark, which strict clients choke on,
+// unless cfg.StripBOM is off.
+func stripBOM(payload string) string {
+	if !cfg.StripBOM {
+		return payload
+	}
+	return strings.TrimPrefix(payload, utf8BOM)
+}
+
+// sseFrame is a single SSE event on the wire.
+type sseFrame struct {
+	id    string
+	event string
+	data  string
+	// retry, when set, changes the client's reconnection delay.
+	retry time.Duration
+}
+
+func writeEvent(w io.Writer, event, data string) error {
+	return writeFrame(w, sseFrame{event: event, data: data})
+}
+
+// writeFrame writes a single SSE frame. An empty event writes an anonymous
+// event (dispatched to `onmessage`) and an empty id leaves the client's last
+// event ID unchanged. Multi-line data is split into several `data:` lines,
+// which the client joins back with newlines. Lines longer than
+// cfg.MaxLineBytes are handled per cfg.LongLines. On a compactWriter,
+// the frame is sent in the compact framing instead.
+func writeFrame(w io.Writer, f sseFrame) error {
+	if cw, ok := w.(compactWriter); ok {
+		return cw.writeFrame(f)
+	}
+	lines, err := dataLines(f.data)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	if f.retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", f.retry.Milliseconds())
+	}
+	if id := fieldValue(f.id); id != "" {
+		fmt.Fprintf(&b, "id: %s\n", id)
+	}
+	if event := fieldValue(f.event); event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range lines {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// errLineTooLong rejects an event with a line over cfg.MaxLineBytes.
+var errLineTooLong = errors.New("data line too long")
+
+// newlineReplacer turns `\r\n` and lone `\r` line endings into `\n`.
+var newlineReplacer = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// dataLines splits data into its `data:` lines, applying cfg.LongLines to
+// those longer than cfg.MaxLineBytes. A split line reaches the client with
+// line breaks where it was cut. With cfg.NormalizeNewlines, `\r\n` and `\r`
+// end lines too: the client would otherwise end the line at a `\r` and take
+// the rest for another field.
+func dataLines(data string) ([]string, error) {
+	if cfg.NormalizeNewlines {
+		data = newlineReplacer.Replace(data)
+	}
+	lines := strings.Split(data, "\n")
+	max := cfg.MaxLineBytes
+	if max <= 0 {
+		return lines, nil
+	}
+	out := lines[:0:0]
+	for _, line := range lines {
+		if len(line) <= max {
+			out = append(out, line)
+			continue
+		}
+		switch cfg.LongLines {
+		case "reject":
+			return nil, fmt.Errorf("%w: %d bytes (max %d)", errLineTooLong, len(line), max)
+		case "truncate":
+			out = append(out, line[:runeCut(line, max)])
+		default:
+			for len(line) > max {
+				n := runeCut(line, max)
+				out = append(out, line[:n])
+				line = line[n:]
+			}
+			out = append(out, line)
+		}
+	}
+	return out, nil
+}
+
+// runeCut returns the largest cut of s at most max bytes long that doesn't
+// split a UTF-8 character.
+func runeCut(s string, max int) int {
+	n := max
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	if n == 0 {
+		return max
+	}
+	return n
+}
+
+// fieldValueReplacer removes the characters that would end an SSE field
+// line early (and NUL, which makes browsers ignore an id).
+var fieldValueReplacer = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+
+// fieldValue sanitizes a single-line field value, which can come from the
+// payload.
+func fieldValue(v string) string {
+	return fieldValueReplacer.Replace(v)
+}
+
+// writeMessage frames a queued message for the client, applying the
+// transform and the envelope if the write pipeline didn't.
+func (c *SSEClient) writeMessage(w io.Writer, msg sseMessage) error {
+	// The id and event name are read from the payload as published.
+	published := msg.asPublished()
+	frame := sseFrame{id: c.eventID(published), event: c.frameEvent(published)}
+	if c.missingEventField(published) && cfg.MissingEventField == missingEventDrop {
+		return fmt.Errorf("%w %q", errMissingEventField, cfg.EventField)
+	}
+	msg = transformMessage(c, msg)
+	frame.data = msg.payload
+	if c.envelopes(msg) {
+		frame.data = envelopeData(msg, c.eventMetadata)
+	}
+	if cfg.SegmentBytes > 0 && len(msg.payload) > cfg.SegmentBytes {
+		c.segmentSeq++
+		return writeSegments(w, fmt.Sprintf("%s-%d", c.id, c.segmentSeq), frame, cfg.SegmentBytes)
+	}
+	return writeFrame(w, frame)
+}
+
+// eventID returns the SSE id for msg: the payload's id field when configured
+// and present, otherwise a per-connection sequence number when enabled. A
+// payload id longer than cfg.MaxEventIDBytes is ignored, since the browser
+// sends it back in Last-Event-ID on every reconnect.
+func (c *SSEClient) eventID(msg sseMessage) string {
+	if cfg.EventIDField != "" {
+		if id := fieldValue(payloadScalar(msg.payload, cfg.EventIDField)); len(id) > cfg.MaxEventIDBytes {
+			c.logf("Ignoring %d byte event id for user %d (max %d)", len(id), c.userID, cfg.MaxEventIDBytes)
+		} else if id != "" {
+			return id
+		}
+	}
+	if cfg.EventIDSequence && msg.seq > 0 {
+		return fmt.Sprintf("%d", msg.seq)
+	}
+	return ""
+}
+
+// writeTimeEvent sends the server's current UTC time so clients can compute
+// their clock offset. It also keeps idle connections alive.
+func writeTimeEvent(w io.Writer, now time.Time) error {
+	now = now.UTC()
+	b, _ := json.Marshal(map[string]interface{}{
+		"server_time": now.Format(time.RFC3339Nano),
+		"unix_ms":     now.UnixMilli(),
+	})
+	return writeEvent(w, "time", string(b))
+}
+
+// writeKeepalive keeps an idle connection alive through proxies, with a
+// comment EventSource ignores or, for clients tracking liveness themselves,
+// an `event: ping` with the server time.
+func writeKeepalive(w io.Writer, now time.Time) error {
+	if cfg.KeepaliveFormat == "event" {
+		return writeEvent(w, "ping", fmt.Sprintf(`{"unix_ms":%d}`, now.UnixMilli()))
+	}
+	_, err := io.WriteString(w, ": keepalive\n\n")
+	return err
+}
+
+// writeReconnectEvent tells the client the server is closing the connection
+// on purpose and how long to wait before reconnecting, both with the SSE
+// retry field (for EventSource) and in the event data.
+func writeReconnectEvent(w io.Writer, reason string, retry time.Duration) error {
+	b, _ := json.Marshal(map[string]interface{}{
+		"retry_after_ms": retry.Milliseconds(),
+		"reason":         reason,
+	})
+	return writeFrame(w, sseFrame{event: "reconnect", data: string(b), retry: retry})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestWriteTimeEvent(t *testing.T) {
+	var b strings.Builder
+	now := time.Date(2024, 3, 1, 12, 30, 0, 500e6, time.FixedZone("CET", 3600))
+	if err := writeTimeEvent(&b, now); err != nil {
+		t.Fatal(err)
+	}
+	want := "event: time\ndata: {\"server_time\":\"2024-03-01T11:30:00.5Z\",\"unix_ms\":1709292600500}\n\n"
+	if b.String() != want {
+		t.Errorf("time event =\n%q\nwant\n%q", b.String(), want)
+	}
+}
+
+func TestStreamSendsPeriodicTimeEvents(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.TimeSyncInterval = 20 * time.Millisecond })
+	s, _ := connect(t, srv, 7, nil)
+
+	for i := 0; i < 2; i++ {
+		ev := s.nextEvent(t, "time")
+		var data struct {
+			UnixMS int64 `json:"unix_ms"`
+		}
+		if err := json.Unmarshal([]byte(ev.data), &data); err != nil {
+			t.Fatalf("time data %q: %v", ev.data, err)
+		}
+		if d := time.Since(time.UnixMilli(data.UnixMS)); d < 0 || d > time.Second {
+			t.Errorf("unix_ms is %v off the local clock", d)
+		}
+	}
+}
+
+func TestEventIDFromPayload(t *testing.T) {
+	useConfig(t, func(c *Config) { c.EventIDField = "id" })
+	c := &SSEClient{}
+
+	tests := []struct {
+		payload, want string
+	}{
+		{`{"id": "evt-1"}`, "evt-1"},
+		{`{"id": 42}`, "42"},
+		{`{"id": "a\nid: injected"}`, "aid: injected"},
+		{`{"other": 1}`, ""},
+		{`plain`, ""},
+	}
+	for _, tt := range tests {
+		if got := c.eventID(sseMessage{payload: tt.payload, seq: 5}); got != tt.want {
+			t.Errorf("eventID(%s) = %q, want %q", tt.payload, got, tt.want)
+		}
+	}
+
+	cfg.EventIDSequence = true
+	if got := c.eventID(sseMessage{payload: `{"other": 1}`, seq: 5}); got != "5" {
+		t.Errorf("eventID without a payload id = %q, want the sequence", got)
+	}
+}
+
+func TestStreamSetsEventIDFromPayload(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.EventIDField = "uuid" })
+	s, _ := connect(t, srv, 7, nil)
+
+	mr.Publish("events:user:7", `{"uuid": "0b5e", "n": 1}`)
+	if ev := s.nextData(t); ev.id != "0b5e" {
+		t.Errorf("id: %q, want the payload's uuid", ev.id)
+	}
+}
+
+func TestOversizedEventIDIgnored(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.EventIDField = "id"
+		c.MaxEventIDBytes = 8
+		c.EventIDSequence = true
+	})
+	c := &SSEClient{}
+	if got := c.eventID(sseMessage{payload: `{"id": "12345678"}`, seq: 3}); got != "12345678" {
+		t.Errorf("id at the limit = %q", got)
+	}
+	if got := c.eventID(sseMessage{payload: `{"id": "123456789"}`, seq: 3}); got != "3" {
+		t.Errorf("id over the limit = %q, want the sequence instead", got)
+	}
+	// The limit is on the id sent, after the line breaks are removed.
+	if got := c.eventID(sseMessage{payload: `{"id": "1234\r\n5678"}`, seq: 3}); got != "12345678" {
+		t.Errorf("id with line breaks = %q", got)
+	}
+}
+
+func TestFrameFieldsStayOnOneLine(t *testing.T) {
+	var b strings.Builder
+	if err := writeFrame(&b, sseFrame{id: "a\nretry: 1", event: "x\r\ndata: forged\x00", data: "line1\nline2"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "id: aretry: 1\nevent: xdata: forged\ndata: line1\ndata: line2\n\n"
+	if b.String() != want {
+		t.Errorf("frame =\n%q\nwant\n%q", b.String(), want)
+	}
+}
+
+func TestStreamIgnoresOversizedEventID(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.EventIDField = "id"
+		c.MaxEventIDBytes = 16
+	})
+	s, _ := connect(t, srv, 1491, nil)
+	mr.Publish("events:user:1491", `{"id": "`+strings.Repeat("x", 1000)+`"}`)
+	mr.Publish("events:user:1491", `{"id": "ok\nid: forged"}`)
+	if ev := s.nextData(t); ev.id != "" {
+		t.Errorf("id: %d bytes, want none", len(ev.id))
+	}
+	if ev := s.nextData(t); ev.id != "okid: forged" {
+		t.Errorf("id: %q", ev.id)
+	}
+}
+
+func TestEmptyPayloadPolicies(t *testing.T) {
+	tests := []struct {
+		policy, payload string
+		want            string
+		ok              bool
+	}{
+		{"skip", "", "", false},
+		{"skip", " \t\r\n", "", false},
+		{"skip", "hi", "hi", true},
+		{"forward", "", "", true},
+		{"forward", "  ", "  ", true},
+		{"forward", "hi", "hi", true},
+		{"placeholder", "", "{}", true},
+		{"placeholder", "\n", "{}", true},
+		{"placeholder", " hi ", " hi ", true},
+	}
+	for _, tt := range tests {
+		useConfig(t, func(c *Config) {
+			c.EmptyPayload = tt.policy
+			c.EmptyPlaceholder = "{}"
+		})
+		if got, ok := emptyPayload(tt.payload); got != tt.want || ok != tt.ok {
+			t.Errorf("%s %q: got %q, %v, want %q, %v", tt.policy, tt.payload, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStreamSkipsEmptyPayloadsByDefault(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 1621, nil)
+	mr.Publish("events:user:1621", "")
+	mr.Publish("events:user:1621", "   ")
+	mr.Publish("events:user:1621", "hi")
+	if ev := s.nextData(t); ev.data != "hi" {
+		t.Errorf("first event %q, want the empty ones skipped", ev.data)
+	}
+}
+
+func TestStreamSendsPlaceholderForEmptyPayloads(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) {
+		c.EmptyPayload = "placeholder"
+		c.EmptyPlaceholder = `{"empty":true}`
+	})
+	s, _ := connect(t, srv, 1622, nil)
+	mr.Publish("events:user:1622", " ")
+	mr.Publish("events:user:1622", "hi")
+	if ev := s.nextData(t); ev.data != `{"empty":true}` {
+		t.Errorf("got %q, want the placeholder", ev.data)
+	}
+	if ev := s.nextData(t); ev.data != "hi" {
+		t.Errorf("got %q", ev.data)
+	}
+}
+
+func TestLongLinePolicies(t *testing.T) {
+	long := strings.Repeat("0123456789", 10)
+	for _, tt := range []struct {
+		policy string
+		want   []string
+	}{
+		{"split", []string{long[:32], long[32:64], long[64:96], long[96:]}},
+		{"truncate", []string{long[:32]}},
+	} {
+		useConfig(t, func(c *Config) {
+			c.MaxLineBytes = 32
+			c.LongLines = tt.policy
+		})
+		lines, err := dataLines("short\n" + long)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.policy, err)
+		}
+		if want := append([]string{"short"}, tt.want...); !reflect.DeepEqual(lines, want) {
+			t.Errorf("%s: lines %q, want %q", tt.policy, lines, want)
+		}
+	}
+
+	useConfig(t, func(c *Config) {
+		c.MaxLineBytes = 32
+		c.LongLines = "reject"
+	})
+	if _, err := dataLines(long); !errors.Is(err, errLineTooLong) {
+		t.Errorf("reject: err = %v, want errLineTooLong", err)
+	}
+	if _, err := dataLines(long[:32]); err != nil {
+		t.Errorf("reject: a line of the maximum refused: %v", err)
+	}
+}
+
+func TestLongLineSplitKeepsCharacters(t *testing.T) {
+	useConfig(t, func(c *Config) { c.MaxLineBytes = 16 })
+	line := strings.Repeat("é", 20)
+	lines, _ := dataLines(line)
+	for _, l := range lines {
+		if len(l) > 16 || !utf8.ValidString(l) {
+			t.Errorf("line %q of %d bytes", l, len(l))
+		}
+	}
+	if strings.Join(lines, "") != line {
+		t.Error("split lines don't add up to the payload")
+	}
+}
+
+func TestStreamSplitsLongLine(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.MaxLineBytes = 1024 })
+	s, _ := connect(t, srv, 1801, nil)
+	long := strings.Repeat("x", 5000)
+	rdb.Publish(ctx, "events:user:1801", long)
+	// EventSource joins the data lines with newlines.
+	ev := s.nextData(t)
+	if strings.ReplaceAll(ev.data, "\n", "") != long || strings.Count(ev.data, "\n") != 4 {
+		t.Errorf("got %d bytes in %d lines", len(ev.data), strings.Count(ev.data, "\n")+1)
+	}
+}
+
+func TestStreamRejectsLongLine(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.MaxLineBytes = 1024
+		c.LongLines = "reject"
+	})
+	s, _ := connect(t, srv, 1802, nil)
+	rdb.Publish(ctx, "events:user:1802", strings.Repeat("x", 5000))
+	rdb.Publish(ctx, "events:user:1802", "next")
+	if ev := s.nextData(t); ev.data != "next" {
+		t.Errorf("got %d bytes, want the long event skipped", len(ev.data))
+	}
+}
+
+func TestLongLinesSplitByDefault(t *testing.T) {
+	useConfig(t, nil)
+	if cfg.LongLines != "split" || cfg.MaxLineBytes != 65536 {
+		t.Errorf("defaults %s at %d bytes, want split at 65536", cfg.LongLines, cfg.MaxLineBytes)
+	}
+}
+
+func TestStripBOM(t *testing.T) {
+	useConfig(t, nil)
+	for payload, want := range map[string]string{
+		"\ufeff{\"a\":1}": `{"a":1}`,
+		"\ufeff\ufeffx":   "\ufeffx",
+		"a\ufeffb":        "a\ufeffb",
+		"plain":           "plain",
+	} {
+		if got := stripBOM(payload); got != want {
+			t.Errorf("stripBOM(%q) = %q, want %q", payload, got, want)
+		}
+	}
+	useConfig(t, func(c *Config) { c.StripBOM = false })
+	if got := stripBOM("\ufeffx"); got != "\ufeffx" {
+		t.Errorf("BOM removed with GO_SSE_SIDECAR_STRIP_BOM off: %q", got)
+	}
+}
+
+func TestStreamStripsBOMWithCharset(t *testing.T) {
+	mr, srv := newSidecar(t, func(c *Config) { c.SnapshotKey = "state:{user_id}" })
+	mr.Set("state:1841", "\ufeff{\"unread\":1}")
+	s, _ := connect(t, srv, 1841, nil)
+	if ct := s.resp.Header.Get("Content-Type"); ct != "text/event-stream; charset=utf-8" {
+		t.Errorf("Content-Type %q, want the utf-8 charset", ct)
+	}
+	if ev := s.nextEvent(t, "snapshot"); ev.data != `{"unread":1}` {
+		t.Errorf("snapshot %q, want it without the BOM", ev.data)
+	}
+	rdb.Publish(ctx, "events:user:1841", "\ufeff{\"n\":1}")
+	ev := s.nextData(t)
+	if ev.data != `{"n":1}` {
+		t.Errorf("got %q, want the payload without the BOM", ev.data)
+	}
+	if !json.Valid([]byte(ev.data)) {
+		t.Error("payload not parseable as JSON")
+	}
+}
+
+func TestStreamKeepsBOMWhenDisabled(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.StripBOM = false })
+	s, _ := connect(t, srv, 1842, nil)
+	rdb.Publish(ctx, "events:user:1842", "\ufeffkept")
+	if ev := s.nextData(t); ev.data != "\ufeffkept" {
+		t.Errorf("got %q with GO_SSE_SIDECAR_STRIP_BOM off", ev.data)
+	}
+}
+
+func TestNewlinesNormalized(t *testing.T) {
+	useConfig(t, nil)
+	for _, tt := range []struct{ name, data string }{
+		{"crlf", "one\r\ntwo\r\nthree"},
+		{"cr", "one\rtwo\rthree"},
+		{"mixed", "one\r\ntwo\rthree"},
+		{"lf", "one\ntwo\nthree"},
+	} {
+		var b strings.Builder
+		if err := writeFrame(&b, sseFrame{data: tt.data}); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.String(); got != "data: one\ndata: two\ndata: three\n\n" {
+			t.Errorf("%s: framed as %q", tt.name, got)
+		}
+	}
+	// CRLF, unlike two line breaks, doesn't end the event early.
+	var b strings.Builder
+	writeFrame(&b, sseFrame{data: "a\r\n\r\nb"})
+	if got := b.String(); got != "data: a\ndata: \ndata: b\n\n" {
+		t.Errorf("blank line framed as %q", got)
+	}
+}
+
+func TestNewlinesKeptWhenDisabled(t *testing.T) {
+	useConfig(t, func(c *Config) { c.NormalizeNewlines = false })
+	var b strings.Builder
+	writeFrame(&b, sseFrame{data: "one\rtwo"})
+	if got := b.String(); got != "data: one\rtwo\n\n" {
+		t.Errorf("framed as %q with GO_SSE_SIDECAR_NORMALIZE_NEWLINES off", got)
+	}
+}
+
+func TestStreamNormalizesNewlines(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	s, _ := connect(t, srv, 2131, nil)
+	rdb.Publish(ctx, "events:user:2131", "first\r\nsecond\rthird")
+	if ev := s.nextData(t); ev.data != "first\nsecond\nthird" {
+		t.Errorf("got %q", ev.data)
+	}
+}
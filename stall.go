@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// stallUnsupported logs only once that stalled writes can't be aborted.
+var stallUnsupported sync.Once
+
+// stallGuard detects a client that stopped reading, ex: one advertising a
+// TCP zero window: a write or flush still blocked after the stall timeout.
+// Such a write doesn't fail on its own and canceling the connection's
+// context doesn't unblock it, so the guard moves the write deadline to now.
+type stallGuard struct {
+	w       io.Writer
+	flusher http.Flusher
+	rc      *http.ResponseController
+
+	mu sync.Mutex
+	// since is when the write in progress started, zero between writes.
+	since time.Time
+}
+
+// newStallGuard wraps out, which writes to w. It returns nil when w can't
+// take write deadlines.
+func newStallGuard(w http.ResponseWriter, out io.Writer, flusher http.Flusher) *stallGuard {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		stallUnsupported.Do(func() {
+			log.Printf("[SSE] Response writer doesn't support write deadlines, GO_SSE_SIDECAR_STALL_TIMEOUT is ignored")
+		})
+		return nil
+	}
+	return &stallGuard{w: out, flusher: flusher, rc: rc}
+}
+
+func (g *stallGuard) Write(p []byte) (n int, err error) {
+	g.busy(func() { n, err = g.w.Write(p) })
+	return n, err
+}
+
+func (g *stallGuard) Flush() {
+	g.busy(g.flusher.Flush)
+}
+
+func (g *stallGuard) busy(f func()) {
+	g.mu.Lock()
+	g.since = time.Now()
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.since = time.Time{}
+		g.mu.Unlock()
+	}()
+	f()
+}
+
+// watch calls onStall and aborts the blocked write once a write takes longer
+// than timeout, until ctx is done.
+func (g *stallGuard) watch(ctx context.Context, timeout time.Duration, onStall func()) {
+	ticker := time.NewTicker(max(timeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			g.mu.Lock()
+			stalled := !g.since.IsZero() && now.Sub(g.since) >= timeout
+			g.mu.Unlock()
+			if stalled {
+				onStall()
+				g.rc.SetWriteDeadline(now)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
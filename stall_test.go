@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nonReadingClient opens a stream for userID over a connection it never
+// reads from, so the sidecar's writes block once the TCP buffers are full.
+func nonReadingClient(t *testing.T, srvAddr string, userID int64) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srvAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	q := url.Values{"ssetoken": {token(t, userID, nil)}}
+	fmt.Fprintf(conn, "GET /sse-events?%s HTTP/1.1\r\nHost: sidecar\r\n\r\n", q.Encode())
+}
+
+func TestNonReadingClientReaped(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.StallTimeout = 200 * time.Millisecond })
+	nonReadingClient(t, srv.Listener.Addr().String(), 1911)
+	waitFor(t, "the stream", func() bool { return len(registry.forUser("", 1911)) == 1 })
+
+	stalled := closeCounts.counter("stalled").Load()
+	payload := strings.Repeat("x", 32<<10)
+	deadline := time.Now().Add(10 * time.Second)
+	for len(registry.forUser("", 1911)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client that stopped reading still connected")
+		}
+		rdb.Publish(ctx, "events:user:1911", payload)
+		time.Sleep(time.Millisecond)
+	}
+	if n := closeCounts.counter("stalled").Load() - stalled; n != 1 {
+		t.Errorf("%d stalled closes counted, want 1", n)
+	}
+}
+
+func TestReadingClientNotReaped(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.StallTimeout = 100 * time.Millisecond })
+	s, _ := connect(t, srv, 1912, nil)
+	// Idle past the timeout: only a blocked write counts as a stall.
+	time.Sleep(300 * time.Millisecond)
+	rdb.Publish(ctx, "events:user:1912", "still here")
+	if ev := s.nextData(t); ev.data != "still here" {
+		t.Errorf("got %q", ev.data)
+	}
+}
+
+func TestStallTimeoutDefault(t *testing.T) {
+	useConfig(t, nil)
+	if cfg.StallTimeout != time.Minute {
+		t.Errorf("default %v, want 1m", cfg.StallTimeout)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// writeStatsEvent sends the connection's running counters so the client can
+// tell whether the server drops its events: the messages written and
+// dropped since the connection opened.
+func (c *SSEClient) writeStatsEvent(w io.Writer) error {
+	return writeEvent(w, "stats", fmt.Sprintf(`{"delivered":%d,"dropped":%d}`, c.delivered.Load(), c.dropped.Load()))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type statsData struct {
+	Delivered int64 `json:"delivered"`
+	Dropped   int64 `json:"dropped"`
+}
+
+// nextStats skips to the next `event: stats` reporting want.
+func (s *sseStream) nextStats(t *testing.T, want statsData) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	var got statsData
+	for time.Now().Before(deadline) {
+		ev := s.nextEvent(t, "stats")
+		if err := json.Unmarshal([]byte(ev.data), &got); err != nil {
+			t.Fatalf("stats data %q: %v", ev.data, err)
+		}
+		if got == want {
+			return
+		}
+	}
+	t.Fatalf("stats %+v, want %+v", got, want)
+}
+
+func TestStatsReflectDeliveredAndDropped(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.StatsInterval = 30 * time.Millisecond
+		c.QueueSize = 2
+	})
+	s, conn := connect(t, srv, 2301, nil)
+	s.nextStats(t, statsData{})
+
+	// Paused, two fit in the queue and three are dropped.
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	for i := 0; i < 5; i++ {
+		rdb.Publish(ctx, "events:user:2301", "m")
+	}
+	waitFor(t, "the drops", func() bool { return registry.get(conn).dropped.Load() == 3 })
+	s.nextStats(t, statsData{Dropped: 3})
+
+	delivery.set(false)
+	for i := 0; i < 2; i++ {
+		s.nextData(t)
+	}
+	s.nextStats(t, statsData{Delivered: 2, Dropped: 3})
+}
+
+func TestStatsArePerConnection(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.StatsInterval = 30 * time.Millisecond })
+	a, _ := connect(t, srv, 2302, nil)
+	b, _ := connect(t, srv, 2303, nil)
+	rdb.Publish(ctx, "events:user:2302", "for a")
+	a.nextData(t)
+	a.nextStats(t, statsData{Delivered: 1})
+	b.nextStats(t, statsData{})
+}
+
+func TestNoStatsByDefault(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.TimeSyncInterval = 20 * time.Millisecond })
+	s, _ := connect(t, srv, 2304, nil)
+	// Several time events in, none of them stats.
+	for i := 0; i < 3; i++ {
+		if ev := s.next(t); ev.event == "stats" {
+			t.Fatalf("stats sent without GO_SSE_SIDECAR_STATS_INTERVAL: %s", ev.data)
+		}
+	}
+	endConnections(t)
+	useConfig(t, func(c *Config) { c.StatsInterval = time.Second })
+	if js := clientJS(t); !strings.Contains(js, `"stats"`) {
+		t.Error("client.js doesn't listen to stats once enabled")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func userChannel(userID int64) string {
+	return fmt.Sprintf("events:user:%d", userID)
+}
+
+func teamChannel(teamID int64) string {
+	return fmt.Sprintf("events:team:%d", teamID)
+}
+
+// subscriptionChannels returns the Redis channels a user's connection listens
+// on. Team membership only comes from the signed token.
+func subscriptionChannels(claims *SSETokenClaims, feed *feedConfig) []string {
+	if feed != nil {
+		return []string{expandUserID(feed.channel, claims.UserID)}
+	}
+	channels := []string{userChannel(claims.UserID)}
+	for _, team := range claims.Teams {
+		channels = append(channels, teamChannel(team))
+	}
+	if cfg.BroadcastChannel != "" {
+		channels = append(channels, cfg.BroadcastChannel)
+	}
+	return channels
+}
+
+// confirmSubscription reads until every channel's subscription is confirmed.
+// A message can be received before the last confirmation, so those are
+// returned to be delivered instead of being lost.
+func confirmSubscription(ctx context.Context, pubsub *redis.PubSub, channels int) ([]*redis.Message, error) {
+	var early []*redis.Message
+	for confirmed := 0; confirmed < channels; {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				confirmed++
+			}
+		case *redis.Message:
+			early = append(early, m)
+		}
+	}
+	return early, nil
+}
+
+// probePrefix starts the warmup probes, which are never delivered. Other
+// connections of the same user receive them too.
+const probePrefix = "__sse_sidecar_probe:"
+
+// awaitProbe publishes a probe to the user's channel and reads until it comes
+// back, which proves the subscription delivers messages. Messages received
+// before it are returned to be delivered.
+func awaitProbe(ctx context.Context, rdb *redis.Client, sub *subscriber, client *SSEClient) ([]*redis.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.WarmupTimeout)
+	defer cancel()
+
+	probe := probePrefix + client.id
+	if err := rdb.Publish(ctx, client.qualify(client.userChannel()), probe).Err(); err != nil {
+		return nil, err
+	}
+	var early []*redis.Message
+	for {
+		select {
+		case m := <-sub.messages:
+			if m.Payload == probe {
+				return early, nil
+			}
+			early = append(early, m)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// runSubscription runs subscribeToUserChannel, and returns a channel closed
+// once it returned.
+func runSubscription(rdb *redis.Client, client *SSEClient, ctx context.Context, subscribed chan<- error) <-chan struct{} {
+	done := make(chan struct{})
+	// Counted until it returns, also when stopSubscription gives up on it.
+	goConn(func() {
+		defer close(done)
+		subscribeToUserChannel(rdb, client, ctx, subscribed)
+	})
+	return done
+}
+
+// stopSubscription cancels the subscription's context and waits up to
+// cfg.SubscriberStopTimeout for its Redis connections to close, so a closed
+// connection doesn't leave the subscription running or queue messages after
+// it was cleaned up.
+func stopSubscription(client *SSEClient, cancel context.CancelFunc, done <-chan struct{}) {
+	cancel()
+	timer := time.NewTimer(cfg.SubscriberStopTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		metrics.subscribersLingering.Add(1)
+		client.logf("Subscription of user %d still running %v after closing", client.userID, cfg.SubscriberStopTimeout)
+	}
+}
+
+// subscribeToUserChannel forwards the messages of the client's channels until
+// ctx is done. The outcome of the subscription is sent on subscribed once
+// Redis confirmed (or refused) it.
+func subscribeToUserChannel(rdb *redis.Client, client *SSEClient, ctx context.Context, subscribed chan<- error) {
+	userID := client.userID
+	channelNames := client.channels
+	client.lifecyclef("Subscribing to Redis channels: %s", strings.Join(channelNames, ", "))
+
+	hybrid := newHybridPoller(ctx, rdb, client)
+
+	sub := newSubscriber(ctx, rdb, client)
+	defer sub.close()
+
+	release, err := acquireSubscribe(ctx)
+	if err != nil {
+		client.logf("Not subscribing user %d: %v", userID, err)
+		subscribed <- err
+		return
+	}
+
+	// Wait for subscription confirmation
+	early, err := sub.subscribe(ctx, channelNames...)
+	if err != nil {
+		release()
+		client.logf("Failed to subscribe to %s: %v", strings.Join(channelNames, ", "), err)
+		subscribed <- err
+		return
+	}
+	if cfg.WarmupTimeout > 0 {
+		more, err := awaitProbe(ctx, rdb, sub, client)
+		if err != nil {
+			release()
+			client.logf("Subscription warmup failed for user %d: %v", userID, err)
+			subscribed <- err
+			return
+		}
+		early = append(early, more...)
+	}
+	release()
+	subscribed <- nil
+
+	client.setSubscriber(sub)
+
+	// The snapshot goes first, then the history, then live messages.
+	if cfg.SnapshotKey != "" {
+		if snapshot, ok := fetchSnapshot(ctx, rdb, client); ok {
+			client.enqueue(sseMessage{event: "snapshot", payload: stripBOM(snapshot)})
+		}
+	}
+
+	var backfilled map[string]int
+	if n := client.backfill(); n > 0 {
+		backfilled = backfillHistory(ctx, rdb, client, n)
+	}
+	if cfg.PersistOnShutdown > 0 {
+		replayPending(ctx, rdb, client)
+	}
+	if cfg.CaughtUp {
+		sendCaughtUp(ctx, client, backfilled)
+	}
+
+	seqs := newSequenceChecker()
+	reorder := newReorderBuffer(cfg.ReorderWindow, cfg.ReorderMax)
+	var reorderTick <-chan time.Time
+	if reorder != nil {
+		ticker := time.NewTicker(max(cfg.ReorderWindow/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		reorderTick = ticker.C
+	}
+
+	forward := func(msg *redis.Message) {
+		seqs.check(client, msg.Channel, msg.Payload)
+		// The channel is the one the message was published on, also when a
+		// pattern matched it.
+		queued, ok := client.receive(sseMessage{channel: msg.Channel, pattern: msg.Pattern, payload: msg.Payload})
+		if !ok {
+			return
+		}
+		client.logf("User %d received message: %s", userID, queued.payload)
+		client.enqueue(queued)
+	}
+
+	deliver := func(msg *redis.Message) {
+		if strings.HasPrefix(msg.Payload, probePrefix) {
+			return
+		}
+		if msg.Channel == cfg.PresenceChannel && !client.watchesPresence(msg.Payload) {
+			return
+		}
+		// Messages published between SUBSCRIBE and LRANGE arrive first,
+		// so the handoff ends with the first message not in the backfill.
+		if backfilled != nil {
+			if backfilled[msg.Payload] > 0 {
+				backfilled[msg.Payload]--
+				client.logf("Skipping live message already backfilled for user %d", userID)
+				return
+			}
+			backfilled = nil
+		}
+		if msg.Channel == client.userChannel() && !hybrid.first(msg.Payload) {
+			client.logf("Skipping live message already recovered by polling for user %d", userID)
+			return
+		}
+		for _, ready := range reorder.push(msg, time.Now()) {
+			forward(ready)
+		}
+	}
+
+	for _, msg := range early {
+		deliver(msg)
+	}
+
+	var hybridTick <-chan time.Time
+	if hybrid != nil {
+		ticker := time.NewTicker(cfg.HybridInterval)
+		defer ticker.Stop()
+		hybridTick = ticker.C
+	}
+
+	for {
+		select {
+		case msg := <-sub.messages:
+			deliver(msg)
+		case <-hybridTick:
+			for _, payload := range hybrid.poll(ctx, rdb, client) {
+				metrics.hybridRecovered.Add(1)
+				client.logf("Recovered message missed by pub/sub for user %d", userID)
+				for _, ready := range reorder.push(&redis.Message{Channel: client.userChannel(), Payload: payload}, time.Now()) {
+					forward(ready)
+				}
+			}
+		case now := <-reorderTick:
+			for _, ready := range reorder.expired(now) {
+				forward(ready)
+			}
+		case <-ctx.Done():
+			client.lifecyclef("Stopping subscription for user %d", userID)
+			return
+		}
+	}
+}
+
+// sequenceChecker detects gaps and reordering in the sequence numbers the
+// publishers put in a payload field (GO_SSE_SIDECAR_SOURCE_SEQ_FIELD), per
+// channel of one connection.
+type sequenceChecker struct {
+	last map[string]int64
+}
+
+func newSequenceChecker() *sequenceChecker {
+	if cfg.SourceSeqField == "" {
+		return nil
+	}
+	return &sequenceChecker{last: make(map[string]int64)}
+}
+
+func (s *sequenceChecker) check(client *SSEClient, channel, payload string) {
+	if s == nil {
+		return
+	}
+	seq, ok := sourceSeq(payload)
+	if !ok {
+		return
+	}
+
+	last, seen := s.last[channel]
+	switch {
+	case !seen:
+	case seq <= last:
+		metrics.sequenceOutOfOrder.Add(1)
+		client.logf("Out of order message on %s: sequence %d after %d", channel, seq, last)
+		return
+	case seq > last+1:
+		metrics.sequenceGaps.Add(1)
+		client.logf("Gap on %s: sequence %d after %d", channel, seq, last)
+	}
+	s.last[channel] = seq
+}
+
+// sourceSeq returns the publisher's sequence number in payload.
+func sourceSeq(payload string) (int64, bool) {
+	seq, err := strconv.ParseInt(payloadScalar(payload, cfg.SourceSeqField), 10, 64)
+	return seq, err == nil
+}
+
+// backlogMonitor warns when go-redis's subscription buffer fills up. Once it's
+// full for cfg.PubSubSendTimeout, go-redis drops messages without the sidecar
+// seeing them, so the warning is the only trace of the loss to come. It warns
+// again only after the backlog went back down.
+type backlogMonitor struct {
+	high, low int
+	warned    bool
+}
+
+func newBacklogMonitor(size int) *backlogMonitor {
+	return &backlogMonitor{high: max(size*3/4, 1), low: size / 4}
+}
+
+func (b *backlogMonitor) check(client *SSEClient, queued int) {
+	switch {
+	case !b.warned && queued >= b.high:
+		b.warned = true
+		metrics.pubsubBacklogWarnings.Add(1)
+		client.logf("Slow consumer: %d messages waiting in the Redis subscription buffer, go-redis drops messages once it stays full for %v", queued, cfg.PubSubSendTimeout)
+	case b.warned && queued <= b.low:
+		b.warned = false
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestConfirmSubscriptionKeepsEarlyMessages(t *testing.T) {
+	useConfig(t, nil)
+	mr := useRedis(t)
+	pubsub := rdb.Subscribe(ctx, "a", "b")
+	defer pubsub.Close()
+
+	// The message arrives between the confirmations: after those of a and b,
+	// before the one of c.
+	waitFor(t, "the subscription", func() bool { return mr.PubSubNumSub("b")["b"] == 1 })
+	mr.Publish("a", "first")
+	if err := pubsub.Subscribe(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	early, err := confirmSubscription(ctx, pubsub, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(early) != 1 || early[0].Channel != "a" || early[0].Payload != "first" {
+		t.Fatalf("early messages = %v, want the one published before the last confirmation", early)
+	}
+
+	// Nothing else is pending: the next read is the next message.
+	mr.Publish("c", "second")
+	msg, err := pubsub.ReceiveMessage(ctx)
+	if err != nil || msg.Payload != "second" {
+		t.Fatalf("next message = %v, %v", msg, err)
+	}
+}
+
+func TestConfirmSubscriptionFailsOnClosedConnection(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer client.Close()
+	pubsub := client.Subscribe(ctx, "a")
+	defer pubsub.Close()
+	mr.Close()
+
+	if _, err := confirmSubscription(ctx, pubsub, 1); err == nil {
+		t.Fatal("confirmed a subscription without Redis")
+	}
+}
+
+func TestFirstEventAfterSubscribeDelivered(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	s := openStream(t, srv, map[string][]string{"ssetoken": {token(t, 7, nil)}})
+
+	// Published as soon as Redis has the subscription, possibly before the
+	// sidecar read the confirmation.
+	waitFor(t, "the subscription", func() bool { return mr.PubSubNumSub("events:user:7")["events:user:7"] == 1 })
+	mr.Publish("events:user:7", "first")
+	if ev := s.nextData(t); ev.data != "first" {
+		t.Fatalf("first event = %q", ev.data)
+	}
+}
+
+func TestSequenceCheckerCountsGapsAndReordering(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SourceSeqField = "seq" })
+	tests := []struct {
+		name           string
+		seqs           []string
+		gaps, reorders int64
+	}{
+		{"in order", []string{"1", "2", "3"}, 0, 0},
+		{"gap", []string{"1", "2", "5", "6"}, 1, 0},
+		{"reordered", []string{"1", "3", "2", "4"}, 1, 1},
+		{"duplicate", []string{"1", "1", "2"}, 0, 1},
+		{"no sequence", []string{"", "x", "1"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &SSEClient{id: "seq-test"}
+			s := newSequenceChecker()
+			gaps, reorders := metrics.sequenceGaps.Load(), metrics.sequenceOutOfOrder.Load()
+			for _, seq := range tt.seqs {
+				s.check(c, "events:user:1", `{"seq": `+strconv.Quote(seq)+`}`)
+			}
+			if got := metrics.sequenceGaps.Load() - gaps; got != tt.gaps {
+				t.Errorf("gaps = %d, want %d", got, tt.gaps)
+			}
+			if got := metrics.sequenceOutOfOrder.Load() - reorders; got != tt.reorders {
+				t.Errorf("out of order = %d, want %d", got, tt.reorders)
+			}
+		})
+	}
+}
+
+func TestSequenceCheckedPerChannel(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SourceSeqField = "seq" })
+	c := &SSEClient{id: "seq-test"}
+	s := newSequenceChecker()
+	gaps := metrics.sequenceGaps.Load()
+	s.check(c, "a", `{"seq": 1}`)
+	s.check(c, "b", `{"seq": 7}`)
+	s.check(c, "a", `{"seq": 2}`)
+	s.check(c, "b", `{"seq": 8}`)
+	if got := metrics.sequenceGaps.Load() - gaps; got != 0 {
+		t.Errorf("%d gaps across two ordered channels", got)
+	}
+}
+
+func TestQueueSequenceSurvivesSourceReordering(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.SourceSeqField = "seq"
+		c.EventIDSequence = true
+	})
+	s, _ := connect(t, srv, 1291, nil)
+	gaps, reorders := metrics.sequenceGaps.Load(), metrics.sequenceOutOfOrder.Load()
+
+	for _, seq := range []int{1, 2, 4, 3} {
+		rdb.Publish(ctx, "events:user:1291", fmt.Sprintf(`{"seq": %d}`, seq))
+	}
+	// The stream's ids count what was queued for the connection, whatever
+	// order the publisher's numbers came in.
+	for i := 1; i <= 4; i++ {
+		if ev := s.nextData(t); ev.id != strconv.Itoa(i) {
+			t.Fatalf("event %d has id %q (%s)", i, ev.id, ev.data)
+		}
+	}
+	if got := metrics.sequenceGaps.Load() - gaps; got != 1 {
+		t.Errorf("gaps = %d, want 1", got)
+	}
+	if got := metrics.sequenceOutOfOrder.Load() - reorders; got != 1 {
+		t.Errorf("out of order = %d, want 1", got)
+	}
+}
+
+func TestTeamMessagesReachConnectedMembers(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		c.ChannelEventNames = true
+		c.ChannelEventMap = parseChannelMap("GO_SSE_SIDECAR_CHANNEL_EVENT_MAP", "events:team:*=team")
+	})
+	alice, _ := connect(t, srv, 1371, url.Values{"ssetoken": {token(t, 1371, jwt.MapClaims{"teams": []int64{10, 11}})}})
+	bob, _ := connect(t, srv, 1372, url.Values{"ssetoken": {token(t, 1372, jwt.MapClaims{"teams": []int64{11}})}})
+	carol, _ := connect(t, srv, 1373, nil)
+
+	rdb.Publish(ctx, "events:team:11", "build finished")
+	for name, s := range map[string]*sseStream{"alice": alice, "bob": bob} {
+		if ev := s.nextData(t); ev.event != "team" || ev.data != "build finished" {
+			t.Errorf("%s got event %q data %q", name, ev.event, ev.data)
+		}
+	}
+
+	// Only members get a team's messages, the next one carol sees is her own.
+	rdb.Publish(ctx, "events:team:10", "alice only")
+	rdb.Publish(ctx, "events:user:1373", "for carol")
+	if ev := carol.nextData(t); ev.data != "for carol" {
+		t.Errorf("non-member got %q", ev.data)
+	}
+	if ev := alice.nextData(t); ev.data != "alice only" {
+		t.Errorf("alice got %q", ev.data)
+	}
+}
+
+func TestTeamsOnlyFromSignedToken(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	// A teams query parameter is no way in.
+	connect(t, srv, 1374, url.Values{"teams": {"12"}, "team": {"12"}})
+	waitFor(t, "the subscription", func() bool { return mr.PubSubNumSub("events:user:1374")["events:user:1374"] == 1 })
+	if n := mr.PubSubNumSub("events:team:12")["events:team:12"]; n != 0 {
+		t.Errorf("%d subscriptions to a team from the query", n)
+	}
+
+	// Nor is a token claiming the team with another key.
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": 1374,
+		"teams":   []int64{12},
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("not-the-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {forged}}.Encode(), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("forged token: %s, want 401", resp.Status)
+	}
+}
+
+func TestWarmupNoLossRightAfterConnect(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.WarmupTimeout = time.Second })
+	for i := 0; i < 5; i++ {
+		s := openStream(t, srv, url.Values{"ssetoken": {token(t, 1541, nil)}})
+		s.nextEvent(t, "connected")
+		// No wait for the subscription: connected means it is live.
+		rdb.Publish(ctx, "events:user:1541", fmt.Sprint("first-", i))
+		if ev := s.nextData(t); ev.data != fmt.Sprint("first-", i) {
+			t.Fatalf("connection %d got %+v first", i, ev)
+		}
+	}
+}
+
+func TestWarmupProbeNotDelivered(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.WarmupTimeout = time.Second })
+	first, _ := connect(t, srv, 1542, nil)
+	// The second connection's probe reaches the first one too.
+	connect(t, srv, 1542, nil)
+	rdb.Publish(ctx, "events:user:1542", "real")
+	if ev := first.nextData(t); ev.data != "real" {
+		t.Errorf("got %+v, want the probe skipped", ev)
+	}
+}
+
+func TestWarmupTimesOut(t *testing.T) {
+	useConfig(t, func(c *Config) { c.WarmupTimeout = 100 * time.Millisecond })
+	useRedis(t)
+	client := &SSEClient{id: "warmup-timeout", userID: 1543}
+	sub := newSubscriber(ctx, rdb, client)
+	defer sub.close()
+	// Subscribed elsewhere, the probe never comes back.
+	if _, err := sub.subscribe(ctx, "events:user:other"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := awaitProbe(ctx, rdb, sub, client); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the warmup timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("gave up after %v", d)
+	}
+}
+
+func TestRapidConnectDisconnectLeavesNothingRunning(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	// The first stream starts the sidecar's own background goroutines.
+	s, _ := connect(t, srv, 2171, nil)
+	s.resp.Body.Close()
+	waitFor(t, "the first stream closed", func() bool { return len(registry.forUser("", 2171)) == 0 })
+	http.DefaultClient.CloseIdleConnections()
+	time.Sleep(50 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 30; i++ {
+		s, _ := connect(t, srv, 2171, nil)
+		s.resp.Body.Close()
+	}
+	waitFor(t, "every stream closed", func() bool {
+		return len(registry.forUser("", 2171)) == 0 && mr.PubSubNumSub("events:user:2171")["events:user:2171"] == 0
+	})
+	http.DefaultClient.CloseIdleConnections()
+	waitFor(t, "the goroutines back to the baseline", func() bool { return runtime.NumGoroutine() <= baseline })
+}
+
+func TestStopSubscriptionWaitsForIt(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SubscriberStopTimeout = time.Second })
+	sctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		<-sctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		close(done)
+	}()
+	lingering := metrics.subscribersLingering.Load()
+	stopSubscription(&SSEClient{userID: 2172}, cancel, done)
+	select {
+	case <-done:
+	default:
+		t.Fatal("returned before the subscription stopped")
+	}
+	if metrics.subscribersLingering.Load() != lingering {
+		t.Error("a stopped subscription counted as lingering")
+	}
+}
+
+func TestStopSubscriptionBounded(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SubscriberStopTimeout = 20 * time.Millisecond })
+	lingering := metrics.subscribersLingering.Load()
+	start := time.Now()
+	stopSubscription(&SSEClient{userID: 2173}, func() {}, make(chan struct{}))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for a stuck subscription", elapsed)
+	}
+	if n := metrics.subscribersLingering.Load() - lingering; n != 1 {
+		t.Errorf("%d lingering subscriptions counted", n)
+	}
+}
+
+// goneWriter is the response writer of a client that went away: every
+// write fails, and is counted.
+type goneWriter struct {
+	header http.Header
+	writes int
+}
+
+func (w *goneWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *goneWriter) Write([]byte) (int, error) {
+	w.writes++
+	return 0, errors.New("write: broken pipe")
+}
+
+func (w *goneWriter) WriteHeader(int) { w.writes++ }
+
+func (w *goneWriter) Flush() {}
+
+func TestGoneClientNotSubscribed(t *testing.T) {
+	mr, _ := newSidecar(t, nil)
+	abandoned := metrics.abandoned.Load()
+	gone, cancel := context.WithCancel(ctx)
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/sse-events?"+url.Values{"ssetoken": {token(t, 2201, nil)}}.Encode(), nil)
+	w := &goneWriter{}
+	sseHandler(w, r.WithContext(gone))
+
+	if w.writes != 0 {
+		t.Errorf("%d writes to a client that went away", w.writes)
+	}
+	if n := mr.PubSubNumSub("events:user:2201")["events:user:2201"]; n != 0 {
+		t.Errorf("%d subscriptions for a client that went away", n)
+	}
+	if len(registry.forUser("", 2201)) != 0 {
+		t.Error("connection registered")
+	}
+	if n := metrics.abandoned.Load() - abandoned; n != 1 {
+		t.Errorf("%d abandoned connections counted, want 1", n)
+	}
+}
+
+func TestClientGoneDuringSetupCounted(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	useSlowSubscribe(t, mr, 300*time.Millisecond)
+	abandoned := metrics.abandoned.Load()
+
+	rctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(rctx, http.MethodGet, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, 2202, nil)}}.Encode(), nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("answered %s before subscribing", resp.Status)
+	}
+	waitFor(t, "the abandoned setup counted", func() bool { return metrics.abandoned.Load()-abandoned == 1 })
+	waitFor(t, "nothing left of it", func() bool {
+		return len(registry.forUser("", 2202)) == 0 && mr.PubSubNumSub("events:user:2202")["events:user:2202"] == 0
+	})
+	if m := scrape(t, srv); m["sse_connections_abandoned_total"] < 1 {
+		t.Errorf("sse_connections_abandoned_total %v", m["sse_connections_abandoned_total"])
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errSubscribeBusy is returned when a subscription waited its
+// cfg.SubscribeQueueTimeout for one of cfg.MaxConcurrentSubscribes.
+var errSubscribeBusy = errors.New("too many subscriptions being set up")
+
+// subscribeSlots bounds the subscriptions being set up at once, so a
+// reconnect storm (ex: after a deploy) reaches Redis gradually. Nil is no
+// limit.
+var subscribeSlots chan struct{}
+
+// acquireSubscribe waits for a free slot, and returns the function
+// releasing it.
+func acquireSubscribe(ctx context.Context) (func(), error) {
+	if subscribeSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case subscribeSlots <- struct{}{}:
+		return func() { <-subscribeSlots }, nil
+	default:
+	}
+
+	metrics.subscribesQueued.Add(1)
+	timeout := time.NewTimer(cfg.SubscribeQueueTimeout)
+	defer timeout.Stop()
+	select {
+	case subscribeSlots <- struct{}{}:
+		return func() { <-subscribeSlots }, nil
+	case <-timeout.C:
+		metrics.subscribesRefused.Add(1)
+		return nil, errSubscribeBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refuseSubscription answers a request whose subscription failed.
+func refuseSubscription(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSubscribeBusy) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many connections being set up, retry", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Subscription failed", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useSubscribeSlots limits the subscriptions set up at once to n for the
+// test, as main does with GO_SSE_SIDECAR_MAX_CONCURRENT_SUBSCRIBES.
+func useSubscribeSlots(t *testing.T, n int) {
+	t.Helper()
+	old := subscribeSlots
+	subscribeSlots = make(chan struct{}, n)
+	t.Cleanup(func() { subscribeSlots = old })
+}
+
+func TestSubscribeBurstCapped(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SubscribeQueueTimeout = 5 * time.Second })
+	useSubscribeSlots(t, 3)
+
+	queued := metrics.subscribesQueued.Load()
+	var mu sync.Mutex
+	active, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := acquireSubscribe(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			active++
+			peak = max(peak, active)
+			mu.Unlock()
+			time.Sleep(30 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			release()
+		}()
+	}
+	wg.Wait()
+	if peak != 3 {
+		t.Errorf("%d subscriptions set up at once, want 3", peak)
+	}
+	if metrics.subscribesQueued.Load() == queued {
+		t.Error("no subscription queued")
+	}
+}
+
+func TestSubscribeRefusedAfterQueueTimeout(t *testing.T) {
+	useConfig(t, func(c *Config) { c.SubscribeQueueTimeout = 20 * time.Millisecond })
+	useSubscribeSlots(t, 1)
+	release, err := acquireSubscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := metrics.subscribesRefused.Load()
+	if _, err := acquireSubscribe(ctx); !errors.Is(err, errSubscribeBusy) {
+		t.Errorf("err = %v, want errSubscribeBusy", err)
+	}
+	if n := metrics.subscribesRefused.Load() - refused; n != 1 {
+		t.Errorf("%d refusals counted", n)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := acquireSubscribe(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v for a canceled request", err)
+	}
+	release()
+	if release, err := acquireSubscribe(ctx); err != nil {
+		t.Errorf("slot not released: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestStreamRetriesWhenSubscribesBusy(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.SubscribeQueueTimeout = 20 * time.Millisecond })
+	useSubscribeSlots(t, 1)
+	subscribeSlots <- struct{}{}
+
+	resp := get(t, srv.URL+"/sse-events?"+url.Values{"ssetoken": {token(t, 2021, nil)}}.Encode(), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("%s, Retry-After %q, want 503 to retry in 1s", resp.Status, resp.Header.Get("Retry-After"))
+	}
+	<-subscribeSlots
+	connect(t, srv, 2021, nil)
+	// The live stream gave its slot back.
+	if n := len(subscribeSlots); n != 0 {
+		t.Errorf("%d slots held after the setup", n)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// subscriber holds a connection's Redis subscriptions. Channels are spread
+// over pub/sub connections (shards) of at most cfg.PubSubMaxChannels channels
+// each, a new one being opened when the others are full, and the messages of
+// all shards are merged into messages.
+type subscriber struct {
+	rdb    *redis.Client
+	client *SSEClient
+	ctx    context.Context
+	// messages is unbuffered: each shard's go-redis buffer holds the backlog.
+	messages chan *redis.Message
+
+	mu     sync.Mutex
+	shards []*pubsubShard
+	// forwarding counts the shards' forward goroutines.
+	forwarding sync.WaitGroup
+}
+
+type pubsubShard struct {
+	pubsub   *redis.PubSub
+	channels map[string]bool
+}
+
+// errTooManyChannels is returned when a subscription would take a connection
+// over cfg.MaxChannels.
+var errTooManyChannels = errors.New("too many channels")
+
+func newSubscriber(ctx context.Context, rdb *redis.Client, client *SSEClient) *subscriber {
+	return &subscriber{rdb: rdb, client: client, ctx: ctx, messages: make(chan *redis.Message)}
+}
+
+// subscribe adds channels, filling the shards with room first. It waits for
+// the confirmation of new shards and returns the messages they received
+// before it.
+func (s *subscriber) subscribe(ctx context.Context, channels ...string) ([]*redis.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pending []string
+	seen := make(map[string]bool, len(channels))
+	for _, ch := range channels {
+		ch = s.client.qualify(ch)
+		if !seen[ch] && !s.subscribedLocked(ch) {
+			pending = append(pending, ch)
+		}
+		seen[ch] = true
+	}
+	if n := s.countLocked() + len(pending); cfg.MaxChannels > 0 && n > cfg.MaxChannels {
+		return nil, fmt.Errorf("%w: %d channels, max %d", errTooManyChannels, n, cfg.MaxChannels)
+	}
+
+	for _, sh := range s.shards {
+		room := len(pending)
+		if cfg.PubSubMaxChannels > 0 {
+			room = min(room, cfg.PubSubMaxChannels-len(sh.channels))
+		}
+		if room <= 0 {
+			continue
+		}
+		if err := subscribeBatches(ctx, sh.pubsub, pending[:room]); err != nil {
+			return nil, err
+		}
+		for _, ch := range pending[:room] {
+			sh.channels[ch] = true
+		}
+		pending = pending[room:]
+	}
+
+	var early []*redis.Message
+	for len(pending) > 0 {
+		n := len(pending)
+		if cfg.PubSubMaxChannels > 0 {
+			n = min(n, cfg.PubSubMaxChannels)
+		}
+		msgs, err := s.openShardLocked(ctx, pending[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			early = append(early, s.local(msg))
+		}
+		pending = pending[n:]
+	}
+	return early, nil
+}
+
+func (s *subscriber) openShardLocked(ctx context.Context, channels []string) ([]*redis.Message, error) {
+	first := channels[:min(len(channels), cfg.SubscribeBatch)]
+	pubsub := s.rdb.Subscribe(ctx, first...)
+	err := subscribeBatches(ctx, pubsub, channels[len(first):])
+	var early []*redis.Message
+	if err == nil {
+		early, err = confirmSubscription(ctx, pubsub, len(channels))
+	}
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	sh := &pubsubShard{pubsub: pubsub, channels: make(map[string]bool, len(channels))}
+	for _, ch := range channels {
+		sh.channels[ch] = true
+	}
+	s.shards = append(s.shards, sh)
+	if len(s.shards) > 1 {
+		s.client.logf("Opened Redis subscription connection %d for user %d", len(s.shards), s.client.userID)
+	}
+	s.forwarding.Add(1)
+	go s.forward(sh)
+	return early, nil
+}
+
+// subscribeBatches sends SUBSCRIBE commands of at most cfg.SubscribeBatch
+// channels, so a user with hundreds of channels doesn't make one huge
+// command.
+func subscribeBatches(ctx context.Context, pubsub *redis.PubSub, channels []string) error {
+	for len(channels) > 0 {
+		n := min(len(channels), cfg.SubscribeBatch)
+		if err := pubsub.Subscribe(ctx, channels[:n]...); err != nil {
+			return err
+		}
+		channels = channels[n:]
+	}
+	return nil
+}
+
+// forward passes a shard's messages on until the shard or the subscriber is
+// closed.
+func (s *subscriber) forward(sh *pubsubShard) {
+	defer s.forwarding.Done()
+	ch := sh.pubsub.Channel(redis.WithChannelSize(cfg.PubSubChannelSize), redis.WithChannelSendTimeout(cfg.PubSubSendTimeout))
+	backlog := newBacklogMonitor(cap(ch))
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			backlog.check(s.client, len(ch))
+			select {
+			case s.messages <- s.local(msg):
+			case <-s.ctx.Done():
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// local names a message's channel without the connection's namespace.
+func (s *subscriber) local(msg *redis.Message) *redis.Message {
+	if s.client.namespace == "" {
+		return msg
+	}
+	m := *msg
+	m.Channel, m.Pattern = s.client.unqualify(m.Channel), s.client.unqualify(m.Pattern)
+	return &m
+}
+
+// unsubscribe removes channels, closing the extra shards left empty.
+func (s *subscriber) unsubscribe(ctx context.Context, channels ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range channels {
+		ch = s.client.qualify(ch)
+		for _, sh := range s.shards {
+			if !sh.channels[ch] {
+				continue
+			}
+			if err := sh.pubsub.Unsubscribe(ctx, ch); err != nil {
+				return err
+			}
+			delete(sh.channels, ch)
+		}
+	}
+
+	if len(s.shards) < 2 {
+		return nil
+	}
+	kept := s.shards[:1]
+	for _, sh := range s.shards[1:] {
+		if len(sh.channels) == 0 {
+			sh.pubsub.Close()
+			continue
+		}
+		kept = append(kept, sh)
+	}
+	s.shards = kept
+	return nil
+}
+
+func (s *subscriber) subscribedLocked(channel string) bool {
+	for _, sh := range s.shards {
+		if sh.channels[channel] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *subscriber) countLocked() int {
+	n := 0
+	for _, sh := range s.shards {
+		n += len(sh.channels)
+	}
+	return n
+}
+
+// close closes every shard and waits for their messages to stop, which
+// takes until the subscriber's context is done when nothing reads them.
+func (s *subscriber) close() {
+	s.mu.Lock()
+	for _, sh := range s.shards {
+		sh.pubsub.Close()
+	}
+	s.shards = nil
+	s.mu.Unlock()
+	s.forwarding.Wait()
+}
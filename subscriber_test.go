@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// publishUnread publishes n messages to a subscriber nobody reads from yet,
+// and gives go-redis the time to buffer them.
+func publishUnread(t *testing.T, s *subscriber, channel string, n int) {
+	t.Helper()
+	if _, err := s.subscribe(ctx, channel); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		rdb.Publish(ctx, channel, fmt.Sprint(i))
+	}
+	// Nothing to wait on: the go-redis buffer can't be seen from here.
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestSlowConsumerWarned(t *testing.T) {
+	useConfig(t, func(c *Config) { c.PubSubChannelSize = 8 })
+	useRedis(t)
+	sctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	s := newSubscriber(sctx, rdb, &SSEClient{id: "slow-sub", userID: 1441})
+
+	warnings := metrics.pubsubBacklogWarnings.Load()
+	publishUnread(t, s, "events:user:1441", 8)
+	for i := 0; i < 8; i++ {
+		if msg := <-s.messages; msg.Payload != fmt.Sprint(i) {
+			t.Fatalf("message %d is %q", i, msg.Payload)
+		}
+	}
+	if n := metrics.pubsubBacklogWarnings.Load() - warnings; n != 1 {
+		t.Errorf("%d warnings, want one for the buffer nearly full", n)
+	}
+}
+
+func TestLargeBufferAbsorbsSlowConsumer(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.PubSubChannelSize = 1000
+		// Any drop in go-redis would be right away.
+		c.PubSubSendTimeout = time.Millisecond
+	})
+	useRedis(t)
+	sctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	s := newSubscriber(sctx, rdb, &SSEClient{id: "buffered-sub", userID: 1442})
+
+	warnings := metrics.pubsubBacklogWarnings.Load()
+	publishUnread(t, s, "events:user:1442", 500)
+	for i := 0; i < 500; i++ {
+		select {
+		case msg := <-s.messages:
+			if msg.Payload != fmt.Sprint(i) {
+				t.Fatalf("message %d is %q, some were lost", i, msg.Payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d of 500 messages", i)
+		}
+	}
+	if n := metrics.pubsubBacklogWarnings.Load() - warnings; n != 0 {
+		t.Errorf("%d warnings with the buffer half empty", n)
+	}
+}
+
+func TestSubscriberSpillsToNewShard(t *testing.T) {
+	useConfig(t, func(c *Config) { c.PubSubMaxChannels = 2 })
+	mr := useRedis(t)
+	sctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	s := newSubscriber(sctx, rdb, &SSEClient{id: "sharded-sub", userID: 1581})
+	defer s.close()
+
+	if _, err := s.subscribe(ctx, "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.subscribe(ctx, "d", "e"); err != nil {
+		t.Fatal(err)
+	}
+	// The second shard had room for d, e opened a third.
+	if len(s.shards) != 3 {
+		t.Fatalf("%d shards for 5 channels of at most 2", len(s.shards))
+	}
+	for i, sh := range s.shards {
+		if len(sh.channels) > 2 {
+			t.Errorf("shard %d has %d channels", i, len(sh.channels))
+		}
+	}
+	if n := mr.CurrentConnectionCount(); n < 3 {
+		t.Errorf("%d Redis connections, want one per shard", n)
+	}
+	for _, ch := range []string{"a", "b", "c", "d", "e"} {
+		mr.Publish(ch, ch)
+		if msg := <-s.messages; msg.Channel != ch {
+			t.Errorf("published on %s, got %s", ch, msg.Channel)
+		}
+	}
+
+	// Emptied, the extra shard is closed.
+	if err := s.unsubscribe(ctx, "e"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.shards) != 2 {
+		t.Errorf("%d shards left, want the empty one closed", len(s.shards))
+	}
+}
+
+func TestSubscribeLargeChannelSet(t *testing.T) {
+	useConfig(t, func(c *Config) {
+		c.SubscribeBatch = 50
+		c.MaxChannels = 500
+	})
+	mr := useRedis(t)
+	sctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	s := newSubscriber(sctx, rdb, &SSEClient{id: "many-channels", userID: 1611})
+	defer s.close()
+
+	channels := make([]string, 480)
+	for i := range channels {
+		channels[i] = fmt.Sprintf("room:%d", i)
+	}
+	if _, err := s.subscribe(ctx, channels...); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(mr.PubSubChannels("room:*")); n != 480 {
+		t.Fatalf("%d channels subscribed, want 480", n)
+	}
+	mr.Publish("room:479", "last")
+	if msg := <-s.messages; msg.Channel != "room:479" {
+		t.Errorf("got a message on %s", msg.Channel)
+	}
+
+	// Unsubscribing is per channel.
+	if err := s.unsubscribe(ctx, "room:7"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the unsubscribe", func() bool { return len(mr.PubSubChannels("room:*")) == 479 })
+	if mr.PubSubNumSub("room:7")["room:7"] != 0 || mr.PubSubNumSub("room:8")["room:8"] != 1 {
+		t.Error("other channels unsubscribed too")
+	}
+
+	// 479 plus 30 is over the cap, nothing is subscribed.
+	more := make([]string, 30)
+	for i := range more {
+		more[i] = fmt.Sprintf("team:%d", i)
+	}
+	if _, err := s.subscribe(ctx, more...); !errors.Is(err, errTooManyChannels) {
+		t.Errorf("err = %v, want errTooManyChannels", err)
+	}
+	if n := len(mr.PubSubChannels("team:*")); n != 0 {
+		t.Errorf("%d channels subscribed over the cap", n)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type subscriptionRequest struct {
+	Action   string   `json:"action"`
+	Channels []string `json:"channels"`
+}
+
+// setSubscriber makes the live subscription available to control requests.
+func (c *SSEClient) setSubscriber(sub *subscriber) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sub = sub
+}
+
+// allowedChannel reports whether the connection's token allows subscribing
+// to channel through the `channels` claim.
+func (c *SSEClient) allowedChannel(channel string) bool {
+	for _, allowed := range c.claims.Channels {
+		if channel == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// updateSubscription subscribes or unsubscribes the live connection from
+// extra channels and returns the extra channels it is now subscribed to.
+func (c *SSEClient) updateSubscription(ctx context.Context, action string, channels []string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sub == nil {
+		return nil, fmt.Errorf("subscription not established yet")
+	}
+
+	var err error
+	switch action {
+	case "subscribe":
+		var early []*redis.Message
+		if early, err = c.sub.subscribe(ctx, channels...); err == nil {
+			// A new shard's first messages, the subscription loop isn't
+			// reading them from it.
+			go func() {
+				for _, msg := range early {
+					select {
+					case c.sub.messages <- msg:
+					case <-c.sub.ctx.Done():
+						return
+					}
+				}
+			}()
+			for _, ch := range channels {
+				c.extraChannels[ch] = true
+			}
+		}
+	case "unsubscribe":
+		if err = c.sub.unsubscribe(ctx, channels...); err == nil {
+			for _, ch := range channels {
+				delete(c.extraChannels, ch)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	current := make([]string, 0, len(c.extraChannels))
+	for ch := range c.extraChannels {
+		current = append(current, ch)
+	}
+	sort.Strings(current)
+	return current, nil
+}
+
+// requestToken returns the SSE token from the Authorization header or, like
+// the SSE endpoint, from the `ssetoken` query parameter.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("ssetoken")
+}
+
+// controlHandler changes the channels of a live connection, so the client
+// doesn't have to reconnect when the feeds it needs change. The request must
+// carry a token for the connection's user, and only channels listed in the
+// connection token's `channels` claim are accepted.
+func controlHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := verifyToken(requestToken(r))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	client := registry.get(r.PathValue("conn_id"))
+	if client == nil {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	if client.userID != claims.UserID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req subscriptionRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	if err != nil || len(req.Channels) == 0 {
+		http.Error(w, "Expected JSON body with action and channels", http.StatusBadRequest)
+		return
+	}
+	for _, ch := range req.Channels {
+		if !client.allowedChannel(ch) {
+			client.logf("Refused %s of channel %s", req.Action, ch)
+			http.Error(w, "Channel not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	if req.Action == "subscribe" {
+		if err := validateChannels(req.Channels); err != nil {
+			client.logf("Refused subscribe: %v", err)
+			http.Error(w, "Channel not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	current, err := client.updateSubscription(r.Context(), req.Action, req.Channels)
+	if errors.Is(err, errTooManyChannels) {
+		client.logf("Refused subscribe: %v", err)
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("[SSE] [conn %s] Control %s failed: %v", client.id, req.Action, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	client.logf("Control %s %s", req.Action, strings.Join(req.Channels, ", "))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"channels": current})
+}
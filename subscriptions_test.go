@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestControlSwitchesChannelsOfLiveConnection(t *testing.T) {
+	mr, srv := newSidecar(t, nil)
+	tok := token(t, 7, jwt.MapClaims{"channels": []string{"news", "sports"}})
+	s, id := connect(t, srv, 7, url.Values{"ssetoken": {tok}})
+
+	resp := post(t, srv.URL+"/control/"+id, `{"action": "subscribe", "channels": ["news", "sports"]}`, tok)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("subscribe: %s", resp.Status)
+	}
+	var body struct {
+		Channels []string `json:"channels"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if want := []string{"news", "sports"}; !reflect.DeepEqual(body.Channels, want) {
+		t.Errorf("channels = %v, want %v", body.Channels, want)
+	}
+	// SUBSCRIBE is sent on the live pub/sub connection, Redis confirms it
+	// asynchronously.
+	waitFor(t, "the news subscription", func() bool { return mr.PubSubNumSub("news")["news"] == 1 })
+	mr.Publish("news", "headline")
+	if ev := s.nextData(t); ev.data != "headline" {
+		t.Fatalf("after subscribe got %q", ev.data)
+	}
+
+	post(t, srv.URL+"/control/"+id, `{"action": "unsubscribe", "channels": ["news"]}`, tok)
+	waitFor(t, "the news unsubscription", func() bool { return mr.PubSubNumSub("news")["news"] == 0 })
+	mr.Publish("news", "missed")
+	mr.Publish("sports", "score")
+	if ev := s.nextData(t); ev.data != "score" {
+		t.Fatalf("after unsubscribe got %q, want only the sports event", ev.data)
+	}
+}
+
+func TestControlRefusals(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	tok := token(t, 7, jwt.MapClaims{"channels": []string{"news"}})
+	_, id := connect(t, srv, 7, url.Values{"ssetoken": {tok}})
+
+	tests := []struct {
+		name, conn, body, token string
+		want                    int
+	}{
+		{"no token", id, `{"action": "subscribe", "channels": ["news"]}`, "", http.StatusUnauthorized},
+		{"another user", id, `{"action": "subscribe", "channels": ["news"]}`, token(t, 8, jwt.MapClaims{"channels": []string{"news"}}), http.StatusForbidden},
+		{"unknown connection", "nope", `{"action": "subscribe", "channels": ["news"]}`, tok, http.StatusNotFound},
+		{"channel not in the claim", id, `{"action": "subscribe", "channels": ["admin"]}`, tok, http.StatusForbidden},
+		{"no channels", id, `{"action": "subscribe"}`, tok, http.StatusBadRequest},
+		{"unknown action", id, `{"action": "replace", "channels": ["news"]}`, tok, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if resp := post(t, srv.URL+"/control/"+tt.conn, tt.body, tt.token); resp.StatusCode != tt.want {
+			t.Errorf("%s: %s, want %d", tt.name, resp.Status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// setKeepaliveInterval sets the interval between the keepalive probes of
+// conn, which Go leaves at 15s when only given the idle time.
+func setKeepaliveInterval(conn *net.TCPConn, d time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	secs := max(int(d/time.Second), 1)
+	if cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
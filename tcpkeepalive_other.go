@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepaliveInterval leaves the interval between keepalive probes to Go
+// and the OS.
+func setKeepaliveInterval(conn *net.TCPConn, d time.Duration) error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	errTenantNotAllowed  = errors.New("tenant has no Redis configured")
+	errTenantClientsFull = errors.New("too many tenant Redis clients open")
+)
+
+// tenantRedisClient is the client of a tenant's dedicated Redis, shared by
+// the tenant's connections on this instance.
+type tenantRedisClient struct {
+	client *redis.Client
+	// users counts the connections using it, idleSince is when the last one
+	// closed.
+	users     int
+	idleSince time.Time
+}
+
+// tenantRedisPool holds the clients of cfg.TenantRedis, created on first use,
+// at most cfg.MaxTenantClients. A client no connection used for
+// cfg.TenantRedisIdle is closed, as is the longest idle one when a new
+// tenant needs room.
+type tenantRedisPool struct {
+	mu      sync.Mutex
+	clients map[string]*tenantRedisClient
+}
+
+var tenantRedis = &tenantRedisPool{clients: make(map[string]*tenantRedisClient)}
+
+// tenantOf returns the token's cfg.TenantClaim, empty without one.
+func tenantOf(claims *SSETokenClaims) string {
+	v, ok := claims.raw[cfg.TenantClaim]
+	if !ok || v == nil {
+		return ""
+	}
+	return claimString(v)
+}
+
+// redisDB returns the Redis of the connection's records and keys: its
+// tenant's, or the sidecar's without one.
+func (c *SSEClient) redisDB() *redis.Client {
+	if c.db != nil {
+		return c.db
+	}
+	return rdb
+}
+
+// acquire returns the client of the tenant's Redis and the func to call
+// once the connection no longer uses it.
+func (p *tenantRedisPool) acquire(tenant string) (*redis.Client, func(), error) {
+	opts, ok := cfg.TenantRedis[tenant]
+	if !ok {
+		return nil, nil, errTenantNotAllowed
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tc, ok := p.clients[tenant]
+	if !ok {
+		if len(p.clients) >= cfg.MaxTenantClients && !p.evictIdle() {
+			return nil, nil, errTenantClientsFull
+		}
+		o := *opts
+		tc = &tenantRedisClient{client: redis.NewClient(&o)}
+		p.clients[tenant] = tc
+		log.Printf("[SSE-SIDECAR] Opened the Redis client of tenant %q (%d open)", tenant, len(p.clients))
+	}
+	tc.users++
+	var once sync.Once
+	return tc.client, func() { once.Do(func() { p.release(tenant, tc) }) }, nil
+}
+
+func (p *tenantRedisPool) release(tenant string, tc *tenantRedisClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tc.users--
+	if tc.users > 0 {
+		return
+	}
+	idleSince := time.Now()
+	tc.idleSince = idleSince
+	time.AfterFunc(cfg.TenantRedisIdle, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.clients[tenant] == tc && tc.users == 0 && tc.idleSince.Equal(idleSince) {
+			p.remove(tenant, tc)
+		}
+	})
+}
+
+// evictIdle closes the client idle for the longest, reporting false when
+// every client is in use. p.mu is held.
+func (p *tenantRedisPool) evictIdle() bool {
+	var oldest string
+	for tenant, tc := range p.clients {
+		if tc.users == 0 && (oldest == "" || tc.idleSince.Before(p.clients[oldest].idleSince)) {
+			oldest = tenant
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	p.remove(oldest, p.clients[oldest])
+	return true
+}
+
+// remove closes a client no connection uses. p.mu is held.
+func (p *tenantRedisPool) remove(tenant string, tc *tenantRedisClient) {
+	delete(p.clients, tenant)
+	go tc.client.Close()
+	log.Printf("[SSE-SIDECAR] Closed the idle Redis client of tenant %q (%d open)", tenant, len(p.clients))
+}
+
+func (p *tenantRedisPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients)
+}
+
+// parseTenantRedis reads `tenant=redis-url` entries, ex:
+// `acme=rediss://acme-redis:6380/0`.
+func parseTenantRedis(name string, list []string) map[string]*redis.Options {
+	tenants := make(map[string]*redis.Options, len(list))
+	for _, entry := range list {
+		tenant, url, ok := strings.Cut(entry, "=")
+		if !ok || tenant == "" {
+			log.Fatalf("Invalid %s entry %q: expected tenant=redis-url", name, entry)
+		}
+		if tenants[tenant] != nil {
+			log.Fatalf("Invalid %s: tenant %q is listed twice", name, tenant)
+		}
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			// The URL may hold a password, it's left out.
+			log.Fatalf("Invalid %s: the Redis URL of tenant %q can't be parsed", name, tenant)
+		}
+		tenants[tenant] = opts
+	}
+	return tenants
+}
+
+func init() {
+	metricDefs = append(metricDefs, metricDef{"sse_tenant_redis_clients", "Open Redis clients of tenants with a dedicated Redis.", gaugeMetric, func() float64 {
+		return float64(tenantRedis.len())
+	}})
+}
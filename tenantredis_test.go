@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// tenantSidecar serves the sidecar on a shared miniredis, with tenants acme
+// and globex each on a Redis of their own and a pool of their clients for
+// the test.
+func tenantSidecar(t *testing.T, set func(c *Config)) (shared, acme, globex *miniredis.Miniredis, srv *httptest.Server) {
+	t.Helper()
+	acme, globex = miniredis.RunT(t), miniredis.RunT(t)
+	shared, srv = newSidecar(t, func(c *Config) {
+		c.TenantRedis = parseTenantRedis("GO_SSE_SIDECAR_TENANT_REDIS_URLS", []string{
+			"acme=redis://" + acme.Addr(),
+			"globex=redis://" + globex.Addr(),
+		})
+		if set != nil {
+			set(c)
+		}
+	})
+	old := tenantRedis
+	tenantRedis = &tenantRedisPool{clients: make(map[string]*tenantRedisClient)}
+	pool := tenantRedis
+	t.Cleanup(func() {
+		// Only once the test server has closed the connections.
+		srv.Close()
+		pool.mu.Lock()
+		for tenant, tc := range pool.clients {
+			pool.remove(tenant, tc)
+		}
+		pool.mu.Unlock()
+		tenantRedis = old
+	})
+	return shared, acme, globex, srv
+}
+
+func tenantToken(t *testing.T, userID int64, tenant string) url.Values {
+	t.Helper()
+	return url.Values{"ssetoken": {token(t, userID, jwt.MapClaims{"tenant": tenant})}}
+}
+
+// status is the status of GET path with query, whose stream is closed.
+func status(t *testing.T, srv *httptest.Server, path string, query url.Values) int {
+	t.Helper()
+	resp := get(t, srv.URL+path+"?"+query.Encode(), nil)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestParseTenantRedis(t *testing.T) {
+	tenants := parseTenantRedis("GO_SSE_SIDECAR_TENANT_REDIS_URLS", []string{"acme=rediss://:secret@acme-redis:6380/2", "globex=redis://globex-redis:6379"})
+	if o := tenants["acme"]; o == nil || o.Addr != "acme-redis:6380" || o.Password != "secret" || o.DB != 2 || o.TLSConfig == nil {
+		t.Errorf("acme %+v", o)
+	}
+	if o := tenants["globex"]; o == nil || o.Addr != "globex-redis:6379" || len(tenants) != 2 {
+		t.Errorf("parsed %v", tenants)
+	}
+}
+
+func TestTenantClaimSelectsRedis(t *testing.T) {
+	shared, acme, _, srv := tenantSidecar(t, func(c *Config) { c.HistoryBackfill = 1 })
+	shared.RPush(historyKey(2391), "shared history")
+	acme.RPush(historyKey(2391), "acme history")
+
+	s, _ := connect(t, srv, 2391, tenantToken(t, 2391, "acme"))
+	if ev := s.nextData(t); ev.data != "acme history" {
+		t.Fatalf("replayed %q, want the history on acme's Redis", ev.data)
+	}
+	// Subscribed on acme's Redis only.
+	shared.Publish(userChannel(2391), "on the shared Redis")
+	acme.Publish(userChannel(2391), "on acme's Redis")
+	if ev := s.nextData(t); ev.data != "on acme's Redis" {
+		t.Errorf("got %q", ev.data)
+	}
+
+	plain, _ := connect(t, srv, 2391, nil)
+	if ev := plain.nextData(t); ev.data != "shared history" {
+		t.Errorf("replayed %q without a tenant, want the shared history", ev.data)
+	}
+}
+
+// subscribeOn returns the records published on mr to channels.
+func subscribeOn(t *testing.T, mr *miniredis.Miniredis, channels ...string) <-chan *redis.Message {
+	t.Helper()
+	c := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	pubsub := c.Subscribe(ctx, channels...)
+	for range channels {
+		if _, err := pubsub.Receive(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		pubsub.Close()
+		c.Close()
+	})
+	return pubsub.Channel()
+}
+
+func TestTenantRecordsOnTenantRedis(t *testing.T) {
+	shared, acme, _, srv := tenantSidecar(t, func(c *Config) {
+		c.PresenceChannel = "presence"
+		c.PresenceTTL = time.Minute
+		c.PresenceRefresh = time.Minute
+		c.ReceiptChannel = "receipts"
+		c.AckChannel = "acks"
+		c.DeadLetterChannel = "deadletters"
+		c.QueueSize = 1
+	})
+	startReceipts(t)
+	startDeadLetters(t)
+	channels := []string{"presence", "receipts", "acks", "deadletters"}
+	leaked := subscribeOn(t, shared, channels...)
+	records := subscribeOn(t, acme, channels...)
+	next := func(want string) string {
+		t.Helper()
+		select {
+		case m := <-records:
+			if m.Channel != want {
+				t.Fatalf("got a record on %s, want %s: %s", m.Channel, want, m.Payload)
+			}
+			return m.Payload
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no record on acme's %s", want)
+			return ""
+		}
+	}
+
+	q := tenantToken(t, 2392, "acme")
+	s, conn := connect(t, srv, 2392, q)
+	if p := decodePresence(t, next("presence")); p.Event != "connect" || p.UserID != 2392 {
+		t.Errorf("presence %+v", p)
+	}
+	waitFor(t, "the online key on acme's Redis", func() bool { return acme.Exists(onlineKey(2392)) })
+
+	acme.Publish(userChannel(2392), `{"receipt_id": "r-1"}`)
+	s.nextData(t)
+	if r := decodeReceipt(t, next("receipts")); r.ReceiptID != "r-1" {
+		t.Errorf("receipt %+v", r)
+	}
+	if code := postAck(t, srv, conn, `{"receipt_id": "r-1"}`, q.Get("ssetoken")); code != http.StatusNoContent {
+		t.Fatalf("ack: %d, want 204", code)
+	}
+	next("acks")
+
+	// Over the queue of 1 while paused.
+	delivery.set(true)
+	t.Cleanup(func() { delivery.set(false) })
+	acme.Publish(userChannel(2392), "kept")
+	acme.Publish(userChannel(2392), "dropped")
+	if r := decodeDeadLetter(t, next("deadletters")); r.UserID != 2392 {
+		t.Errorf("dead letter %+v", r)
+	}
+	delivery.set(false)
+
+	s.resp.Body.Close()
+	if p := decodePresence(t, next("presence")); p.Event != "disconnect" {
+		t.Errorf("presence %+v, want the disconnect", p)
+	}
+	waitFor(t, "the online key deleted", func() bool { return !acme.Exists(onlineKey(2392)) })
+
+	select {
+	case m := <-leaked:
+		t.Errorf("acme's record on the shared Redis: %s %s", m.Channel, m.Payload)
+	default:
+	}
+	if shared.Exists(onlineKey(2392)) {
+		t.Error("acme's online key on the shared Redis")
+	}
+}
+
+func TestTenantClientSharedAndClosedIdle(t *testing.T) {
+	_, _, _, srv := tenantSidecar(t, func(c *Config) { c.TenantRedisIdle = 50 * time.Millisecond })
+	first, firstConn := connect(t, srv, 2393, tenantToken(t, 2393, "acme"))
+	second, secondConn := connect(t, srv, 2394, tenantToken(t, 2394, "acme"))
+	if registry.get(firstConn).db != registry.get(secondConn).db || tenantRedis.len() != 1 {
+		t.Fatalf("%d clients for one tenant", tenantRedis.len())
+	}
+	if got := scrape(t, srv)["sse_tenant_redis_clients"]; got != 1 {
+		t.Errorf("sse_tenant_redis_clients %v", got)
+	}
+
+	first.resp.Body.Close()
+	waitFor(t, "the first closed", func() bool { return registry.get(firstConn) == nil })
+	time.Sleep(100 * time.Millisecond)
+	if tenantRedis.len() != 1 {
+		t.Fatal("closed while a connection uses it")
+	}
+	second.resp.Body.Close()
+	waitFor(t, "the idle client closed", func() bool { return tenantRedis.len() == 0 })
+}
+
+func TestTenantClientsCapped(t *testing.T) {
+	_, _, globex, srv := tenantSidecar(t, func(c *Config) {
+		c.MaxTenantClients = 1
+		c.TenantRedisIdle = time.Hour
+	})
+	s, conn := connect(t, srv, 2395, tenantToken(t, 2395, "acme"))
+	if code := status(t, srv, "/sse-events", tenantToken(t, 2396, "globex")); code != http.StatusServiceUnavailable {
+		t.Errorf("another tenant while acme's client is in use: %d, want 503", code)
+	}
+
+	// Idle, acme's client makes room.
+	s.resp.Body.Close()
+	waitFor(t, "acme's connection closed", func() bool { return registry.get(conn) == nil })
+	globex.RPush(historyKey(2396), "globex history")
+	cfg.HistoryBackfill = 1
+	other, _ := connect(t, srv, 2396, tenantToken(t, 2396, "globex"))
+	if ev := other.nextData(t); ev.data != "globex history" {
+		t.Errorf("replayed %q", ev.data)
+	}
+	tenantRedis.mu.Lock()
+	_, acmeOpen := tenantRedis.clients["acme"]
+	tenantRedis.mu.Unlock()
+	if acmeOpen || tenantRedis.len() != 1 {
+		t.Error("acme's idle client not closed for globex")
+	}
+}
+
+func TestUnlistedTenantRefused(t *testing.T) {
+	_, _, _, srv := tenantSidecar(t, func(c *Config) { c.RedisDBs = map[int]bool{2: true} })
+	for _, path := range []string{"/sse-events", "/poll"} {
+		if code := status(t, srv, path, tenantToken(t, 2397, "initech")); code != http.StatusForbidden {
+			t.Errorf("%s with an unlisted tenant: %d, want 403", path, code)
+		}
+	}
+	q := url.Values{"ssetoken": {token(t, 2397, jwt.MapClaims{"tenant": "acme", "db": 2})}}
+	if code := status(t, srv, "/sse-events", q); code != http.StatusForbidden {
+		t.Errorf("a tenant selecting a db: %d, want 403", code)
+	}
+	if _, _, err := redisFor(&SSETokenClaims{raw: jwt.MapClaims{"tenant": "initech"}}); !errors.Is(err, errTenantNotAllowed) {
+		t.Errorf("err = %v, want errTenantNotAllowed", err)
+	}
+	if tenantRedis.len() != 0 {
+		t.Error("a client opened for a refused connection")
+	}
+}
+
+func TestWithoutTenantsTheClaimIsIgnored(t *testing.T) {
+	useConfig(t, nil)
+	useRedis(t)
+	c, release, err := redisFor(&SSETokenClaims{raw: jwt.MapClaims{"tenant": "acme"}})
+	if err != nil || c != rdb {
+		t.Fatalf("got %v %v, want the shared client", c, err)
+	}
+	release()
+	if db := (&SSEClient{}).redisDB(); db != rdb {
+		t.Error("a connection without a tenant client doesn't use the shared one")
+	}
+	other := redis.NewClient(&redis.Options{Addr: "localhost:0"})
+	defer other.Close()
+	if db := (&SSEClient{db: other}).redisDB(); db != other {
+		t.Error("a connection's own client not used")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tierLimits are the limits of a subscription tier. Zero is no limit, or
+// for the queue size cfg.QueueSize. weight is the share of the tier's users
+// under GO_SSE_SIDECAR_FAIR_SHARE_RATE, 1 by default.
+type tierLimits struct {
+	maxConns  int
+	rate      int
+	queueSize int
+	weight    int
+}
+
+// parseTiers parses `tier=max_connections:events_per_second:queue_size`
+// entries separated by commas, ex: `free=2:5:10,pro=10:0:100`, optionally
+// followed by `:weight`.
+func parseTiers(name, v string) map[string]tierLimits {
+	tiers := make(map[string]tierLimits)
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tier, limits, ok := strings.Cut(entry, "=")
+		parts := strings.Split(limits, ":")
+		if !ok || tier == "" || len(parts) < 3 || len(parts) > 4 {
+			log.Fatalf("Invalid %s entry %q, expected tier=max_connections:events_per_second:queue_size[:weight]", name, entry)
+		}
+		n := [4]int{3: 1}
+		for i, part := range parts {
+			var err error
+			if n[i], err = strconv.Atoi(part); err != nil || n[i] < 0 || n[i] > 100000 {
+				log.Fatalf("Invalid %s entry %q: %q is not a number between 0 and 100000", name, entry, part)
+			}
+		}
+		if n[3] == 0 {
+			log.Fatalf("Invalid %s entry %q: the weight must be at least 1", name, entry)
+		}
+		tiers[tier] = tierLimits{maxConns: n[0], rate: n[1], queueSize: n[2], weight: n[3]}
+	}
+	return tiers
+}
+
+// tierFor returns the limits of the token's `tier` claim. Without tiers
+// nothing is limited; a token without a known tier gets the most restrictive
+// limit of every tier.
+func tierFor(claims *SSETokenClaims) tierLimits {
+	if limits, ok := cfg.Tiers[claims.Tier]; ok {
+		return limits
+	}
+	var strictest tierLimits
+	first := true
+	for _, limits := range cfg.Tiers {
+		if first {
+			strictest, first = limits, false
+			continue
+		}
+		strictest.maxConns = stricter(strictest.maxConns, limits.maxConns)
+		strictest.rate = stricter(strictest.rate, limits.rate)
+		strictest.queueSize = stricter(strictest.queueSize, limits.queueSize)
+		strictest.weight = min(strictest.weight, limits.weight)
+	}
+	return strictest
+}
+
+// stricter returns the lower of two limits, zero being none.
+func stricter(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (l tierLimits) queue() int {
+	if l.queueSize == 0 {
+		return cfg.QueueSize
+	}
+	return l.queueSize
+}
+
+// eventPacer holds a connection to a number of events per second.
+type eventPacer struct {
+	rate        int
+	windowStart time.Time
+	sent        int
+}
+
+func newEventPacer(rate int) *eventPacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &eventPacer{rate: rate}
+}
+
+// wait returns how long to wait before the next event may be sent.
+func (p *eventPacer) wait(now time.Time) time.Duration {
+	if p == nil {
+		return 0
+	}
+	if now.Sub(p.windowStart) >= time.Second {
+		p.windowStart, p.sent = now, 0
+	}
+	if p.sent < p.rate {
+		return 0
+	}
+	return p.windowStart.Add(time.Second).Sub(now)
+}
+
+// count counts an event sent.
+func (p *eventPacer) count() {
+	if p != nil {
+		p.sent++
+	}
+}
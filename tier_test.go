@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func useTiers(c *Config) {
+	c.Tiers = parseTiers("GO_SSE_SIDECAR_TIERS", "free=1:2:4, pro=3:0:0:5")
+}
+
+func tierToken(t *testing.T, userID int64, tier string) url.Values {
+	t.Helper()
+	return url.Values{"ssetoken": {token(t, userID, jwt.MapClaims{"tier": tier})}}
+}
+
+func TestParseTiers(t *testing.T) {
+	got := parseTiers("GO_SSE_SIDECAR_TIERS", "free=1:2:4, pro=3:0:0:5")
+	want := map[string]tierLimits{
+		"free": {maxConns: 1, rate: 2, queueSize: 4, weight: 1},
+		"pro":  {maxConns: 3, rate: 0, queueSize: 0, weight: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if len(parseTiers("GO_SSE_SIDECAR_TIERS", "")) != 0 {
+		t.Error("tiers without GO_SSE_SIDECAR_TIERS")
+	}
+}
+
+func TestUnknownTierGetsStrictestLimits(t *testing.T) {
+	useConfig(t, useTiers)
+	for tier, want := range map[string]tierLimits{
+		"free": {maxConns: 1, rate: 2, queueSize: 4, weight: 1},
+		"pro":  {maxConns: 3, queueSize: 0, weight: 5},
+		// Zero is no limit, so the rate and queue of free are the strictest.
+		"enterprise": {maxConns: 1, rate: 2, queueSize: 4, weight: 1},
+		"":           {maxConns: 1, rate: 2, queueSize: 4, weight: 1},
+	} {
+		if got := tierFor(&SSETokenClaims{Tier: tier}); got != want {
+			t.Errorf("tier %q: %+v, want %+v", tier, got, want)
+		}
+	}
+	useConfig(t, nil)
+	if got := tierFor(&SSETokenClaims{Tier: "free"}); got != (tierLimits{}) {
+		t.Errorf("limits %+v without tiers", got)
+	}
+}
+
+func TestTierConnectionLimit(t *testing.T) {
+	_, srv := newSidecar(t, useTiers)
+	connect(t, srv, 2001, tierToken(t, 2001, "free"))
+	resp := get(t, srv.URL+"/sse-events?"+tierToken(t, 2001, "free").Encode(), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second free connection: %s, want 429", resp.Status)
+	}
+	for i := 0; i < 3; i++ {
+		connect(t, srv, 2002, tierToken(t, 2002, "pro"))
+	}
+	if n := len(registry.forUser("", 2002)); n != 3 {
+		t.Errorf("%d pro connections, want 3", n)
+	}
+}
+
+func TestTierQueueSize(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) {
+		useTiers(c)
+		c.QueueSize = 16
+	})
+	// A user apiece: the free tier allows a single connection.
+	for _, tt := range []struct {
+		tier   string
+		userID int64
+		want   int
+	}{{"free", 2003, 4}, {"pro", 2005, 16}} {
+		_, conn := connect(t, srv, tt.userID, tierToken(t, tt.userID, tt.tier))
+		if n := cap(registry.get(conn).channel); n != tt.want {
+			t.Errorf("%s: queue of %d, want %d", tt.tier, n, tt.want)
+		}
+	}
+}
+
+func TestTierRateLimit(t *testing.T) {
+	_, srv := newSidecar(t, useTiers)
+	s, _ := connect(t, srv, 2004, tierToken(t, 2004, "free"))
+	start := time.Now()
+	for _, payload := range []string{"1", "2", "3"} {
+		rdb.Publish(ctx, "events:user:2004", payload)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		if ev := s.nextData(t); ev.data != want {
+			t.Fatalf("got %q, want %q", ev.data, want)
+		}
+	}
+	// Two events a second: the third waits for the next second.
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Errorf("3 events in %v at 2 per second", d)
+	}
+}
+
+func TestEventPacer(t *testing.T) {
+	now := time.Now()
+	p := newEventPacer(2)
+	for i := 0; i < 2; i++ {
+		if wait := p.wait(now); wait != 0 {
+			t.Fatalf("event %d waits %v", i+1, wait)
+		}
+		p.count()
+	}
+	if wait := p.wait(now.Add(300 * time.Millisecond)); wait != 700*time.Millisecond {
+		t.Errorf("third event waits %v, want the rest of the second", wait)
+	}
+	if wait := p.wait(now.Add(time.Second)); wait != 0 {
+		t.Errorf("next second waits %v", wait)
+	}
+	if newEventPacer(0).wait(now) != 0 {
+		t.Error("unlimited pacer waits")
+	}
+}
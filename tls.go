@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newServer returns the HTTP server, configured for TLS (and client
+// certificates) when GO_SSE_SIDECAR_TLS_CERT is set.
+func newServer(addr string) *http.Server {
+	srv := &http.Server{Addr: addr}
+	if cfg.TLSCert == "" {
+		return srv
+	}
+
+	srv.TLSConfig = &tls.Config{MinVersion: cfg.TLSMinVersion, CipherSuites: cfg.TLSCipherSuites}
+	if cfg.ClientCA != "" {
+		pem, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			log.Fatalf("Failed to read GO_SSE_SIDECAR_CLIENT_CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatal("GO_SSE_SIDECAR_CLIENT_CA has no valid certificates")
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return srv
+}
+
+// parseTLSVersion parses a minimum TLS version, `1.2` or `1.3`. Older
+// versions are refused.
+func parseTLSVersion(v string) uint16 {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12
+	case "1.3":
+		return tls.VersionTLS13
+	}
+	log.Fatalf("Invalid GO_SSE_SIDECAR_TLS_MIN_VERSION %q, expected 1.2 or 1.3", v)
+	return 0
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names, ex:
+// `TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256`. Only the suites Go considers
+// secure are accepted. They apply to TLS 1.2, TLS 1.3 suites are not
+// configurable.
+func parseCipherSuites(v string) []uint16 {
+	if v == "" {
+		return nil
+	}
+	secure := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		secure[s.Name] = s.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := secure[name]
+		if !ok {
+			log.Fatalf("Invalid GO_SSE_SIDECAR_TLS_CIPHER_SUITES entry %q, unknown or insecure cipher suite", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// certClaims authenticates a request by its verified client certificate,
+// reading the numeric user ID from the configured certificate field (`cn`
+// or the first DNS `san`).
+func certClaims(r *http.Request) (*SSETokenClaims, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, fmt.Errorf("no verified client certificate")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var value string
+	switch cfg.ClientCertUser {
+	case "cn":
+		value = cert.Subject.CommonName
+	case "san":
+		if len(cert.DNSNames) > 0 {
+			value = cert.DNSNames[0]
+		}
+	}
+
+	userID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate %s %q is not a user ID", cfg.ClientCertUser, value)
+	}
+	return &SSETokenClaims{UserID: userID}, nil
+}
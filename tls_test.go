@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA signs client certificates for the mTLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writePEM saves the CA certificate in a file for GO_SSE_SIDECAR_CLIENT_CA.
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns a client certificate with the common name and DNS SANs.
+func (ca *testCA) issue(t *testing.T, cn string, sans ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     sans,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// mtlsSidecar serves the SSE endpoint over TLS with the server's TLS config,
+// requiring certificates of ca.
+func mtlsSidecar(t *testing.T, ca *testCA, certUser string) *httptest.Server {
+	t.Helper()
+	caFile := ca.writePEM(t)
+	return tlsSidecar(t, func(c *Config) {
+		c.ClientCA = caFile
+		c.ClientCertUser = certUser
+	})
+}
+
+// tlsSidecar serves the SSE endpoint with the server's TLS config.
+func tlsSidecar(t *testing.T, set func(c *Config)) *httptest.Server {
+	t.Helper()
+	useConfig(t, func(c *Config) {
+		// httptest serves its own certificate, the file is never read.
+		c.TLSCert = "unused"
+		if set != nil {
+			set(c)
+		}
+	})
+	useRedis(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(sseHandler))
+	srv.TLS = newServer("").TLSConfig
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// getWithCert requests the SSE endpoint presenting certs.
+func getWithCert(t *testing.T, srv *httptest.Server, certs ...tls.Certificate) (*http.Response, error) {
+	t.Helper()
+	client := srv.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = certs
+	return client.Get(srv.URL + "/sse-events")
+}
+
+func TestClientCertificateAccepted(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	tests := []struct {
+		certUser string
+		cert     tls.Certificate
+		want     int64
+	}{
+		{"cn", ca.issue(t, "1281"), 1281},
+		{"san", ca.issue(t, "service-a", "1282", "1283"), 1282},
+	}
+	for _, tt := range tests {
+		t.Run(tt.certUser, func(t *testing.T) {
+			srv := mtlsSidecar(t, ca, tt.certUser)
+			resp, err := getWithCert(t, srv, tt.cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				t.Fatalf("status = %s", resp.Status)
+			}
+			readStream(t, resp).nextEvent(t, "connected")
+			if n := len(registry.forUser("", tt.want)); n != 1 {
+				t.Errorf("%d connections of user %d, want 1", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCertificateRejected(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	srv := mtlsSidecar(t, ca, "cn")
+
+	t.Run("no certificate", func(t *testing.T) {
+		if resp, err := getWithCert(t, srv); err == nil {
+			resp.Body.Close()
+			t.Fatalf("connected without a certificate: %s", resp.Status)
+		}
+	})
+	t.Run("other CA", func(t *testing.T) {
+		other := newTestCA(t, "other CA")
+		if resp, err := getWithCert(t, srv, other.issue(t, "1284")); err == nil {
+			resp.Body.Close()
+			t.Fatalf("connected with a certificate of another CA: %s", resp.Status)
+		}
+	})
+	t.Run("common name not a user ID", func(t *testing.T) {
+		resp, err := getWithCert(t, srv, ca.issue(t, "alice"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status = %d, want 401", resp.StatusCode)
+		}
+	})
+}
+
+// handshake connects to srv with the client's TLS settings and returns the
+// negotiated state.
+func handshake(srv *httptest.Server, set func(c *tls.Config)) (tls.ConnectionState, error) {
+	c := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	set(c)
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), c)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	tests := []struct {
+		min    uint16
+		client uint16
+		ok     bool
+	}{
+		{tls.VersionTLS12, tls.VersionTLS10, false},
+		{tls.VersionTLS12, tls.VersionTLS11, false},
+		{tls.VersionTLS12, tls.VersionTLS12, true},
+		{tls.VersionTLS13, tls.VersionTLS12, false},
+		{tls.VersionTLS13, tls.VersionTLS13, true},
+	}
+	for _, tt := range tests {
+		t.Run(tls.VersionName(tt.min)+"/"+tls.VersionName(tt.client), func(t *testing.T) {
+			srv := tlsSidecar(t, func(c *Config) { c.TLSMinVersion = tt.min })
+			state, err := handshake(srv, func(c *tls.Config) {
+				c.MinVersion, c.MaxVersion = tt.client, tt.client
+			})
+			if (err == nil) != tt.ok {
+				t.Fatalf("handshake err = %v, want ok=%v", err, tt.ok)
+			}
+			if tt.ok && state.Version != tt.client {
+				t.Errorf("negotiated %s", tls.VersionName(state.Version))
+			}
+		})
+	}
+}
+
+func TestDefaultTLSMinVersionIs12(t *testing.T) {
+	if v := parseTLSVersion("1.2"); cfg.TLSMinVersion != v {
+		t.Errorf("default minimum is %s", tls.VersionName(cfg.TLSMinVersion))
+	}
+}
+
+func TestTLSCipherSuites(t *testing.T) {
+	// httptest's certificate is RSA.
+	suites := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	srv := tlsSidecar(t, func(c *Config) { c.TLSCipherSuites = suites })
+
+	state, err := handshake(srv, func(c *tls.Config) { c.MaxVersion = tls.VersionTLS12 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("negotiated %s", tls.CipherSuiteName(state.CipherSuite))
+	}
+	if _, err := handshake(srv, func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	}); err == nil {
+		t.Error("a suite outside the list was negotiated")
+	}
+}
+
+// TestWeakTLSConfigFailsStartup checks the settings log.Fatal is called for,
+// in a child process.
+func TestWeakTLSConfigFailsStartup(t *testing.T) {
+	if setting := os.Getenv("TLS_FATAL_TEST"); setting != "" {
+		name, value, _ := strings.Cut(setting, "=")
+		if name == "version" {
+			parseTLSVersion(value)
+		} else {
+			parseCipherSuites(value)
+		}
+		return
+	}
+	for _, setting := range []string{
+		"version=1.0",
+		"version=1.1",
+		"version=tls12",
+		"suites=TLS_RSA_WITH_RC4_128_SHA",
+		"suites=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+		"suites=NOT_A_SUITE",
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWeakTLSConfigFailsStartup$", "-test.v")
+		cmd.Env = append(os.Environ(), "TLS_FATAL_TEST="+setting)
+		out, err := cmd.CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "Invalid GO_SSE_SIDECAR_TLS_") {
+			t.Errorf("%s: %v, output %q", setting, err, out)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// payloadTransform reshapes the top-level fields of JSON object payloads
+// before they are sent: only the included fields are kept (all when none
+// are listed), excluded ones are removed, then fields are renamed. Other
+// payloads are sent unchanged.
+type payloadTransform struct {
+	include map[string]bool
+	exclude map[string]bool
+	rename  map[string]string
+}
+
+// parseTransform parses the comma-separated include and exclude field lists
+// and the `old=new` rename pairs. It returns nil when all are empty.
+func parseTransform(include, exclude, rename string) *payloadTransform {
+	if include == "" && exclude == "" && rename == "" {
+		return nil
+	}
+	t := &payloadTransform{include: parseFieldSet(include), exclude: parseFieldSet(exclude), rename: make(map[string]string)}
+	for _, entry := range strings.Split(rename, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(entry, "=")
+		if !ok || from == "" || to == "" {
+			log.Fatalf("Invalid GO_SSE_SIDECAR_TRANSFORM_RENAME entry %q, expected old=new", entry)
+		}
+		t.rename[from] = to
+	}
+	return t
+}
+
+func parseFieldSet(v string) map[string]bool {
+	fields := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func (t *payloadTransform) apply(payload string) string {
+	if t == nil || !strings.HasPrefix(strings.TrimSpace(payload), "{") {
+		return payload
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return payload
+	}
+
+	out := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		if (len(t.include) > 0 && !t.include[name]) || t.exclude[name] {
+			continue
+		}
+		if to, ok := t.rename[name]; ok {
+			name = to
+		}
+		out[name] = value
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return payload
+	}
+	return string(b)
+}
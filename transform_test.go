@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	payload := `{"id": 7, "text": "hi", "internal_score": 0.4, "owner": {"id": 2}}`
+	tests := []struct {
+		name                     string
+		include, exclude, rename string
+		want                     map[string]interface{}
+	}{
+		{"include", "id,text", "", "", map[string]interface{}{"id": 7.0, "text": "hi"}},
+		{"exclude", "", "internal_score", "", map[string]interface{}{"id": 7.0, "text": "hi", "owner": map[string]interface{}{"id": 2.0}}},
+		{"rename", "", "", "text=body, owner=author", map[string]interface{}{"id": 7.0, "body": "hi", "internal_score": 0.4, "author": map[string]interface{}{"id": 2.0}}},
+		// Fields are selected by their published name, then renamed.
+		{"all three", "id,text,internal_score", "internal_score", "id=message_id", map[string]interface{}{"message_id": 7.0, "text": "hi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := parseTransform(tt.include, tt.exclude, tt.rename).apply(payload)
+			var got map[string]interface{}
+			if err := json.Unmarshal([]byte(out), &got); err != nil {
+				t.Fatalf("%s: %v", out, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %s", out)
+			}
+		})
+	}
+}
+
+func TestTransformPassesOtherPayloadsThrough(t *testing.T) {
+	tr := parseTransform("id", "", "")
+	for _, payload := range []string{"plain text", `[{"id": 1, "x": 2}]`, `{"id": 1,`, `"quoted"`} {
+		if got := tr.apply(payload); got != payload {
+			t.Errorf("%q became %q", payload, got)
+		}
+	}
+}
+
+func TestTransformOffByDefault(t *testing.T) {
+	if tr := parseTransform("", "", ""); tr != nil {
+		t.Fatalf("transform %+v without any setting", tr)
+	}
+	useConfig(t, nil)
+	if cfg.Transform != nil {
+		t.Error("transform configured by default")
+	}
+	var tr *payloadTransform
+	if got := tr.apply(`{"a": 1}`); got != `{"a": 1}` {
+		t.Errorf("no transform changed the payload to %s", got)
+	}
+}
+
+func TestTransformedOnStream(t *testing.T) {
+	_, srv := newSidecar(t, func(c *Config) { c.Transform = parseTransform("", "secret", "msg=message") })
+	s, _ := connect(t, srv, 1451, nil)
+	rdb.Publish(ctx, "events:user:1451", `{"msg": "hello", "secret": "x"}`)
+	if ev := s.nextData(t); ev.data != `{"message":"hello"}` {
+		t.Errorf("data %s", ev.data)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// The transports a connection can use, the values of the `transport` label.
+const (
+	transportSSE  = "sse"
+	transportPoll = "poll"
+	transportWS   = "ws"
+)
+
+var transports = []string{transportSSE, transportPoll, transportWS}
+
+// transportCounters are the core connection and delivery counters of a
+// transport.
+type transportCounters struct {
+	opened    atomic.Int64
+	delivered atomic.Int64
+	dropped   atomic.Int64
+}
+
+var transportCounts = func() map[string]*transportCounters {
+	counts := make(map[string]*transportCounters, len(transports))
+	for _, t := range transports {
+		counts[t] = new(transportCounters)
+	}
+	return counts
+}()
+
+// counters returns the counters of the connection's transport, SSE when it
+// wasn't set.
+func (c *SSEClient) counters() *transportCounters {
+	if counts, ok := transportCounts[c.transport]; ok {
+		return counts
+	}
+	return transportCounts[transportSSE]
+}
+
+// streamTransport is the transport of a stream with opts.
+func streamTransport(opts connOptions) string {
+	if opts.websocket {
+		return transportWS
+	}
+	return transportSSE
+}
+
+// countDelivered and countDropped count a message of the connection in the
+// instance, transport and connection counters.
+func (c *SSEClient) countDelivered() {
+	metrics.delivered.Add(1)
+	c.counters().delivered.Add(1)
+	c.delivered.Add(1)
+}
+
+func (c *SSEClient) countDropped() {
+	metrics.dropped.Add(1)
+	c.counters().dropped.Add(1)
+	c.dropped.Add(1)
+}
+
+// transportDefs describes the per-transport series, exported with
+// cfg.MetricsByTransport.
+func transportDefs() []metricDef {
+	if !cfg.MetricsByTransport {
+		return nil
+	}
+	var defs []metricDef
+	for _, t := range transports {
+		t := t
+		defs = append(defs, metricDef{fmt.Sprintf("sse_transport_connections{transport=%q}", t), "Open connections, by transport.", gaugeMetric, func() float64 {
+			n := 0
+			for _, c := range registry.all() {
+				if c.counters() == transportCounts[t] {
+					n++
+				}
+			}
+			return float64(n)
+		}})
+	}
+	series := []struct {
+		name, help string
+		value      func(*transportCounters) *atomic.Int64
+	}{
+		{"sse_transport_connections_opened_total", "Connections opened, by transport.", func(c *transportCounters) *atomic.Int64 { return &c.opened }},
+		{"sse_transport_messages_delivered_total", "Messages written to clients, by transport.", func(c *transportCounters) *atomic.Int64 { return &c.delivered }},
+		{"sse_transport_messages_dropped_total", "Messages dropped for slow clients or staleness, by transport.", func(c *transportCounters) *atomic.Int64 { return &c.dropped }},
+	}
+	for _, s := range series {
+		for _, t := range transports {
+			defs = append(defs, metricDef{fmt.Sprintf("%s{transport=%q}", s.name, t), s.help, counterMetric, counterValue(s.value(transportCounts[t]))})
+		}
+	}
+	return defs
+}
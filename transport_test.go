@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// h2Sidecar is newSidecar over TLS, with HTTP/2 offered when h2 is set.
+func h2Sidecar(t *testing.T, h2 bool) *httptest.Server {
+	t.Helper()
+	_, plain := newSidecar(t, nil)
+	plain.Close()
+	srv := httptest.NewUnstartedServer(plain.Config.Handler)
+	srv.EnableHTTP2 = h2
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamNegotiatesHTTP2(t *testing.T) {
+	for _, tt := range []struct {
+		h2    bool
+		proto int
+	}{
+		{true, 2},
+		{false, 1},
+	} {
+		srv := h2Sidecar(t, tt.h2)
+		q := url.Values{"ssetoken": {token(t, 1871, nil)}}
+		resp, err := srv.Client().Get(srv.URL + "/sse-events?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ProtoMajor != tt.proto {
+			t.Errorf("HTTP/2 offered %v: stream over %s", tt.h2, resp.Proto)
+		}
+		s := readStream(t, resp)
+		s.nextEvent(t, "connected")
+		rdb.Publish(ctx, "events:user:1871", resp.Proto)
+		if ev := s.nextData(t); ev.data != resp.Proto {
+			t.Errorf("%s: got %q", resp.Proto, ev.data)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestPollFallbackAfterStream(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) { c.PollTimeout = 50 * time.Millisecond })
+	// The stream was fine but is closed, ex: by a buffering proxy, and the
+	// client moves to long-polling for the same user.
+	s, _ := connect(t, srv, 1872, nil)
+	s.resp.Body.Close()
+	_, _, cursor := poll(t, srv, 1872, "")
+	rdb.Publish(ctx, "events:user:1872", "polled")
+	if _, events, _ := poll(t, srv, 1872, cursor); len(events) != 1 || events[0].Data != "polled" {
+		t.Errorf("polled %v", pollData(events))
+	}
+}
+
+func TestClientJSTransportOrder(t *testing.T) {
+	for _, tt := range []struct {
+		transports []string
+		want       string
+	}{
+		{[]string{"sse", "poll"}, `var TRANSPORTS = ["sse","poll"];`},
+		{[]string{"poll", "sse"}, `var TRANSPORTS = ["poll","sse"];`},
+		{[]string{"sse"}, `var TRANSPORTS = ["sse"];`},
+		{[]string{"poll"}, `var TRANSPORTS = ["poll"];`},
+	} {
+		useConfig(t, func(c *Config) { c.ClientTransports = tt.transports })
+		js := clientJS(t)
+		if !strings.Contains(js, tt.want) {
+			t.Errorf("%v: client.js lacks %s", tt.transports, tt.want)
+		}
+	}
+	useConfig(t, nil)
+	if !strings.Contains(clientJS(t), `var TRANSPORTS = ["sse","poll"];`) {
+		t.Error("client.js doesn't try SSE then long-polling by default")
+	}
+}
+
+func TestMixedTransportsOfOneUserAllReceive(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) { c.PollTimeout = 500 * time.Millisecond })
+	tab, _ := connect(t, srv, 1991, nil)
+	_, _, cursor := poll(t, srv, 1991, "")
+	if n := len(registry.forUser("", 1991)); n != 2 {
+		t.Fatalf("%d connections of the user, want the stream and the poll session", n)
+	}
+
+	rdb.Publish(ctx, "events:user:1991", "to every transport")
+	if ev := tab.nextData(t); ev.data != "to every transport" {
+		t.Errorf("stream got %q", ev.data)
+	}
+	if _, events, _ := poll(t, srv, 1991, cursor); len(events) != 1 || events[0].Data != "to every transport" {
+		t.Errorf("poll got %v", pollData(events))
+	}
+}
+
+func TestMetricsByTransport(t *testing.T) {
+	_, srv := pollSidecar(t, func(c *Config) {
+		c.MetricsByTransport = true
+		c.WebSocket = true
+		c.PollTimeout = 500 * time.Millisecond
+	})
+	t.Cleanup(webSockets.Wait)
+	before := scrape(t, srv)
+
+	s, _ := connect(t, srv, 2221, nil)
+	_, _, cursor := poll(t, srv, 2222, "")
+	ws := dialWS(t, srv, wsQuery(t, 2223), "")
+	ws.event(t)
+	waitFor(t, "the WebSocket stream", func() bool { return len(registry.forUser("", 2223)) == 1 })
+	for _, id := range []int64{2221, 2222, 2223} {
+		rdb.Publish(ctx, userChannel(id), "hi")
+	}
+	if ev := s.nextData(t); ev.data != "hi" {
+		t.Fatalf("stream got %q", ev.data)
+	}
+	if _, events, _ := poll(t, srv, 2222, cursor); len(events) != 1 {
+		t.Fatalf("poll got %v", pollData(events))
+	}
+	if ev := ws.event(t); ev.data != "hi" {
+		t.Fatalf("WebSocket got %+v", ev)
+	}
+
+	after := scrape(t, srv)
+	for _, tr := range transports {
+		for _, name := range []string{"sse_transport_connections", "sse_transport_connections_opened_total", "sse_transport_messages_delivered_total"} {
+			series := name + `{transport="` + tr + `"}`
+			if d := after[series] - before[series]; d != 1 {
+				t.Errorf("%s went up by %v, want 1", series, d)
+			}
+		}
+	}
+	// The label takes no other value.
+	labels := map[string]bool{}
+	for series := range after {
+		if _, label, ok := strings.Cut(series, `{transport="`); ok && strings.HasPrefix(series, "sse_transport_") {
+			labels[strings.TrimSuffix(label, `"}`)] = true
+		}
+	}
+	if len(labels) != len(transports) {
+		t.Errorf("transport labels %v, want %v", labels, transports)
+	}
+}
+
+func TestTransportDropsCounted(t *testing.T) {
+	useConfig(t, nil)
+	for _, tt := range []struct{ transport, counted string }{
+		{transportWS, transportWS},
+		{transportPoll, transportPoll},
+		// Unset or unknown, counted as SSE.
+		{"", transportSSE},
+		{"carrier-pigeon", transportSSE},
+	} {
+		dropped := transportCounts[tt.counted].dropped.Load()
+		c := &SSEClient{id: "drops", userID: 2224, transport: tt.transport, channel: make(chan sseMessage)}
+		if c.enqueue(sseMessage{channel: "events:user:2224", payload: "x"}) {
+			t.Fatal("queued without room")
+		}
+		if n := transportCounts[tt.counted].dropped.Load() - dropped; n != 1 {
+			t.Errorf("transport %q: %d drops counted for %s, want 1", tt.transport, n, tt.counted)
+		}
+	}
+}
+
+func TestNoTransportSeriesByDefault(t *testing.T) {
+	_, srv := newSidecar(t, nil)
+	for series := range scrape(t, srv) {
+		if strings.HasPrefix(series, "sse_transport_") {
+			t.Errorf("%s exported without GO_SSE_SIDECAR_METRICS_BY_TRANSPORT", series)
+		}
+	}
+}
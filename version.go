@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// configHash identifies the effective configuration, so instances running
+// with different settings can be spotted. Set in main.
+var configHash string
+
+// secretSetting reports whether an environment variable holds a secret and
+// must be left out of the config hash.
+func secretSetting(name string) bool {
+	return strings.HasSuffix(name, "_TOKEN") || strings.HasSuffix(name, "_SECRET") || strings.HasSuffix(name, "_PASSWORD")
+}
+
+// computeConfigHash hashes the GO_SSE_SIDECAR_* settings, without secrets and
+// with the Redis password removed. Unset settings take the same defaults on a
+// given version, so they don't need to be included.
+func computeConfigHash() string {
+	var settings []string
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, "GO_SSE_SIDECAR_") || secretSetting(name) {
+			continue
+		}
+		switch name {
+		case "GO_SSE_SIDECAR_REDIS_URL":
+			value = withoutPassword(value)
+		case "GO_SSE_SIDECAR_REDIS_URLS":
+			urls := strings.Split(value, ",")
+			for i := range urls {
+				urls[i] = withoutPassword(strings.TrimSpace(urls[i]))
+			}
+			value = strings.Join(urls, ",")
+		}
+		settings = append(settings, name+"="+value)
+	}
+	sort.Strings(settings)
+
+	sum := sha256.Sum256([]byte(strings.Join(settings, "\n")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// withoutPassword removes the password of a Redis URL.
+func withoutPassword(value string) string {
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		u.User = url.User(u.User.Username())
+		return u.String()
+	}
+	return value
+}
+
+type versionResponse struct {
+	Version    string `json:"version"`
+	ConfigHash string `json:"config_hash"`
+	GoVersion  string `json:"go_version"`
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versionResponse{
+		Version:    version,
+		ConfigHash: configHash,
+		GoVersion:  runtime.Version(),
+	})
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The WebSocket transport streams the same events as SSE, one binary
+// message per event in the compact framing (see compactFrame), for clients
+// that upgrade `GET /sse-events?transport=ws`. Only what the sidecar needs
+// of RFC 6455 is implemented: no extensions, fragmented messages from the
+// client are ignored like every other client message.
+
+// wsGUID is appended to the client's key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsProtocol is the subprotocol echoed to clients that offer it.
+const wsProtocol = "sse-compact"
+
+// The opcodes of WebSocket frames.
+const (
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xa
+)
+
+// wsMaxClientFrame bounds the frames read from the client, which has
+// nothing to send but control frames.
+const wsMaxClientFrame = 4096
+
+var (
+	errWebSocketDisabled = errors.New("the websocket transport is not enabled")
+	errNotWebSocket      = errors.New("transport ws needs a WebSocket upgrade over HTTP/1.1")
+)
+
+// webSockets counts the streams over a WebSocket until their handler
+// returns. The server forgets hijacked connections, so its Shutdown doesn't
+// wait for them, waitWebSockets does.
+var webSockets sync.WaitGroup
+
+// waitWebSockets waits for the WebSocket streams to end, until ctx is done.
+func waitWebSockets(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		webSockets.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isWebSocketUpgrade reports whether r asks for a WebSocket connection.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.ProtoMajor == 1 &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Upgrade", "websocket") &&
+		r.Header.Get("Sec-WebSocket-Version") == "13" &&
+		r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// headerHasToken reports whether a comma-separated header lists token,
+// ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsAccept is the Sec-WebSocket-Accept for a client's Sec-WebSocket-Key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn is a server side WebSocket connection. It stands in for the
+// response writer of the stream: every Write is sent as one binary message,
+// and Flush sends what was written.
+type wsConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	header http.Header
+
+	// mu serializes the writes of the stream and the control frames of the
+	// reader.
+	mu     sync.Mutex
+	bw     *bufio.Writer
+	closed bool
+}
+
+// acceptWebSocket hijacks the connection of w and completes the handshake,
+// with the headers set on w so far.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// The server's deadlines no longer apply once hijacked.
+	conn.SetDeadline(time.Time{})
+
+	h := w.Header().Clone()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", wsAccept(r.Header.Get("Sec-WebSocket-Key")))
+	if headerHasToken(r.Header, "Sec-WebSocket-Protocol", wsProtocol) {
+		h.Set("Sec-WebSocket-Protocol", wsProtocol)
+	}
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader, bw: brw.Writer, header: make(http.Header)}, nil
+}
+
+func (c *wsConn) Header() http.Header { return c.header }
+
+func (c *wsConn) WriteHeader(int) {}
+
+// Write sends p as a binary message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if err := c.writeFrameLocked(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bw.Flush()
+}
+
+// SetWriteDeadline lets http.ResponseController bound the stream's writes.
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// writeFrameLocked writes a single unmasked frame, as servers must.
+func (c *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if _, err := c.bw.Write(header); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(payload)
+	return err
+}
+
+// control sends a control frame right away.
+func (c *wsConn) control(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if err := c.writeFrameLocked(opcode, payload); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// close sends a close frame with code and closes the connection.
+func (c *wsConn) close(code uint16) {
+	c.control(wsClose, binary.BigEndian.AppendUint16(nil, code))
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+// readLoop answers the client's pings and calls gone once it closes the
+// connection, goes away or breaks the protocol. Messages from the client
+// are ignored.
+func (c *wsConn) readLoop(gone func()) {
+	defer gone()
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			if errors.Is(err, errWebSocketProtocol) {
+				c.control(wsClose, binary.BigEndian.AppendUint16(nil, 1002))
+			}
+			return
+		}
+		switch opcode {
+		case wsClose:
+			c.control(wsClose, payload[:min(len(payload), 2)])
+			return
+		case wsPing:
+			c.control(wsPong, payload)
+		}
+	}
+}
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+
+// readFrame reads a frame from the client, which must be masked.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("%w: unmasked client frame", errWebSocketProtocol)
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxClientFrame || (opcode >= wsClose && n > 125) {
+		return 0, nil, fmt.Errorf("%w: %d byte frame", errWebSocketProtocol, n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// compactWriter frames the events of a stream in the compact framing
+// instead of SSE text, see writeFrame. Anything else written to it, like
+// keepalive comments, is sent as an empty message.
+type compactWriter struct {
+	w io.Writer
+}
+
+func (c compactWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c compactWriter) writeFrame(f sseFrame) error {
+	_, err := c.w.Write(compactFrame(f))
+	return err
+}
+
+// compactFrame encodes an event as the length of its name as a uvarint and
+// the name, the length of its id and the id, the retry in milliseconds as a
+// uvarint (0 when unset), then the data up to the end of the message. None
+// of the SSE line handling applies: the fields can hold any bytes.
+func compactFrame(f sseFrame) []byte {
+	b := make([]byte, 0, 3*binary.MaxVarintLen16+len(f.event)+len(f.id)+len(f.data))
+	b = binary.AppendUvarint(b, uint64(len(f.event)))
+	b = append(b, f.event...)
+	b = binary.AppendUvarint(b, uint64(len(f.id)))
+	b = append(b, f.id...)
+	b = binary.AppendUvarint(b, uint64(f.retry.Milliseconds()))
+	return append(b, f.data...)
+}
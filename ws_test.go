@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// wsClient is the client end of a WebSocket connection to the sidecar.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+	resp *http.Response
+}
+
+// dialWS upgrades `GET /sse-events` of srv with the query, offering the
+// subprotocols in protocol if set.
+func dialWS(t *testing.T, srv *httptest.Server, query url.Values, protocol string) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/sse-events?"+query.Encode(), nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if protocol != "" {
+		req.Header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsClient{conn: conn, br: br, resp: resp}
+}
+
+// read reads a frame from the server, which must not be masked.
+func (c *wsClient) read(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	c.readFull(t, head[:])
+	if head[1]&0x80 != 0 {
+		t.Fatal("masked server frame")
+	}
+	n := int(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		c.readFull(t, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		c.readFull(t, ext[:])
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, n)
+	c.readFull(t, payload)
+	return head[0] & 0x0f, payload
+}
+
+func (c *wsClient) readFull(t *testing.T, p []byte) {
+	t.Helper()
+	if _, err := io.ReadFull(c.br, p); err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+}
+
+// event reads binary messages up to the next one that isn't empty, and
+// decodes it.
+func (c *wsClient) event(t *testing.T) sseFrame {
+	t.Helper()
+	for {
+		opcode, payload := c.read(t)
+		if opcode != wsBinary {
+			t.Fatalf("opcode %#x, want a binary message", opcode)
+		}
+		if len(payload) > 0 {
+			return decodeCompact(t, payload)
+		}
+	}
+}
+
+// write sends a frame, masked unless unmasked is set.
+func (c *wsClient) write(t *testing.T, opcode byte, payload []byte, unmasked bool) {
+	t.Helper()
+	b := []byte{0x80 | opcode, byte(len(payload))}
+	if unmasked {
+		b = append(b, payload...)
+	} else {
+		mask := []byte{1, 2, 3, 4}
+		b[1] |= 0x80
+		b = append(b, mask...)
+		for i, p := range payload {
+			b = append(b, p^mask[i%4])
+		}
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func decodeCompact(t *testing.T, b []byte) sseFrame {
+	t.Helper()
+	r := bytes.NewReader(b)
+	field := func() string {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			t.Fatalf("compact frame %q: bad length", b)
+		}
+		s := make([]byte, n)
+		r.Read(s)
+		return string(s)
+	}
+	var f sseFrame
+	f.event = field()
+	f.id = field()
+	retry, err := binary.ReadUvarint(r)
+	if err != nil {
+		t.Fatalf("compact frame %q: bad retry", b)
+	}
+	f.retry = time.Duration(retry) * time.Millisecond
+	f.data = string(b[len(b)-r.Len():])
+	return f
+}
+
+func wsQuery(t *testing.T, userID int64) url.Values {
+	return url.Values{"transport": {"ws"}, "ssetoken": {token(t, userID, nil)}}
+}
+
+// wsSidecar is newSidecar with the WebSocket transport enabled. The test
+// server doesn't wait for hijacked connections, so it waits for their
+// streams to end once the test has closed them.
+func wsSidecar(t *testing.T, set func(c *Config)) *httptest.Server {
+	t.Helper()
+	_, srv := newSidecar(t, func(c *Config) {
+		c.WebSocket = true
+		if set != nil {
+			set(c)
+		}
+	})
+	t.Cleanup(webSockets.Wait)
+	return srv
+}
+
+func TestCompactFrame(t *testing.T) {
+	f := sseFrame{event: "order", id: "e-1", data: "line one\nline two\r\n", retry: 1500 * time.Millisecond}
+	b := compactFrame(f)
+	want := append([]byte{5}, "order"...)
+	want = append(want, 3)
+	want = append(want, "e-1"...)
+	want = binary.AppendUvarint(want, 1500)
+	want = append(want, "line one\nline two\r\n"...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("compactFrame = %q, want %q", b, want)
+	}
+	if got := decodeCompact(t, b); got != f {
+		t.Errorf("decoded %+v, want %+v", got, f)
+	}
+	// Only the data: three zero bytes of framing.
+	if b := compactFrame(sseFrame{data: "x"}); string(b) != "\x00\x00\x00x" {
+		t.Errorf("data only: %q", b)
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	srv := wsSidecar(t, nil)
+	c := dialWS(t, srv, wsQuery(t, 2181), "other, sse-compact")
+	if c.resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %s, want 101", c.resp.Status)
+	}
+	if got := c.resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept %q", got)
+	}
+	if got := c.resp.Header.Get("Sec-WebSocket-Protocol"); got != wsProtocol {
+		t.Errorf("Sec-WebSocket-Protocol %q, want %s", got, wsProtocol)
+	}
+	connID := c.resp.Header.Get("X-Connection-ID")
+	if connID == "" {
+		t.Error("no X-Connection-ID on the upgrade")
+	}
+
+	ev := c.event(t)
+	var data struct {
+		ConnectionID string `json:"connection_id"`
+		Transport    string `json:"transport"`
+	}
+	if err := json.Unmarshal([]byte(ev.data), &data); ev.event != "connected" || err != nil {
+		t.Fatalf("first event %+v, want connected", ev)
+	}
+	if data.ConnectionID != connID {
+		t.Errorf("connected to %s, header says %s", data.ConnectionID, connID)
+	}
+
+	// No subprotocol offered, none answered.
+	c = dialWS(t, srv, wsQuery(t, 2181), "")
+	if _, ok := c.resp.Header["Sec-Websocket-Protocol"]; ok {
+		t.Error("subprotocol answered without an offer")
+	}
+}
+
+func TestWebSocketStreamsEvents(t *testing.T) {
+	srv := wsSidecar(t, func(c *Config) {
+		c.EventIDField = "id"
+	})
+	c := dialWS(t, srv, wsQuery(t, 2182), "")
+	c.event(t)
+	channel := userChannel(2182)
+	waitFor(t, "the subscription", func() bool { return len(registry.forUser("", 2182)) == 1 })
+	rdb.Publish(ctx, channel, `{"id":"e1","text":"a\nb"}`)
+	rdb.Publish(ctx, channel, "plain")
+
+	for _, want := range []sseFrame{
+		{id: "e1", data: `{"id":"e1","text":"a\nb"}`},
+		{data: "plain"},
+	} {
+		ev := c.event(t)
+		for sidecarEvent(ev.event) {
+			ev = c.event(t)
+		}
+		if ev != want {
+			t.Errorf("event %+v, want %+v", ev, want)
+		}
+	}
+}
+
+func TestWebSocketEnvelope(t *testing.T) {
+	srv := wsSidecar(t, nil)
+	q := wsQuery(t, 2183)
+	q.Set("framing", "envelope")
+	c := dialWS(t, srv, q, "")
+	c.event(t)
+	waitFor(t, "the subscription", func() bool { return len(registry.forUser("", 2183)) == 1 })
+	rdb.Publish(ctx, userChannel(2183), "hi")
+	ev := c.event(t)
+	if want := `{"channel":"events:user:2183","content_type":"text/plain","data":"hi"}`; ev.data != want {
+		t.Errorf("data %s, want %s", ev.data, want)
+	}
+}
+
+func TestWebSocketKeepaliveIsEmptyMessage(t *testing.T) {
+	srv := wsSidecar(t, func(c *Config) {
+		c.KeepaliveInterval = 20 * time.Millisecond
+	})
+	c := dialWS(t, srv, wsQuery(t, 2184), "")
+	c.event(t)
+	for {
+		opcode, payload := c.read(t)
+		if opcode != wsBinary {
+			t.Fatalf("opcode %#x", opcode)
+		}
+		if len(payload) == 0 {
+			return
+		}
+		if ev := decodeCompact(t, payload); !sidecarEvent(ev.event) {
+			t.Fatalf("event %+v before a keepalive", ev)
+		}
+	}
+}
+
+func TestWebSocketPingAnswered(t *testing.T) {
+	srv := wsSidecar(t, nil)
+	c := dialWS(t, srv, wsQuery(t, 2185), "")
+	c.event(t)
+	c.write(t, wsPing, []byte("are you there"), false)
+	for {
+		opcode, payload := c.read(t)
+		if opcode == wsPong {
+			if string(payload) != "are you there" {
+				t.Errorf("pong %q", payload)
+			}
+			return
+		}
+	}
+}
+
+func TestWebSocketClosedByClient(t *testing.T) {
+	srv := wsSidecar(t, nil)
+	c := dialWS(t, srv, wsQuery(t, 2186), "")
+	c.event(t)
+	waitFor(t, "the connection", func() bool { return len(registry.forUser("", 2186)) == 1 })
+	c.write(t, wsClose, []byte{0x03, 0xe8}, false)
+	for {
+		opcode, payload := c.read(t)
+		if opcode == wsClose {
+			if code := binary.BigEndian.Uint16(payload); code != 1000 {
+				t.Errorf("closed with %d, want 1000", code)
+			}
+			break
+		}
+	}
+	waitFor(t, "the connection removed", func() bool { return len(registry.forUser("", 2186)) == 0 })
+}
+
+func TestWebSocketUnmaskedFrameIsProtocolError(t *testing.T) {
+	srv := wsSidecar(t, nil)
+	c := dialWS(t, srv, wsQuery(t, 2187), "")
+	c.event(t)
+	c.write(t, wsPing, []byte("x"), true)
+	for {
+		opcode, payload := c.read(t)
+		if opcode == wsClose {
+			if code := binary.BigEndian.Uint16(payload); code != 1002 {
+				t.Errorf("closed with %d, want 1002", code)
+			}
+			break
+		}
+	}
+	waitFor(t, "the connection removed", func() bool { return len(registry.forUser("", 2187)) == 0 })
+}
+
+func TestWebSocketTransportRefused(t *testing.T) {
+	// Not enabled.
+	_, srv := newSidecar(t, nil)
+	if c := dialWS(t, srv, wsQuery(t, 2188), ""); c.resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("disabled: %s, want 400", c.resp.Status)
+	}
+
+	// Enabled, but no upgrade.
+	srv = wsSidecar(t, nil)
+	resp := get(t, srv.URL+"/sse-events?"+wsQuery(t, 2188).Encode(), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("without an upgrade: %s, want 400", resp.Status)
+	}
+
+	// SSE stays the default.
+	s, _ := connect(t, srv, 2188, nil)
+	if ct := s.resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Content-Type %q without a transport", ct)
+	}
+	if c := dialWS(t, srv, url.Values{"transport": {"carrier-pigeon"}, "ssetoken": {token(t, 2188, jwt.MapClaims{})}}, ""); c.resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown transport: %s, want 400", c.resp.Status)
+	}
+}
+
+func TestWebSocketEncodingUnsupported(t *testing.T) {
+	tests := []struct {
+		policy, encoding string
+		want             int
+		downgraded       []string
+	}{
+		{"reject", "gzip", http.StatusBadRequest, nil},
+		{"reject", "identity", http.StatusSwitchingProtocols, nil},
+		{"ignore", "gzip", http.StatusSwitchingProtocols, nil},
+		{"downgrade", "deflate", http.StatusSwitchingProtocols, []string{"encoding"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.encoding, func(t *testing.T) {
+			// Enabled for SSE streams.
+			srv := wsSidecar(t, func(c *Config) {
+				c.Compression = []string{"gzip", "deflate"}
+				c.UnsupportedOptions = parseUnsupportedPolicies("GO_SSE_SIDECAR_UNSUPPORTED_OPTIONS", tt.policy)
+			})
+			q := wsQuery(t, 2189)
+			q.Set("encoding", tt.encoding)
+			c := dialWS(t, srv, q, "")
+			if c.resp.StatusCode != tt.want {
+				t.Fatalf("status %s, want %d", c.resp.Status, tt.want)
+			}
+			if tt.want != http.StatusSwitchingProtocols {
+				return
+			}
+			var got connectedEvent
+			if err := json.Unmarshal([]byte(c.event(t).data), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Options["encoding"] != "identity" || !reflect.DeepEqual(got.Downgraded, tt.downgraded) {
+				t.Errorf("connected %+v, want identity, downgraded %v", got, tt.downgraded)
+			}
+		})
+	}
+}
+
+// BenchmarkFraming writes events in SSE and in the compact framing over a
+// WebSocket, and reports the bytes sent per event.
+func BenchmarkFraming(b *testing.B) {
+	frames := []struct {
+		name string
+		f    sseFrame
+	}{
+		{"data", sseFrame{data: `{"event_type":"order_paid","id":"8c1f","amount":1250,"currency":"EUR"}`}},
+		{"named_with_id", sseFrame{event: "order_paid", id: "8c1f", data: `{"amount":1250,"currency":"EUR"}`}},
+		{"multiline", sseFrame{data: "line one\nline two\nline three\nline four"}},
+	}
+	for _, fr := range frames {
+		for _, transport := range []string{"sse", "ws"} {
+			b.Run(fr.name+"/"+transport, func(b *testing.B) {
+				useConfig(b, nil)
+				var sent atomic.Int64
+				bw := bufio.NewWriter(countingWriter{io.Discard, &sent})
+				var w io.Writer = bw
+				if transport == "ws" {
+					w = compactWriter{&wsConn{bw: bw, header: make(http.Header)}}
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := writeFrame(w, fr.f); err != nil {
+						b.Fatal(err)
+					}
+				}
+				bw.Flush()
+				b.ReportMetric(float64(sent.Load())/float64(b.N), "wire-B/event")
+			})
+		}
+	}
+}